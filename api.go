@@ -0,0 +1,31 @@
+package irc
+
+// ClientAPI is the subset of Client's methods that handlers commonly
+// use. Handlers written against ClientAPI instead of *Client can be
+// tested with irctest.Fake.
+type ClientAPI interface {
+	Send(s string) error
+	Sendf(format string, args ...interface{}) error
+	SendMessage(m *Message) error
+	Privmsg(target, message string) error
+	Notice(target, message string) error
+	Reply(m *Message, response string) error
+	ReplyCTCP(m *Message, response string) error
+	Join(channel, password string) error
+	SetNick(nick string) error
+	CurrentNick() string
+	Identity() Mask
+	Support() *ISupport
+	HasCap(name string) bool
+	ChannelForMsg(m *Message) (string, bool)
+}
+
+var _ ClientAPI = (*Client)(nil)
+
+// APIHandlerFunc adapts a function written against ClientAPI to the
+// Handler interface.
+type APIHandlerFunc func(ClientAPI, *Message)
+
+func (f APIHandlerFunc) Process(c *Client, m *Message) {
+	f(c, m)
+}
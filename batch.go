@@ -0,0 +1,66 @@
+package irc
+
+// Batch describes an IRCv3 batch. Messages belonging to a batch have
+// their Batch field set to its metadata; Messages is only populated
+// for the irc:batch signal, which is dispatched with the complete
+// batch once it ends.
+type Batch struct {
+	// The reference tag identifying the batch
+	Ref string
+	// The batch type, e.g. netsplit or chathistory
+	Type   string
+	Params []string
+	// The batch this batch is nested in, if any
+	Parent *Batch
+	// The messages in the batch, in order, including the BATCH
+	// messages that start nested batches
+	Messages []*Message
+}
+
+type openBatch struct {
+	meta *Batch
+	msgs []*Message
+}
+
+// trackBatch updates the set of open batches and sets m.Batch. If m
+// ends a batch, the complete batch is returned. It must only be
+// called from Read.
+func (c *Client) trackBatch(m *Message) *Batch {
+	var parent *openBatch
+	if ref, ok := m.Tags["batch"]; ok {
+		parent = c.batches[ref]
+		if parent != nil {
+			m.Batch = parent.meta
+			parent.msgs = append(parent.msgs, m)
+		}
+	}
+	if m.Command != "BATCH" || len(m.Params) == 0 || len(m.Params[0]) < 2 {
+		return nil
+	}
+	ref := m.Params[0][1:]
+	switch m.Params[0][0] {
+	case '+':
+		meta := &Batch{Ref: ref}
+		if len(m.Params) > 1 {
+			meta.Type = m.Params[1]
+			meta.Params = append([]string(nil), m.Params[2:]...)
+		}
+		if parent != nil {
+			meta.Parent = parent.meta
+		}
+		if c.batches == nil {
+			c.batches = make(map[string]*openBatch)
+		}
+		c.batches[ref] = &openBatch{meta: meta}
+	case '-':
+		b, ok := c.batches[ref]
+		if !ok {
+			return nil
+		}
+		delete(c.batches, ref)
+		done := *b.meta
+		done.Messages = b.msgs
+		return &done
+	}
+	return nil
+}
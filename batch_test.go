@@ -0,0 +1,45 @@
+package irc
+
+import "testing"
+
+func TestTrackBatch(t *testing.T) {
+	c := &Client{}
+	lines := []string{
+		":server BATCH +outer chathistory #chan",
+		"@batch=outer :nick!user@host PRIVMSG #chan :one",
+		"@batch=outer :server BATCH +inner netsplit a.example b.example",
+		"@batch=inner :nick!user@host QUIT :a.example b.example",
+		":server BATCH -inner",
+		"@batch=outer :nick!user@host PRIVMSG #chan :two",
+		":server BATCH -outer",
+	}
+	var done []*Batch
+	var msgs []*Message
+	for _, line := range lines {
+		m := Parse(line)
+		if b := c.trackBatch(m); b != nil {
+			done = append(done, b)
+		}
+		msgs = append(msgs, m)
+	}
+
+	if len(done) != 2 {
+		t.Fatalf("expected 2 completed batches, got %d", len(done))
+	}
+	inner, outer := done[0], done[1]
+	if inner.Type != "netsplit" || len(inner.Params) != 2 || len(inner.Messages) != 1 {
+		t.Errorf("unexpected inner batch %+v", inner)
+	}
+	if inner.Parent == nil || inner.Parent.Ref != "outer" {
+		t.Errorf("expected inner batch to be nested in outer, got parent %+v", inner.Parent)
+	}
+	if outer.Type != "chathistory" || len(outer.Messages) != 3 {
+		t.Errorf("unexpected outer batch %+v", outer)
+	}
+	if msgs[1].Batch == nil || msgs[1].Batch.Ref != "outer" {
+		t.Errorf("expected message to belong to outer batch, got %+v", msgs[1].Batch)
+	}
+	if len(c.batches) != 0 {
+		t.Errorf("expected no open batches, got %d", len(c.batches))
+	}
+}
@@ -0,0 +1,223 @@
+// Package bot is the quickest way to write an IRC bot. It wires a
+// client up with reconnects, automatic joins, commands, CTCP replies
+// and flood protection, using defaults that suit most networks:
+//
+//	b := bot.New(bot.Config{
+//		Addr:     "irc.libera.chat:6697",
+//		TLS:      true,
+//		Nick:     "examplebot",
+//		Channels: []string{"#example"},
+//		Owners:   []string{"*!*@owner.example"},
+//	})
+//	b.Command("hello", "hello - say hello", func(c *irc.Client, m *irc.Message, args []string) error {
+//		return c.Reply(m, "Hello, "+m.Prefix.Nick+"!")
+//	})
+//	log.Fatal(b.Run())
+//
+// Everything it sets up remains accessible, and further handlers and
+// components from the irc and framework packages can be registered
+// with the bot's Mux.
+package bot // import "honnef.co/go/irc/bot"
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/framework"
+	"honnef.co/go/irc/sasl"
+)
+
+type Config struct {
+	// The address of the server, as host:port.
+	Addr string
+	// TLS causes the bot to connect with TLS, using TLSConfig if it
+	// is set.
+	TLS       bool
+	TLSConfig *tls.Config
+	// Dialer, if set, establishes the connections, for example
+	// through a proxy.
+	Dialer irc.Dialer
+
+	Nick string
+	// Defaults to Nick.
+	User string
+	// Defaults to Nick.
+	Name string
+	// The server password, if any.
+	Password string
+	// If set, the bot logs in to services with SASL PLAIN.
+	Account         string
+	AccountPassword string
+
+	// The channels to join after connecting.
+	Channels []string
+	// The prefix of commands. Defaults to "!".
+	Prefix string
+	// Hostmask patterns of the bot's owners, who may use the
+	// commands of framework.Inspection and those registered with
+	// OwnerCommand.
+	Owners []string
+	// The reply to CTCP VERSION. Defaults to "honnef.co/go/irc".
+	Version string
+
+	// Limits how quickly messages are sent. Defaults to
+	// irc.ProfileRFC1459.
+	RateLimit *irc.RateProfile
+	// How long to wait between reconnects.
+	Backoff framework.Backoff
+	Logger  irc.Logger
+}
+
+// Bot is an IRC bot. Its Mux dispatches the messages of all
+// connections; handlers are shared across reconnects.
+type Bot struct {
+	*irc.Mux
+	Config   Config
+	State    *framework.State
+	Commands *framework.Commands
+	CTCP     *framework.CTCPResponder
+	// Owner allows the users matching Config.Owners.
+	Owner framework.Permission
+
+	sasl   *sasl.SASL
+	mu     sync.Mutex
+	client *irc.Client
+	joined *irc.Client
+}
+
+// New returns a bot configured by config. Call Run to connect it.
+func New(config Config) *Bot {
+	if config.User == "" {
+		config.User = config.Nick
+	}
+	if config.Name == "" {
+		config.Name = config.Nick
+	}
+	if config.Prefix == "" {
+		config.Prefix = "!"
+	}
+	if config.Version == "" {
+		config.Version = "honnef.co/go/irc"
+	}
+	if config.RateLimit == nil {
+		config.RateLimit = irc.ProfileRFC1459
+	}
+
+	b := &Bot{
+		Mux:      irc.NewMux(),
+		Config:   config,
+		State:    framework.NewState(),
+		Commands: framework.NewCommands(config.Prefix),
+		CTCP:     framework.NewCTCPResponder(config.Version, "", ""),
+		Owner:    framework.Owners(config.Owners...),
+	}
+	b.HandleSync("", b.State)
+	b.Handle("", b.CTCP)
+	b.Handle("PRIVMSG", b.Commands)
+	b.HandleFunc(irc.ERR_NICKNAMEINUSE, framework.AvoidNickCollision(framework.SimpleNickChanger("_")))
+	b.HandleFunc(irc.RPL_ENDOFMOTD, b.autojoin)
+	b.HandleFunc(irc.ERR_NOMOTD, b.autojoin)
+	if config.Account != "" {
+		b.sasl = sasl.New(&sasl.Plain{User: config.Account, Password: config.AccountPassword})
+		b.Handle("", b.sasl)
+	}
+	if len(config.Owners) > 0 {
+		in := &framework.Inspection{Owner: b.Owner}
+		in.Register(b.Commands)
+	}
+	return b
+}
+
+// Command registers a command that everyone may use.
+func (b *Bot) Command(name, help string, fn framework.CommandFunc) {
+	b.Commands.Register(&framework.Command{Name: name, Help: help, Func: fn})
+}
+
+// OwnerCommand registers a command that only the bot's owners may
+// use.
+func (b *Bot) OwnerCommand(name, help string, fn framework.CommandFunc) {
+	b.Commands.Register(&framework.Command{Name: name, Help: help, Permission: b.Owner, Func: fn})
+}
+
+// Client returns the client of the current connection, or nil if the
+// bot hasn't connected yet.
+func (b *Bot) Client() *irc.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.client
+}
+
+func (b *Bot) autojoin(c *irc.Client, m *irc.Message) {
+	b.mu.Lock()
+	if b.joined == c {
+		b.mu.Unlock()
+		return
+	}
+	b.joined = c
+	b.mu.Unlock()
+	channels := make(map[string]string, len(b.Config.Channels))
+	for _, channel := range b.Config.Channels {
+		channels[channel] = ""
+	}
+	framework.JoinPaced(c, channels, time.Second)
+}
+
+func (b *Bot) newClient() *irc.Client {
+	cfg := b.Config
+	c := &irc.Client{
+		Nick:          cfg.Nick,
+		User:          cfg.User,
+		Name:          cfg.Name,
+		Password:      cfg.Password,
+		Mux:           b.Mux,
+		Logger:        cfg.Logger,
+		Dialer:        cfg.Dialer,
+		TLSConfig:     cfg.TLSConfig,
+		RateLimit:     cfg.RateLimit,
+		RecoverPanics: true,
+	}
+	if b.sasl != nil {
+		c.Authenticator = b.sasl
+	}
+	return c
+}
+
+// Run connects the bot and reconnects it after network failures,
+// waiting according to Config.Backoff. It returns when the bot quits,
+// either because Quit was called or because the process received
+// SIGINT or SIGTERM, or when reconnecting isn't possible.
+func (b *Bot) Run() error {
+	err := b.Config.Backoff.Retry(func() error {
+		c := b.newClient()
+		var err error
+		if b.Config.TLS {
+			err = c.DialTLS("tcp", b.Config.Addr)
+		} else {
+			err = c.Dial("tcp", b.Config.Addr)
+		}
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.client = c
+		b.mu.Unlock()
+		stop := framework.QuitOnSignal(c, "Shutting down", 5*time.Second)
+		defer stop()
+		return c.Process()
+	})
+	if err == irc.ErrQuit {
+		return nil
+	}
+	return err
+}
+
+// Quit disconnects the bot, making Run return.
+func (b *Bot) Quit(reason string) error {
+	c := b.Client()
+	if c == nil {
+		return irc.ErrDeadClient
+	}
+	return c.Quit(reason)
+}
@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestBot(t *testing.T) {
+	srv := irctest.NewServer()
+	b := New(Config{
+		Addr:     "irc.test:6667",
+		Dialer:   srv,
+		Nick:     "bot",
+		Channels: []string{"#test"},
+	})
+	b.Command("hello", "hello - say hello", func(c *irc.Client, m *irc.Message, args []string) error {
+		return c.Reply(m, "Hello, "+m.Prefix.Nick+"!")
+	})
+	done := make(chan error, 1)
+	go func() { done <- b.Run() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := srv.WaitFor(ctx, "JOIN"); err != nil {
+		t.Fatal("bot didn't join:", err)
+	}
+
+	conn, _ := srv.Dial("tcp", "irc.test:6667")
+	defer conn.Close()
+	fmt.Fprintf(conn, "NICK user\r\nUSER user 0 * :user\r\nJOIN #test\r\nPRIVMSG #test :!hello\r\n")
+	scanner := bufio.NewScanner(conn)
+	found := make(chan bool, 1)
+	go func() {
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "Hello, user!") {
+				found <- true
+				return
+			}
+		}
+		found <- false
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Fatal("connection closed before the bot replied")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reply")
+	}
+
+	if err := b.Quit("bye"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v after Quit", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after Quit")
+	}
+}
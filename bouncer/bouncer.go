@@ -0,0 +1,483 @@
+// Package bouncer shares one upstream connection between any number
+// of downstream clients, in the manner of ZNC.
+//
+// Downstream clients connect to the bouncer as if it were a server
+// and see everything the upstream connection receives. What they
+// send is forwarded upstream. Each downstream client is identified
+// by the user name it registers with, so that, for example, a phone
+// and a desktop client can be told apart. When a client disconnects,
+// it is detached: messages are buffered for it and replayed once a
+// client with the same name attaches again.
+package bouncer // import "honnef.co/go/irc/bouncer"
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"honnef.co/go/irc"
+)
+
+// Bouncer fans the messages of its upstream client out to downstream
+// connections.
+//
+// Bouncer needs to be registered as a catch-all handler with
+// HandleSync on the upstream client's Mux, so that downstream
+// clients see messages in order:
+//
+//	b := bouncer.New(upstream)
+//	mux.HandleSync("", b)
+//	go b.Serve(listener)
+type Bouncer struct {
+	*irc.Mux
+	Upstream *irc.Client
+	// Password, if set, has to be sent with PASS by downstream
+	// clients.
+	Password string
+	// How many messages to buffer per detached client. Attached
+	// clients that fall this far behind are disconnected, and thus
+	// detached. Defaults to 1000.
+	BufferSize int
+
+	mu          sync.Mutex
+	downstreams map[string]*downstream
+	// the registration burst of the upstream connection, replayed to
+	// attaching clients
+	welcome []*irc.Message
+	// casefolded names to the channels the upstream client is in
+	channels map[string]*channel
+}
+
+type channel struct {
+	name  string
+	topic string
+}
+
+type downstream struct {
+	// the attached connection, nil when detached
+	conn *downConn
+	// lines buffered while detached
+	buffer []string
+}
+
+func New(upstream *irc.Client) *Bouncer {
+	b := &Bouncer{
+		Mux:         irc.NewOrderedMux(),
+		Upstream:    upstream,
+		downstreams: make(map[string]*downstream),
+		channels:    make(map[string]*channel),
+	}
+	b.HandleFunc("", b.relay)
+	return b
+}
+
+func (b *Bouncer) bufferSize() int {
+	if b.BufferSize == 0 {
+		return 1000
+	}
+	return b.BufferSize
+}
+
+// Downstreams returns the sorted names of the known downstream
+// clients, attached or not.
+func (b *Bouncer) Downstreams() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for name := range b.downstreams {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Attached reports whether a client with the given name is attached.
+func (b *Bouncer) Attached(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ds, ok := b.downstreams[name]
+	return ok && ds.conn != nil
+}
+
+// Forget disconnects the named client and discards its buffer.
+func (b *Bouncer) Forget(name string) {
+	b.mu.Lock()
+	ds, ok := b.downstreams[name]
+	delete(b.downstreams, name)
+	b.mu.Unlock()
+	if ok && ds.conn != nil {
+		ds.conn.close()
+	}
+}
+
+// Serve accepts downstream connections on l until it is closed.
+func (b *Bouncer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single downstream connection until it is
+// closed.
+func (b *Bouncer) ServeConn(conn net.Conn) {
+	dc := newDownConn(conn)
+	defer dc.close()
+	name, nick, ok := b.register(dc)
+	if !ok {
+		return
+	}
+	b.attach(name, nick, dc)
+	defer b.detach(name, dc)
+
+	for {
+		m, err := dc.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch m.Command {
+		case "":
+		case "PING":
+			dc.sendMessage(&irc.Message{Command: "PONG", Params: append([]string{b.serverName()}, m.Params...)})
+		case "QUIT":
+			// Detach, without quitting upstream
+			return
+		case "PASS", "USER", "CAP":
+		case "PRIVMSG", "NOTICE":
+			out := &irc.Message{Tags: m.Tags, Command: m.Command, Params: m.Params}
+			if b.Upstream.SendMessage(out) != nil {
+				continue
+			}
+			if !b.Upstream.HasCap("echo-message") {
+				// Let the other clients see what was said.
+				echo := out.Copy()
+				echo.Tags = nil
+				echo.Prefix = b.Upstream.Identity()
+				b.broadcast(echo, dc)
+			}
+		default:
+			b.Upstream.SendMessage(&irc.Message{Tags: m.Tags, Command: m.Command, Params: m.Params})
+		}
+	}
+}
+
+func (b *Bouncer) serverName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.serverNameLocked()
+}
+
+// register handles the registration of a downstream client and
+// returns its name and the nick it asked for.
+func (b *Bouncer) register(dc *downConn) (name, nick string, ok bool) {
+	var pass string
+	negotiating := false
+	for name == "" || nick == "" || negotiating {
+		m, err := dc.conn.ReadMessage()
+		if err != nil {
+			return "", "", false
+		}
+		switch m.Command {
+		case "PASS":
+			if len(m.Params) > 0 {
+				pass = m.Params[0]
+			}
+		case "NICK":
+			if len(m.Params) > 0 {
+				nick = m.Params[0]
+			}
+		case "USER":
+			if len(m.Params) > 0 {
+				name = m.Params[0]
+			}
+		case "CAP":
+			if len(m.Params) == 0 {
+				continue
+			}
+			switch strings.ToUpper(m.Params[0]) {
+			case "LS":
+				// We don't offer any capabilities.
+				negotiating = true
+				dc.sendMessage(&irc.Message{Command: "CAP", Params: []string{"*", "LS", ""}})
+			case "REQ":
+				negotiating = true
+				if len(m.Params) > 1 {
+					dc.sendMessage(&irc.Message{Command: "CAP", Params: []string{"*", "NAK", m.Params[1]}})
+				}
+			case "END":
+				negotiating = false
+			}
+		case "QUIT":
+			return "", "", false
+		}
+	}
+	if b.Password != "" && pass != b.Password {
+		dc.sendMessage(&irc.Message{Command: "ERROR", Params: []string{"Invalid password"}})
+		return "", "", false
+	}
+	return name, nick, true
+}
+
+// attach makes dc the connection of the named client, replacing any
+// connection it already has, and brings it up to date.
+func (b *Bouncer) attach(name, nick string, dc *downConn) {
+	b.mu.Lock()
+	ds, ok := b.downstreams[name]
+	if !ok {
+		ds = &downstream{}
+		b.downstreams[name] = ds
+	}
+	if ds.conn != nil {
+		ds.conn.sendMessage(&irc.Message{Command: "ERROR", Params: []string{"Attached from elsewhere"}})
+		ds.conn.close()
+	}
+	ds.conn = dc
+
+	self := b.Upstream.Identity()
+	current := self.Nick
+	if current == "" {
+		// The upstream connection hasn't registered yet.
+		current = nick
+	}
+	for _, m := range b.welcome {
+		m = m.Copy()
+		if len(m.Params) > 0 {
+			m.Params[0] = current
+		}
+		dc.sendMessage(m)
+	}
+	dc.sendMessage(&irc.Message{
+		Prefix:  irc.Mask{Host: b.serverNameLocked()},
+		Command: irc.ERR_NOMOTD,
+		Params:  []string{current, "MOTD File is missing"},
+	})
+	if nick != current {
+		dc.sendMessage(&irc.Message{Prefix: irc.Mask{Nick: nick}, Command: "NICK", Params: []string{current}})
+	}
+
+	var channels []*channel
+	var names []string
+	for _, ch := range b.channels {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].name < channels[j].name })
+	for _, ch := range channels {
+		names = append(names, ch.name)
+		dc.sendMessage(&irc.Message{Prefix: self, Command: "JOIN", Params: []string{ch.name}})
+		if ch.topic != "" {
+			dc.sendMessage(&irc.Message{
+				Prefix:  irc.Mask{Host: b.serverNameLocked()},
+				Command: irc.RPL_TOPIC,
+				Params:  []string{current, ch.name, ch.topic},
+			})
+		}
+	}
+	for _, line := range ds.buffer {
+		dc.send(line)
+	}
+	ds.buffer = nil
+	b.mu.Unlock()
+
+	if len(names) > 0 {
+		// The replies go to all attached clients, which merely
+		// refreshes their member lists.
+		b.Upstream.Send("NAMES " + strings.Join(names, ","))
+	}
+}
+
+// serverNameLocked returns the name of the upstream server. b.mu
+// must be held.
+func (b *Bouncer) serverNameLocked() string {
+	if len(b.welcome) > 0 && b.welcome[0].Prefix.String() != "" {
+		return b.welcome[0].Prefix.String()
+	}
+	return "bouncer"
+}
+
+// detach marks the named client as detached, unless another
+// connection has taken its place.
+func (b *Bouncer) detach(name string, dc *downConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ds, ok := b.downstreams[name]; ok && ds.conn == dc {
+		ds.conn = nil
+	}
+}
+
+// broadcast sends m to all attached clients except skip and buffers
+// it for detached ones.
+func (b *Bouncer) broadcast(m *irc.Message, skip *downConn) {
+	line := m.WireString()
+	var buffered string
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ds := range b.downstreams {
+		switch {
+		case skip != nil && ds.conn == skip:
+		case ds.conn != nil:
+			if !ds.conn.send(line) || ds.conn.queued() > b.bufferSize() {
+				// Too slow; it will be detached once the
+				// connection is gone.
+				ds.conn.close()
+			}
+		default:
+			if buffered == "" {
+				buffered = timestamped(m)
+			}
+			ds.buffer = append(ds.buffer, buffered)
+			if n := len(ds.buffer) - b.bufferSize(); n > 0 {
+				ds.buffer = append(ds.buffer[:0], ds.buffer[n:]...)
+			}
+		}
+	}
+}
+
+// timestamped returns m with a server-time tag, so that clients show
+// buffered messages with the time they were received at.
+func timestamped(m *irc.Message) string {
+	if _, ok := m.Tags["time"]; ok || m.Time.IsZero() {
+		return m.WireString()
+	}
+	m = m.Copy()
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags["time"] = m.Time.UTC().Format("2006-01-02T15:04:05.000Z")
+	return m.WireString()
+}
+
+func (b *Bouncer) relay(c *irc.Client, m *irc.Message) {
+	switch m.Command {
+	case "", "PING", "PONG":
+		// Signals, and the upstream client's own keepalive
+		return
+	case irc.RPL_WELCOME:
+		b.mu.Lock()
+		b.welcome = []*irc.Message{m}
+		b.channels = make(map[string]*channel)
+		b.mu.Unlock()
+	case irc.RPL_YOURHOST, irc.RPL_CREATED, irc.RPL_MYINFO, irc.RPL_ISUPPORT:
+		b.mu.Lock()
+		b.welcome = append(b.welcome, m)
+		b.mu.Unlock()
+	}
+	b.track(c, m)
+	b.broadcast(m, nil)
+}
+
+// track keeps the list of channels and their topics current.
+func (b *Bouncer) track(c *irc.Client, m *irc.Message) {
+	is := c.Support()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch m.Command {
+	case "JOIN":
+		if len(m.Params) > 0 && c.IsMe(m.Prefix.Nick) {
+			b.channels[is.Casefold(m.Params[0])] = &channel{name: m.Params[0]}
+		}
+	case "PART":
+		if len(m.Params) > 0 && c.IsMe(m.Prefix.Nick) {
+			delete(b.channels, is.Casefold(m.Params[0]))
+		}
+	case "KICK":
+		if len(m.Params) > 1 && c.IsMe(m.Params[1]) {
+			delete(b.channels, is.Casefold(m.Params[0]))
+		}
+	case "TOPIC":
+		if len(m.Params) > 1 {
+			if ch, ok := b.channels[is.Casefold(m.Params[0])]; ok {
+				ch.topic = m.Params[1]
+			}
+		}
+	case irc.RPL_TOPIC:
+		// :server 332 me #channel :topic
+		if len(m.Params) > 2 {
+			if ch, ok := b.channels[is.Casefold(m.Params[1])]; ok {
+				ch.topic = m.Params[2]
+			}
+		}
+	}
+}
+
+// downConn is a downstream connection. Lines are queued and written
+// by a goroutine of their own, so that slow clients can't hold up
+// the upstream connection.
+type downConn struct {
+	conn *irc.Conn
+
+	mu     sync.Mutex
+	lines  []string
+	wake   chan struct{}
+	closed bool
+}
+
+func newDownConn(conn net.Conn) *downConn {
+	dc := &downConn{conn: irc.NewConn(conn), wake: make(chan struct{}, 1)}
+	go dc.writeLoop()
+	return dc
+}
+
+// send queues a line and reports whether the connection is still
+// open.
+func (dc *downConn) send(line string) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.closed {
+		return false
+	}
+	dc.lines = append(dc.lines, line)
+	dc.signal()
+	return true
+}
+
+func (dc *downConn) sendMessage(m *irc.Message) bool {
+	return dc.send(m.WireString())
+}
+
+func (dc *downConn) queued() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.lines)
+}
+
+// signal wakes up writeLoop. dc.mu must be held.
+func (dc *downConn) signal() {
+	select {
+	case dc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close closes the connection once the queued lines have been
+// written.
+func (dc *downConn) close() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if !dc.closed {
+		dc.closed = true
+		dc.signal()
+	}
+}
+
+func (dc *downConn) writeLoop() {
+	for range dc.wake {
+		dc.mu.Lock()
+		lines, closed := dc.lines, dc.closed
+		dc.lines = nil
+		dc.mu.Unlock()
+		for _, line := range lines {
+			if err := dc.conn.WriteLine(line); err != nil {
+				dc.conn.Close()
+				return
+			}
+		}
+		if closed {
+			dc.conn.Close()
+			return
+		}
+	}
+}
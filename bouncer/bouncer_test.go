@@ -0,0 +1,102 @@
+package bouncer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+// downstreamClient connects a raw downstream client to b.
+func downstreamClient(b *Bouncer, name string) (net.Conn, *bufio.Scanner) {
+	conn, server := net.Pipe()
+	go b.ServeConn(server)
+	go fmt.Fprintf(conn, "NICK %s\r\nUSER %s 0 * :%s\r\n", name, name, name)
+	return conn, bufio.NewScanner(conn)
+}
+
+func waitFor(t *testing.T, scanner *bufio.Scanner, substr string) string {
+	t.Helper()
+	found := make(chan string, 1)
+	go func() {
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), substr) {
+				found <- scanner.Text()
+				return
+			}
+		}
+		close(found)
+	}()
+	select {
+	case line, ok := <-found:
+		if !ok {
+			t.Fatalf("connection closed before receiving %q", substr)
+		}
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", substr)
+	}
+	return ""
+}
+
+func TestBouncer(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Echo = false
+	mux := irc.NewMux()
+	upstream := &irc.Client{Nick: "bnc", User: "bnc", Mux: mux, Dialer: srv}
+	b := New(upstream)
+	mux.HandleSync("", b)
+	relayed := make(chan struct{}, 1)
+	mux.HandleSyncFunc("", func(c *irc.Client, m *irc.Message) {
+		if m.Command == "PRIVMSG" {
+			relayed <- struct{}{}
+		}
+	})
+	if err := upstream.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go upstream.Process()
+	for deadline := time.Now().Add(5 * time.Second); !upstream.Connected(); {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream didn't register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	upstream.Join("#test", "")
+
+	conn, scanner := downstreamClient(b, "phone")
+	waitFor(t, scanner, "JOIN #test")
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); b.Attached("phone"); {
+		if time.Now().After(deadline) {
+			t.Fatal("downstream wasn't detached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	other, _ := srv.Dial("tcp", "irc.test:6667")
+	defer other.Close()
+	go io.Copy(ioutil.Discard, other)
+	fmt.Fprintf(other, "NICK other\r\nUSER other 0 * :other\r\nJOIN #test\r\nPRIVMSG #test :hello\r\n")
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	conn, scanner = downstreamClient(b, "phone")
+	defer conn.Close()
+	waitFor(t, scanner, "001 bnc")
+	line := waitFor(t, scanner, "PRIVMSG #test hello")
+	if !strings.HasPrefix(line, "@time=") {
+		t.Errorf("buffered message %q lacks a server-time tag", line)
+	}
+}
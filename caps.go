@@ -0,0 +1,351 @@
+package irc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCapTimeout is the error a connection fails with when capability
+// negotiation times out and CapabilityManager.Strict is set.
+var ErrCapTimeout = errors.New("capability negotiation timed out")
+
+// CapabilityManager negotiates IRCv3 capabilities with the server. It
+// requests the intersection of the requested and available
+// capabilities, keeps track of which capabilities are enabled and
+// handles capabilities appearing (CAP NEW) and disappearing (CAP DEL)
+// after registration.
+//
+// Once the initial negotiation completes, the client emits the
+// irc:capabilities signal. If the client has no Authenticator, it
+// ends negotiation with CAP END by itself; otherwise, it is the
+// Authenticator's responsibility to send CAP END when it's done.
+//
+// Some bouncers and servers never respond to CAP LS. If negotiation
+// doesn't finish within Timeout, the client registers without the
+// capabilities that haven't been acknowledged yet, as if negotiation
+// had completed.
+type CapabilityManager struct {
+	// How long to wait for negotiation to finish. Defaults to 30
+	// seconds. A negative value disables the timeout.
+	Timeout time.Duration
+	// Strict causes the connection to fail with ErrCapTimeout,
+	// instead of registering without capabilities, when negotiation
+	// times out.
+	Strict bool
+
+	mu          sync.RWMutex
+	requested   []string
+	available   map[string]string
+	enabled     map[string]bool
+	pending     int
+	negotiating bool
+	completed   bool
+	// closed when the current negotiation finishes
+	done chan struct{}
+	// closed when the next reply to CAP LS is complete
+	listed chan struct{}
+}
+
+// NewCapabilityManager returns a CapabilityManager that requests
+// caps.
+func NewCapabilityManager(caps ...string) *CapabilityManager {
+	cm := &CapabilityManager{}
+	cm.reset()
+	cm.Request(caps...)
+	return cm
+}
+
+func (cm *CapabilityManager) reset() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.available = make(map[string]string)
+	cm.enabled = make(map[string]bool)
+	cm.pending = 0
+	cm.negotiating = false
+	cm.completed = false
+	cm.done = nil
+	cm.listed = nil
+}
+
+func (cm *CapabilityManager) timeout() time.Duration {
+	if cm.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return cm.Timeout
+}
+
+// finish ends the current negotiation. cm.mu must be held.
+func (cm *CapabilityManager) finish() {
+	cm.negotiating = false
+	if cm.done != nil {
+		close(cm.done)
+		cm.done = nil
+	}
+}
+
+// listing returns a channel that is closed once the server has
+// completed its next reply to CAP LS, or rejected CAP altogether.
+func (cm *CapabilityManager) listing() <-chan struct{} {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.listed == nil {
+		cm.listed = make(chan struct{})
+	}
+	return cm.listed
+}
+
+// listingDone closes the channel returned by listing. cm.mu must be
+// held.
+func (cm *CapabilityManager) listingDone() {
+	if cm.listed != nil {
+		close(cm.listed)
+		cm.listed = nil
+	}
+}
+
+// Request adds caps to the set of capabilities that will be requested
+// when negotiation starts.
+func (cm *CapabilityManager) Request(caps ...string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, name := range caps {
+		if !inStrings(cm.requested, name) {
+			cm.requested = append(cm.requested, name)
+		}
+	}
+}
+
+// Available returns the capabilities advertised by the server,
+// mapped to their values.
+func (cm *CapabilityManager) Available() map[string]string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	out := make(map[string]string, len(cm.available))
+	for k, v := range cm.available {
+		out[k] = v
+	}
+	return out
+}
+
+// Enabled returns the sorted list of enabled capabilities.
+func (cm *CapabilityManager) Enabled() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var out []string
+	for name := range cm.enabled {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Has reports whether the capability name is enabled.
+func (cm *CapabilityManager) Has(name string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.enabled[name]
+}
+
+// wanted returns the requested capabilities that are available but
+// not yet enabled.
+func (cm *CapabilityManager) wanted() []string {
+	var out []string
+	for _, name := range cm.requested {
+		if _, ok := cm.available[name]; ok && !cm.enabled[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// takeCompleted reports whether the initial negotiation has completed
+// since the last call.
+func (cm *CapabilityManager) takeCompleted() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	completed := cm.completed
+	cm.completed = false
+	return completed
+}
+
+func parseCaps(s string) map[string]string {
+	caps := make(map[string]string)
+	for _, token := range strings.Fields(s) {
+		parts := pad(strings.SplitN(token, "=", 2), 2)
+		caps[parts[0]] = parts[1]
+	}
+	return caps
+}
+
+// HasCap reports whether the capability name has been enabled.
+func (c *Client) HasCap(name string) bool {
+	if c.Caps == nil {
+		return false
+	}
+	return c.Caps.Has(name)
+}
+
+// NegotiateCaps starts capability negotiation by sending CAP LS, if
+// any capabilities have been requested. It has to be called before
+// Login.
+func (c *Client) NegotiateCaps() error {
+	cm := c.Caps
+	if cm == nil {
+		return nil
+	}
+	cm.mu.Lock()
+	if len(cm.requested) == 0 {
+		cm.mu.Unlock()
+		return nil
+	}
+	cm.negotiating = true
+	done := make(chan struct{})
+	cm.done = done
+	cm.mu.Unlock()
+	if timeout := cm.timeout(); timeout > 0 {
+		c.spawn("caps", func() { c.capTimeout(timeout, done) })
+	}
+	return c.Send("CAP LS 302")
+}
+
+// capTimeout ends negotiation if it hasn't finished after timeout.
+func (c *Client) capTimeout(timeout time.Duration, done chan struct{}) {
+	defer c.recoverPanic()
+	t := OrRealClock(c.Clock).NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-t.C():
+	case <-done:
+		return
+	case <-c.Done():
+		return
+	}
+
+	cm := c.Caps
+	cm.mu.Lock()
+	if cm.done != done {
+		cm.mu.Unlock()
+		return
+	}
+	cm.finish()
+	cm.pending = 0
+	cm.mu.Unlock()
+
+	if cm.Strict {
+		c.error(ErrCapTimeout)
+		return
+	}
+	c.Logger.Debug("capability negotiation timed out, registering without it")
+	c.Mux.Process(c, &Message{Signal: "irc:capabilities"})
+	if c.Authenticator == nil {
+		c.Send("CAP END")
+	}
+}
+
+// capRequests packs caps into as few CAP REQ messages as possible.
+func capRequests(caps []string) []string {
+	var out []string
+	line := ""
+	for _, name := range caps {
+		if line != "" && len("CAP REQ :")+len(line)+1+len(name) > 510 {
+			out = append(out, "CAP REQ :"+line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += name
+	}
+	if line != "" {
+		out = append(out, "CAP REQ :"+line)
+	}
+	return out
+}
+
+func (c *Client) handleCap(m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	cm := c.Caps
+	sub, list := m.Params[1], m.Params[len(m.Params)-1]
+	more := len(m.Params) > 3 && m.Params[2] == "*"
+
+	cm.mu.Lock()
+	var req []string
+	finish := false
+	switch sub {
+	case "LS":
+		for k, v := range parseCaps(list) {
+			cm.available[k] = v
+		}
+		if !more {
+			cm.listingDone()
+		}
+		if more || !cm.negotiating {
+			break
+		}
+		req = cm.wanted()
+		if len(req) == 0 {
+			finish = true
+		}
+	case "ACK", "NAK":
+		if sub == "ACK" {
+			for _, name := range strings.Fields(list) {
+				if strings.HasPrefix(name, "-") {
+					delete(cm.enabled, name[1:])
+				} else {
+					cm.enabled[name] = true
+				}
+			}
+		}
+		if cm.pending > 0 {
+			cm.pending--
+		}
+		finish = cm.negotiating && cm.pending == 0
+	case "NEW":
+		for k, v := range parseCaps(list) {
+			cm.available[k] = v
+		}
+		req = cm.wanted()
+	case "DEL":
+		for _, name := range strings.Fields(list) {
+			delete(cm.available, name)
+			delete(cm.enabled, name)
+		}
+	}
+	reqs := capRequests(req)
+	cm.pending += len(reqs)
+	if finish {
+		cm.finish()
+		cm.completed = true
+	}
+	cm.mu.Unlock()
+
+	for _, msg := range reqs {
+		c.Send(msg)
+	}
+	if finish && c.Authenticator == nil {
+		c.Send("CAP END")
+	}
+}
+
+// capUnsupported handles servers that don't know the CAP command at
+// all.
+func (c *Client) capUnsupported(m *Message) {
+	if len(m.Params) < 2 || m.Params[1] != "CAP" {
+		return
+	}
+	cm := c.Caps
+	cm.mu.Lock()
+	cm.listingDone()
+	if !cm.negotiating {
+		cm.mu.Unlock()
+		return
+	}
+	cm.finish()
+	cm.completed = true
+	cm.mu.Unlock()
+}
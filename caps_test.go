@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapsNil(t *testing.T) {
+	c := &Client{}
+	if c.HasCap("sasl") {
+		t.Error("expected no caps before connecting")
+	}
+	if err := c.NegotiateCaps(); err != nil {
+		t.Errorf("unexpected error negotiating without a CapabilityManager: %s", err)
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	done := make(chan struct{})
+	var reqs []string
+	c := fakeServer(t, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{
+				":server CAP * LS * :sasl=PLAIN,EXTERNAL draft/multiline=max-bytes=4096,max-lines=24",
+				":server CAP * LS :away-notify server-time",
+			}
+		case strings.HasPrefix(line, "CAP REQ "):
+			caps := strings.TrimPrefix(strings.TrimPrefix(line, "CAP REQ "), ":")
+			reqs = append(reqs, caps)
+			out := []string{":server CAP * ACK :" + caps}
+			if caps == "account-notify" {
+				out = append(out, ":server CAP me DEL :away-notify", "PING done")
+			}
+			return out
+		case line == "CAP END":
+			return []string{":server CAP me NEW :account-notify extended-join"}
+		case strings.HasPrefix(line, "PONG") && strings.HasSuffix(line, "done"):
+			close(done)
+		}
+		return nil
+	})
+	defer c.Close()
+	c.Caps.Request("sasl", "draft/multiline", "away-notify", "account-notify")
+	if err := c.NegotiateCaps(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for negotiation")
+	}
+
+	expectedReqs := []string{"sasl draft/multiline away-notify", "account-notify"}
+	if !reflect.DeepEqual(reqs, expectedReqs) {
+		t.Errorf("expected requests %q, got %q", expectedReqs, reqs)
+	}
+	expectedAvailable := map[string]string{
+		"sasl":            "PLAIN,EXTERNAL",
+		"draft/multiline": "max-bytes=4096,max-lines=24",
+		"server-time":     "",
+		"account-notify":  "",
+		"extended-join":   "",
+	}
+	if available := c.Caps.Available(); !reflect.DeepEqual(available, expectedAvailable) {
+		t.Errorf("expected available caps %q, got %q", expectedAvailable, available)
+	}
+	expectedEnabled := []string{"account-notify", "draft/multiline", "sasl"}
+	if enabled := c.Caps.Enabled(); !reflect.DeepEqual(enabled, expectedEnabled) {
+		t.Errorf("expected enabled caps %q, got %q", expectedEnabled, enabled)
+	}
+}
@@ -0,0 +1,101 @@
+package irc
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader provides a client certificate, such as one used for
+// CertFP, that is reloaded from disk whenever the files change. Use
+// its GetClientCertificate method in Client.TLSConfig, so that
+// rotated certificates are picked up by the next connection without
+// restarting the process:
+//
+//	r, err := irc.NewCertReloader("bot.crt", "bot.key")
+//	...
+//	c.TLSConfig = &tls.Config{GetClientCertificate: r.GetClientCertificate}
+//
+// Certificates that come from elsewhere can be provided with a
+// GetClientCertificate function of one's own.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader returns a CertReloader for the given files, which
+// are loaded immediately so that errors surface early.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the most recent modification time of the
+// certificate and key.
+func (r *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.CertFile, r.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the certificate and key from disk, regardless of
+// whether they changed.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// Certificate returns the current certificate, reloading it first if
+// the files changed. If reloading fails, for example because only one
+// of the files has been replaced so far, the previous certificate is
+// returned along with the error.
+func (r *CertReloader) Certificate() (*tls.Certificate, error) {
+	modTime, err := r.modified()
+	r.mu.Lock()
+	cert, changed := r.cert, modTime.After(r.modTime)
+	r.mu.Unlock()
+	if err == nil && changed {
+		err = r.Reload()
+		r.mu.Lock()
+		cert = r.cert
+		r.mu.Unlock()
+	}
+	return cert, err
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+// If the certificate can't be reloaded, the previous one is used.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := r.Certificate()
+	if cert == nil {
+		return nil, err
+	}
+	return cert, nil
+}
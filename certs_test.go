@@ -0,0 +1,83 @@
+package irc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, dir, cn string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeCert(t, dir, "old", now.Add(-time.Hour))
+	r, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := r.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := commonName(); cn != "old" {
+		t.Errorf("got certificate %q, expected old", cn)
+	}
+	writeCert(t, dir, "new", now)
+	if cn := commonName(); cn != "new" {
+		t.Errorf("got certificate %q after rotation, expected new", cn)
+	}
+
+	os.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600)
+	os.Chtimes(filepath.Join(dir, "key.pem"), now.Add(time.Hour), now.Add(time.Hour))
+	if cn := commonName(); cn != "new" {
+		t.Errorf("got certificate %q after broken rotation, expected new", cn)
+	}
+}
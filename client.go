@@ -1,15 +1,20 @@
 package irc // import "honnef.co/go/irc"
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -17,6 +22,10 @@ import (
 
 const CTCPDelim = "\001"
 
+// Logger logs a client's traffic. Incoming and Outgoing are called
+// in order from a goroutine dedicated to logging, so they may send
+// messages with the client, for example to echo traffic to a debug
+// channel.
 type Logger interface {
 	Incoming(*Message)
 	Outgoing(*Message)
@@ -161,9 +170,31 @@ type Mask struct {
 	Host string
 }
 
+// String returns the mask in the form nick!user@host, omitting
+// missing parts.
+func (m Mask) String() string {
+	s := m.Nick
+	if m.User != "" {
+		s += "!" + m.User
+	}
+	if m.Host != "" {
+		if s != "" {
+			s += "@"
+		}
+		s += m.Host
+	}
+	return s
+}
+
 type Message struct {
 	// The raw IRC message
-	Raw     string
+	Raw string
+	// The exact bytes of the received line, including the line
+	// terminator. Only set if the client's CaptureRaw is enabled.
+	RawBytes []byte
+	// IRCv3 message tags. Values have already been unescaped. Tags
+	// without values map to the empty string.
+	Tags    map[string]string
 	Prefix  Mask
 	Command string
 	Params  []string
@@ -171,6 +202,26 @@ type Message struct {
 	// will equal the command. In some cases, such as CTCP messages,
 	// it will be different.
 	Signal string
+	// The time at which the message was sent. For messages received
+	// with a server-time tag, this is the server's timestamp, which
+	// may lie in the past for replayed history. Otherwise, it is the
+	// time at which the client read the message, or zero for
+	// messages that weren't received, such as those created by
+	// Parse.
+	Time time.Time
+	// The time at which the client read the message, including a
+	// monotonic clock reading, independent of server-time. Zero for
+	// messages that weren't received.
+	Received time.Time
+	// The batch the message belongs to, if any. For BATCH messages
+	// ending a batch, as well as the irc:batch signal, the complete
+	// batch that ended.
+	Batch *Batch
+
+	// dispatched is set on the copies Mux.Process passes to
+	// handlers, so that muxes nested in components don't measure
+	// the message again.
+	dispatched bool
 }
 
 // Copy performs a deep copy of a message. This is useful when passing
@@ -181,6 +232,15 @@ func (m *Message) Copy() *Message {
 	m2 := *m
 	m2.Params = make([]string, len(m.Params))
 	copy(m2.Params, m.Params)
+	if m.RawBytes != nil {
+		m2.RawBytes = append([]byte(nil), m.RawBytes...)
+	}
+	if m.Tags != nil {
+		m2.Tags = make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			m2.Tags[k] = v
+		}
+	}
 	return &m2
 }
 
@@ -196,6 +256,21 @@ func pad(in []string, n int) []string {
 // Parse parses an IRC message as it may be sent or received.
 func Parse(s string) *Message {
 	m := &Message{Raw: s}
+	if len(s) == 0 {
+		return m
+	}
+
+	if s[0] == '@' {
+		parts := pad(strings.SplitN(s, " ", 2), 2)
+		m.Tags = parseTags(parts[0][1:])
+		if t, ok := m.Tags["time"]; ok {
+			m.Time, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		s = strings.TrimLeft(parts[1], " ")
+		if len(s) == 0 {
+			return m
+		}
+	}
 
 	if s[0] == ':' {
 		parts := pad(strings.SplitN(s, " ", 3), 3)
@@ -222,6 +297,52 @@ func Parse(s string) *Message {
 	return m
 }
 
+func parseTags(tags string) map[string]string {
+	out := make(map[string]string)
+	for _, tag := range strings.Split(tags, ";") {
+		if tag == "" {
+			continue
+		}
+		parts := pad(strings.SplitN(tag, "=", 2), 2)
+		out[parts[0]] = unescapeTag(parts[1])
+	}
+	return out
+}
+
+var tagEscapes = map[byte]byte{
+	':':  ';',
+	's':  ' ',
+	'\\': '\\',
+	'r':  '\r',
+	'n':  '\n',
+}
+
+// unescapeTag unescapes a tag value according to the IRCv3
+// message-tags specification.
+func unescapeTag(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			// A trailing backslash is dropped
+			break
+		}
+		if r, ok := tagEscapes[s[i]]; ok {
+			b = append(b, r)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
 func parseParams(params string) []string {
 	if len(params) == 0 {
 		return nil
@@ -254,6 +375,97 @@ func (m *Message) String() string {
 	return m.Raw
 }
 
+// WireString renders the message in the IRC wire format, without the
+// terminating CRLF. It doesn't verify that the message is valid; use
+// Validate for that.
+func (m *Message) WireString() string {
+	var b []byte
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = append(b, '@')
+		for i, k := range keys {
+			if i > 0 {
+				b = append(b, ';')
+			}
+			b = append(b, k...)
+			if v := m.Tags[k]; v != "" {
+				b = append(b, '=')
+				b = append(b, escapeTag(v)...)
+			}
+		}
+		b = append(b, ' ')
+	}
+	if m.Prefix != (Mask{}) {
+		b = append(b, ':')
+		b = append(b, m.Prefix.String()...)
+		b = append(b, ' ')
+	}
+	b = append(b, m.Command...)
+	for i, p := range m.Params {
+		b = append(b, ' ')
+		if i == len(m.Params)-1 && (p == "" || p[0] == ':' || strings.IndexByte(p, ' ') != -1) {
+			b = append(b, ':')
+		}
+		b = append(b, p...)
+	}
+	return string(b)
+}
+
+// Bytes renders the message in the IRC wire format, including the
+// terminating CRLF.
+func (m *Message) Bytes() []byte {
+	return []byte(m.WireString() + "\r\n")
+}
+
+// Validate checks that the message can be represented in the IRC wire
+// format.
+func (m *Message) Validate() error {
+	if m.Command == "" {
+		return errors.New("message has no command")
+	}
+	if strings.ContainsAny(m.Command, " \r\n\x00") {
+		return fmt.Errorf("invalid command %q", m.Command)
+	}
+	for k, v := range m.Tags {
+		if k == "" || strings.ContainsAny(k, " ;=\r\n\x00") {
+			return fmt.Errorf("invalid tag name %q", k)
+		}
+		if strings.IndexByte(v, 0) != -1 {
+			return fmt.Errorf("invalid value for tag %q", k)
+		}
+	}
+	if strings.ContainsAny(m.Prefix.String(), " \r\n\x00") {
+		return fmt.Errorf("invalid prefix %q", m.Prefix.String())
+	}
+	for i, p := range m.Params {
+		if strings.ContainsAny(p, "\r\n\x00") {
+			return fmt.Errorf("parameter %d contains CR, LF or NUL", i)
+		}
+		if i < len(m.Params)-1 && (p == "" || p[0] == ':' || strings.IndexByte(p, ' ') != -1) {
+			return fmt.Errorf("only the last parameter may be empty, start with a colon or contain spaces")
+		}
+	}
+	return nil
+}
+
+// escapeTag escapes a tag value according to the IRCv3 message-tags
+// specification.
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
 // IsNumeric reports whether the message's command is numeric (e.g.
 // 001) as opposed to a string (e.g. "JOIN".)
 func (m *Message) IsNumeric() bool {
@@ -297,6 +509,10 @@ type CTCPMessage struct {
 	Raw     string
 	Command string
 	Params  []string
+	// Text is everything following the command, with spacing
+	// preserved. This is useful for commands such as ACTION, whose
+	// argument is free-form text.
+	Text string
 }
 
 func ParseCTCP(s string) (*CTCPMessage, error) {
@@ -309,6 +525,7 @@ func ParseCTCP(s string) (*CTCPMessage, error) {
 	m.Command = parts[0]
 	if len(parts) > 1 {
 		m.Params = parts[1:]
+		m.Text = s[len(m.Command)+1:]
 	}
 	return m, nil
 }
@@ -324,48 +541,289 @@ func (f HandlerFunc) Process(c *Client, m *Message) {
 }
 
 type Mux struct {
-	mu *sync.RWMutex
-	m  map[string][]Handler
+	mu         *sync.RWMutex
+	m          map[string][]*registered
+	middleware []func(Handler) Handler
+	ordered    bool
+	// signals containing wildcards
+	globs []string
 }
 
 func NewMux() *Mux {
-	mux := &Mux{new(sync.RWMutex), make(map[string][]Handler)}
+	mux := &Mux{mu: new(sync.RWMutex), m: make(map[string][]*registered)}
+	return mux
+}
+
+// NewOrderedMux returns a Mux that runs all handlers synchronously,
+// as if they had been registered with HandleSync.
+func NewOrderedMux() *Mux {
+	mux := NewMux()
+	mux.ordered = true
 	return mux
 }
 
-func (mux *Mux) Handle(signal string, handler Handler) {
+// syncHandler marks handlers registered with HandleSync.
+type syncHandler struct {
+	Handler
+}
+
+func (h syncHandler) Name() string { return HandlerName(h.Handler) }
+
+func isSync(h Handler) bool {
+	switch h := h.(type) {
+	case syncHandler:
+		return true
+	case *onceHandler:
+		return isSync(h.Handler)
+	default:
+		return false
+	}
+}
+
+// HandleSync registers a handler that runs synchronously: the mux
+// runs it in the goroutine that called Process, in the order
+// handlers were registered, instead of in a goroutine of its own.
+// For the client's Mux, this means that such handlers see messages
+// in the order they were received, which is needed for tracking
+// state.
+//
+// Synchronous handlers block the client from reading further
+// messages and must not wait for replies from the server, such as
+// via Whois.
+func (mux *Mux) HandleSync(signal string, handler Handler) *Registration {
+	return mux.Handle(signal, syncHandler{handler})
+}
+
+// HandleSyncFunc is like HandleSync, but for functions.
+func (mux *Mux) HandleSyncFunc(signal string, handler func(*Client, *Message)) *Registration {
+	return mux.HandleSync(signal, HandlerFunc(handler))
+}
+
+// Use adds middleware that wraps every handler the mux dispatches to,
+// analogous to net/http middleware. Middleware added first is the
+// outermost. It is useful for panic recovery, logging or access
+// control.
+func (mux *Mux) Use(middleware func(next Handler) Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.middleware = append(mux.middleware, middleware)
+}
+
+func (mux *Mux) wrap(h Handler) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	for i := len(mux.middleware) - 1; i >= 0; i-- {
+		h = mux.middleware[i](h)
+	}
+	return h
+}
+
+// A Registration is returned when registering a handler and allows
+// removing it again.
+type Registration struct {
+	once   sync.Once
+	remove func()
+}
+
+// NewRegistration returns a Registration that calls remove the first
+// time it is removed. It is meant for implementations of Muxer.
+func NewRegistration(remove func()) *Registration {
+	return &Registration{remove: remove}
+}
+
+// Remove removes the handler. Messages that are already being
+// dispatched may still reach it. Calling Remove more than once has
+// no effect.
+func (r *Registration) Remove() {
+	r.once.Do(r.remove)
+}
+
+// registered is a handler registered with a Mux. It gives the
+// registration an identity, as handlers themselves may not be
+// comparable.
+type registered struct {
+	h Handler
+}
+
+// Handle registers handler for signal. The empty signal registers a
+// catch-all handler. Signals may contain the wildcards * and ?, as in
+// "ctcp:*" or "4??", to handle classes of signals; see WildcardMatch.
+func (mux *Mux) Handle(signal string, handler Handler) *Registration {
+	r := &registered{handler}
+	mux.add(signal, r)
+	return NewRegistration(func() { mux.remove(signal, r) })
+}
+
+func (mux *Mux) HandleFunc(signal string, handler func(*Client, *Message)) *Registration {
+	return mux.Handle(signal, HandlerFunc(handler))
+}
+
+// onceHandler is a handler registered with HandleOnce.
+type onceHandler struct {
+	Handler
+	reg   *Registration
+	fired int32
+}
+
+func (h *onceHandler) Process(c *Client, m *Message) {
+	if !atomic.CompareAndSwapInt32(&h.fired, 0, 1) {
+		return
+	}
+	h.reg.Remove()
+	h.Handler.Process(c, m)
+}
+
+func (h *onceHandler) Name() string { return HandlerName(h.Handler) }
+
+// HandleOnce registers a handler that is removed after it processed
+// the first message, such as when waiting for a single numeric.
+func (mux *Mux) HandleOnce(signal string, handler Handler) *Registration {
+	h := &onceHandler{Handler: handler}
+	r := &registered{h}
+	h.reg = NewRegistration(func() { mux.remove(signal, r) })
+	mux.add(signal, r)
+	return h.reg
+}
+
+// HandleOnceFunc is like HandleOnce, but for functions.
+func (mux *Mux) HandleOnceFunc(signal string, handler func(*Client, *Message)) *Registration {
+	return mux.HandleOnce(signal, HandlerFunc(handler))
+}
+
+func (mux *Mux) add(signal string, r *registered) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
-	mux.m[signal] = append(mux.m[signal], handler)
+	if _, ok := mux.m[signal]; !ok && strings.ContainsAny(signal, "*?") {
+		mux.globs = append(mux.globs, signal)
+	}
+	mux.m[signal] = append(mux.m[signal], r)
 }
 
-func (mux *Mux) HandleFunc(signal string, handler func(*Client, *Message)) {
-	mux.Handle(signal, HandlerFunc(handler))
+func (mux *Mux) remove(signal string, r *registered) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	var rs []*registered
+	for _, other := range mux.m[signal] {
+		if other != r {
+			rs = append(rs, other)
+		}
+	}
+	if len(rs) > 0 {
+		mux.m[signal] = rs
+		return
+	}
+	delete(mux.m, signal)
+	for i, glob := range mux.globs {
+		if glob == signal {
+			mux.globs = append(mux.globs[:i:i], mux.globs[i+1:]...)
+			break
+		}
+	}
 }
 
 func (mux *Mux) Handlers(m *Message) (hs []Handler) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
-	hs = mux.m[m.Signal]
-	hs = append(hs, mux.m[""]...)
+	add := func(rs []*registered) {
+		for _, r := range rs {
+			hs = append(hs, r.h)
+		}
+	}
+	add(mux.m[m.Signal])
+	for _, glob := range mux.globs {
+		if glob != m.Signal && WildcardMatch(glob, m.Signal) {
+			add(mux.m[glob])
+		}
+	}
+	add(mux.m[""])
 	return hs
 }
 
+// Process dispatches m to the handlers registered for its signal. c
+// may be nil, for example in tests, in which case panics in handlers
+// aren't recovered.
 func (mux *Mux) Process(c *Client, m *Message) {
 	hs := mux.Handlers(m)
 	if hs != nil {
 		for _, h := range hs {
-			go h.Process(c, m.Copy())
+			inline := isSync(h)
+			h, m := mux.wrap(h), m.Copy()
+			nested := m.dispatched
+			m.dispatched = true
+			if c == nil {
+				if inline || mux.ordered {
+					h.Process(c, m)
+				} else {
+					go h.Process(c, m)
+				}
+				continue
+			}
+			run := func() {
+				defer c.RecoverHandler(m)
+				if c.Metrics != nil && !nested {
+					start := time.Now()
+					defer func() { c.Metrics.HandlerDone(m.Signal, time.Since(start)) }()
+				}
+				h.Process(c, m)
+			}
+			if inline || mux.ordered {
+				run()
+			} else {
+				c.spawn("handler", run)
+			}
+		}
+	}
+}
+
+// Signals returns the signals that have handlers registered, mapped
+// to the number of handlers. Catch-all handlers are registered for
+// the empty signal.
+func (mux *Mux) Signals() map[string]int {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	out := make(map[string]int, len(mux.m))
+	for signal, hs := range mux.m {
+		out[signal] = len(hs)
+	}
+	return out
+}
+
+// Describe returns the names of the handlers registered for each
+// signal. See HandlerName for how handlers are named.
+func (mux *Mux) Describe() map[string][]string {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	out := make(map[string][]string, len(mux.m))
+	for signal, rs := range mux.m {
+		for _, r := range rs {
+			out[signal] = append(out[signal], HandlerName(r.h))
 		}
 	}
+	return out
+}
+
+type namedHandler struct {
+	Handler
+	name string
 }
 
-var DefaultMux = NewMux()
+func (h namedHandler) Name() string { return h.name }
 
-func Handle(signal string, handler Handler) { DefaultMux.Handle(signal, handler) }
+// Named attaches a name to a handler, for use in introspection.
+func Named(name string, h Handler) Handler {
+	return namedHandler{h, name}
+}
 
-func HandleFunc(signal string, handler func(*Client, *Message)) {
-	DefaultMux.HandleFunc(signal, handler)
+// HandlerName returns the name of a handler. Handlers that have a
+// Name() string method, such as those returned by Named, are named by
+// it. All other handlers are named after their type.
+func HandlerName(h Handler) string {
+	if n, ok := h.(interface {
+		Name() string
+	}); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", h)
 }
 
 type Authenticator interface {
@@ -374,38 +832,157 @@ type Authenticator interface {
 
 type Muxer interface {
 	Handler
-	Handle(command string, handler Handler)
-	HandleFunc(command string, handler func(*Client, *Message))
+	Handle(command string, handler Handler) *Registration
+	HandleFunc(command string, handler func(*Client, *Message)) *Registration
 	Handlers(m *Message) (hs []Handler)
 }
 
 type Client struct {
 	Authenticator Authenticator
-	Err           error
+	// Caps negotiates IRCv3 capabilities. It will be created during
+	// dialing if it is nil.
+	Caps *CapabilityManager
+	// CaptureRaw causes received messages to retain the exact bytes
+	// of their line, including the line terminator, in
+	// Message.RawBytes. This is useful for proxies that need to
+	// relay lines unaltered.
+	CaptureRaw bool
+	// Dialer is used by Dial and DialTLS to establish connections.
+	// If nil, a net.Dialer is used. To use a connection established
+	// by other means, use Connect.
+	Dialer Dialer
+	// Diagnostics, if set, is called with problems that the client
+	// worked around, such as malformed ISUPPORT tokens (as
+	// *ISupportError). If nil, they are logged with Logger.Debug.
+	Diagnostics func(err error)
+	// Err is the error that caused the connection to fail.
+	//
+	// Deprecated: Reading Err races with the client's goroutines;
+	// use the Error method instead.
+	Err error
 	// TODO proper documentation. The ISupport field will be
 	// automatically set to a default value during dialing and will
-	// then be populated by the IRC server.
-	ISupport    *ISupport
-	Logger      Logger
-	Mux         Muxer
-	Name        string
-	Nick        string
-	Password    string
-	TLSConfig   *tls.Config
-	User        string
-	mu          sync.RWMutex
-	currentNick string
-	connected   []string
-	conn        net.Conn
-	chSend      chan sendMessage
-	chQuit      chan struct{}
-	scanner     *bufio.Scanner
-	dead        bool
+	// then be populated by the IRC server. Rather than being
+	// modified, it is replaced whenever the server advertises new
+	// tokens; use Support to read it while the client is running.
+	ISupport *ISupport
+	// Lengths determines how arguments exceeding the limits
+	// advertised in ISupport are handled.
+	Lengths LengthPolicy
+	Logger  Logger
+	// Metrics, if set, receives measurements of the client's
+	// traffic and handlers.
+	Metrics Metrics
+	// Mux dispatches incoming messages and signals. If nil,
+	// DefaultMux is used, unless RequireMux is set.
+	Mux  Muxer
+	Name string
+	Nick string
+	// PanicHandler, if set, is called with panics recovered from
+	// handlers, in addition to them being logged. m is the message
+	// the handler was processing.
+	PanicHandler func(m *Message, err *PanicError)
+	Password     string
+	// How often to send PING to the server, to keep the connection
+	// alive and measure lag. Defaults to 120 seconds.
+	PingInterval time.Duration
+	// RateLimit limits how quickly messages are sent to the server.
+	// If nil, messages are sent as fast as possible. Use
+	// SetRateLimit to change it while connected.
+	RateLimit *RateProfile
+	// Labels are added to the pprof labels of the client's
+	// goroutines, in addition to irc.goroutine, which identifies the
+	// goroutine's purpose. Multi-network bots should set a "network"
+	// label; otherwise the NETWORK advertised by the server is used
+	// once known. Use SetLabels to change them while connected.
+	Labels map[string]string
+	// RecoverPanics causes panics in the client's own goroutines,
+	// such as the read loop, to be recovered. They will be logged
+	// via Logger.Panic and fail the connection with a *PanicError,
+	// which Process returns.
+	RecoverPanics bool
+	// RequireMux causes connecting to fail with ErrNoMux if Mux is
+	// nil, instead of falling back to DefaultMux. Libraries and
+	// programs running several independent clients should set it to
+	// avoid sharing handlers by accident.
+	RequireMux bool
+	// RegistrationTimeout is how long to wait for RPL_WELCOME after
+	// Login before failing the connection with
+	// ErrRegistrationTimeout. Defaults to 60 seconds. A negative
+	// value disables the timeout.
+	RegistrationTimeout time.Duration
+	// ReplyMode determines whether Reply uses PRIVMSG or NOTICE.
+	// It can be overridden per channel with SetChannelReplyMode.
+	ReplyMode ReplyMode
+	// ReplyToNotices allows Reply to answer NOTICE messages, which
+	// it otherwise ignores to avoid loops between bots.
+	ReplyToNotices bool
+	// Clock is used for pings, rate limiting and timeouts. Defaults
+	// to RealClock.
+	Clock Clock
+	// Proxy, if set, is sent before anything else, to forward the
+	// address of the user the client connects on behalf of.
+	Proxy *ProxyHeader
+	// Timeout is how long reading from or writing to the server may
+	// take before the connection is considered dead. It should be
+	// longer than PingInterval. Defaults to 240 seconds.
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+	// WebIRC, if set, is sent before registering, to forward the
+	// hostname and IP of the user the client connects on behalf of.
+	WebIRC *WebIRC
+	// UpgradeTLS causes the client to upgrade plaintext connections
+	// to TLS with STARTTLS before registering, if the server
+	// advertises the tls capability. If the server doesn't support
+	// STARTTLS, registration continues unencrypted, unless
+	// RequireTLS is set; use TLS to check. TLSConfig is used for the
+	// handshake. If it doesn't specify a ServerName, the host passed
+	// to Dial is used.
+	UpgradeTLS bool
+	// RequireTLS causes connections that UpgradeTLS fails to upgrade
+	// to fail with ErrNoTLS instead of registering unencrypted.
+	RequireTLS bool
+	User       string
+	mu         sync.RWMutex
+	rmu        sync.Mutex
+	host       string
+	chTLS      chan struct{}
+	replyModes map[string]ReplyMode
+	// pprof label sets by goroutine kind, reset when the labels change
+	labelSets map[string]pprof.LabelSet
+	qmu       sync.Mutex
+	queries   []*query
+	// closed when a handover in progress has failed
+	handover   chan struct{}
+	lmu        sync.Mutex
+	labeled    map[string]*labeled
+	lastLabel  uint64
+	batches    map[string]*openBatch
+	logs       *logQueue
+	self       Mask
+	connected  []string
+	conn       *Conn
+	chSend     chan sendMessage
+	chPriority chan sendMessage
+	queued     int32
+	chQuit     chan struct{}
+	chWelcome  chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	dead       bool
+	quitting   bool
+	resumed    bool
+	limiter    rateLimiter
+	outgoing   []func(*Message) []*Message
+	pingToken  string
+	pingSent   time.Time
+	lag        time.Duration
 }
 
 type sendMessage struct {
-	msg string
-	ch  chan error
+	msg      string
+	ch       chan error
+	priority bool
 }
 
 func inStrings(in []string, s string) bool {
@@ -417,6 +994,16 @@ func inStrings(in []string, s string) bool {
 	return false
 }
 
+// Support returns the ISUPPORT information of the current
+// connection. The returned ISupport is never modified, so it can be
+// read without synchronization; when the server sends RPL_ISUPPORT,
+// the client replaces it.
+func (c *Client) Support() *ISupport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ISupport
+}
+
 func (c *Client) Connected() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -429,54 +1016,230 @@ func (c *Client) Connected() bool {
 
 var ErrDeadClient = errors.New("dead client")
 
-func (c *Client) Dial(network, addr string) error {
-	c.mu.Lock()
-	if c.dead {
-		return ErrDeadClient
+// ErrQuit is returned by Process after the connection has been torn
+// down in response to Quit or Close.
+var ErrQuit = errors.New("client quit")
+
+// ErrNoMux is returned when connecting a client that has no Mux,
+// either because RequireMux is set or because the package was built
+// without DefaultMux.
+var ErrNoMux = errors.New("client has no mux")
+
+// ErrRegistrationTimeout is the error a connection fails with when
+// the server doesn't complete registration in time. See
+// Client.RegistrationTimeout.
+var ErrRegistrationTimeout = errors.New("timed out waiting for registration")
+
+// ErrNoTLS is the error a connection fails with when it couldn't be
+// upgraded with STARTTLS and Client.RequireTLS is set, or when the
+// server didn't answer STARTTLS in time.
+var ErrNoTLS = errors.New("couldn't upgrade connection to TLS")
+
+// A Dialer establishes connections. *net.Dialer and the dialers of
+// golang.org/x/net/proxy, such as for SOCKS5 or Tor, implement it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+func (c *Client) dial(network, addr string) (net.Conn, error) {
+	c.mu.RLock()
+	dead, dialer := c.dead, c.Dialer
+	c.mu.RUnlock()
+	if dead {
+		return nil, ErrDeadClient
 	}
-	c.mu.Unlock()
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		c.mu.Lock()
+		c.host = host
+		c.mu.Unlock()
+	}
+	return conn, nil
+}
 
-	conn, err := net.Dial(network, addr)
+func (c *Client) Dial(network, addr string) error {
+	conn, err := c.dial(network, addr)
 	if err != nil {
 		return err
 	}
-	c.conn = conn
-	c.init()
-	return nil
+	return c.Connect(conn)
 }
 
 func (c *Client) DialTLS(network, addr string) error {
+	conn, err := c.dial(network, addr)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.host
+	}
+	c.mu.RUnlock()
+	tconn := tls.Client(conn, cfg)
+	tconn.SetDeadline(time.Now().Add(60 * time.Second))
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	tconn.SetDeadline(time.Time{})
+	return c.Connect(tconn)
+}
+
+// A ClientOption configures a client created by NewClient.
+type ClientOption func(c *Client)
+
+// WithMux sets the client's Mux.
+func WithMux(mux Muxer) ClientOption {
+	return func(c *Client) { c.Mux = mux }
+}
+
+// WithIdentity sets the client's nick, user name and real name.
+func WithIdentity(nick, user, name string) ClientOption {
+	return func(c *Client) {
+		c.Nick = nick
+		c.User = user
+		c.Name = name
+	}
+}
+
+// WithLogger sets the client's Logger.
+func WithLogger(l Logger) ClientOption {
+	return func(c *Client) { c.Logger = l }
+}
+
+// WithMetrics sets the client's Metrics.
+func WithMetrics(m Metrics) ClientOption {
+	return func(c *Client) { c.Metrics = m }
+}
+
+// NewClient returns a client that uses an already established
+// connection, such as one end of a net.Pipe, possibly wrapped in
+// TLS. The options are applied in order; any option is a function,
+// so fields without a dedicated option can be set with a closure:
+//
+//	c, err := irc.NewClient(conn, irc.WithMux(mux), func(c *irc.Client) {
+//		c.RequireMux = true
+//	})
+//
+// Call Process to register and process messages.
+func NewClient(conn net.Conn, opts ...ClientOption) (*Client, error) {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.Connect(conn); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ErrAlreadyConnected is returned when connecting a client that
+// already has a connection. Clients can't be reused; create a new
+// one to reconnect.
+var ErrAlreadyConnected = errors.New("client already connected")
+
+// Connect uses an already established connection, such as one
+// created by a custom dialer or net.Pipe.
+func (c *Client) Connect(conn net.Conn) error {
 	c.mu.Lock()
 	if c.dead {
+		c.mu.Unlock()
 		return ErrDeadClient
 	}
+	if c.conn != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrAlreadyConnected
+	}
+	if c.Mux == nil && (c.RequireMux || defaultMuxer() == nil) {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrNoMux
+	}
+	c.conn = NewConn(conn)
+	proxy := c.Proxy
 	c.mu.Unlock()
-
-	conn, err := tls.Dial(network, addr, c.TLSConfig)
-	if err != nil {
-		return err
+	if proxy != nil {
+		header, err := proxy.Format()
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
 	}
-	c.conn = conn
 	c.init()
+	if c.Metrics != nil {
+		c.Metrics.Connected()
+	}
+	logs, quit := c.logs, c.chQuit
+	c.spawn("log", func() { c.logLoop(logs, quit) })
+	c.spawn("write", c.writeLoop)
 	return nil
 }
 
+// parseISupport parses a RPL_ISUPPORT message into a copy of the
+// current ISupport, which it then replaces, as handlers may be
+// reading the current one.
+func (c *Client) parseISupport(m *Message) {
+	is := c.Support().clone()
+	is.ParseReport(m, func(err *ISupportError) { c.diagnose(err) })
+	c.mu.Lock()
+	if c.ISupport == nil || is.Network != c.ISupport.Network {
+		c.labelSets = nil
+	}
+	c.ISupport = is
+	c.mu.Unlock()
+}
+
 func (c *Client) init() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.Mux == nil {
-		c.Mux = DefaultMux
+		c.Mux = defaultMuxer()
 	}
 	if c.Logger == nil {
 		c.Logger = nullLogger{}
 	}
-	c.ISupport = NewISupport()
+	is := NewISupport()
+	if c.ISupport != nil && c.ISupport.onChange != nil {
+		is.onChange = c.ISupport.onChange
+	}
+	c.ISupport = is
+	c.labelSets = nil
+	if c.Caps == nil {
+		c.Caps = NewCapabilityManager()
+	}
+	c.Caps.reset()
 	c.chSend = make(chan sendMessage)
+	c.chPriority = make(chan sendMessage)
 	c.chQuit = make(chan struct{})
-	c.scanner = bufio.NewScanner(c.conn)
+	c.chWelcome = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.chTLS = make(chan struct{})
+	c.logs = newLogQueue()
+	c.conn.Timeout = c.timeout()
+	c.conn.CaptureRaw = c.CaptureRaw
+	c.conn.Clock = c.Clock
 	c.connected = nil
-	c.currentNick = ""
-	go c.writeLoop()
+	c.batches = nil
+	c.self = Mask{}
+	c.quitting = false
+	c.pingToken = ""
+	c.lag = 0
+	c.limiter = rateLimiter{clock: c.Clock}
+	c.limiter.setProfile(c.RateLimit)
 }
 
 func (c *Client) error(err error) {
@@ -489,90 +1252,524 @@ func (c *Client) error(err error) {
 	c.dead = true
 	c.conn.Close()
 	close(c.chQuit)
+	c.cancel()
+	c.closeLabeled()
+}
+
+// Error returns the error that caused the connection to fail, or nil
+// if it hasn't failed.
+func (c *Client) Error() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Err
 }
 
-func (c *Client) Process() error {
-	go c.pingLoop()
-	if c.Authenticator != nil {
-		go c.Authenticator.Authenticate(c)
+func (c *Client) Process() (err error) {
+	c.spawn("ping", c.pingLoop)
+	c.mu.RLock()
+	resumed := c.resumed
+	c.mu.RUnlock()
+	if resumed {
+		c.Mux.Process(c, &Message{Signal: "irc:resumed"})
 	} else {
-		go c.Login()
+		c.register()
+	}
+	pprof.Do(context.Background(), c.labels("read"), func(context.Context) {
+		err = c.readLoop()
+	})
+	return err
+}
+
+// register registers the connection with the server.
+func (c *Client) register() {
+	c.spawn("register", func() {
+		defer c.recoverPanic()
+		if c.UpgradeTLS && !c.TLS() {
+			if err := c.upgradeTLS(); err != nil {
+				c.error(err)
+				return
+			}
+		}
+		if c.WebIRC != nil {
+			// WEBIRC has to precede everything else, including CAP.
+			if err := c.SendMessage(c.WebIRC.message()); err != nil {
+				c.error(err)
+				return
+			}
+		}
+		if c.Authenticator != nil {
+			c.Authenticator.Authenticate(c)
+		} else {
+			c.NegotiateCaps()
+			c.Login()
+		}
+	})
+}
+
+// labels returns the pprof labels for one of the client's
+// goroutines. They are computed once per connection and kind, and
+// again after NETWORK or Labels changed.
+func (c *Client) labels(kind string) pprof.LabelSet {
+	c.mu.RLock()
+	labels, ok := c.labelSets[kind]
+	c.mu.RUnlock()
+	if ok {
+		return labels
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	args := []string{"irc.goroutine", kind}
+	for k, v := range c.Labels {
+		args = append(args, k, v)
+	}
+	if _, ok := c.Labels["network"]; !ok && c.ISupport != nil && c.ISupport.Network != "" {
+		args = append(args, "network", c.ISupport.Network)
 	}
-	return c.readLoop()
+	labels = pprof.Labels(args...)
+	if c.labelSets == nil {
+		c.labelSets = make(map[string]pprof.LabelSet)
+	}
+	c.labelSets[kind] = labels
+	return labels
 }
 
-type readReply struct {
-	msg *Message
-	err error
+// SetLabels changes the Labels of a connected client. Goroutines
+// started afterwards are labelled with the new labels.
+func (c *Client) SetLabels(labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Labels = labels
+	c.labelSets = nil
 }
 
-func (c *Client) read(ch chan readReply) {
-	ok := c.scanner.Scan()
-	if !ok {
-		err := c.scanner.Err()
-		if err == nil {
-			err = io.EOF
-		}
-		c.error(err)
+// spawn runs fn in a new goroutine, tagged with pprof labels.
+func (c *Client) spawn(kind string, fn func()) {
+	labels := c.labels(kind)
+	go pprof.Do(context.Background(), labels, func(context.Context) { fn() })
+}
+
+// A PanicError is the error a connection fails with when a panic
+// was recovered. See Client.RecoverPanics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+// recoverPanic recovers a panic if RecoverPanics is set, logs it and
+// fails the connection. It must be deferred directly.
+func (c *Client) recoverPanic() {
+	if !c.RecoverPanics {
 		return
 	}
-	c.conn.SetReadDeadline(time.Now().Add(240 * time.Second))
-	m := Parse(c.scanner.Text())
-	ch <- readReply{m, nil}
+	if v := recover(); v != nil {
+		c.panicked(v)
+	}
 }
 
-func (c *Client) Read() (*Message, error) {
-	select {
-	case <-c.chQuit:
-		return nil, c.Err
+// RecoverHandler recovers a panic in a handler that was processing
+// m, logs it via Logger.Panic and passes it to PanicHandler, if set.
+// Unlike panics in the client's own goroutines, it doesn't affect
+// the connection. Mux.Process uses it for all handlers; custom
+// Muxers should do the same. It must be deferred directly.
+func (c *Client) RecoverHandler(m *Message) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	c.mu.RLock()
+	logger := c.Logger
+	c.mu.RUnlock()
+	if logger != nil {
+		logger.Panic(v)
+	}
+	if c.Metrics != nil {
+		c.Metrics.HandlerPanicked(m.Signal)
+	}
+	if c.PanicHandler != nil {
+		c.PanicHandler(m, err)
+	}
+}
+
+func (c *Client) panicked(v interface{}) *PanicError {
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	c.Logger.Panic(v)
+	c.error(err)
+	return err
+}
+
+// TLS reports whether the connection is encrypted, either because it
+// was established with DialTLS or because it was upgraded with
+// STARTTLS.
+func (c *Client) TLS() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn.TLS()
+}
+
+// startTLS performs the TLS handshake after the server accepted our
+// STARTTLS. It must only be called from Read, so that no read is in
+// progress on the plaintext connection.
+func (c *Client) startTLS() error {
+	c.mu.RLock()
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.host
+	}
+	conn := c.conn
+	c.mu.RUnlock()
+	return conn.StartTLS(cfg)
+}
+
+// upgradeTLS upgrades the connection with STARTTLS if the server
+// advertises the tls capability. Failing to upgrade is only an error
+// if RequireTLS is set. Both the capability listing and the reply to
+// STARTTLS are waited for no longer than the capability negotiation
+// timeout.
+func (c *Client) upgradeTLS() error {
+	timeout := c.Caps.timeout()
+	listed := c.Caps.listing()
+	if err := c.Send("CAP LS 302"); err != nil {
+		return err
+	}
+	ok, err := c.await(listed, timeout)
+	if err != nil {
+		return err
+	}
+	if _, tls := c.Caps.Available()["tls"]; !ok || !tls {
+		return c.withoutTLS()
+	}
+
+	c.mu.RLock()
+	done := c.chTLS
+	c.mu.RUnlock()
+	if err := c.Send("STARTTLS"); err != nil {
+		return err
+	}
+	ok, err = c.await(done, timeout)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// A late reply would upgrade the connection in the middle
+		// of registration.
+		return ErrNoTLS
+	}
+	if !c.TLS() {
+		return c.withoutTLS()
+	}
+	return nil
+}
+
+// withoutTLS decides whether to register on a connection that
+// couldn't be upgraded.
+func (c *Client) withoutTLS() error {
+	if c.RequireTLS {
+		return ErrNoTLS
+	}
+	c.Logger.Debug("couldn't upgrade to TLS, registering unencrypted")
+	return nil
+}
+
+// await waits for ch to be closed. It returns false if the timeout
+// expired first, and ErrDeadClient if the connection died. A timeout
+// of zero or less waits forever.
+func (c *Client) await(ch <-chan struct{}, timeout time.Duration) (bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := OrRealClock(c.Clock).NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C()
+	}
+	select {
+	case <-ch:
+		return true, nil
+	case <-expired:
+		return false, nil
+	case <-c.Done():
+		return false, ErrDeadClient
+	}
+}
+
+// tlsDone lets registration proceed after STARTTLS succeeded or
+// failed.
+func (c *Client) tlsDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.chTLS:
 	default:
+		close(c.chTLS)
 	}
+}
 
-	ch := make(chan readReply, 1)
-	go c.read(ch)
+type readReply struct {
+	msg *Message
+	err error
+}
+
+func (c *Client) read(ch chan readReply) {
+	m, err := c.conn.ReadMessage()
+	if err != nil {
+		c.mu.RLock()
+		if c.quitting {
+			err = ErrQuit
+		}
+		c.mu.RUnlock()
+		if err == errPaused {
+			ch <- readReply{nil, err}
+			return
+		}
+		c.error(err)
+		return
+	}
+	ch <- readReply{m, nil}
+}
+
+// diagnose reports a problem that the client worked around.
+func (c *Client) diagnose(err error) {
+	if c.Diagnostics != nil {
+		c.Diagnostics(err)
+		return
+	}
+	c.Logger.Debug(err)
+}
+
+func (c *Client) Read() (*Message, error) {
+	// Handover waits for the message being read to be processed.
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
 	select {
-	case reply := <-ch:
-		m := reply.msg
-		c.Logger.Incoming(m)
-		switch m.Command {
-		case "PING":
-			c.Sendf("PONG %s", reply.msg.Params[0])
-		case RPL_ISUPPORT:
-			c.ISupport.Parse(m)
-		case RPL_WELCOME, RPL_YOURHOST, RPL_CREATED, RPL_MYINFO, ERR_NOMOTD:
-			c.mu.Lock()
-			c.connected = append(c.connected, m.Command)
-			c.currentNick = m.Params[0]
-			c.mu.Unlock()
-		case "NICK":
-			// We don't need to lock for reading here, there is no
-			// concurrent writer to c.currentNick
-			if m.Prefix.Nick != c.currentNick {
-				break
+	case <-c.chQuit:
+		return nil, c.Error()
+	default:
+	}
+
+	ch := make(chan readReply, 1)
+	for {
+		go c.read(ch)
+		select {
+		case reply := <-ch:
+			if reply.err == errPaused {
+				// A handover is in progress. Let it proceed and
+				// wait for its outcome; if it failed, reading
+				// resumes.
+				c.rmu.Unlock()
+				resumed := c.awaitHandover()
+				c.rmu.Lock()
+				if !resumed {
+					return nil, c.Error()
+				}
+				continue
 			}
-			c.mu.Lock()
-			c.currentNick = m.Params[0]
-			c.mu.Unlock()
+			m := reply.msg
+			// The logger runs concurrently with the rest of Read, which
+			// still modifies m.
+			c.logs.push(m.Copy(), false)
+			if c.Metrics != nil {
+				c.Metrics.MessageReceived(m.Command, len(m.Raw)+2)
+			}
+			switch m.Command {
+			case "PING":
+				c.Sendf("PONG %s", reply.msg.Params[0])
+			case RPL_ISUPPORT:
+				c.parseISupport(m)
+			case "CAP":
+				c.handleCap(m)
+			case ERR_UNKNOWNCOMMAND, ERR_NOTREGISTERED:
+				c.capUnsupported(m)
+				if len(m.Params) > 1 && m.Params[1] == "STARTTLS" {
+					c.tlsDone()
+				}
+			case RPL_STARTTLS:
+				if err := c.startTLS(); err != nil {
+					c.error(err)
+					return nil, err
+				}
+				c.tlsDone()
+			case ERR_STARTTLS:
+				c.tlsDone()
+			case RPL_WELCOME, RPL_YOURHOST, RPL_CREATED, RPL_MYINFO, ERR_NOMOTD:
+				c.mu.Lock()
+				// Servers may send these in any order, and more than
+				// once.
+				select {
+				case <-c.chWelcome:
+				default:
+					close(c.chWelcome)
+				}
+				c.connected = append(c.connected, m.Command)
+				c.mu.Unlock()
+			}
+			c.updateIdentity(m)
+			c.feedQueries(m)
+			c.routeLabeled(m)
+			if b := c.trackBatch(m); b != nil {
+				m.Batch = b
+			}
+			if m.Command == RPL_WELCOME {
+				// Learn our hostmask for MaxMessageLen. Sending from
+				// the read loop could block it behind the rate limit.
+				nick := c.CurrentNick()
+				c.spawn("userhost", func() {
+					defer c.recoverPanic()
+					c.Sendf("USERHOST %s", nick)
+				})
+			}
+			return reply.msg, reply.err
+		case <-c.chQuit:
+			return nil, c.Error()
 		}
-		return reply.msg, reply.err
-	case <-c.chQuit:
-		return nil, c.Err
 	}
 }
 
+// updateIdentity updates the client's view of its own nick, user and
+// host based on an incoming message.
+func (c *Client) updateIdentity(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.Prefix.Nick != "" && m.Prefix.Nick == c.self.Nick && m.Prefix.User != "" {
+		// Messages we caused, e.g. our own JOINs, carry our full
+		// hostmask.
+		c.self.User = m.Prefix.User
+		c.self.Host = m.Prefix.Host
+	}
+	switch m.Command {
+	case RPL_WELCOME, RPL_YOURHOST, RPL_CREATED, RPL_MYINFO, ERR_NOMOTD:
+		if len(m.Params) > 0 {
+			c.self.Nick = m.Params[0]
+		}
+	case "NICK":
+		if len(m.Params) > 0 && m.Prefix.Nick == c.self.Nick {
+			c.self.Nick = m.Params[0]
+		}
+	case RPL_VISIBLEHOST:
+		// Some servers send user@host, most only send the host.
+		if len(m.Params) < 2 {
+			break
+		}
+		if idx := strings.Index(m.Params[1], "@"); idx != -1 {
+			c.self.User = m.Params[1][:idx]
+			c.self.Host = m.Params[1][idx+1:]
+		} else {
+			c.self.Host = m.Params[1]
+		}
+	case RPL_USERHOST:
+		if len(m.Params) < 2 {
+			break
+		}
+		// Replies take the form nick[*]=[+-]user@host
+		for _, reply := range strings.Fields(m.Params[len(m.Params)-1]) {
+			idx := strings.Index(reply, "=")
+			if idx < 1 || idx+2 > len(reply) {
+				continue
+			}
+			nick := strings.TrimSuffix(reply[:idx], "*")
+			if nick != c.self.Nick {
+				continue
+			}
+			userhost := reply[idx+2:]
+			at := strings.Index(userhost, "@")
+			if at == -1 {
+				continue
+			}
+			c.self.User = userhost[:at]
+			c.self.Host = userhost[at+1:]
+		}
+	}
+}
+
+// MaxMessageLen returns the maximum length of a message sent by the
+// client, such that it doesn't get truncated when the server relays
+// it to other clients with our hostmask as its prefix. If our user or
+// host aren't known yet, a pessimistic estimate is used.
+func (c *Client) MaxMessageLen() int {
+	self := c.Identity()
+	user, host := len(self.User), len(self.Host)
+	if user == 0 {
+		user = 10
+	}
+	if host == 0 {
+		host = 63
+	}
+	// 512 bytes, minus CRLF, minus ":nick!user@host "
+	return 510 - (1 + len(self.Nick) + 1 + user + 1 + host + 1)
+}
+
+func (c *Client) pingInterval() time.Duration {
+	if c.PingInterval == 0 {
+		return 120 * time.Second
+	}
+	return c.PingInterval
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 240 * time.Second
+	}
+	return c.Timeout
+}
+
 func (c *Client) pingLoop() {
-	ticker := time.NewTicker(120 * time.Second)
+	defer c.recoverPanic()
+	ticker := OrRealClock(c.Clock).NewTicker(c.pingInterval())
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			c.Send("PING :0")
+		case <-ticker.C():
+			now := OrRealClock(c.Clock).Now()
+			token := strconv.FormatInt(now.UnixNano(), 10)
+			c.mu.Lock()
+			c.pingToken, c.pingSent = token, now
+			c.mu.Unlock()
+			c.Send("PING :" + token)
 		case <-c.chQuit:
 			return
 		}
 	}
 }
 
-func (c *Client) readLoop() error {
+// Lag returns the round-trip time of the most recent PING, or zero
+// if none has been answered yet. Whenever the lag is measured, the
+// client also emits the irc:lag signal, whose only parameter is the
+// lag in milliseconds.
+func (c *Client) Lag() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lag
+}
+
+// measureLag updates the lag if m answers our most recent PING.
+func (c *Client) measureLag(m *Message) (time.Duration, bool) {
+	if len(m.Params) == 0 {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pingToken == "" || m.Params[len(m.Params)-1] != c.pingToken {
+		return 0, false
+	}
+	c.lag = m.Received.Sub(c.pingSent)
+	c.pingToken = ""
+	return c.lag, true
+}
+
+func (c *Client) readLoop() (err error) {
+	if c.RecoverPanics {
+		defer func() {
+			if v := recover(); v != nil {
+				err = c.panicked(v)
+			}
+		}()
+	}
 	for {
 		m, err := c.Read()
 		if err != nil {
@@ -584,9 +1781,44 @@ func (c *Client) readLoop() error {
 			if c.Connected() {
 				c.Mux.Process(c, &Message{Signal: "irc:connected"})
 			}
+		case RPL_ISUPPORT:
+			// The read loop was labelled before NETWORK was known.
+			pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), c.labels("read")))
+		case "PONG":
+			if lag, ok := c.measureLag(m); ok {
+				ms := strconv.FormatInt(int64(lag/time.Millisecond), 10)
+				c.Mux.Process(c, &Message{Signal: "irc:lag", Params: []string{ms}})
+			}
+		case "CAP", ERR_UNKNOWNCOMMAND:
+			if c.Caps.takeCompleted() {
+				c.Mux.Process(c, &Message{Signal: "irc:capabilities"})
+			}
+		case "BATCH":
+			if len(m.Params) > 0 && strings.HasPrefix(m.Params[0], "-") && m.Batch != nil {
+				c.Mux.Process(c, &Message{Signal: "irc:batch", Batch: m.Batch, Time: m.Time})
+			}
+		case "JOIN":
+			if c.IsMe(m.Prefix.Nick) {
+				self := m.Copy()
+				self.Signal = "self:JOIN"
+				c.Mux.Process(c, self)
+			}
+		case "KICK", "PART":
+			if m.Command == "PART" && c.IsMe(m.Prefix.Nick) {
+				self := m.Copy()
+				self.Signal = "self:PART"
+				c.Mux.Process(c, self)
+			}
+			if kicked := c.kicked(m); kicked != nil {
+				c.Mux.Process(c, kicked)
+			}
 		case "PRIVMSG", "NOTICE":
-			if ctcp, err := m.CTCP(); err == nil {
+			// Every embedded CTCP is dispatched as a message of
+			// its own, so that handlers can use Message.CTCP.
+			ctcps, _ := m.CTCPs()
+			for _, ctcp := range ctcps {
 				m := m.Copy()
+				m.Params[len(m.Params)-1] = CTCPDelim + ctcp.Raw + CTCPDelim
 				m.Signal = "ctcp:" + ctcp.Command
 				c.Mux.Process(c, m)
 			}
@@ -597,22 +1829,59 @@ func (c *Client) readLoop() error {
 }
 
 func (c *Client) writeLoop() {
+	defer c.recoverPanic()
 	for {
+		var m sendMessage
+		// Priority messages always go first.
 		select {
-		case m := <-c.chSend:
-			s := m.msg
-			c.Logger.Outgoing(Parse(s))
-			c.conn.SetWriteDeadline(time.Now().Add(240 * time.Second))
-			_, err := io.WriteString(c.conn, s+"\r\n")
-			if err != nil {
-				m.ch <- err
-				c.error(err)
+		case m = <-c.chPriority:
+		default:
+			select {
+			case m = <-c.chPriority:
+			case m = <-c.chSend:
+			case <-c.chQuit:
+				return
+			}
+		}
+		pm := Parse(m.msg)
+		d := c.limiter.reserve(pm.Command, len(m.msg)+2)
+		if m.priority {
+			d = 0
+		}
+		if d > 0 {
+			wait := OrRealClock(c.Clock).After(d)
+		waitLoop:
+			for {
+				select {
+				case <-wait:
+					break waitLoop
+				case prio := <-c.chPriority:
+					c.limiter.reserve("", len(prio.msg)+2)
+					c.write(prio, Parse(prio.msg))
+				case <-c.chQuit:
+					m.ch <- ErrDeadClient
+					return
+				}
 			}
-			m.ch <- nil
-		case <-c.chQuit:
-			return
 		}
+		c.write(m, pm)
+	}
+}
+
+func (c *Client) write(m sendMessage, pm *Message) {
+	c.logs.push(pm, true)
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if err := conn.WriteLine(m.msg); err != nil {
+		m.ch <- err
+		c.error(err)
+		return
+	}
+	if c.Metrics != nil {
+		c.Metrics.MessageSent(pm.Command, len(m.msg)+2)
 	}
+	m.ch <- nil
 }
 
 func firstError(errs ...error) error {
@@ -631,19 +1900,181 @@ func (c *Client) Login() error {
 	}
 	err2 = c.Sendf("USER %s 0 * :%s", c.User, c.Name)
 	err3 = c.Sendf("NICK %s", c.Nick)
+	if timeout := c.registrationTimeout(); timeout > 0 {
+		c.mu.RLock()
+		welcome, quit := c.chWelcome, c.chQuit
+		c.mu.RUnlock()
+		c.spawn("registration", func() {
+			t := OrRealClock(c.Clock).NewTimer(timeout)
+			defer t.Stop()
+			select {
+			case <-t.C():
+				c.error(ErrRegistrationTimeout)
+			case <-welcome:
+			case <-quit:
+			}
+		})
+	}
 	return firstError(err1, err2, err3)
 }
 
+func (c *Client) registrationTimeout() time.Duration {
+	if c.RegistrationTimeout == 0 {
+		return 60 * time.Second
+	}
+	return c.RegistrationTimeout
+}
+
+// Quit sends a QUIT message with the given reason. The server will
+// respond by closing the connection, after which Process returns
+// ErrQuit.
+func (c *Client) Quit(reason string) error {
+	c.mu.Lock()
+	c.quitting = true
+	c.mu.Unlock()
+	return c.Sendf("QUIT :%s", reason)
+}
+
+// Close tears down the connection without sending a QUIT message.
+func (c *Client) Close() error {
+	c.error(ErrQuit)
+	return nil
+}
+
+// Done returns a channel that gets closed once the connection has
+// been torn down, for whatever reason.
+func (c *Client) Done() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.chQuit
+}
+
+// Context returns a context that is cancelled when the connection
+// is torn down, for whatever reason. Long-running handlers should
+// use it to abort once their connection is gone. Before connecting,
+// it returns a context that is never cancelled.
+func (c *Client) Context() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// SetRateLimit changes the rate limit of a connected client. A nil
+// profile disables rate limiting.
+func (c *Client) SetRateLimit(p *RateProfile) {
+	c.mu.Lock()
+	c.RateLimit = p
+	c.mu.Unlock()
+	c.limiter.setProfile(p)
+}
+
+// UseOutgoing adds fn to the chain of functions that every outgoing
+// message passes through before it is sent, in the order they were
+// added. fn returns the messages to send instead: it may modify the
+// message in place and return it, replace it with one or more other
+// messages, or return none to drop it. Each message fn returns passes
+// through the rest of the chain on its own.
+//
+// This is useful for features such as stripping colors, counting
+// messages or splitting long messages, which would otherwise require
+// wrapping every call to Send.
+func (c *Client) UseOutgoing(fn func(*Message) []*Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outgoing = append(c.outgoing, fn)
+}
+
+// applyOutgoing passes s through the functions added with
+// UseOutgoing and returns the lines to send instead.
+func (c *Client) applyOutgoing(s string) []string {
+	c.mu.RLock()
+	fns := c.outgoing
+	c.mu.RUnlock()
+	if len(fns) == 0 {
+		return []string{s}
+	}
+	msgs := []*Message{Parse(s)}
+	for _, fn := range fns {
+		var next []*Message
+		for _, m := range msgs {
+			next = append(next, fn(m)...)
+		}
+		msgs = next
+	}
+	out := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, m.WireString())
+	}
+	return out
+}
+
+// Send sends a raw line to the server. If a rate limit is in effect,
+// Send blocks until the line has been sent. PONG and QUIT messages
+// bypass the rate limit. If functions added with UseOutgoing replace
+// the line with several, Send blocks until all of them have been
+// sent and returns the first error. Lines they drop aren't sent and
+// don't cause an error.
 func (c *Client) Send(s string) error {
-	ch := make(chan error)
+	for _, line := range c.applyOutgoing(s) {
+		if err := c.send(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends a single line, after UseOutgoing has been applied.
+func (c *Client) send(s string) error {
+	ch := make(chan error, 1)
+	m := sendMessage{msg: s, ch: ch}
+	send := c.chSend
+	switch commandOf(s) {
+	case "PONG", "QUIT":
+		m.priority = true
+		send = c.chPriority
+	}
+	atomic.AddInt32(&c.queued, 1)
+	defer atomic.AddInt32(&c.queued, -1)
 	select {
-	case c.chSend <- sendMessage{s, ch}:
+	case send <- m:
 		return <-ch
 	case <-c.chQuit:
 		return ErrDeadClient
 	}
 }
 
+// QueueLen returns the number of messages waiting to be sent.
+func (c *Client) QueueLen() int {
+	return int(atomic.LoadInt32(&c.queued))
+}
+
+// commandOf returns the command of a raw line, skipping tags and
+// prefix.
+func commandOf(s string) string {
+	for len(s) > 0 && (s[0] == '@' || s[0] == ':') {
+		idx := strings.IndexByte(s, ' ')
+		if idx == -1 {
+			return ""
+		}
+		s = strings.TrimLeft(s[idx:], " ")
+	}
+	if idx := strings.IndexByte(s, ' '); idx != -1 {
+		s = s[:idx]
+	}
+	return strings.ToUpper(s)
+}
+
+// SendMessage validates m and sends it to the server.
+func (c *Client) SendMessage(m *Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	return c.Send(m.WireString())
+}
+
 func (c *Client) Sendf(format string, args ...interface{}) error {
 	return c.Send(fmt.Sprintf(format, args...))
 }
@@ -655,8 +2086,11 @@ func (c *Client) Privmsg(target, message string) error {
 
 // PrivmsgSplit sends a PRIVMSG message to target and splits it into
 // chunks of n. See SplitMessage for more information on how said
-// splitting is done.
+// splitting is done. If n <= 0, MaxMessageLen will be used.
 func (c *Client) PrivmsgSplit(target, message string, n int) error {
+	if n <= 0 {
+		n = c.MaxMessageLen()
+	}
 	s := fmt.Sprintf("PRIVMSG %s :%s", target, message)
 	for _, msg := range SplitMessage(s, n) {
 		err := c.Send(msg)
@@ -667,6 +2101,30 @@ func (c *Client) PrivmsgSplit(target, message string, n int) error {
 	return nil
 }
 
+// PrivmsgMulti sends a PRIVMSG message to all targets, naming as
+// many targets per message as the server allows.
+func (c *Client) PrivmsgMulti(targets []string, message string) error {
+	return c.sendMulti("PRIVMSG", targets, message)
+}
+
+// NoticeMulti sends a NOTICE message to all targets, naming as many
+// targets per message as the server allows.
+func (c *Client) NoticeMulti(targets []string, message string) error {
+	return c.sendMulti("NOTICE", targets, message)
+}
+
+func (c *Client) sendMulti(command string, targets []string, message string) error {
+	max := c.Support().MaxTargetsFor(command)
+	// Leave room for " :message"
+	n := c.MaxMessageLen() - len(message) - 2
+	for _, msg := range PackList(command, targets, max, n) {
+		if err := c.Send(msg + " :" + message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Notice sends a NOTICE message to target.
 func (c *Client) Notice(target, message string) error {
 	return c.Sendf("NOTICE %s :%s", target, message)
@@ -674,8 +2132,11 @@ func (c *Client) Notice(target, message string) error {
 
 // NoticeSplit sends a NOTICE message to target and splits it into
 // chunks of n. See SplitMessage for more information on how said
-// splitting is done.
+// splitting is done. If n <= 0, MaxMessageLen will be used.
 func (c *Client) NoticeSplit(target, message string, n int) error {
+	if n <= 0 {
+		n = c.MaxMessageLen()
+	}
 	s := fmt.Sprintf("NOTICE %s :%s", target, message)
 	for _, msg := range SplitMessage(s, n) {
 		err := c.Send(msg)
@@ -686,36 +2147,114 @@ func (c *Client) NoticeSplit(target, message string, n int) error {
 	return nil
 }
 
+// ReplyMode determines whether Reply uses PRIVMSG or NOTICE.
+type ReplyMode int
+
+const (
+	ReplyPrivmsg ReplyMode = iota
+	ReplyNotice
+)
+
+// SetChannelReplyMode overrides the ReplyMode for replies sent to
+// channel. Channel names are compared using the server's casemapping.
+func (c *Client) SetChannelReplyMode(channel string, mode ReplyMode) {
+	channel = c.Support().Casefold(channel)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replyModes == nil {
+		c.replyModes = make(map[string]ReplyMode)
+	}
+	c.replyModes[channel] = mode
+}
+
+// ClearChannelReplyMode removes the override set by
+// SetChannelReplyMode.
+func (c *Client) ClearChannelReplyMode(channel string) {
+	channel = c.Support().Casefold(channel)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replyModes, channel)
+}
+
+func (c *Client) replyMode(target string) ReplyMode {
+	target = c.Support().Casefold(target)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if mode, ok := c.replyModes[target]; ok {
+		return mode
+	}
+	return c.ReplyMode
+}
+
+// mayReply reports whether replying to m is allowed.
+func (c *Client) mayReply(m *Message) bool {
+	return m.Command != "NOTICE" || c.ReplyToNotices
+}
+
+// Reply replies to a PRIVMSG or NOTICE, in the channel it was sent to
+// or privately. Whether PRIVMSG or NOTICE is used depends on the
+// ReplyMode.
+//
+// As RFC 1459 asks, automatic replies to NOTICE are suppressed, so
+// that bots can't get caught in loops with each other, unless
+// ReplyToNotices is set. Reply returns nil without sending anything
+// in that case.
 func (c *Client) Reply(m *Message, response string) error {
 	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
 		panic("cannot reply to " + m.Command)
 	}
-	target, ok := c.ChannelForMsg(m)
-	if !ok {
-		// TODO message was sent to us directly, not a channel
-		target = m.Prefix.Nick
+	if !c.mayReply(m) {
+		return nil
+	}
+	target := c.Support().ReplyTarget(m)
+	if c.replyMode(target) == ReplyNotice {
+		return c.Notice(target, response)
 	}
 	return c.Privmsg(target, response)
 }
 
+// ReplySplit is like Reply, but splits the response into chunks of
+// n, like PrivmsgSplit.
 func (c *Client) ReplySplit(m *Message, response string, n int) error {
 	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
 		panic("cannot reply to " + m.Command)
 	}
-	target, ok := c.ChannelForMsg(m)
-	if !ok {
-		// message was sent to us directly, not a channel
-		target = m.Prefix.Nick
+	if !c.mayReply(m) {
+		return nil
+	}
+	target := c.Support().ReplyTarget(m)
+	if c.replyMode(target) == ReplyNotice {
+		return c.NoticeSplit(target, response, n)
 	}
 	return c.PrivmsgSplit(target, response, n)
 }
 
+// ReplyCTCP answers a CTCP query. CTCPs sent as NOTICE are replies
+// themselves and are never answered.
 func (c *Client) ReplyCTCP(m *Message, response string) error {
 	if !m.IsCTCP() {
 		panic("message is not a CTCP")
 	}
+	if m.Command == "NOTICE" {
+		return nil
+	}
 	ctcp, _ := m.CTCP()
-	return c.Notice(m.Prefix.Nick, fmt.Sprintf("%s%s %s%s", CTCPDelim, ctcp.Command, response, CTCPDelim))
+	return c.CTCPReplyTo(m.Prefix.Nick, ctcp.Command, response)
+}
+
+// CTCP sends a CTCP query to target.
+func (c *Client) CTCP(target, command string, params ...string) error {
+	return c.Privmsg(target, FormatCTCP(command, strings.Join(params, " ")))
+}
+
+// Action sends a CTCP ACTION, commonly known as /me, to target.
+func (c *Client) Action(target, text string) error {
+	return c.CTCP(target, "ACTION", text)
+}
+
+// CTCPReplyTo sends a CTCP reply to nick.
+func (c *Client) CTCPReplyTo(nick, command, text string) error {
+	return c.Notice(nick, FormatCTCP(command, text))
 }
 
 func inRunes(runes []rune, search rune) bool {
@@ -728,23 +2267,7 @@ func inRunes(runes []rune, search rune) bool {
 }
 
 func (c *Client) ChannelForMsg(m *Message) (string, bool) {
-	if len(m.Params) == 0 {
-		return "", false
-	}
-	switch m.Command {
-	case "INVITE", RPL_CHANNELMODEIS, RPL_BANLIST:
-		return m.Params[1], true
-	case RPL_NAMEREPLY:
-		return m.Params[2], true
-	default:
-		if inRunes(c.ISupport.ChanTypes, []rune(m.Params[0])[0]) {
-			return m.Params[0], true
-		}
-		if m.IsNumeric() && len(m.Params) > 1 && inRunes(c.ISupport.ChanTypes, []rune(m.Params[1])[0]) {
-			return m.Params[1], true
-		}
-	}
-	return "", false
+	return c.Support().ChannelForMsg(m)
 }
 
 // SplitMessage splits a PRIVMSG or NOTICE into many messages, each at
@@ -803,21 +2326,210 @@ func SplitMessage(s string, n int) []string {
 	return parts
 }
 
+// JoinMessages packs channels, a map of channel names to keys, into
+// as few JOIN messages as possible, each at most n bytes long.
+// Channels with keys are listed first so that the list of keys lines
+// up with the list of channels. An empty key denotes a channel
+// without a key.
+//
+// A single channel that is longer than n bytes will still be sent in
+// a message of its own.
+func JoinMessages(channels map[string]string, n int) []string {
+	var keyed, unkeyed []string
+	for channel, key := range channels {
+		if key == "" {
+			unkeyed = append(unkeyed, channel)
+		} else {
+			keyed = append(keyed, channel)
+		}
+	}
+	sort.Strings(keyed)
+	sort.Strings(unkeyed)
+
+	var out []string
+	var names, keys []string
+	format := func(names, keys []string) string {
+		s := "JOIN " + strings.Join(names, ",")
+		if len(keys) > 0 {
+			s += " " + strings.Join(keys, ",")
+		}
+		return s
+	}
+	for _, channel := range append(keyed, unkeyed...) {
+		key := channels[channel]
+		nnames, nkeys := append(names, channel), keys
+		if key != "" {
+			nkeys = append(keys, key)
+		}
+		if len(names) > 0 && len(format(nnames, nkeys)) > n {
+			out = append(out, format(names, keys))
+			nnames, nkeys = []string{channel}, nil
+			if key != "" {
+				nkeys = []string{key}
+			}
+		}
+		names, keys = nnames, nkeys
+	}
+	if len(names) > 0 {
+		out = append(out, format(names, keys))
+	}
+	return out
+}
+
+// PackList packs items into as few messages as possible, each
+// consisting of prefix followed by a space and a comma-separated list
+// of at most max items (or any number of items, if max <= 0). No
+// message will be longer than n bytes, unless a single item doesn't
+// fit.
+//
+// PackList is useful for commands that accept lists of targets, such
+// as MONITOR or PRIVMSG.
+func PackList(prefix string, items []string, max, n int) []string {
+	var out []string
+	var cur []string
+	size := len(prefix) + 1
+	for _, item := range items {
+		if len(cur) > 0 && ((max > 0 && len(cur) == max) || size+1+len(item) > n) {
+			out = append(out, prefix+" "+strings.Join(cur, ","))
+			cur = nil
+			size = len(prefix) + 1
+		}
+		if len(cur) > 0 {
+			size++
+		}
+		cur = append(cur, item)
+		size += len(item)
+	}
+	if len(cur) > 0 {
+		out = append(out, prefix+" "+strings.Join(cur, ","))
+	}
+	return out
+}
+
+// Join sends a JOIN for channel, which may be a comma-separated list
+// of channels. It doesn't wait for the server's response; use
+// JoinContext for that.
 func (c *Client) Join(channel, password string) error {
-	// FIXME do not return until we actually joined the channel. or
-	// maybe put that in the framework?
+	max := c.Support().ChannelLen
+	for _, name := range strings.Split(channel, ",") {
+		if _, err := c.checkLen("CHANNELLEN", name, max, false); err != nil {
+			return err
+		}
+	}
 	if password == "" {
 		return c.Sendf("JOIN %s", channel)
 	}
 	return c.Sendf("JOIN %s %s", channel, password)
 }
 
+// CreateSafeChannel creates a new safe channel with the given short
+// name, such as !foo, by joining !!foo. The server assigns the
+// channel an ID; the JOIN it sends back contains the full name.
+func (c *Client) CreateSafeChannel(name, key string) error {
+	return c.Join("!!"+strings.TrimLeft(name, "!"), key)
+}
+
 func (c *Client) SetNick(nick string) error {
+	nick, err := c.checkLen("NICKLEN", nick, c.Support().NickLen, true)
+	if err != nil {
+		return err
+	}
 	return c.Sendf("NICK %s", nick)
 }
 
+// SetTopic sets the topic of a channel.
+func (c *Client) SetTopic(channel, topic string) error {
+	is := c.Support()
+	topic, err := c.checkLen("TOPICLEN", topic, is.TopicLen, true)
+	if err != nil {
+		return err
+	}
+	topic = is.TruncateTopic(topic)
+	return c.Sendf("TOPIC %s :%s", channel, topic)
+}
+
+// Kick kicks nick from channel, with an optional reason.
+func (c *Client) Kick(channel, nick, reason string) error {
+	is := c.Support()
+	reason, err := c.checkLen("KICKLEN", reason, is.KickLen, true)
+	if err != nil {
+		return err
+	}
+	reason = is.TruncateKickReason(reason)
+	if reason == "" {
+		return c.Sendf("KICK %s %s", channel, nick)
+	}
+	return c.Sendf("KICK %s %s :%s", channel, nick, reason)
+}
+
+// Away marks the client as away with the given message. An empty
+// message marks the client as no longer being away.
+func (c *Client) Away(message string) error {
+	is := c.Support()
+	message, err := c.checkLen("AWAYLEN", message, is.AwayLen, true)
+	if err != nil {
+		return err
+	}
+	message = is.TruncateAwayMessage(message)
+	if message == "" {
+		return c.Send("AWAY")
+	}
+	return c.Sendf("AWAY :%s", message)
+}
+
+// IsMe reports whether nick is the client's current nick, using the
+// server's casemapping.
+func (c *Client) IsMe(nick string) bool {
+	is := c.Support()
+	return is.Casefold(nick) == is.Casefold(c.CurrentNick())
+}
+
+// kicked returns a normalized KICK message with the irc:kicked
+// signal if m describes the client being kicked from a channel. Some
+// servers implement REMOVE, which makes the removed user part with
+// a reason of the form "requested by <nick> (<reason>)"; these are
+// normalized to KICKs as well.
+func (c *Client) kicked(m *Message) *Message {
+	switch {
+	case m.Command == "KICK" && len(m.Params) >= 2 && c.IsMe(m.Params[1]):
+		kicked := m.Copy()
+		kicked.Signal = "irc:kicked"
+		return kicked
+	case m.Command == "PART" && len(m.Params) >= 2 && c.IsMe(m.Prefix.Nick):
+		const prefix = "requested by "
+		reason := m.Params[1]
+		if !strings.HasPrefix(reason, prefix) {
+			return nil
+		}
+		reason = reason[len(prefix):]
+		by := reason
+		if idx := strings.IndexByte(reason, ' '); idx != -1 {
+			by = reason[:idx]
+			reason = strings.TrimSuffix(strings.TrimPrefix(reason[idx+1:], "("), ")")
+		} else {
+			reason = ""
+		}
+		return &Message{
+			Prefix:  Mask{Nick: by},
+			Command: "KICK",
+			Params:  []string{m.Params[0], m.Prefix.Nick, reason},
+			Signal:  "irc:kicked",
+			Tags:    m.Tags,
+			Time:    m.Time,
+		}
+	}
+	return nil
+}
+
 func (c *Client) CurrentNick() string {
+	return c.Identity().Nick
+}
+
+// Identity returns a snapshot of the client's own hostmask, as seen
+// by the server. User and Host will be empty until the server has
+// told us about them.
+func (c *Client) Identity() Mask {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.currentNick
+	return c.self
 }
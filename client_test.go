@@ -1,7 +1,16 @@
 package irc
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func msgEquals(one, other *Message) bool {
@@ -19,11 +28,19 @@ func msgEquals(one, other *Message) bool {
 			return false
 		}
 	}
+	if len(one.Tags) != len(other.Tags) {
+		return false
+	}
+	for k, v := range one.Tags {
+		if v2, ok := other.Tags[k]; !ok || v != v2 {
+			return false
+		}
+	}
 	return true
 }
 
 func ctcpEquals(one, other *CTCPMessage) bool {
-	if one.Command != other.Command {
+	if one.Command != other.Command || one.Text != other.Text {
 		return false
 	}
 	if len(one.Params) != len(other.Params) {
@@ -71,6 +88,15 @@ func TestMessageParsing(t *testing.T) {
 		{":nick!user@host CMD",
 			&Message{Prefix: Mask{Nick: "nick", User: "user", Host: "host"}, Command: "CMD",
 				Params: []string{}}},
+		{"@time=2011-10-19T16:40:51.620Z;account=foo :nick!user@host PRIVMSG #channel :hi",
+			&Message{Tags: map[string]string{"time": "2011-10-19T16:40:51.620Z", "account": "foo"},
+				Prefix: Mask{Nick: "nick", User: "user", Host: "host"}, Command: "PRIVMSG",
+				Params: []string{"#channel", "hi"}}},
+		{`@a=semi\:colon\sspace\\back;b;c= PING :x`,
+			&Message{Tags: map[string]string{"a": `semi;colon space\back`, "b": "", "c": ""},
+				Command: "PING", Params: []string{"x"}}},
+		{`@a=trailing\ PING`,
+			&Message{Tags: map[string]string{"a": "trailing"}, Command: "PING"}},
 	}
 
 	for _, test := range table {
@@ -93,14 +119,20 @@ func TestCTCPParsing(t *testing.T) {
 			nil},
 		{"PRIVMSG #channel :\u0001ACTION a test message\u0001",
 			true,
-			&CTCPMessage{Command: "ACTION", Params: []string{"a", "test", "message"}}},
+			&CTCPMessage{Command: "ACTION", Params: []string{"a", "test", "message"}, Text: "a test message"}},
+		{"PRIVMSG #channel :\u0001ACTION  spaced   out \u0001",
+			true,
+			&CTCPMessage{Command: "ACTION", Params: []string{"", "spaced", "", "", "out", ""}, Text: " spaced   out "}},
+		{"PRIVMSG #channel :\u0001VERSION\u0001",
+			true,
+			&CTCPMessage{Command: "VERSION"}},
 	}
 
 	for _, test := range table {
 		m := Parse(test.in)
 		isCTCP := m.IsCTCP()
 		if isCTCP != test.ctcp {
-			t.Fatalf("parsed %q, expected IsCTCP to return %s, got %s", test.in, test.ctcp, isCTCP)
+			t.Fatalf("parsed %q, expected IsCTCP to return %t, got %t", test.in, test.ctcp, isCTCP)
 		}
 		if !isCTCP {
 			continue
@@ -110,9 +142,77 @@ func TestCTCPParsing(t *testing.T) {
 			t.Fatalf("expected m.CTCP() not to return any error, got %q", err)
 		}
 		if !ctcpEquals(test.out, ctcp) {
-			t.Errorf("parsed %q, expected %#v, got %#v", test.out, ctcp)
+			t.Errorf("parsed %q, expected %#v, got %#v", test.in, test.out, ctcp)
+		}
+	}
+}
+
+// sentBy runs fn on a connected client and returns the first n lines
+// the client sent, exactly as written, including line endings.
+func sentBy(t *testing.T, n int, fn func(c *Client) error) []string {
+	t.Helper()
+	conn, server := net.Pipe()
+	lines := make(chan string, n)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	c := &Client{Mux: NewMux()}
+	if err := c.Connect(conn); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := fn(c); err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for len(out) < n {
+		select {
+		case line := <-lines:
+			out = append(out, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %q", out)
 		}
 	}
+	return out
+}
+
+func TestCTCPSending(t *testing.T) {
+	got := sentBy(t, 4, func(c *Client) error {
+		c.CTCP("alice", "VERSION")
+		c.CTCP("alice", "PING", "1792159205", "123")
+		c.CTCPReplyTo("alice", "VERSION", "bot 1.0")
+		return c.CTCPReplyTo("alice", "PING", "")
+	})
+	want := []string{
+		"PRIVMSG alice :\x01VERSION\x01\r\n",
+		"PRIVMSG alice :\x01PING 1792159205 123\x01\r\n",
+		"NOTICE alice :\x01VERSION bot 1.0\x01\r\n",
+		"NOTICE alice :\x01PING\x01\r\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestAction(t *testing.T) {
+	got := sentBy(t, 2, func(c *Client) error {
+		c.Action("#chan", "waves")
+		return c.Action("alice", "hands  over  a  cookie")
+	})
+	want := []string{
+		"PRIVMSG #chan :\x01ACTION waves\x01\r\n",
+		"PRIVMSG alice :\x01ACTION hands  over  a  cookie\x01\r\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
 }
 
 func stringsEqual(a, b []string) bool {
@@ -195,3 +295,1032 @@ func TestMessageSplitting(t *testing.T) {
 		}
 	}
 }
+
+func TestJoinMessages(t *testing.T) {
+	table := []struct {
+		in  map[string]string
+		out []string
+		n   int
+	}{
+		{
+			map[string]string{"#a": "", "#b": "key", "#c": ""},
+			[]string{"JOIN #b,#a,#c key"},
+			510,
+		},
+		{
+			map[string]string{"#one": "k1", "#two": "", "#three": "k3", "#four": ""},
+			[]string{
+				"JOIN #one,#three k1,k3",
+				"JOIN #four,#two",
+			},
+			22,
+		},
+		{
+			map[string]string{"#a_very_long_channel": "", "#b": ""},
+			[]string{
+				"JOIN #a_very_long_channel",
+				"JOIN #b",
+			},
+			10,
+		},
+	}
+
+	for i, test := range table {
+		r := JoinMessages(test.in, test.n)
+		if !stringsEqual(test.out, r) {
+			t.Errorf("join #%d, expected %#v, got %#v", i, test.out, r)
+		}
+	}
+}
+
+func TestPackList(t *testing.T) {
+	table := []struct {
+		items []string
+		out   []string
+		max   int
+		n     int
+	}{
+		{
+			[]string{"a", "b", "c"},
+			[]string{"MONITOR + a,b,c"},
+			0, 510,
+		},
+		{
+			[]string{"a", "b", "c"},
+			[]string{"MONITOR + a,b", "MONITOR + c"},
+			2, 510,
+		},
+		{
+			[]string{"alice", "bob", "carol"},
+			[]string{"MONITOR + alice,bob", "MONITOR + carol"},
+			0, 19,
+		},
+	}
+
+	for i, test := range table {
+		r := PackList("MONITOR +", test.items, test.max, test.n)
+		if !stringsEqual(test.out, r) {
+			t.Errorf("pack #%d, expected %#v, got %#v", i, test.out, r)
+		}
+	}
+}
+
+func TestMessageSerialization(t *testing.T) {
+	table := []struct {
+		in  *Message
+		out string
+	}{
+		{&Message{Command: "QUIT"}, "QUIT"},
+		{&Message{Command: "PRIVMSG", Params: []string{"#channel", "some message"}},
+			"PRIVMSG #channel :some message"},
+		{&Message{Command: "PRIVMSG", Params: []string{"#channel", "word"}},
+			"PRIVMSG #channel word"},
+		{&Message{Command: "FOO", Params: []string{"bar", ""}},
+			"FOO bar :"},
+		{&Message{Command: "FOO", Params: []string{":colon"}},
+			"FOO ::colon"},
+		{&Message{Prefix: Mask{Nick: "nick", User: "user", Host: "host"}, Command: "JOIN", Params: []string{"#channel"}},
+			":nick!user@host JOIN #channel"},
+		{&Message{Prefix: Mask{Host: "example.com"}, Command: "001", Params: []string{"nick", "Welcome"}},
+			":example.com 001 nick Welcome"},
+		{&Message{Tags: map[string]string{"b": "semi;colon space", "a": ""}, Command: "PING", Params: []string{"x"}},
+			`@a;b=semi\:colon\sspace PING x`},
+	}
+
+	for _, test := range table {
+		if s := test.in.WireString(); s != test.out {
+			t.Errorf("serialized %#v, expected %q, got %q", test.in, test.out, s)
+		}
+		if err := test.in.Validate(); err != nil {
+			t.Errorf("expected %#v to be valid, got %s", test.in, err)
+		}
+		test.in.Raw = test.out
+		if m := Parse(test.out); !msgEquals(test.in, m) {
+			t.Errorf("round-tripping %q, expected %#v, got %#v", test.out, test.in, m)
+		}
+	}
+
+	invalid := []*Message{
+		{},
+		{Command: "PRIVMSG", Params: []string{"#channel", "line\r\nbreak"}},
+		{Command: "PRIVMSG", Params: []string{"two words", "text"}},
+	}
+	for _, m := range invalid {
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", m)
+		}
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	m := Parse("@time=2011-10-19T16:40:51.620Z :nick!user@host PRIVMSG #chan :hi")
+	expected := time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)
+	if !m.Time.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, m.Time)
+	}
+	if m := Parse(":nick!user@host PRIVMSG #chan :hi"); !m.Time.IsZero() {
+		t.Errorf("expected zero time for untagged message, got %s", m.Time)
+	}
+}
+
+func TestScanRawLines(t *testing.T) {
+	input := "PING a\r\n:srv  NOTICE * :two  spaces\nPING b"
+	s := newScanner(strings.NewReader(input))
+	var raw []string
+	var lines []string
+	for s.Scan() {
+		raw = append(raw, s.Text())
+		lines = append(lines, string(trimLine(s.Bytes())))
+	}
+	if got := strings.Join(raw, ""); got != input {
+		t.Errorf("raw lines don't add up to the input: got %q", got)
+	}
+	expected := []string{"PING a", ":srv  NOTICE * :two  spaces", "PING b"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("got lines %q, expected %q", lines, expected)
+	}
+}
+
+func TestUseOutgoing(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		lines <- line
+		return nil
+	})
+	defer c.Close()
+	c.UseOutgoing(func(m *Message) []*Message {
+		if m.Command == "NOTICE" {
+			return nil
+		}
+		return []*Message{m}
+	})
+	// Split messages into words.
+	c.UseOutgoing(func(m *Message) []*Message {
+		if m.Command != "PRIVMSG" {
+			return []*Message{m}
+		}
+		var out []*Message
+		for _, word := range strings.Fields(m.Params[1]) {
+			out = append(out, &Message{Command: "PRIVMSG", Params: []string{m.Params[0], word}})
+		}
+		return out
+	})
+	c.UseOutgoing(func(m *Message) []*Message {
+		m.Params[len(m.Params)-1] = strings.ToUpper(m.Params[len(m.Params)-1])
+		return []*Message{m}
+	})
+
+	c.Privmsg("#chan", "hello world")
+	c.Notice("#chan", "dropped")
+	c.Privmsg("#chan", "done")
+	for _, expected := range []string{"PRIVMSG #chan HELLO", "PRIVMSG #chan WORLD", "PRIVMSG #chan DONE"} {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("got %q, expected %q", line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestRequireMux(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &Client{RequireMux: true}
+	if err := c.Connect(a); err != ErrNoMux {
+		t.Errorf("got error %v, expected ErrNoMux", err)
+	}
+}
+
+func TestMuxUse(t *testing.T) {
+	mux := NewMux()
+	calls := make(chan string, 3)
+	trace := func(name string) func(Handler) Handler {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(c *Client, m *Message) {
+				calls <- name
+				next.Process(c, m)
+			})
+		}
+	}
+	mux.Use(trace("outer"))
+	mux.Use(trace("inner"))
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) { calls <- "handler" })
+	mux.Process(&Client{}, Parse(":nick!user@host PRIVMSG #chan :hi"))
+
+	for _, expected := range []string{"outer", "inner", "handler"} {
+		select {
+		case got := <-calls:
+			if got != expected {
+				t.Errorf("got call %q, expected %q", got, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	errs := make(chan *PanicError, 1)
+	c := &Client{PanicHandler: func(m *Message, err *PanicError) { errs <- err }}
+	mux := NewMux()
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) { panic("boom") })
+	mux.Process(c, Parse(":nick!user@host PRIVMSG #chan :hi"))
+	select {
+	case err := <-errs:
+		if err.Value != "boom" {
+			t.Errorf("got panic value %v, expected boom", err.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for PanicHandler")
+	}
+}
+
+func TestContext(t *testing.T) {
+	c := fakeServer(t, func(line string) []string { return nil })
+	ctx := c.Context()
+	if ctx.Err() != nil {
+		t.Fatalf("context of live connection is done: %v", ctx.Err())
+	}
+	c.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context wasn't cancelled after closing the connection")
+	}
+}
+
+func TestCreateSafeChannel(t *testing.T) {
+	joins := make(chan string, 3)
+	c := fakeServer(t, func(line string) []string {
+		if strings.HasPrefix(line, "JOIN") {
+			joins <- line
+		}
+		return nil
+	})
+	defer c.Close()
+	for _, name := range []string{"!foo", "foo", "!!foo"} {
+		if err := c.CreateSafeChannel(name, ""); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case line := <-joins:
+			if line != "JOIN !!foo" {
+				t.Errorf("CreateSafeChannel(%q) sent %q, expected JOIN !!foo", name, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for JOIN")
+		}
+	}
+}
+
+func TestOrderedMux(t *testing.T) {
+	mux := NewOrderedMux()
+	var got []string
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) { got = append(got, m.Params[1]) })
+	c := &Client{}
+	var expected []string
+	for i := 0; i < 100; i++ {
+		text := fmt.Sprint(i)
+		expected = append(expected, text)
+		mux.Process(c, Parse("PRIVMSG #chan "+text))
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("handlers ran out of order: %v", got)
+	}
+}
+
+func TestMuxNilClient(t *testing.T) {
+	mux := NewMux()
+	done := make(chan struct{})
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) { close(done) })
+	mux.Process(nil, Parse("PRIVMSG #chan :hi"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't run")
+	}
+}
+
+func TestSupportSnapshot(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		if line == "VERSION" {
+			return []string{":server 005 me NETWORK=Example NICKLEN=30 :are supported by this server"}
+		}
+		return nil
+	})
+	defer c.Close()
+	changes := make(chan string, 10)
+	c.Support().OnChange(func(token, old, new string) { changes <- token })
+	before := c.Support()
+	c.Send("VERSION")
+	for _, token := range []string{"NETWORK", "NICKLEN"} {
+		select {
+		case got := <-changes:
+			if got != token {
+				t.Errorf("got change of %q, expected %q", got, token)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change of %q", token)
+		}
+	}
+	if before.Network != "" || before.NickLen != 9 {
+		t.Errorf("old ISupport was modified: %q, %d", before.Network, before.NickLen)
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.Support().Network != "Example"; {
+		if time.Now().After(deadline) {
+			t.Fatal("ISupport wasn't replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Support().NickLen != 30 {
+		t.Errorf("got NICKLEN %d, expected 30", c.Support().NickLen)
+	}
+}
+
+func TestMuxGlob(t *testing.T) {
+	mux := NewMux()
+	h := HandlerFunc(func(*Client, *Message) {})
+	mux.Handle("ctcp:*", h)
+	mux.Handle("4??", h)
+	mux.Handle("401", h)
+	mux.Handle("", h)
+	for signal, n := range map[string]int{
+		"ctcp:VERSION": 2,
+		"401":          3,
+		"433":          2,
+		"4333":         1,
+		"PRIVMSG":      1,
+	} {
+		if got := len(mux.Handlers(&Message{Signal: signal})); got != n {
+			t.Errorf("got %d handlers for %s, expected %d", got, signal, n)
+		}
+	}
+}
+
+func TestMuxRemove(t *testing.T) {
+	mux := NewMux()
+	c := &Client{}
+	var calls int32
+	h := func(*Client, *Message) { atomic.AddInt32(&calls, 1) }
+	reg := mux.HandleSyncFunc("PING", h)
+	mux.HandleOnce("PING", syncHandler{HandlerFunc(h)})
+
+	mux.Process(c, Parse("PING a"))
+	mux.Process(c, Parse("PING b"))
+	if calls != 3 {
+		t.Errorf("got %d calls, expected 3", calls)
+	}
+	reg.Remove()
+	reg.Remove()
+	if hs := mux.Handlers(Parse("PING c")); len(hs) != 0 {
+		t.Errorf("got %d handlers after removing all of them", len(hs))
+	}
+}
+
+func TestPrivmsgMulti(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		lines <- line
+		return nil
+	})
+	defer c.Close()
+	c.ISupport.Parse(Parse(":server 005 nick TARGMAX=PRIVMSG:2 :are supported by this server"))
+
+	c.PrivmsgMulti([]string{"#a", "#b", "#c"}, "hello")
+	for _, expected := range []string{"PRIVMSG #a,#b :hello", "PRIVMSG #c :hello"} {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("got %q, expected %q", line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestCapTimeout(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		// Swallow CAP LS, like some bouncers do
+		lines <- line
+		return nil
+	})
+	defer c.Close()
+	c.Caps.Request("server-time")
+	c.Caps.Timeout = 10 * time.Millisecond
+	capabilities := make(chan struct{}, 1)
+	c.Mux.(*Mux).HandleFunc("irc:capabilities", func(*Client, *Message) { capabilities <- struct{}{} })
+
+	c.NegotiateCaps()
+	for _, expected := range []string{"CAP LS 302", "CAP END"} {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("got %q, expected %q", line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	select {
+	case <-capabilities:
+	case <-time.After(5 * time.Second):
+		t.Fatal("irc:capabilities wasn't emitted")
+	}
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		return []string{":server NOTICE * :*** Looking up your hostname..."}
+	})
+	c.RegistrationTimeout = 10 * time.Millisecond
+	c.Login()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection didn't fail")
+	}
+	if err := c.Error(); err != ErrRegistrationTimeout {
+		t.Errorf("got error %v, expected ErrRegistrationTimeout", err)
+	}
+}
+
+func TestUserhostAfterWelcome(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		lines <- line
+		if line != "VERSION" {
+			return nil
+		}
+		// Keep writing while the client wants to send USERHOST; the
+		// read loop must not wait for it.
+		return []string{
+			":server 001 me :Welcome",
+			":server 351 me version server :comments",
+			":server 351 me version server :comments",
+		}
+	})
+	defer c.Close()
+	versions := make(chan struct{}, 2)
+	c.Mux.(*Mux).HandleFunc(RPL_VERSION, func(*Client, *Message) { versions <- struct{}{} })
+	c.Send("VERSION")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-versions:
+		case <-time.After(5 * time.Second):
+			t.Fatal("read loop is blocked")
+		}
+	}
+	for {
+		select {
+		case line := <-lines:
+			if line == "USERHOST me" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("USERHOST wasn't sent")
+		}
+	}
+}
+
+func TestWelcomeOutOfOrder(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		if line != "VERSION" {
+			return nil
+		}
+		return []string{
+			":server 002 me :Your host is server",
+			":server 001 me :Welcome",
+			":server 003 me :This server was created today",
+			":server 004 me server version iow biklmnopstv",
+			":server 001 me :Welcome again",
+		}
+	})
+	defer c.Close()
+	c.Send("VERSION")
+	for deadline := time.Now().Add(5 * time.Second); !c.Connected(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client didn't register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-c.chWelcome:
+	default:
+		t.Error("chWelcome wasn't closed")
+	}
+}
+
+func TestLag(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		if strings.HasPrefix(line, "PING :") {
+			time.Sleep(5 * time.Millisecond)
+			return []string{":server PONG server :" + line[len("PING :"):]}
+		}
+		return nil
+	})
+	defer c.Close()
+	lags := make(chan string, 1)
+	c.Mux.(*Mux).HandleFunc("irc:lag", func(c *Client, m *Message) {
+		select {
+		case lags <- m.Params[0]:
+		default:
+		}
+	})
+	c.PingInterval = 10 * time.Millisecond
+	go c.pingLoop()
+	select {
+	case <-lags:
+	case <-time.After(5 * time.Second):
+		t.Fatal("irc:lag wasn't emitted")
+	}
+	if lag := c.Lag(); lag < 5*time.Millisecond {
+		t.Errorf("got lag %v, expected at least 5ms", lag)
+	}
+}
+
+type pipeDialer struct {
+	addrs []string
+	conns []net.Conn
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	a, b := net.Pipe()
+	d.conns = append(d.conns, b)
+	return a, nil
+}
+
+func TestDialer(t *testing.T) {
+	d := &pipeDialer{}
+	c := &Client{Mux: NewMux(), Dialer: d}
+	if err := c.Dial("tcp", "irc.example.net:6667"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if len(d.addrs) != 1 || d.addrs[0] != "irc.example.net:6667" {
+		t.Errorf("dialer was called with %q", d.addrs)
+	}
+}
+
+func TestReplyToNotice(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		lines <- line
+		return nil
+	})
+	defer c.Close()
+
+	notice := Parse(":bot!user@host NOTICE me :hello")
+	c.Reply(notice, "suppressed")
+	c.ReplyToNotices = true
+	c.Reply(notice, "allowed")
+	select {
+	case line := <-lines:
+		if line != "PRIVMSG bot :allowed" {
+			t.Errorf("got %q, expected the reply that was allowed", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reply")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		switch line {
+		case "VERSION":
+			return []string{":server 005 me NETWORK=Example :are supported by this server"}
+		case "PING 1", "PING 2":
+			return []string{":alice!a@host PRIVMSG #chan :" + line}
+		}
+		return nil
+	})
+	defer c.Close()
+	c.SetLabels(map[string]string{"bot": "one"})
+	profiles := make(chan string, 1)
+	c.Mux.(*Mux).HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		// The goroutine profile lists the labels of all goroutines,
+		// including this handler.
+		var buf strings.Builder
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		profiles <- buf.String()
+	})
+	profile := func(ping string) string {
+		t.Helper()
+		c.Send(ping)
+		select {
+		case p := <-profiles:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler didn't run")
+			return ""
+		}
+	}
+	expect := func(profile string, labels ...string) {
+		t.Helper()
+		for _, l := range labels {
+			if !strings.Contains(profile, "# labels: "+l+"\n") {
+				t.Errorf("no goroutine is labelled %s", l)
+			}
+		}
+	}
+
+	c.Send("VERSION")
+	for deadline := time.Now().Add(5 * time.Second); c.Support().Network != "Example"; {
+		if time.Now().After(deadline) {
+			t.Fatal("RPL_ISUPPORT wasn't processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expect(profile("PING 1"),
+		`{"bot":"one", "irc.goroutine":"handler", "network":"Example"}`,
+		`{"bot":"one", "irc.goroutine":"read", "network":"Example"}`)
+
+	c.SetLabels(map[string]string{"network": "override"})
+	expect(profile("PING 2"), `{"irc.goroutine":"handler", "network":"override"}`)
+}
+
+func TestIdentity(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		switch line {
+		case "VERSION":
+			return []string{":server 001 me :Welcome"}
+		case "USERHOST me":
+			return []string{":server 302 me :me=+user@host.example"}
+		case "NICK newme":
+			return []string{":me!user@host.example NICK newme"}
+		case "MODE newme +x":
+			return []string{":server 396 newme cloaked.example :is now your displayed host"}
+		case "NAMES #chan":
+			// Somebody else changing their nick doesn't affect us.
+			return []string{":bob!b@bob.example NICK me"}
+		case "JOIN #chan":
+			return []string{":newme!ident@vhost.example JOIN #chan"}
+		}
+		return nil
+	})
+	defer c.Close()
+	if id := c.Identity(); id != (Mask{}) {
+		t.Errorf("expected an empty identity before registration, got %v", id)
+	}
+	expect := func(line string, want Mask) {
+		t.Helper()
+		c.Send(line)
+		deadline := time.Now().Add(5 * time.Second)
+		for c.Identity() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("after %q, expected identity %v, got %v", line, want, c.Identity())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// RPL_WELCOME tells us our nick, USERHOST our user and host.
+	expect("VERSION", Mask{Nick: "me", User: "user", Host: "host.example"})
+	expect("NICK newme", Mask{Nick: "newme", User: "user", Host: "host.example"})
+	expect("MODE newme +x", Mask{Nick: "newme", User: "user", Host: "cloaked.example"})
+	c.Send("NAMES #chan")
+	// Our own messages carry our current hostmask.
+	expect("JOIN #chan", Mask{Nick: "newme", User: "ident", Host: "vhost.example"})
+	if nick := c.CurrentNick(); nick != "newme" {
+		t.Errorf("expected current nick newme, got %q", nick)
+	}
+}
+
+func TestReplyMode(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		if line == "VERSION" {
+			return []string{
+				":server 001 me :Welcome",
+				":server 005 me CHANTYPES=# CASEMAPPING=rfc1459 :are supported by this server",
+			}
+		}
+		if !strings.HasPrefix(line, "USERHOST ") {
+			lines <- line
+		}
+		return nil
+	})
+	defer c.Close()
+	c.Send("VERSION")
+	for deadline := time.Now().Add(5 * time.Second); !c.Support().IsChannel("#foo"); {
+		if time.Now().After(deadline) {
+			t.Fatal("RPL_ISUPPORT wasn't processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	expect := func(m *Message, want string) {
+		t.Helper()
+		c.Reply(m, "hi")
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("got %q, expected %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	private := Parse(":alice!a@host PRIVMSG me :hello")
+	channel := Parse(":alice!a@host PRIVMSG #foo{1} :hello")
+
+	expect(private, "PRIVMSG alice :hi")
+	c.ReplyMode = ReplyNotice
+	expect(private, "NOTICE alice :hi")
+	expect(channel, "NOTICE #foo{1} :hi")
+
+	// Overrides use the server's casemapping, in which [ and { are
+	// the same.
+	c.SetChannelReplyMode("#FOO[1]", ReplyPrivmsg)
+	expect(channel, "PRIVMSG #foo{1} :hi")
+	expect(private, "NOTICE alice :hi")
+	c.ClearChannelReplyMode("#Foo{1}")
+	expect(channel, "NOTICE #foo{1} :hi")
+}
+
+func TestNewClient(t *testing.T) {
+	conn, server := net.Pipe()
+	c, err := NewClient(conn, WithMux(NewMux()), WithIdentity("bot", "botuser", "Bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Process()
+
+	scanner := bufio.NewScanner(server)
+	var lines []string
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	expected := []string{"USER botuser 0 * :Bot", "NICK bot"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+
+	other, _ := net.Pipe()
+	if err := c.Connect(other); err != ErrAlreadyConnected {
+		t.Errorf("connecting twice returned %v, expected ErrAlreadyConnected", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	conn, server := net.Pipe()
+	counters := NewCounters()
+	mux := NewMux()
+	done := make(chan struct{})
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		defer close(done)
+		panic("boom")
+	})
+	// Handlers of nested muxes count towards the component.
+	component := NewOrderedMux()
+	component.HandleFunc("PRIVMSG", func(c *Client, m *Message) {})
+	mux.Handle("PRIVMSG", component)
+	c, err := NewClient(conn, WithMux(mux), WithIdentity("bot", "bot", "Bot"), WithMetrics(counters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Process()
+
+	scanner := bufio.NewScanner(server)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+	}
+	go io.WriteString(server, ":nick!user@host PRIVMSG bot :hi\r\n")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for handler")
+	}
+	// Counters are updated after the fact: the panic once
+	// RecoverHandler reports it, sent messages once Write returns,
+	// and handlers once they return.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s := counters.Snapshot()
+		if s.Panics != 0 && s.Sent["NICK"] != 0 && s.Handled["PRIVMSG"] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counters weren't updated: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s := counters.Snapshot()
+	if s.Connects != 1 {
+		t.Errorf("got %d connects, expected 1", s.Connects)
+	}
+	if s.Sent["NICK"] != 1 || s.Sent["USER"] != 1 || s.BytesOut != int64(len("USER bot 0 * :Bot\r\nNICK bot\r\n")) {
+		t.Errorf("unexpected sent counters %v, %d bytes", s.Sent, s.BytesOut)
+	}
+	if s.Received["PRIVMSG"] != 1 || s.BytesIn != int64(len(":nick!user@host PRIVMSG bot :hi\r\n")) {
+		t.Errorf("unexpected received counters %v, %d bytes", s.Received, s.BytesIn)
+	}
+	// Give stray measurements of the nested handler a chance to
+	// show up.
+	time.Sleep(10 * time.Millisecond)
+	if s := counters.Snapshot(); s.Handled["PRIVMSG"] != 2 {
+		t.Errorf("got %d handled PRIVMSG, expected 2", s.Handled["PRIVMSG"])
+	}
+}
+
+func TestUpgradeTLS(t *testing.T) {
+	table := []struct {
+		name    string
+		caps    string
+		reply   string
+		require bool
+		sent    bool
+		err     error
+	}{
+		{"not advertised", "sasl", "", false, false, nil},
+		{"not advertised, required", "sasl", "", true, false, ErrNoTLS},
+		{"unknown command", "tls", ":server 421 * STARTTLS :Unknown command", false, true, nil},
+		{"failed, required", "tls", ":server 691 * :STARTTLS failed", true, true, ErrNoTLS},
+		{"no reply", "tls", "", false, true, ErrNoTLS},
+	}
+	for _, test := range table {
+		lines := make(chan string, 10)
+		c := fakeServer(t, func(line string) []string {
+			lines <- line
+			switch line {
+			case "CAP LS 302":
+				return []string{":server CAP * LS :" + test.caps}
+			case "STARTTLS":
+				if test.reply != "" {
+					return []string{test.reply}
+				}
+			}
+			return nil
+		})
+		c.UpgradeTLS = true
+		c.RequireTLS = test.require
+		c.Caps.Timeout = 50 * time.Millisecond
+		c.register()
+
+		var sent []string
+		registered := false
+	loop:
+		for {
+			select {
+			case line := <-lines:
+				sent = append(sent, line)
+				if strings.HasPrefix(line, "NICK") {
+					registered = true
+					break loop
+				}
+			case <-c.Done():
+				break loop
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out, sent %q", test.name, sent)
+			}
+		}
+		if inStrings(sent, "STARTTLS") != test.sent {
+			t.Errorf("%s: sent %q, expected STARTTLS to be sent: %t", test.name, sent, test.sent)
+		}
+		if test.err != nil {
+			if registered {
+				t.Errorf("%s: registered unencrypted", test.name)
+			}
+			if err := c.Error(); err != test.err {
+				t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+			}
+		} else if !registered {
+			t.Errorf("%s: didn't register, error %v", test.name, c.Error())
+		}
+		c.Close()
+	}
+}
+
+func TestKicked(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		if line != "VERSION" {
+			return nil
+		}
+		return []string{
+			":server 001 me :Welcome",
+			":op!o@host KICK #chan other :not you",
+			":op!o@host KICK #chan ME :bye",
+			":me!u@host PART #chan :requested by op (go away)",
+			":me!u@host PART #chan :requested by chanserv",
+			":me!u@host PART #chan :leaving",
+			":other!o@host PART #chan :requested by op (bye)",
+		}
+	})
+	defer c.Close()
+	kicks := make(chan *Message, 10)
+	c.Mux.(*Mux).HandleFunc("irc:kicked", func(c *Client, m *Message) { kicks <- m })
+	c.Send("VERSION")
+	// Handlers of a plain Mux run concurrently, so the order of the
+	// kicks isn't checked.
+	expected := map[string]bool{
+		"op KICK #chan ME bye":     true,
+		"op KICK #chan me go away": true,
+		"chanserv KICK #chan me ":  true,
+	}
+	got := make(map[string]bool)
+	for range expected {
+		select {
+		case m := <-kicks:
+			got[m.Prefix.Nick+" "+m.Command+" "+strings.Join(m.Params, " ")] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d kicks, got %d", len(expected), len(got))
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected kicks %v, got %v", expected, got)
+	}
+	select {
+	case m := <-kicks:
+		t.Errorf("unexpected kick %q", m.Raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLengthPolicy(t *testing.T) {
+	lines := make(chan string, 10)
+	c := fakeServer(t, func(line string) []string {
+		if line == "VERSION" {
+			return []string{
+				":server 001 me :Welcome",
+				":server 005 me NICKLEN=5 CHANNELLEN=6 TOPICLEN=5 KICKLEN=4 AWAYLEN=3 :are supported by this server",
+			}
+		}
+		if !strings.HasPrefix(line, "USERHOST ") {
+			lines <- line
+		}
+		return nil
+	})
+	defer c.Close()
+	c.Send("VERSION")
+	for deadline := time.Now().Add(5 * time.Second); c.Support().AwayLen != 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("RPL_ISUPPORT wasn't processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	type call struct {
+		fn func() error
+		// The line sent, or the token of the expected LengthError
+		want map[LengthPolicy]string
+	}
+	calls := []call{
+		{
+			func() error { return c.SetNick("nickname") },
+			map[LengthPolicy]string{LengthIgnore: "NICK nickname", LengthReject: "NICKLEN", LengthTruncate: "NICK nickn"},
+		},
+		{
+			func() error { return c.SetNick("nick") },
+			map[LengthPolicy]string{LengthIgnore: "NICK nick", LengthReject: "NICK nick", LengthTruncate: "NICK nick"},
+		},
+		{
+			// Channel names are never truncated.
+			func() error { return c.Join("#short,#toolong", "") },
+			map[LengthPolicy]string{LengthIgnore: "JOIN #short,#toolong", LengthReject: "CHANNELLEN", LengthTruncate: "CHANNELLEN"},
+		},
+		{
+			// Topics, kick reasons and away messages are always cut
+			// at a rune boundary.
+			func() error { return c.SetTopic("#chan", "héllo") },
+			map[LengthPolicy]string{LengthIgnore: "TOPIC #chan :héll", LengthReject: "TOPICLEN", LengthTruncate: "TOPIC #chan :héll"},
+		},
+		{
+			func() error { return c.Kick("#chan", "eve", "begone") },
+			map[LengthPolicy]string{LengthIgnore: "KICK #chan eve :bego", LengthReject: "KICKLEN", LengthTruncate: "KICK #chan eve :bego"},
+		},
+		{
+			func() error { return c.Away("lunch") },
+			map[LengthPolicy]string{LengthIgnore: "AWAY :lun", LengthReject: "AWAYLEN", LengthTruncate: "AWAY :lun"},
+		},
+	}
+	for _, policy := range []LengthPolicy{LengthIgnore, LengthReject, LengthTruncate} {
+		c.Lengths = policy
+		for i, call := range calls {
+			want := call.want[policy]
+			err := call.fn()
+			if lerr, ok := err.(*LengthError); ok {
+				if lerr.Token != want {
+					t.Errorf("policy %d, call %d: expected %q, got error for %s", policy, i, want, lerr.Token)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case line := <-lines:
+				if line != want {
+					t.Errorf("policy %d, call %d: expected %q, got %q", policy, i, want, line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("policy %d, call %d: expected %q, got nothing", policy, i, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package irc
+
+import "time"
+
+// Clock tells the time and creates timers, for the parts of the
+// client and of components whose behavior depends on time, such as
+// pings, rate limiting and timeouts. Tests can substitute a fake
+// clock, such as irctest.Clock, to control time deterministically.
+// Network deadlines always use the real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine after d. The returned
+	// Timer's channel is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the Clock equivalent of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is the Clock equivalent of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock used when none is configured. It uses the
+// time package.
+var RealClock Clock = realClock{}
+
+// OrRealClock returns c, or RealClock if c is nil. It implements the
+// default of Clock fields.
+func OrRealClock(c Clock) Clock {
+	if c == nil {
+		return RealClock
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,267 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn reads and writes IRC messages, one line at a time, on top of a
+// net.Conn. It takes care of line framing and deadlines and can be
+// used on its own by servers, bouncers and tests. Client uses a Conn
+// for its connection to the server.
+//
+// ReadMessage must not be called concurrently with itself or
+// StartTLS. Writes are serialized and may happen concurrently with
+// reads.
+type Conn struct {
+	// Timeout, if positive, is the deadline for every read and
+	// write.
+	Timeout time.Duration
+	// CaptureRaw causes read messages to retain the exact bytes of
+	// their line, including the line terminator, in
+	// Message.RawBytes.
+	CaptureRaw bool
+	// Logger, if set, is passed every message that is read or
+	// written.
+	Logger Logger
+	// Clock provides the time at which messages are received.
+	// Defaults to RealClock.
+	Clock Clock
+
+	// wmu serializes writes, so that nothing gets written during a
+	// STARTTLS handshake.
+	wmu     sync.Mutex
+	mu      sync.RWMutex
+	conn    net.Conn
+	in      *pendingReader
+	scanner *bufio.Scanner
+	// rmu is held by ReadMessage, so that pause can wait for it.
+	rmu sync.Mutex
+	// pmu orders pausing with the deadlines set by ReadMessage.
+	pmu sync.Mutex
+}
+
+// NewConn returns a Conn that uses conn.
+func NewConn(conn net.Conn) *Conn {
+	c := &Conn{conn: conn, in: &pendingReader{r: conn}}
+	c.scanner = newTrackingScanner(c.in)
+	return c
+}
+
+// NetConn returns the underlying connection. After StartTLS, this is
+// the *tls.Conn.
+func (c *Conn) NetConn() net.Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// TLS reports whether the connection is encrypted.
+func (c *Conn) TLS() bool {
+	_, ok := c.NetConn().(*tls.Conn)
+	return ok
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.NetConn().Close()
+}
+
+// ReadMessage reads the next message. Empty lines are returned as
+// messages without a command. At the end of the stream, it returns
+// io.EOF.
+func (c *Conn) ReadMessage() (*Message, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	conn := c.NetConn()
+	c.pmu.Lock()
+	if c.in.isPaused() {
+		c.pmu.Unlock()
+		return nil, errPaused
+	}
+	if c.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	}
+	c.pmu.Unlock()
+	if !c.scanner.Scan() {
+		err := c.scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	now := OrRealClock(c.Clock).Now()
+	raw := c.scanner.Bytes()
+	m := Parse(string(trimLine(raw)))
+	if c.CaptureRaw {
+		m.RawBytes = append([]byte(nil), raw...)
+	}
+	m.Received = now
+	if m.Time.IsZero() {
+		m.Time = now
+	}
+	if c.Logger != nil {
+		c.Logger.Incoming(m)
+	}
+	return m, nil
+}
+
+// WriteMessage validates m and writes it.
+func (c *Conn) WriteMessage(m *Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	return c.writeLine(m.WireString(), m)
+}
+
+// WriteLine writes a raw line, which must not contain a line
+// terminator.
+func (c *Conn) WriteLine(line string) error {
+	var m *Message
+	if c.Logger != nil {
+		m = Parse(line)
+	}
+	return c.writeLine(line, m)
+}
+
+func (c *Conn) writeLine(line string, m *Message) error {
+	if c.Logger != nil {
+		c.Logger.Outgoing(m)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn := c.NetConn()
+	if c.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	}
+	_, err := io.WriteString(conn, line+"\r\n")
+	return err
+}
+
+// StartTLS performs a client-side TLS handshake on the connection,
+// such as after the server accepted STARTTLS. It must not be called
+// concurrently with ReadMessage, and the server must not have sent
+// anything after its acceptance yet.
+func (c *Conn) StartTLS(cfg *tls.Config) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn := tls.Client(c.conn, cfg)
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn = conn
+	c.in = &pendingReader{r: conn}
+	c.scanner = newTrackingScanner(c.in)
+	return nil
+}
+
+// errPaused is returned by ReadMessage after pause.
+var errPaused = errors.New("reading paused")
+
+// pause stops reading, interrupting a ReadMessage in progress, and
+// returns the bytes that were read from the connection but not yet
+// returned as messages. No further messages will be read.
+func (c *Conn) pause() []byte {
+	c.pmu.Lock()
+	atomic.StoreInt32(&c.in.paused, 1)
+	c.NetConn().SetReadDeadline(time.Unix(1, 0))
+	c.pmu.Unlock()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return append([]byte(nil), c.in.pending...)
+}
+
+// resume resumes reading after pause, starting with the bytes that
+// were read but not yet consumed.
+func (c *Conn) resume() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	c.NetConn().SetReadDeadline(time.Time{})
+	c.in = &pendingReader{r: io.MultiReader(bytes.NewReader(c.in.pending), c.in.r)}
+	c.scanner = newTrackingScanner(c.in)
+}
+
+// unread makes b the first bytes read from the connection. It must
+// be called before the first call to ReadMessage.
+func (c *Conn) unread(b []byte) {
+	c.in.r = io.MultiReader(bytes.NewReader(b), c.in.r)
+}
+
+// pendingReader records the bytes read from r that haven't been
+// consumed by the scanner yet, so that they can be handed over along
+// with the connection.
+type pendingReader struct {
+	r       io.Reader
+	pending []byte
+	paused  int32
+}
+
+func (p *pendingReader) isPaused() bool {
+	return atomic.LoadInt32(&p.paused) != 0
+}
+
+func (p *pendingReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.pending = append(p.pending, b[:n]...)
+	if p.isPaused() {
+		return n, errPaused
+	}
+	return n, err
+}
+
+// newTrackingScanner is like newScanner, but removes consumed lines
+// from p's pending bytes. Once p is paused, it stops returning lines.
+func newTrackingScanner(p *pendingReader) *bufio.Scanner {
+	s := bufio.NewScanner(p)
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if p.isPaused() {
+			return 0, nil, errPaused
+		}
+		advance, token, err := scanLines(data, atEOF)
+		p.pending = p.pending[advance:]
+		return advance, token, err
+	})
+	return s
+}
+
+// newScanner returns a scanner for lines that, unlike
+// bufio.ScanLines, keeps line terminators, so that CaptureRaw can
+// preserve them. Use trimLine to remove them.
+func newScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Split(scanLines)
+	return s
+}
+
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// trimLine removes the line terminator from a line returned by a
+// scanner created with newScanner.
+func trimLine(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
@@ -0,0 +1,40 @@
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	server.CaptureRaw = true
+
+	go func() {
+		client.WriteMessage(&Message{Command: "PRIVMSG", Params: []string{"#chan", "hello world"}})
+		client.WriteLine("PING :token")
+	}()
+	m, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "PRIVMSG" || m.Params[1] != "hello world" || string(m.RawBytes) != "PRIVMSG #chan :hello world\r\n" {
+		t.Errorf("got %#v", m)
+	}
+	if m.Received.IsZero() {
+		t.Error("Received isn't set")
+	}
+	m, err = server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "PING" || m.Params[0] != "token" {
+		t.Errorf("got %#v", m)
+	}
+
+	if err := client.WriteMessage(&Message{Command: "PRIVMSG", Params: []string{"#chan", "a\r\nQUIT"}}); err == nil {
+		t.Error("WriteMessage accepted a message containing a line break")
+	}
+}
@@ -71,9 +71,10 @@ const (
 	RPL_CHANNELMODEIS   = "324"
 	RPL_NOTOPIC         = "331"
 	RPL_TOPIC           = "332"
+	RPL_TOPICWHOTIME    = "333"
 	RPL_INVITING        = "341"
 	RPL_SUMMONING       = "342"
-	RPL_WHOISACCOUNT    = "350"
+	RPL_WHOISACCOUNT    = "330"
 	RPL_VERSION         = "351"
 	RPL_WHOREPLY        = "352"
 	RPL_ENDOFWHO        = "315"
@@ -99,6 +100,7 @@ const (
 	RPL_USERS           = "393"
 	RPL_ENDOFUSERS      = "394"
 	RPL_NOUSERS         = "395"
+	RPL_VISIBLEHOST     = "396"
 	RPL_TRACELINK       = "200"
 	RPL_TRACECONNECTING = "201"
 	RPL_TRACEHANDSHAKE  = "202"
@@ -130,6 +132,9 @@ const (
 	RPL_ADMINLOC1       = "257"
 	RPL_ADMINLOC2       = "258"
 	RPL_ADMINEMAIL      = "259"
+	RPL_STARTTLS        = "670"
+	RPL_WHOISSECURE     = "671"
+	ERR_STARTTLS        = "691"
 	RPL_MONONLINE       = "730"
 	RPL_MONOFFLINE      = "731"
 	RPL_MONLIST         = "732"
@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"errors"
+	"strings"
+)
+
+// The CTCP specification defines two levels of quoting. Low-level
+// quoting, using \020 as the escape character, protects characters
+// that cannot appear in IRC messages. CTCP-level quoting, using \134
+// (backslash) as the escape character, protects the CTCP delimiter
+// inside CTCP data.
+//
+// Many clients implement neither, which is why ParseCTCP and
+// FormatCTCP don't quote. Use QuoteCTCP and ParseCTCPQuoted when
+// talking to clients that do.
+
+var (
+	lowQuoter = strings.NewReplacer(
+		"\020", "\020\020",
+		"\000", "\0200",
+		"\n", "\020n",
+		"\r", "\020r",
+	)
+	ctcpQuoter = strings.NewReplacer(
+		"\\", "\\\\",
+		"\001", "\\a",
+	)
+)
+
+func dequote(s string, esc byte, table map[byte]byte) string {
+	if strings.IndexByte(s, esc) == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != esc {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		if r, ok := table[s[i]]; ok {
+			b = append(b, r)
+		} else {
+			// Undefined escapes are dropped, leaving the
+			// character itself.
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
+var (
+	lowEscapes  = map[byte]byte{'0': 0, 'n': '\n', 'r': '\r', '\020': '\020'}
+	ctcpEscapes = map[byte]byte{'a': 1, '\\': '\\'}
+)
+
+// QuoteCTCP applies CTCP-level and low-level quoting to s, so that it
+// can be embedded in a CTCP message even if it contains the CTCP
+// delimiter, CR, LF or NUL.
+func QuoteCTCP(s string) string {
+	return lowQuoter.Replace(ctcpQuoter.Replace(s))
+}
+
+// DequoteCTCP reverses QuoteCTCP.
+func DequoteCTCP(s string) string {
+	return dequote(dequote(s, '\020', lowEscapes), '\\', ctcpEscapes)
+}
+
+// ParseCTCPQuoted is like ParseCTCP but removes quoting from the CTCP
+// data.
+func ParseCTCPQuoted(s string) (*CTCPMessage, error) {
+	s = dequote(s, '\020', lowEscapes)
+	if len(s) < 2 {
+		return nil, errors.New("not a CTCP message")
+	}
+	return ParseCTCP(CTCPDelim + dequote(s[1:len(s)-1], '\\', ctcpEscapes) + CTCPDelim)
+}
+
+// FormatCTCP formats a CTCP message consisting of command and text,
+// for use as the trailing parameter of a PRIVMSG or NOTICE. text is
+// not quoted; see QuoteCTCP.
+func FormatCTCP(command, text string) string {
+	if text == "" {
+		return CTCPDelim + command + CTCPDelim
+	}
+	return CTCPDelim + command + " " + text + CTCPDelim
+}
+
+// ParseCTCPs parses all CTCP messages embedded in s, which may be
+// interspersed with plain text. The plain text is returned
+// separately. A missing final delimiter is tolerated.
+func ParseCTCPs(s string) (ctcps []*CTCPMessage, text string) {
+	var plain []string
+	for {
+		start := strings.Index(s, CTCPDelim)
+		if start == -1 {
+			plain = append(plain, s)
+			break
+		}
+		plain = append(plain, s[:start])
+		s = s[start+1:]
+		end := strings.Index(s, CTCPDelim)
+		if end == -1 {
+			end = len(s)
+		}
+		if end > 0 {
+			ctcp, _ := ParseCTCP(CTCPDelim + s[:end] + CTCPDelim)
+			ctcps = append(ctcps, ctcp)
+		}
+		if end == len(s) {
+			break
+		}
+		s = s[end+1:]
+	}
+	return ctcps, strings.Join(plain, "")
+}
+
+// CTCPs returns all CTCP messages embedded in the message's last
+// parameter, as well as the remaining plain text. See ParseCTCPs.
+func (m *Message) CTCPs() (ctcps []*CTCPMessage, text string) {
+	if len(m.Params) == 0 {
+		return nil, ""
+	}
+	return ParseCTCPs(m.Params[len(m.Params)-1])
+}
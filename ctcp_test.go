@@ -0,0 +1,57 @@
+package irc
+
+import "testing"
+
+func TestCTCPQuoting(t *testing.T) {
+	table := []struct {
+		in     string
+		quoted string
+	}{
+		{"plain", "plain"},
+		{"back\\slash", "back\\\\slash"},
+		{"delim\001iter", "delim\\aiter"},
+		{"line\r\nbreak", "line\020r\020nbreak"},
+		{"nul\000 and \020", "nul\0200 and \020\020"},
+	}
+
+	for _, test := range table {
+		if q := QuoteCTCP(test.in); q != test.quoted {
+			t.Errorf("quoting %q, expected %q, got %q", test.in, test.quoted, q)
+		}
+		if d := DequoteCTCP(test.quoted); d != test.in {
+			t.Errorf("dequoting %q, expected %q, got %q", test.quoted, test.in, d)
+		}
+	}
+
+	m, err := ParseCTCPQuoted(FormatCTCP("PING", QuoteCTCP("a\001b\nc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "PING" || m.Text != "a\001b\nc" {
+		t.Errorf("expected PING with text %q, got %#v", "a\001b\nc", m)
+	}
+}
+
+func TestParseCTCPs(t *testing.T) {
+	table := []struct {
+		in       string
+		commands []string
+		text     string
+	}{
+		{"just text", nil, "just text"},
+		{"\001VERSION\001", []string{"VERSION"}, ""},
+		{"hello \001PING 1\001 world \001TIME\001!", []string{"PING", "TIME"}, "hello  world !"},
+		{"\001ACTION waves", []string{"ACTION"}, ""},
+	}
+
+	for _, test := range table {
+		ctcps, text := ParseCTCPs(test.in)
+		var commands []string
+		for _, ctcp := range ctcps {
+			commands = append(commands, ctcp.Command)
+		}
+		if !stringsEqual(commands, test.commands) || text != test.text {
+			t.Errorf("parsing %q, expected %q and %q, got %q and %q", test.in, test.commands, test.text, commands, text)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+// Package dcc implements the Direct Client-to-Client protocol for
+// chatting and transferring files outside of IRC.
+//
+// DCC offers are sent as CTCP messages, which the client dispatches
+// as ctcp:DCC signals. Handler parses incoming offers and hands them
+// to user-provided callbacks, which can accept them.
+package dcc // import "honnef.co/go/irc/dcc"
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Offer is a DCC CHAT or SEND offer.
+type Offer struct {
+	// The sender of the offer
+	From irc.Mask
+	// CHAT or SEND
+	Type string
+	// The file name, for SEND offers
+	File string
+	Addr net.TCPAddr
+	// The file size, for SEND offers. -1 if unknown.
+	Size int64
+	// Token is set for passive (reverse) DCC, in which case the
+	// port is zero and the receiver has to listen instead.
+	Token string
+}
+
+// Passive reports whether the offer is a passive DCC offer, i.e. the
+// sender is waiting for us to listen.
+func (o *Offer) Passive() bool {
+	return o.Token != "" && o.Addr.Port == 0
+}
+
+// ErrNotDCC is returned by ParseOffer for CTCP messages that aren't
+// DCC CHAT or DCC SEND offers.
+var ErrNotDCC = errors.New("not a DCC offer")
+
+// ParseOffer parses a DCC CHAT or DCC SEND offer.
+func ParseOffer(m *irc.Message) (*Offer, error) {
+	ctcp, err := m.CTCP()
+	if err != nil || ctcp.Command != "DCC" {
+		return nil, ErrNotDCC
+	}
+	args := splitArgs(ctcp.Text)
+	if len(args) < 4 {
+		return nil, ErrNotDCC
+	}
+	o := &Offer{From: m.Prefix, Type: strings.ToUpper(args[0]), File: args[1], Size: -1}
+	if o.Type != "CHAT" && o.Type != "SEND" {
+		return nil, ErrNotDCC
+	}
+	ip, err := parseIP(args[2])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(args[3])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", args[3])
+	}
+	o.Addr = net.TCPAddr{IP: ip, Port: port}
+	rest := args[4:]
+	if o.Type == "SEND" && len(rest) > 0 {
+		if size, err := strconv.ParseInt(rest[0], 10, 64); err == nil {
+			o.Size = size
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		o.Token = rest[0]
+	}
+	return o, nil
+}
+
+// splitArgs splits DCC arguments on spaces, honouring double-quoted
+// file names.
+func splitArgs(s string) []string {
+	var out []string
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return out
+		}
+		if s[0] == '"' {
+			if end := strings.IndexByte(s[1:], '"'); end != -1 {
+				out = append(out, s[1:end+1])
+				s = s[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexByte(s, ' ')
+		if end == -1 {
+			end = len(s)
+		}
+		out = append(out, s[:end])
+		s = s[end:]
+	}
+}
+
+func parseIP(s string) (net.IP, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		return ip, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("invalid IP %q", s)
+}
+
+// formatIP formats an IP for use in DCC offers: IPv4 addresses as a
+// single integer, IPv6 addresses in their textual form.
+func formatIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+func quoteFile(name string) string {
+	if strings.IndexByte(name, ' ') != -1 {
+		return `"` + name + `"`
+	}
+	return name
+}
+
+// Handler dispatches incoming DCC offers and resume negotiation. It
+// needs to be registered as a handler for the ctcp:DCC signal.
+type Handler struct {
+	// OnChat is called for incoming DCC CHAT offers.
+	OnChat func(c *irc.Client, o *Offer)
+	// OnSend is called for incoming DCC SEND offers.
+	OnSend func(c *irc.Client, o *Offer)
+
+	mu      sync.Mutex
+	resumes map[string]chan int64
+	sends   map[string]*Sender
+}
+
+func (h *Handler) Process(c *irc.Client, m *irc.Message) {
+	ctcp, err := m.CTCP()
+	if err != nil || ctcp.Command != "DCC" {
+		return
+	}
+	args := splitArgs(ctcp.Text)
+	if len(args) == 0 {
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CHAT", "SEND":
+		o, err := ParseOffer(m)
+		if err != nil {
+			return
+		}
+		if o.Token != "" && !o.Passive() {
+			if s := h.sender(o.Token); s != nil {
+				// The reply to one of our passive offers, which
+				// carries the port the peer is listening on
+				s.passiveReply(o)
+				return
+			}
+		}
+		switch {
+		case o.Type == "CHAT" && h.OnChat != nil:
+			h.OnChat(c, o)
+		case o.Type == "SEND" && h.OnSend != nil:
+			h.OnSend(c, o)
+		}
+	case "RESUME":
+		// DCC RESUME file port position [token]
+		if len(args) < 4 {
+			return
+		}
+		pos, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return
+		}
+		key := args[2]
+		if len(args) > 4 {
+			key = args[4]
+		}
+		if s := h.sender(key); s != nil {
+			s.resume(pos)
+			accept := append([]string{"ACCEPT", quoteFile(args[1])}, args[2:]...)
+			c.CTCP(m.Prefix.Nick, "DCC", accept...)
+		}
+	case "ACCEPT":
+		// DCC ACCEPT file port position [token]
+		if len(args) < 4 {
+			return
+		}
+		pos, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return
+		}
+		key := args[2]
+		if len(args) > 4 {
+			key = args[4]
+		}
+		h.mu.Lock()
+		ch := h.resumes[key]
+		delete(h.resumes, key)
+		h.mu.Unlock()
+		if ch != nil {
+			ch <- pos
+		}
+	}
+}
+
+func (h *Handler) sender(key string) *Sender {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sends[key]
+}
+
+func (h *Handler) register(key string, s *Sender) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sends == nil {
+		h.sends = make(map[string]*Sender)
+	}
+	h.sends[key] = s
+}
+
+func (h *Handler) unregister(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sends, key)
+}
+
+// Chat is an established DCC CHAT session.
+type Chat struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func newChat(conn net.Conn) *Chat {
+	return &Chat{conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// ReadLine reads the next line sent by the peer.
+func (ch *Chat) ReadLine() (string, error) {
+	if !ch.scanner.Scan() {
+		if err := ch.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return strings.TrimSuffix(ch.scanner.Text(), "\r"), nil
+}
+
+// WriteLine sends a line to the peer.
+func (ch *Chat) WriteLine(s string) error {
+	_, err := io.WriteString(ch.conn, s+"\n")
+	return err
+}
+
+func (ch *Chat) Close() error {
+	return ch.conn.Close()
+}
+
+// AcceptChat accepts a DCC CHAT offer by connecting to the sender.
+func AcceptChat(o *Offer) (*Chat, error) {
+	conn, err := net.DialTimeout("tcp", o.Addr.String(), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return newChat(conn), nil
+}
+
+// OfferChat offers a DCC CHAT session to nick and waits for it to
+// connect. ip is the address the peer should connect to, usually our
+// public IP.
+func OfferChat(c *irc.Client, nick string, ip net.IP, timeout time.Duration) (*Chat, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	if err := c.CTCP(nick, "DCC", "CHAT", "chat", formatIP(ip), strconv.Itoa(port)); err != nil {
+		return nil, err
+	}
+	conn, err := acceptTimeout(l, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newChat(conn), nil
+}
+
+func acceptTimeout(l net.Listener, timeout time.Duration) (net.Conn, error) {
+	if tl, ok := l.(*net.TCPListener); ok && timeout > 0 {
+		tl.SetDeadline(time.Now().Add(timeout))
+	}
+	return l.Accept()
+}
+
+// Progress is called periodically during file transfers with the
+// number of bytes transferred so far and the total size, which is -1
+// if unknown.
+type Progress func(done, total int64)
+
+// Receive accepts a DCC SEND offer and writes the file to w, starting
+// at offset. If offset is non-zero, a DCC RESUME is negotiated with
+// the sender first, which requires h to be registered as a handler.
+// For passive offers, Receive listens on a local port and announces
+// it to the sender, using ip as the address to connect to.
+func (h *Handler) Receive(c *irc.Client, o *Offer, w io.WriterAt, offset int64, ip net.IP, progress Progress) error {
+	if offset > 0 {
+		key := strconv.Itoa(o.Addr.Port)
+		if o.Passive() {
+			key = o.Token
+		}
+		ch := make(chan int64, 1)
+		h.mu.Lock()
+		if h.resumes == nil {
+			h.resumes = make(map[string]chan int64)
+		}
+		h.resumes[key] = ch
+		h.mu.Unlock()
+		args := []string{"RESUME", quoteFile(o.File), strconv.Itoa(o.Addr.Port), strconv.FormatInt(offset, 10)}
+		if o.Token != "" {
+			args = append(args, o.Token)
+		}
+		if err := c.CTCP(o.From.Nick, "DCC", args...); err != nil {
+			return err
+		}
+		select {
+		case offset = <-ch:
+		case <-irc.OrRealClock(c.Clock).After(30 * time.Second):
+			h.mu.Lock()
+			delete(h.resumes, key)
+			h.mu.Unlock()
+			return errors.New("timed out waiting for DCC ACCEPT")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if o.Passive() {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		port := l.Addr().(*net.TCPAddr).Port
+		err = c.CTCP(o.From.Nick, "DCC", "SEND", quoteFile(o.File), formatIP(ip), strconv.Itoa(port), strconv.FormatInt(o.Size, 10), o.Token)
+		if err != nil {
+			return err
+		}
+		conn, err = acceptTimeout(l, 60*time.Second)
+		if err != nil {
+			return err
+		}
+	} else {
+		conn, err = net.DialTimeout("tcp", o.Addr.String(), 30*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 32<<10)
+	done := offset
+	for o.Size < 0 || done < o.Size {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteAt(buf[:n], done); err != nil {
+				return err
+			}
+			done += int64(n)
+			// Acknowledge the number of received bytes,
+			// truncated to 32 bits as per the protocol.
+			var ack [4]byte
+			binary.BigEndian.PutUint32(ack[:], uint32(done))
+			if _, err := conn.Write(ack[:]); err != nil {
+				// Senders may close the connection as soon as
+				// they've sent the whole file, without waiting
+				// for the final acknowledgement.
+				if o.Size < 0 || done < o.Size {
+					return err
+				}
+			}
+			if progress != nil {
+				progress(done, o.Size)
+			}
+		}
+		if err == io.EOF {
+			if o.Size >= 0 && done < o.Size {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sender is an outgoing DCC SEND offer.
+type Sender struct {
+	size    int64
+	mu      sync.Mutex
+	offset  int64
+	passive chan *Offer
+}
+
+func (s *Sender) resume(pos int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos >= 0 && pos <= s.size {
+		s.offset = pos
+	}
+}
+
+func (s *Sender) passiveReply(o *Offer) {
+	select {
+	case s.passive <- o:
+	default:
+	}
+}
+
+// NewToken returns a token for a passive offer. Peers usually expect
+// tokens to be numeric, so it consists of digits, drawn from
+// crypto/rand.
+func NewToken() string {
+	return strconv.FormatInt(irc.CryptoRandom.Int63n(1e9), 10)
+}
+
+// Send offers the file at path to nick and transfers it once the peer
+// accepts. If ip is nil, a passive offer is made and the peer is
+// expected to listen instead; token must then be a unique, hard to
+// guess string, such as one returned by NewToken. h must be registered as a handler to support resuming
+// and passive offers.
+func (h *Handler) Send(c *irc.Client, nick, path string, ip net.IP, token string, timeout time.Duration, progress Progress) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	name := fi.Name()
+	s := &Sender{size: fi.Size(), passive: make(chan *Offer, 1)}
+
+	var conn net.Conn
+	if ip == nil {
+		h.register(token, s)
+		defer h.unregister(token)
+		err := c.CTCP(nick, "DCC", "SEND", quoteFile(name), "0", "0", strconv.FormatInt(s.size, 10), token)
+		if err != nil {
+			return err
+		}
+		var o *Offer
+		select {
+		case o = <-s.passive:
+		case <-irc.OrRealClock(c.Clock).After(timeout):
+			return errors.New("timed out waiting for passive DCC reply")
+		}
+		conn, err = net.DialTimeout("tcp", o.Addr.String(), 30*time.Second)
+		if err != nil {
+			return err
+		}
+	} else {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		h.register(port, s)
+		defer h.unregister(port)
+		err = c.CTCP(nick, "DCC", "SEND", quoteFile(name), formatIP(ip), port, strconv.FormatInt(s.size, 10))
+		if err != nil {
+			return err
+		}
+		conn, err = acceptTimeout(l, timeout)
+		if err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	offset := s.offset
+	s.mu.Unlock()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Read acknowledgements so the peer doesn't block on them, and
+	// so that we don't close the connection before the peer has
+	// received everything.
+	acked := make(chan error, 1)
+	go func() { acked <- awaitAck(conn, s.size) }()
+
+	buf := make([]byte, 32<<10)
+	done := offset
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+			done += int64(n)
+			if progress != nil {
+				progress(done, s.size)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-acked:
+		return err
+	case <-irc.OrRealClock(c.Clock).After(timeout):
+		return errors.New("timed out waiting for DCC acknowledgement")
+	}
+}
+
+// awaitAck reads acknowledgements from r until the peer has
+// acknowledged size bytes or closed the connection.
+func awaitAck(r io.Reader, size int64) error {
+	var ack [4]byte
+	for {
+		if _, err := io.ReadFull(r, ack[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Acknowledgements are truncated to 32 bits.
+		if binary.BigEndian.Uint32(ack[:]) == uint32(size) {
+			return nil
+		}
+	}
+}
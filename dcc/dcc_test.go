@@ -0,0 +1,160 @@
+package dcc
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestParseOffer(t *testing.T) {
+	table := []struct {
+		in  string
+		out Offer
+	}{
+		{
+			":nick!user@host PRIVMSG me :\x01DCC CHAT chat 3232235777 5000\x01",
+			Offer{Type: "CHAT", File: "chat", Addr: net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 5000}, Size: -1},
+		},
+		{
+			":nick!user@host PRIVMSG me :\x01DCC SEND \"my file.txt\" 3232235777 5000 1024\x01",
+			Offer{Type: "SEND", File: "my file.txt", Addr: net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 5000}, Size: 1024},
+		},
+		{
+			":nick!user@host PRIVMSG me :\x01DCC SEND file.txt 3232235777 0 1024 42\x01",
+			Offer{Type: "SEND", File: "file.txt", Addr: net.TCPAddr{IP: net.IPv4(192, 168, 1, 1)}, Size: 1024, Token: "42"},
+		},
+	}
+
+	for _, test := range table {
+		o, err := ParseOffer(irc.Parse(test.in))
+		if err != nil {
+			t.Errorf("parsing %q: %s", test.in, err)
+			continue
+		}
+		if o.Type != test.out.Type || o.File != test.out.File || !o.Addr.IP.Equal(test.out.Addr.IP) ||
+			o.Addr.Port != test.out.Addr.Port || o.Size != test.out.Size || o.Token != test.out.Token {
+			t.Errorf("parsing %q, expected %+v, got %+v", test.in, test.out, *o)
+		}
+	}
+}
+
+// peer is a client connected to an irctest.Server that dispatches DCC
+// messages to a Handler.
+type peer struct {
+	c *irc.Client
+	h *Handler
+}
+
+func newPeer(t *testing.T, srv *irctest.Server, nick string, onSend func(c *irc.Client, o *Offer)) *peer {
+	t.Helper()
+	p := &peer{h: &Handler{OnSend: onSend}}
+	mux := irc.NewMux()
+	mux.Handle("ctcp:DCC", p.h)
+	connected := make(chan struct{}, 1)
+	mux.HandleFunc("irc:connected", func(c *irc.Client, m *irc.Message) { connected <- struct{}{} })
+	p.c = &irc.Client{Nick: nick, User: nick, Mux: mux, Dialer: srv}
+	if err := p.c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go p.c.Process()
+	t.Cleanup(func() { p.c.Close() })
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s didn't register", nick)
+	}
+	return p
+}
+
+func TestSendReceive(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	src := filepath.Join(dir, "my file.bin")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	table := []struct {
+		name string
+		// The sender's IP, or nil for passive offers
+		ip net.IP
+		// How much of the file the receiver already has
+		offset int64
+	}{
+		{"active", localhost, 0},
+		{"passive", nil, 0},
+		{"resume", localhost, 12345},
+		{"passive resume", nil, 54321},
+	}
+	for _, test := range table {
+		srv := irctest.NewServer()
+		srv.Echo = false
+		dst, err := os.Create(filepath.Join(dir, test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dst.Write(data[:test.offset]); err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan error, 1)
+		bob := newPeer(t, srv, "bob", nil)
+		bob.h.OnSend = func(c *irc.Client, o *Offer) {
+			go func() { received <- bob.h.Receive(c, o, dst, test.offset, localhost, nil) }()
+		}
+		alice := newPeer(t, srv, "alice", nil)
+
+		var token string
+		if test.ip == nil {
+			token = NewToken()
+		}
+		if err := alice.h.Send(alice.c, "bob", src, test.ip, token, 5*time.Second, nil); err != nil {
+			t.Fatalf("%s: sending failed: %s", test.name, err)
+		}
+		select {
+		case err := <-received:
+			if err != nil {
+				t.Fatalf("%s: receiving failed: %s", test.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out receiving", test.name)
+		}
+		dst.Close()
+		got, err := os.ReadFile(dst.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: received %d bytes that differ from the %d bytes sent", test.name, len(got), len(data))
+		}
+
+		if test.offset == 0 {
+			continue
+		}
+		// The sender accepts the resume with the parameters it was
+		// asked for.
+		var resume, accept string
+		for _, m := range srv.Received() {
+			ctcp, err := m.CTCP()
+			if err != nil || ctcp.Command != "DCC" {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(ctcp.Text, "RESUME "):
+				resume = ctcp.Text
+			case strings.HasPrefix(ctcp.Text, "ACCEPT "):
+				accept = ctcp.Text
+			}
+		}
+		if want := "ACCEPT" + strings.TrimPrefix(resume, "RESUME"); resume == "" || accept != want {
+			t.Errorf("%s: expected %q in response to %q, got %q", test.name, want, resume, accept)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !irc_nodefaultmux
+
+package irc
+
+// DefaultMux is the Mux used by clients that don't have one. Building
+// with the irc_nodefaultmux tag removes DefaultMux, Handle and
+// HandleFunc, so that clients without a Mux fail to connect instead
+// of sharing global state.
+var DefaultMux = NewMux()
+
+// Handle registers handler for signal on DefaultMux.
+func Handle(signal string, handler Handler) *Registration {
+	return DefaultMux.Handle(signal, handler)
+}
+
+// HandleFunc registers handler for signal on DefaultMux.
+func HandleFunc(signal string, handler func(*Client, *Message)) *Registration {
+	return DefaultMux.HandleFunc(signal, handler)
+}
+
+func defaultMuxer() Muxer { return DefaultMux }
@@ -0,0 +1,305 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownEvent is returned by Decode for messages that don't have
+// a typed event.
+var ErrUnknownEvent = errors.New("no event type for message")
+
+// A DecodeError is returned when a message can't be decoded into its
+// event type, usually because it has too few parameters.
+type DecodeError struct {
+	Command string
+	Reason  string
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("cannot decode %s: %s", err.Command, err.Reason)
+}
+
+func needParams(m *Message, n int) error {
+	if len(m.Params) < n {
+		return &DecodeError{m.Command, fmt.Sprintf("need %d parameters, got %d", n, len(m.Params))}
+	}
+	return nil
+}
+
+func expectCommand(m *Message, cmds ...string) error {
+	for _, cmd := range cmds {
+		if m.Command == cmd {
+			return nil
+		}
+	}
+	return &DecodeError{m.Command, "unexpected command"}
+}
+
+// JoinEvent is a user joining a channel. Account and RealName are
+// only set if the extended-join capability is enabled; Account is "*"
+// for users that aren't logged in.
+type JoinEvent struct {
+	Channel  string
+	User     Mask
+	Account  string
+	RealName string
+}
+
+func DecodeJoin(m *Message) (*JoinEvent, error) {
+	if err := expectCommand(m, "JOIN"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 1); err != nil {
+		return nil, err
+	}
+	ev := &JoinEvent{Channel: m.Params[0], User: m.Prefix}
+	if len(m.Params) >= 3 {
+		ev.Account = m.Params[1]
+		ev.RealName = m.Params[2]
+	}
+	return ev, nil
+}
+
+// PartEvent is a user leaving a channel.
+type PartEvent struct {
+	Channel string
+	User    Mask
+	Reason  string
+}
+
+func DecodePart(m *Message) (*PartEvent, error) {
+	if err := expectCommand(m, "PART"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 1); err != nil {
+		return nil, err
+	}
+	ev := &PartEvent{Channel: m.Params[0], User: m.Prefix}
+	if len(m.Params) >= 2 {
+		ev.Reason = m.Params[1]
+	}
+	return ev, nil
+}
+
+// KickEvent is a user being kicked from a channel by another user.
+type KickEvent struct {
+	Channel string
+	Target  string
+	By      Mask
+	Reason  string
+}
+
+func DecodeKick(m *Message) (*KickEvent, error) {
+	if err := expectCommand(m, "KICK"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 2); err != nil {
+		return nil, err
+	}
+	ev := &KickEvent{Channel: m.Params[0], Target: m.Params[1], By: m.Prefix}
+	if len(m.Params) >= 3 {
+		ev.Reason = m.Params[2]
+	}
+	return ev, nil
+}
+
+// QuitEvent is a user disconnecting from the network.
+type QuitEvent struct {
+	User   Mask
+	Reason string
+}
+
+func DecodeQuit(m *Message) (*QuitEvent, error) {
+	if err := expectCommand(m, "QUIT"); err != nil {
+		return nil, err
+	}
+	ev := &QuitEvent{User: m.Prefix}
+	if len(m.Params) >= 1 {
+		ev.Reason = m.Params[0]
+	}
+	return ev, nil
+}
+
+// NickEvent is a user changing their nick.
+type NickEvent struct {
+	User Mask
+	New  string
+}
+
+func DecodeNick(m *Message) (*NickEvent, error) {
+	if err := expectCommand(m, "NICK"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 1); err != nil {
+		return nil, err
+	}
+	return &NickEvent{User: m.Prefix, New: m.Params[0]}, nil
+}
+
+// TopicEvent is a channel's topic, either because it was changed
+// (TOPIC) or because the server told us about it (RPL_TOPIC). By is
+// only set for changes.
+type TopicEvent struct {
+	Channel string
+	Topic   string
+	By      Mask
+}
+
+func DecodeTopic(m *Message) (*TopicEvent, error) {
+	if err := expectCommand(m, "TOPIC", RPL_TOPIC); err != nil {
+		return nil, err
+	}
+	if m.Command == RPL_TOPIC {
+		if err := needParams(m, 3); err != nil {
+			return nil, err
+		}
+		return &TopicEvent{Channel: m.Params[1], Topic: m.Params[2]}, nil
+	}
+	if err := needParams(m, 2); err != nil {
+		return nil, err
+	}
+	return &TopicEvent{Channel: m.Params[0], Topic: m.Params[1], By: m.Prefix}, nil
+}
+
+// ModeEvent is a change of user or channel modes. Modes is the raw
+// mode string, e.g. "+ov-b", and Params are its arguments.
+type ModeEvent struct {
+	Target string
+	By     Mask
+	Modes  string
+	Params []string
+}
+
+func DecodeMode(m *Message) (*ModeEvent, error) {
+	if err := expectCommand(m, "MODE"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 2); err != nil {
+		return nil, err
+	}
+	return &ModeEvent{
+		Target: m.Params[0],
+		By:     m.Prefix,
+		Modes:  m.Params[1],
+		Params: append([]string(nil), m.Params[2:]...),
+	}, nil
+}
+
+// InviteEvent is us, or with invite-notify another user, being
+// invited to a channel.
+type InviteEvent struct {
+	By      Mask
+	Target  string
+	Channel string
+}
+
+func DecodeInvite(m *Message) (*InviteEvent, error) {
+	if err := expectCommand(m, "INVITE"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 2); err != nil {
+		return nil, err
+	}
+	return &InviteEvent{By: m.Prefix, Target: m.Params[0], Channel: m.Params[1]}, nil
+}
+
+// MessageEvent is a PRIVMSG or NOTICE. Messages containing CTCPs are
+// decoded as MessageEvents as well; use Message.CTCPs to extract
+// them.
+type MessageEvent struct {
+	From   Mask
+	Target string
+	Text   string
+	Notice bool
+}
+
+func DecodeMessage(m *Message) (*MessageEvent, error) {
+	if err := expectCommand(m, "PRIVMSG", "NOTICE"); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 2); err != nil {
+		return nil, err
+	}
+	return &MessageEvent{
+		From:   m.Prefix,
+		Target: m.Params[0],
+		Text:   m.Params[len(m.Params)-1],
+		Notice: m.Command == "NOTICE",
+	}, nil
+}
+
+// WhoisUserReply is the RPL_WHOISUSER part of a WHOIS reply.
+type WhoisUserReply struct {
+	User     Mask
+	RealName string
+}
+
+func DecodeWhoisUser(m *Message) (*WhoisUserReply, error) {
+	if err := expectCommand(m, RPL_WHOISUSER); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 6); err != nil {
+		return nil, err
+	}
+	return &WhoisUserReply{
+		User:     Mask{Nick: m.Params[1], User: m.Params[2], Host: m.Params[3]},
+		RealName: m.Params[5],
+	}, nil
+}
+
+// WhoisAccountReply is the RPL_WHOISACCOUNT part of a WHOIS reply.
+type WhoisAccountReply struct {
+	Nick    string
+	Account string
+}
+
+func DecodeWhoisAccount(m *Message) (*WhoisAccountReply, error) {
+	if err := expectCommand(m, RPL_WHOISACCOUNT); err != nil {
+		return nil, err
+	}
+	if err := needParams(m, 3); err != nil {
+		return nil, err
+	}
+	return &WhoisAccountReply{Nick: m.Params[1], Account: m.Params[2]}, nil
+}
+
+// Decode converts a message into its typed event, such as
+// *JoinEvent or *KickEvent, so that handlers can use a type switch
+// instead of indexing Params. It returns ErrUnknownEvent for messages
+// without an event type.
+func Decode(m *Message) (interface{}, error) {
+	var ev interface{}
+	var err error
+	switch m.Command {
+	case "JOIN":
+		ev, err = DecodeJoin(m)
+	case "PART":
+		ev, err = DecodePart(m)
+	case "KICK":
+		ev, err = DecodeKick(m)
+	case "QUIT":
+		ev, err = DecodeQuit(m)
+	case "NICK":
+		ev, err = DecodeNick(m)
+	case "TOPIC", RPL_TOPIC:
+		ev, err = DecodeTopic(m)
+	case "MODE":
+		ev, err = DecodeMode(m)
+	case "INVITE":
+		ev, err = DecodeInvite(m)
+	case "PRIVMSG", "NOTICE":
+		ev, err = DecodeMessage(m)
+	case RPL_WHOISUSER:
+		ev, err = DecodeWhoisUser(m)
+	case RPL_WHOISACCOUNT:
+		ev, err = DecodeWhoisAccount(m)
+	default:
+		return nil, ErrUnknownEvent
+	}
+	if err != nil {
+		// Don't return typed nil pointers
+		return nil, err
+	}
+	return ev, nil
+}
@@ -0,0 +1,46 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	table := []struct {
+		in  string
+		out interface{}
+	}{
+		{":nick!user@host JOIN #chan", &JoinEvent{Channel: "#chan", User: Mask{"nick", "user", "host"}}},
+		{":nick!user@host JOIN #chan account :Real Name", &JoinEvent{Channel: "#chan", User: Mask{"nick", "user", "host"}, Account: "account", RealName: "Real Name"}},
+		{":nick!user@host PART #chan :bye", &PartEvent{Channel: "#chan", User: Mask{"nick", "user", "host"}, Reason: "bye"}},
+		{":op!user@host KICK #chan nick :go away", &KickEvent{Channel: "#chan", Target: "nick", By: Mask{"op", "user", "host"}, Reason: "go away"}},
+		{":nick!user@host QUIT :Ping timeout", &QuitEvent{User: Mask{"nick", "user", "host"}, Reason: "Ping timeout"}},
+		{":nick!user@host NICK other", &NickEvent{User: Mask{"nick", "user", "host"}, New: "other"}},
+		{":nick!user@host TOPIC #chan :new topic", &TopicEvent{Channel: "#chan", Topic: "new topic", By: Mask{"nick", "user", "host"}}},
+		{":server 332 me #chan :the topic", &TopicEvent{Channel: "#chan", Topic: "the topic"}},
+		{":op!user@host MODE #chan +ov-b a b c!*@*", &ModeEvent{Target: "#chan", By: Mask{"op", "user", "host"}, Modes: "+ov-b", Params: []string{"a", "b", "c!*@*"}}},
+		{":nick!user@host INVITE me #chan", &InviteEvent{By: Mask{"nick", "user", "host"}, Target: "me", Channel: "#chan"}},
+		{":nick!user@host NOTICE #chan :hi", &MessageEvent{From: Mask{"nick", "user", "host"}, Target: "#chan", Text: "hi", Notice: true}},
+		{":server 311 me nick user host * :Real Name", &WhoisUserReply{User: Mask{"nick", "user", "host"}, RealName: "Real Name"}},
+		{":server 330 me nick account :is logged in as", &WhoisAccountReply{Nick: "nick", Account: "account"}},
+	}
+
+	for _, test := range table {
+		ev, err := Decode(Parse(test.in))
+		if err != nil {
+			t.Errorf("decoding %q: %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(ev, test.out) {
+			t.Errorf("decoding %q: expected %#v, got %#v", test.in, test.out, ev)
+		}
+	}
+
+	if _, err := Decode(Parse(":server 001 me :welcome")); err != ErrUnknownEvent {
+		t.Errorf("decoding 001: expected ErrUnknownEvent, got %v", err)
+	}
+	ev, err := Decode(Parse(":op!user@host KICK #chan"))
+	if _, ok := err.(*DecodeError); !ok || ev != nil {
+		t.Errorf("decoding short KICK: expected nil and *DecodeError, got %#v and %v", ev, err)
+	}
+}
@@ -0,0 +1,130 @@
+// Package extban constructs extended bans, such as bans matching
+// users' accounts, in the syntax of the connected network.
+//
+// Servers advertise the extended bans they support via the EXTBAN
+// ISUPPORT token, but the letters used for each type differ between
+// server software, which is inferred from the extban prefix: $ for
+// charybdis and its descendants, ~ for UnrealIRCd and no prefix for
+// InspIRCd.
+package extban // import "honnef.co/go/irc/extban"
+
+import (
+	"errors"
+	"fmt"
+
+	"honnef.co/go/irc"
+)
+
+// ErrNoExtBans is returned when the server doesn't support extended
+// bans at all.
+var ErrNoExtBans = errors.New("server doesn't support extended bans")
+
+// An UnsupportedError is returned when the server doesn't support a
+// specific type of extended ban.
+type UnsupportedError struct {
+	Ban Ban
+}
+
+func (err *UnsupportedError) Error() string {
+	return fmt.Sprintf("server doesn't support %s extbans", err.Ban.kind)
+}
+
+type kind int
+
+const (
+	kindCustom kind = iota
+	kindAccount
+	kindRealname
+	kindChannel
+	kindCertFP
+	kindOper
+	kindQuiet
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindAccount:
+		return "account"
+	case kindRealname:
+		return "realname"
+	case kindChannel:
+		return "channel"
+	case kindCertFP:
+		return "certificate fingerprint"
+	case kindOper:
+		return "oper"
+	case kindQuiet:
+		return "quiet"
+	default:
+		return "custom"
+	}
+}
+
+// The letters used by the different families of servers, indexed by
+// their extban prefix.
+var letters = map[string]map[kind]rune{
+	"$": {kindAccount: 'a', kindRealname: 'r', kindChannel: 'j', kindOper: 'o'},
+	"~": {kindAccount: 'a', kindRealname: 'r', kindChannel: 'c', kindCertFP: 'S', kindOper: 'O', kindQuiet: 'q'},
+	"":  {kindAccount: 'R', kindRealname: 'r', kindChannel: 'j', kindCertFP: 'z', kindOper: 'O', kindQuiet: 'm'},
+}
+
+// Ban is an extended ban, independent of any network's syntax. Use
+// Format to render it.
+type Ban struct {
+	kind   kind
+	letter rune
+	arg    string
+}
+
+// Account matches users logged in to account.
+func Account(account string) Ban { return Ban{kind: kindAccount, arg: account} }
+
+// Realname matches users whose realname matches pattern.
+func Realname(pattern string) Ban { return Ban{kind: kindRealname, arg: pattern} }
+
+// Channel matches users who are in channel.
+func Channel(channel string) Ban { return Ban{kind: kindChannel, arg: channel} }
+
+// CertFP matches users whose TLS client certificate has the given
+// fingerprint.
+func CertFP(fingerprint string) Ban { return Ban{kind: kindCertFP, arg: fingerprint} }
+
+// Oper matches IRC operators. On some servers, arg restricts the
+// match to a class of operators; it may be empty.
+func Oper(arg string) Ban { return Ban{kind: kindOper, arg: arg} }
+
+// Quiet prevents users matching mask from speaking, without
+// preventing them from joining. Servers in the charybdis family use
+// the +q list mode instead.
+func Quiet(mask string) Ban { return Ban{kind: kindQuiet, arg: mask} }
+
+// Custom is an extended ban of a type not otherwise supported by
+// this package, identified by its letter.
+func Custom(letter rune, arg string) Ban { return Ban{kind: kindCustom, letter: letter, arg: arg} }
+
+// Format renders the ban in the syntax of the server described by
+// is. The result can be used as the argument to MODE +b.
+func (b Ban) Format(is *irc.ISupport) (string, error) {
+	eb := is.ExtBan
+	if len(eb.Types) == 0 {
+		return "", ErrNoExtBans
+	}
+	letter := b.letter
+	if b.kind != kindCustom {
+		family, ok := letters[eb.Prefix]
+		if !ok {
+			return "", &UnsupportedError{b}
+		}
+		letter, ok = family[b.kind]
+		if !ok {
+			return "", &UnsupportedError{b}
+		}
+	}
+	if !eb.Supports(letter) {
+		return "", &UnsupportedError{b}
+	}
+	if b.arg == "" {
+		return eb.Prefix + string(letter), nil
+	}
+	return eb.Prefix + string(letter) + ":" + b.arg, nil
+}
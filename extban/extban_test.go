@@ -0,0 +1,44 @@
+package extban
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func isupport(extban string) *irc.ISupport {
+	is := irc.NewISupport()
+	is.Parse(irc.Parse(":server 005 me EXTBAN=" + extban))
+	return is
+}
+
+func TestFormat(t *testing.T) {
+	table := []struct {
+		extban string
+		ban    Ban
+		out    string
+	}{
+		{"$,arxz", Account("user"), "$a:user"},
+		{"$,arxz", Realname("*spam*"), "$r:*spam*"},
+		{"~,acrS", Account("user"), "~a:user"},
+		{"~,acrS", Channel("#chan"), "~c:#chan"},
+		{",ORrjz", Account("user"), "R:user"},
+		{",ORrjz", Oper(""), "O"},
+		{"$,arxz", Custom('x', "n!u@h#r"), "$x:n!u@h#r"},
+		{"~,acqrS", Quiet("*!*@host"), "~q:*!*@host"},
+		{",ORmrjz", Quiet("*!*@host"), "m:*!*@host"},
+	}
+	for _, test := range table {
+		out, err := test.ban.Format(isupport(test.extban))
+		if err != nil || out != test.out {
+			t.Errorf("formatting %v for EXTBAN=%s: expected %q, got %q, %v", test.ban, test.extban, test.out, out, err)
+		}
+	}
+
+	if _, err := Channel("#chan").Format(isupport("$,arxz")); err == nil {
+		t.Errorf("expected error for unsupported extban type")
+	}
+	if _, err := Account("user").Format(irc.NewISupport()); err != ErrNoExtBans {
+		t.Errorf("expected ErrNoExtBans, got %v", err)
+	}
+}
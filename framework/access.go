@@ -0,0 +1,294 @@
+package framework
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// An AccessEntry assigns a level to users matching a hostmask
+// pattern or logged in to a services account. Exactly one of Mask
+// and Account is set.
+type AccessEntry struct {
+	Mask    string
+	Account string
+	Level   int
+}
+
+// AccessList assigns levels to users, for use in access control,
+// bans and ignores. What the levels mean is up to the bot; a common
+// choice is negative levels for ignored users and positive ones for
+// privileges.
+//
+// Entries are keyed either by hostmask or by services account.
+// Account entries survive nick and host changes, which makes them
+// preferable. When a user matching a hostmask entry is seen logged
+// in to an account, via account-tag, extended-join or
+// account-notify, the entry is migrated to the account and the
+// access:migrated signal is emitted, with the mask, the account and
+// the level as parameters. Only complete hostmasks of the form
+// nick!user@host, without wildcards, are migrated; broader masks
+// such as *!*@shared.host may match many users.
+//
+// Account names are compared using the casemapping of the network.
+//
+// Permission turns levels into a Permission for commands.
+//
+// The entries are stored in Brain, under keys starting with access:,
+// so that they persist if Brain does.
+//
+// AccessList needs to be registered as a catch-all handler, with
+// HandleSync if migrations should see account changes in order.
+type AccessList struct {
+	*irc.Mux
+	Brain *Brain
+	// State, if set, provides the accounts of users whose messages
+	// don't carry an account tag.
+	State *State
+
+	// mu serializes changes to account entries, which span several
+	// Brain operations.
+	mu sync.Mutex
+	// the ISupport of the connection we last saw a message from
+	is *irc.ISupport
+	// the prefix of the Brain keys and of the migration signal
+	prefix string
+}
+
+func NewAccessList(brain *Brain) *AccessList {
+	return newAccessList(brain, "access:")
+}
+
+// newAccessList returns an AccessList that stores its entries under
+// keys starting with prefix and emits the migration signal
+// prefix+"migrated". IgnoreList uses it to store its own entries.
+func newAccessList(brain *Brain, prefix string) *AccessList {
+	l := &AccessList{Mux: irc.NewOrderedMux(), Brain: brain, prefix: prefix}
+	l.HandleFunc("", l.observe)
+	return l
+}
+
+func (l *AccessList) maskPrefix() string    { return l.prefix + "mask:" }
+func (l *AccessList) accountPrefix() string { return l.prefix + "account:" }
+
+// SetMask sets the level of users matching mask.
+func (l *AccessList) SetMask(mask string, level int) error {
+	return l.Brain.Set(l.maskPrefix()+mask, strconv.Itoa(level), 0)
+}
+
+// SetAccount sets the level of users logged in to account, replacing
+// entries for the same account in a different case.
+func (l *AccessList) SetAccount(account string, level int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.setAccount(account, level, 0)
+}
+
+// setAccount is like SetAccount, but the entry expires after ttl if
+// it is positive. l.mu must be held.
+func (l *AccessList) setAccount(account string, level int, ttl time.Duration) error {
+	for _, key := range l.accountKeys(l.support(), account) {
+		if err := l.Brain.Delete(key); err != nil {
+			return err
+		}
+	}
+	return l.Brain.Set(l.accountPrefix()+account, strconv.Itoa(level), ttl)
+}
+
+// RemoveMask removes the entry for mask.
+func (l *AccessList) RemoveMask(mask string) error {
+	return l.Brain.Delete(l.maskPrefix() + mask)
+}
+
+// RemoveAccount removes the entry for account.
+func (l *AccessList) RemoveAccount(account string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.accountKeys(l.support(), account) {
+		if err := l.Brain.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// support returns the ISupport of the connection we last saw a
+// message from, or the defaults if there was none. l.mu must be held.
+func (l *AccessList) support() *irc.ISupport {
+	if l.is == nil {
+		return irc.NewISupport()
+	}
+	return l.is
+}
+
+// accountKeys returns the keys of the entries for account.
+func (l *AccessList) accountKeys(is *irc.ISupport, account string) []string {
+	folded := is.Casefold(account)
+	var out []string
+	for _, key := range l.Brain.Keys(l.accountPrefix()) {
+		if is.Casefold(key[len(l.accountPrefix()):]) == folded {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// Entries returns all entries, account entries first.
+func (l *AccessList) Entries() []AccessEntry {
+	var out []AccessEntry
+	for _, key := range l.Brain.Keys(l.accountPrefix()) {
+		if level, ok := l.level(key); ok {
+			out = append(out, AccessEntry{Account: key[len(l.accountPrefix()):], Level: level})
+		}
+	}
+	for _, key := range l.Brain.Keys(l.maskPrefix()) {
+		if level, ok := l.level(key); ok {
+			out = append(out, AccessEntry{Mask: key[len(l.maskPrefix()):], Level: level})
+		}
+	}
+	return out
+}
+
+func (l *AccessList) level(key string) (int, bool) {
+	v, ok := l.Brain.Get(key)
+	if !ok {
+		return 0, false
+	}
+	level, err := strconv.Atoi(v)
+	return level, err == nil
+}
+
+// LevelFor returns the level of the user with the given hostmask and
+// account, which may be empty. An account entry takes precedence. If
+// several hostmask entries match, the lowest level wins, so that bans
+// take precedence over grants.
+func (l *AccessList) LevelFor(is *irc.ISupport, mask irc.Mask, account string) (int, bool) {
+	if account != "" {
+		for _, key := range l.accountKeys(is, account) {
+			if level, ok := l.level(key); ok {
+				return level, true
+			}
+		}
+	}
+	var (
+		min   int
+		found bool
+	)
+	for _, key := range l.Brain.Keys(l.maskPrefix()) {
+		if !is.Match(mask, key[len(l.maskPrefix()):]) {
+			continue
+		}
+		if level, ok := l.level(key); ok && (!found || level < min) {
+			min, found = level, true
+		}
+	}
+	return min, found
+}
+
+// Level returns the level of the sender of m.
+func (l *AccessList) Level(c *irc.Client, m *irc.Message) (int, bool) {
+	return l.LevelFor(c.Support(), m.Prefix, accountOf(l.State, m))
+}
+
+// Permission returns a Permission that allows users whose level is
+// at least min.
+func (l *AccessList) Permission(min int) Permission {
+	return func(c *irc.Client, m *irc.Message) bool {
+		level, ok := l.Level(c, m)
+		return ok && level >= min
+	}
+}
+
+func (l *AccessList) observe(c *irc.Client, m *irc.Message) {
+	l.mu.Lock()
+	l.is = c.Support()
+	l.mu.Unlock()
+	if m.Prefix.Nick == "" {
+		return
+	}
+	var account string
+	switch m.Command {
+	case "JOIN":
+		// extended-join
+		if ev, err := irc.DecodeJoin(m); err == nil {
+			account = ev.Account
+		}
+	case "ACCOUNT":
+		// account-notify
+		if len(m.Params) > 0 {
+			account = m.Params[0]
+		}
+	}
+	if account == "" || account == "*" {
+		account = m.Tags["account"]
+	}
+	if account == "" || account == "*" {
+		return
+	}
+	l.migrate(c, m.Prefix, account)
+}
+
+// migrate moves the hostmask entries for exactly mask to account. If
+// account already has an entry, the hostmask entries are merely
+// removed.
+func (l *AccessList) migrate(c *irc.Client, mask irc.Mask, account string) {
+	is := c.Support()
+	type migration struct {
+		mask  string
+		level int
+		ttl   time.Duration
+	}
+	var migrations []migration
+
+	l.mu.Lock()
+	hasAccount := len(l.accountKeys(is, account)) > 0
+	for _, key := range l.Brain.Keys(l.maskPrefix()) {
+		pattern := key[len(l.maskPrefix()):]
+		if !isExactMask(pattern) || !is.Match(mask, pattern) {
+			continue
+		}
+		level, ok := l.level(key)
+		if !ok {
+			continue
+		}
+		ttl, _ := l.Brain.TTL(key)
+		migrations = append(migrations, migration{pattern, level, ttl})
+	}
+	if len(migrations) == 0 {
+		l.mu.Unlock()
+		return
+	}
+	if !hasAccount {
+		// Like LevelFor, prefer the lowest level.
+		sort.Slice(migrations, func(i, j int) bool { return migrations[i].level < migrations[j].level })
+		if err := l.setAccount(account, migrations[0].level, migrations[0].ttl); err != nil {
+			l.mu.Unlock()
+			return
+		}
+	}
+	for _, mig := range migrations {
+		l.RemoveMask(mig.mask)
+	}
+	l.mu.Unlock()
+
+	for _, mig := range migrations {
+		c.Mux.Process(c, &irc.Message{
+			Signal: l.prefix + "migrated",
+			Params: []string{mig.mask, account, strconv.Itoa(mig.level)},
+		})
+	}
+}
+
+// isExactMask reports whether pattern is a complete hostmask without
+// wildcards, which matches a single user.
+func isExactMask(pattern string) bool {
+	if strings.ContainsAny(pattern, "*?") {
+		return false
+	}
+	m := irc.ParseMask(pattern)
+	return m.Nick != "" && m.User != "" && m.Host != ""
+}
@@ -0,0 +1,72 @@
+package framework
+
+import (
+	"reflect"
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestAccessList(t *testing.T) {
+	brain, _ := NewBrain(nil)
+	l := NewAccessList(brain)
+	l.SetMask("alice!a@home.example", 10)
+	l.SetMask("*!*@shared.example", 5)
+	l.SetMask("*!*@bad.example", -1)
+	l.SetAccount("Bob", 20)
+
+	mux := irc.NewOrderedMux()
+	mux.Handle("", l)
+	var migrated [][]string
+	mux.HandleFunc("access:migrated", func(c *irc.Client, m *irc.Message) {
+		migrated = append(migrated, m.Params)
+	})
+	s := newTestServer(t, mux)
+	s.welcome()
+	s.send(
+		"@account=Alice :alice!a@home.example PRIVMSG #chan :hi",
+		"@account=mallory :mallory!m@shared.example PRIVMSG #chan :hi",
+	)
+	s.sync()
+
+	expectedMigrated := [][]string{{"alice!a@home.example", "Alice", "10"}}
+	if !reflect.DeepEqual(migrated, expectedMigrated) {
+		t.Errorf("expected migrations %q, got %q", expectedMigrated, migrated)
+	}
+	expected := []AccessEntry{
+		{Account: "Alice", Level: 10},
+		{Account: "Bob", Level: 20},
+		{Mask: "*!*@bad.example", Level: -1},
+		{Mask: "*!*@shared.example", Level: 5},
+	}
+	if entries := l.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected entries %v, got %v", expected, entries)
+	}
+
+	// Accounts are compared using the network's casemapping.
+	l.SetAccount("carol[", 1)
+	l.SetAccount("CAROL{", 2)
+	is := s.c.Support()
+	if level, ok := l.LevelFor(is, irc.Mask{Nick: "c"}, "Carol{"); !ok || level != 2 {
+		t.Errorf("expected level 2 for Carol{, got %d, %t", level, ok)
+	}
+	if level, ok := l.LevelFor(is, irc.Mask{Nick: "b"}, "BOB"); !ok || level != 20 {
+		t.Errorf("expected level 20 for BOB, got %d, %t", level, ok)
+	}
+
+	allow := l.Permission(10)
+	table := []struct {
+		line string
+		want bool
+	}{
+		{"@account=alice :alice!a@elsewhere.example PRIVMSG #chan :hi", true},
+		{":mallory!m@shared.example PRIVMSG #chan :hi", false},
+		{"@account=bob :bob!b@bad.example PRIVMSG #chan :hi", true},
+		{":eve!e@bad.example PRIVMSG #chan :hi", false},
+	}
+	for _, test := range table {
+		if got := allow(s.c, irc.Parse(test.line)); got != test.want {
+			t.Errorf("%q: expected permission %t, got %t", test.line, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// ErrServicesTimeout is returned by AccountVerifier.Identified when
+// the server or services didn't answer in time.
+var ErrServicesTimeout = errors.New("timed out waiting for services")
+
+// AccountVerifier checks whether nicks are identified to services. It
+// prefers the account reported in WHOIS (numeric 330) and falls back
+// to asking NickServ via ACC, and if that isn't understood, STATUS.
+// The replies of Atheme and Anope are supported.
+//
+// AccountVerifier needs to be registered as a catch-all handler, and
+// its Coalesce has to be registered as well.
+type AccountVerifier struct {
+	*irc.Mux
+	Coalesce *Coalesce
+	// The nick of the services bot. Defaults to NickServ.
+	Services string
+	// How long to wait for services to reply. Defaults to 10
+	// seconds.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// whether the server has ever sent RPL_WHOISACCOUNT, in which
+	// case its absence means that a user isn't identified
+	whoisAccounts bool
+	// whether services don't understand ACC
+	noACC  bool
+	probes map[string][]chan accReply
+}
+
+type accReply struct {
+	account     string
+	identified  bool
+	unsupported bool
+}
+
+func NewAccountVerifier(co *Coalesce) *AccountVerifier {
+	v := &AccountVerifier{
+		Mux:      irc.NewMux(),
+		Coalesce: co,
+		probes:   make(map[string][]chan accReply),
+	}
+	v.HandleFunc(irc.RPL_WHOISACCOUNT, v.whoisAccount)
+	v.HandleFunc("NOTICE", v.notice)
+	return v
+}
+
+func (v *AccountVerifier) services() string {
+	if v.Services == "" {
+		return "NickServ"
+	}
+	return v.Services
+}
+
+func (v *AccountVerifier) timeout() time.Duration {
+	if v.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return v.Timeout
+}
+
+// Identified reports whether nick is identified to services and the
+// account it is identified to.
+func (v *AccountVerifier) Identified(c *irc.Client, nick string) (account string, identified bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout())
+	u, err := WhoisContext(ctx, c, v.Coalesce, nick)
+	cancel()
+	if err != nil {
+		return "", false, ErrServicesTimeout
+	}
+	if u.Account != "" {
+		return u.Account, true, nil
+	}
+	v.mu.Lock()
+	trusted, noACC := v.whoisAccounts, v.noACC
+	v.mu.Unlock()
+	if trusted {
+		return "", false, nil
+	}
+
+	if !noACC {
+		r, err := v.probe(c, "ACC "+nick, nick)
+		if err != nil {
+			return "", false, err
+		}
+		if !r.unsupported {
+			return r.account, r.identified, nil
+		}
+		v.mu.Lock()
+		v.noACC = true
+		v.mu.Unlock()
+	}
+	r, err := v.probe(c, "STATUS "+nick, nick)
+	if err != nil {
+		return "", false, err
+	}
+	if r.unsupported {
+		return "", false, errors.New("services support neither ACC nor STATUS")
+	}
+	return r.account, r.identified, nil
+}
+
+func (v *AccountVerifier) probe(c *irc.Client, query, nick string) (accReply, error) {
+	key := strings.ToLower(nick)
+	ch := make(chan accReply, 1)
+	v.mu.Lock()
+	v.probes[key] = append(v.probes[key], ch)
+	v.mu.Unlock()
+
+	timeout := v.timeout()
+	if err := c.Privmsg(v.services(), query); err != nil {
+		v.cancel(key, ch)
+		return accReply{}, err
+	}
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-irc.OrRealClock(c.Clock).After(timeout):
+		v.cancel(key, ch)
+		return accReply{}, ErrServicesTimeout
+	}
+}
+
+func (v *AccountVerifier) cancel(key string, ch chan accReply) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	chs := v.probes[key]
+	for i, other := range chs {
+		if other == ch {
+			v.probes[key] = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(v.probes[key]) == 0 {
+		delete(v.probes, key)
+	}
+}
+
+func (v *AccountVerifier) whoisAccount(c *irc.Client, m *irc.Message) {
+	v.mu.Lock()
+	v.whoisAccounts = true
+	v.mu.Unlock()
+}
+
+func (v *AccountVerifier) notice(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 2 || !strings.EqualFold(m.Prefix.Nick, v.services()) {
+		return
+	}
+	text := m.Params[len(m.Params)-1]
+	if strings.Contains(strings.ToLower(text), "unknown command") {
+		// The reply doesn't tell us which nick it was about, so
+		// inform all pending probes.
+		v.mu.Lock()
+		probes := v.probes
+		v.probes = make(map[string][]chan accReply)
+		v.mu.Unlock()
+		for _, chs := range probes {
+			for _, ch := range chs {
+				ch <- accReply{unsupported: true}
+			}
+		}
+		return
+	}
+	nick, r, ok := parseACC(text)
+	if !ok {
+		return
+	}
+	key := strings.ToLower(nick)
+	v.mu.Lock()
+	chs := v.probes[key]
+	delete(v.probes, key)
+	v.mu.Unlock()
+	for _, ch := range chs {
+		ch <- r
+	}
+}
+
+// parseACC parses the replies to ACC and STATUS queries:
+//
+//	nick ACC 3                 (Atheme, Anope)
+//	nick -> account ACC 3      (Atheme, grouped nicks)
+//	STATUS nick 3 [account]    (Atheme, Anope)
+//
+// A level of 3 means that the user is identified.
+func parseACC(text string) (nick string, r accReply, ok bool) {
+	fields := strings.Fields(text)
+	var level string
+	switch {
+	case len(fields) >= 3 && fields[1] == "ACC":
+		nick, level = fields[0], fields[2]
+		r.account = nick
+	case len(fields) >= 5 && fields[1] == "->" && fields[3] == "ACC":
+		nick, level = fields[0], fields[4]
+		r.account = fields[2]
+	case len(fields) >= 3 && fields[0] == "STATUS":
+		nick, level = fields[1], fields[2]
+		r.account = nick
+		if len(fields) >= 4 {
+			r.account = fields[3]
+		}
+	default:
+		return "", accReply{}, false
+	}
+	r.identified = level == "3"
+	if !r.identified {
+		r.account = ""
+	}
+	return nick, r, true
+}
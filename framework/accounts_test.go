@@ -0,0 +1,31 @@
+package framework
+
+import "testing"
+
+func TestParseACC(t *testing.T) {
+	table := []struct {
+		text string
+		nick string
+		r    accReply
+		ok   bool
+	}{
+		{"alice ACC 3", "alice", accReply{account: "alice", identified: true}, true},
+		{"alice ACC 1", "alice", accReply{}, true},
+		{"alice ACC 0 (not registered)", "alice", accReply{}, true},
+		{"alice -> Alice ACC 3", "alice", accReply{account: "Alice", identified: true}, true},
+		{"alice -> Alice ACC 2", "alice", accReply{}, true},
+		{"STATUS alice 3", "alice", accReply{account: "alice", identified: true}, true},
+		{"STATUS alice 3 Alice", "alice", accReply{account: "Alice", identified: true}, true},
+		{"STATUS alice 0", "alice", accReply{}, true},
+		{"You are now identified for alice.", "", accReply{}, false},
+		{"ACC", "", accReply{}, false},
+		{"", "", accReply{}, false},
+	}
+	for _, test := range table {
+		nick, r, ok := parseACC(test.text)
+		if nick != test.nick || r != test.r || ok != test.ok {
+			t.Errorf("parseACC(%q) = %q, %+v, %t, expected %q, %+v, %t",
+				test.text, nick, r, ok, test.nick, test.r, test.ok)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package framework
+
+import (
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Outcome is the result of an attempt to run a command.
+type Outcome int
+
+const (
+	// The command ran and succeeded.
+	Allowed Outcome = iota
+	// The user lacked permission to run the command.
+	Denied
+	// The command ran and returned an error, including ErrUsage.
+	Failed
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Allowed:
+		return "allowed"
+	case Denied:
+		return "denied"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// AuditEntry records a single invocation of a command.
+type AuditEntry struct {
+	Time time.Time
+	User irc.Mask
+	// The account the user was logged in to, if known from the
+	// account-tag capability
+	Account string
+	// Where the command was sent, i.e. a channel or the bot's nick
+	Target  string
+	Command string
+	Args    []string
+	Outcome Outcome
+	// The error returned by the command, if Outcome is Failed
+	Err error
+}
+
+// An AuditSink receives a record of every command invocation, e.g.
+// to write an audit log or collect metrics. Audit is called
+// synchronously after the command ran and should not block.
+type AuditSink interface {
+	Audit(e AuditEntry)
+}
+
+// AuditFunc adapts a function to the AuditSink interface.
+type AuditFunc func(e AuditEntry)
+
+func (fn AuditFunc) Audit(e AuditEntry) { fn(e) }
+
+// CommandUsage counts the invocations of a command by outcome.
+type CommandUsage struct {
+	Allowed int
+	Denied  int
+	Failed  int
+}
+
+// UsageCounter is an AuditSink that counts how often each command
+// was invoked.
+type UsageCounter struct {
+	mu     sync.Mutex
+	counts map[string]CommandUsage
+}
+
+func (uc *UsageCounter) Audit(e AuditEntry) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if uc.counts == nil {
+		uc.counts = make(map[string]CommandUsage)
+	}
+	u := uc.counts[e.Command]
+	switch e.Outcome {
+	case Allowed:
+		u.Allowed++
+	case Denied:
+		u.Denied++
+	case Failed:
+		u.Failed++
+	}
+	uc.counts[e.Command] = u
+}
+
+// Counts returns the usage of all commands that have been invoked at
+// least once.
+func (uc *UsageCounter) Counts() map[string]CommandUsage {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	out := make(map[string]CommandUsage, len(uc.counts))
+	for name, u := range uc.counts {
+		out[name] = u
+	}
+	return out
+}
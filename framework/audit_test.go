@@ -0,0 +1,122 @@
+package framework
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+func TestAudit(t *testing.T) {
+	boom := errors.New("boom")
+	cs := NewCommands("!")
+	for name, err := range map[string]error{
+		"ok":    nil,
+		"deny":  fmt.Errorf("not today: %w", ErrDenied),
+		"quiet": ErrIgnored,
+		"fail":  boom,
+		"usage": fmt.Errorf("missing argument: %w", ErrUsage),
+	} {
+		err := err
+		cs.Register(&Command{
+			Name: name,
+			Help: name + " <arg>",
+			Func: func(c *irc.Client, m *irc.Message, args []string) error { return err },
+		})
+	}
+	cs.Register(&Command{
+		Name:       "secret",
+		Permission: func(c *irc.Client, m *irc.Message) bool { return false },
+		Func:       func(c *irc.Client, m *irc.Message, args []string) error { return nil },
+	})
+	var (
+		mu      sync.Mutex
+		entries []AuditEntry
+	)
+	uc := &UsageCounter{}
+	cs.Audit = AuditFunc(func(e AuditEntry) {
+		mu.Lock()
+		entries = append(entries, e)
+		mu.Unlock()
+		uc.Audit(e)
+	})
+	mux := irc.NewOrderedMux()
+	mux.Handle("PRIVMSG", cs)
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	at := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s.send("@time=2026-10-16T12:00:00.000Z;account=alice :alice!a@host PRIVMSG #chan :!ok one two")
+	s.sync()
+	mu.Lock()
+	want := AuditEntry{
+		Time:    at,
+		User:    irc.Mask{Nick: "alice", User: "a", Host: "host"},
+		Account: "alice",
+		Target:  "#chan",
+		Command: "ok",
+		Args:    []string{"one", "two"},
+		Outcome: Allowed,
+	}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("expected %+v, got %+v", want, entries)
+	}
+	entries = nil
+	mu.Unlock()
+
+	for _, test := range []struct {
+		command string
+		reply   string
+		outcome Outcome
+		err     error
+	}{
+		{"secret", "PRIVMSG #chan :permission denied", Denied, nil},
+		{"deny", "PRIVMSG #chan :permission denied", Denied, nil},
+		{"quiet", "", Denied, nil},
+		{"fail", "PRIVMSG #chan :error: boom", Failed, boom},
+		{"usage", "PRIVMSG #chan :usage: !usage <arg>", Failed, ErrUsage},
+		{"ok", "", Allowed, nil},
+	} {
+		s.send(":bob!b@host PRIVMSG #chan :!" + test.command)
+		if test.reply != "" {
+			s.expectSent(test.reply)
+		} else {
+			s.expectQuiet()
+		}
+		mu.Lock()
+		if len(entries) != 1 {
+			t.Fatalf("%s: expected one audit entry, got %+v", test.command, entries)
+		}
+		e := entries[0]
+		entries = nil
+		mu.Unlock()
+		if e.Command != test.command || e.Outcome != test.outcome || !errors.Is(e.Err, test.err) || (test.err == nil && e.Err != nil) {
+			t.Errorf("%s: expected %s and %v, got %+v", test.command, test.outcome, test.err, e)
+		}
+	}
+
+	// Unknown commands aren't audited.
+	s.send(":bob!b@host PRIVMSG #chan :!unknown")
+	s.expectQuiet()
+	mu.Lock()
+	if len(entries) != 0 {
+		t.Errorf("unknown command was audited: %+v", entries)
+	}
+	mu.Unlock()
+
+	expected := map[string]CommandUsage{
+		"ok":     {Allowed: 2},
+		"secret": {Denied: 1},
+		"deny":   {Denied: 1},
+		"quiet":  {Denied: 1},
+		"fail":   {Failed: 1},
+		"usage":  {Failed: 1},
+	}
+	if got := uc.Counts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected counts %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,213 @@
+package framework
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// A BrainEntry is a value stored in a Brain.
+type BrainEntry struct {
+	Value string
+	// When the entry expires. The zero value means never.
+	Expires time.Time
+}
+
+func (e BrainEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// A BrainStore persists the entries of a Brain.
+type BrainStore interface {
+	Load() (map[string]BrainEntry, error)
+	Save(entries map[string]BrainEntry) error
+}
+
+// JSONFileStore is a BrainStore that stores entries as JSON in the
+// named file. A missing file is treated as an empty store.
+type JSONFileStore string
+
+func (name JSONFileStore) Load() (map[string]BrainEntry, error) {
+	b, err := os.ReadFile(string(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]BrainEntry
+	err = json.Unmarshal(b, &entries)
+	return entries, err
+}
+
+func (name JSONFileStore) Save(entries map[string]BrainEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash doesn't leave
+	// a truncated file behind.
+	tmp := string(name) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(name))
+}
+
+// Brain is a small key/value store for bot state that doesn't
+// warrant a database, such as factoids, temporary mutes or per-user
+// cooldowns. Entries may expire. If Store is set, every change is
+// persisted.
+type Brain struct {
+	Store BrainStore
+	// Clock decides when entries expire. Defaults to
+	// irc.RealClock.
+	Clock irc.Clock
+
+	mu      sync.Mutex
+	entries map[string]BrainEntry
+	// incremented whenever an entry is set or deleted
+	version uint64
+}
+
+// NewBrain returns a Brain that persists its entries to store, which
+// may be nil. Existing entries are loaded from store.
+func NewBrain(store BrainStore) (*Brain, error) {
+	b := &Brain{Store: store, entries: make(map[string]BrainEntry)}
+	if store == nil {
+		return b, nil
+	}
+	entries, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	now := irc.OrRealClock(b.Clock).Now()
+	for key, e := range entries {
+		if !e.expired(now) {
+			b.entries[key] = e
+		}
+	}
+	return b, nil
+}
+
+// save records a change and persists the entries. b.mu must be
+// held.
+func (b *Brain) save() error {
+	b.version++
+	if b.Store == nil {
+		return nil
+	}
+	return b.Store.Save(b.entries)
+}
+
+// expire removes expired entries. b.mu must be held.
+func (b *Brain) expire(now time.Time) {
+	for key, e := range b.entries {
+		if e.expired(now) {
+			delete(b.entries, key)
+		}
+	}
+}
+
+// Get returns the value of key.
+func (b *Brain) Get(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[key]
+	if !ok || e.expired(irc.OrRealClock(b.Clock).Now()) {
+		return "", false
+	}
+	return e.Value, true
+}
+
+// Set sets key to value. If ttl is positive, the entry expires after
+// ttl.
+func (b *Brain) Set(key, value string, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := irc.OrRealClock(b.Clock).Now()
+	b.expire(now)
+	b.entries[key] = newBrainEntry(now, value, ttl)
+	return b.save()
+}
+
+// Add is like Set, but only sets key if it isn't set already, and
+// reports whether it did. This is useful for cooldowns:
+//
+//	if ok, _ := brain.Add("cooldown:"+nick, "", time.Minute); !ok {
+//		return
+//	}
+func (b *Brain) Add(key, value string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := irc.OrRealClock(b.Clock).Now()
+	b.expire(now)
+	if _, ok := b.entries[key]; ok {
+		return false, nil
+	}
+	b.entries[key] = newBrainEntry(now, value, ttl)
+	return true, b.save()
+}
+
+func newBrainEntry(now time.Time, value string, ttl time.Duration) BrainEntry {
+	e := BrainEntry{Value: value}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl)
+	}
+	return e
+}
+
+// changes returns a number that changes whenever an entry is set or
+// deleted, for caching data derived from entries. Entries expiring
+// don't change it.
+func (b *Brain) changes() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.version
+}
+
+// TTL returns how long until key expires, or zero if it never does.
+func (b *Brain) TTL(key string) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := irc.OrRealClock(b.Clock).Now()
+	e, ok := b.entries[key]
+	if !ok || e.expired(now) {
+		return 0, false
+	}
+	if e.Expires.IsZero() {
+		return 0, true
+	}
+	return e.Expires.Sub(now), true
+}
+
+// Delete removes key.
+func (b *Brain) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[key]; !ok {
+		return nil
+	}
+	delete(b.entries, key)
+	return b.save()
+}
+
+// Keys returns the sorted keys that start with prefix.
+func (b *Brain) Keys(prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := irc.OrRealClock(b.Clock).Now()
+	var out []string
+	for key, e := range b.entries {
+		if strings.HasPrefix(key, prefix) && !e.expired(now) {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,69 @@
+package framework
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc/irctest"
+)
+
+func TestBrain(t *testing.T) {
+	store := JSONFileStore(filepath.Join(t.TempDir(), "brain.json"))
+	b, err := NewBrain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := irctest.NewClock(time.Time{})
+	b.Clock = clock
+
+	if err := b.Set("factoid:go", "a programming language", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set("mute:eve", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.Add("cooldown:alice", "", time.Minute); !ok || err != nil {
+		t.Errorf("expected Add to set a new key, got %t, %v", ok, err)
+	}
+	if ok, err := b.Add("cooldown:alice", "", time.Minute); ok || err != nil {
+		t.Errorf("expected Add not to set an existing key, got %t, %v", ok, err)
+	}
+	if v, ok := b.Get("factoid:go"); !ok || v != "a programming language" {
+		t.Errorf("got %q, %t for factoid:go", v, ok)
+	}
+	if ttl, ok := b.TTL("mute:eve"); !ok || ttl != time.Hour {
+		t.Errorf("expected TTL of an hour for mute:eve, got %s, %t", ttl, ok)
+	}
+	if ttl, ok := b.TTL("factoid:go"); !ok || ttl != 0 {
+		t.Errorf("expected no TTL for factoid:go, got %s, %t", ttl, ok)
+	}
+
+	clock.Advance(time.Minute)
+	if _, ok := b.Get("cooldown:alice"); ok {
+		t.Error("cooldown:alice didn't expire")
+	}
+	if ok, _ := b.Add("cooldown:alice", "", time.Minute); !ok {
+		t.Error("expected Add to replace an expired key")
+	}
+	if keys, expected := b.Keys("mute:"), []string{"mute:eve"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %q, got %q", expected, keys)
+	}
+	if err := b.Delete("mute:eve"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Get("mute:eve"); ok {
+		t.Error("mute:eve wasn't deleted")
+	}
+
+	// Entries are persisted, and ones that expired in the meantime
+	// aren't loaded.
+	b, err = NewBrain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, expected := b.Keys(""), []string{"factoid:go"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %q after loading, got %q", expected, keys)
+	}
+}
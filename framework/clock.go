@@ -0,0 +1,131 @@
+package framework
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+var timeLayouts = []string{
+	"Monday January 2 2006 -- 15:04:05 -07:00",
+	"Monday January 2 2006 -- 15:04:05 -0700",
+	"Monday January 2 2006 -- 15:04 -07:00",
+	"Mon Jan 2 2006 -- 15:04:05 -07:00",
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC1123Z,
+	time.RFC3339,
+}
+
+// ServerClock estimates the offset between the local clock and the
+// server's clock, so that timestamps computed locally (e.g. for
+// history queries or timed bans) line up with the server's.
+//
+// Measurements are taken from the server-time tags of incoming
+// messages, by sending TIME and parsing RPL_TIME, or by calling
+// Observe with timestamps learned elsewhere. Messages in batches are
+// ignored, as they may be replayed history.
+//
+// ServerClock needs to be registered as a catch-all handler.
+type ServerClock struct {
+	*irc.Mux
+	// Clock is the local clock. Defaults to irc.RealClock.
+	Clock irc.Clock
+
+	mu     sync.Mutex
+	offset time.Duration
+	valid  bool
+	sent   time.Time
+}
+
+func NewServerClock() *ServerClock {
+	sc := &ServerClock{Mux: irc.NewOrderedMux()}
+	sc.HandleFunc("", sc.tagged)
+	sc.HandleFunc(irc.RPL_TIME, sc.rplTime)
+	return sc
+}
+
+// Measure asks the server for its current time. The offset will be
+// updated once the server replies.
+func (sc *ServerClock) Measure(c *irc.Client) error {
+	sc.mu.Lock()
+	sc.sent = irc.OrRealClock(sc.Clock).Now()
+	sc.mu.Unlock()
+	return c.Send("TIME")
+}
+
+// Observe records that the server's clock read server at the local
+// time local.
+func (sc *ServerClock) Observe(server, local time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	d := server.Sub(local)
+	if !sc.valid {
+		sc.offset = d
+		sc.valid = true
+		return
+	}
+	// Smooth out jitter caused by network latency.
+	sc.offset += (d - sc.offset) / 4
+}
+
+// Offset returns the estimated offset of the server's clock relative
+// to the local one. ok is false if no measurements have been made
+// yet.
+func (sc *ServerClock) Offset() (offset time.Duration, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.offset, sc.valid
+}
+
+// Now returns the estimated current time on the server.
+func (sc *ServerClock) Now() time.Time {
+	offset, _ := sc.Offset()
+	return irc.OrRealClock(sc.Clock).Now().Add(offset)
+}
+
+func (sc *ServerClock) tagged(c *irc.Client, m *irc.Message) {
+	if _, ok := m.Tags["time"]; !ok || m.Time.IsZero() || m.Received.IsZero() || m.Batch != nil {
+		return
+	}
+	sc.Observe(m.Time, m.Received)
+}
+
+func (sc *ServerClock) rplTime(c *irc.Client, m *irc.Message) {
+	now := irc.OrRealClock(sc.Clock).Now()
+	sc.mu.Lock()
+	sent := sc.sent
+	sc.sent = time.Time{}
+	sc.mu.Unlock()
+	if sent.IsZero() {
+		// We didn't ask for the time, so we cannot account for
+		// latency.
+		sent = now
+	}
+	server, ok := parseServerTime(m.Params)
+	if !ok {
+		return
+	}
+	sc.Observe(server, sent.Add(now.Sub(sent)/2))
+}
+
+func parseServerTime(params []string) (time.Time, bool) {
+	if len(params) < 3 {
+		return time.Time{}, false
+	}
+	// Some servers (e.g. InspIRCd) include a UNIX timestamp.
+	for _, p := range params[2 : len(params)-1] {
+		if ts, err := strconv.ParseInt(p, 10, 64); err == nil {
+			return time.Unix(ts, 0), true
+		}
+	}
+	s := params[len(params)-1]
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
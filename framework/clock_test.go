@@ -0,0 +1,87 @@
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestParseServerTime(t *testing.T) {
+	want := time.Date(2026, 10, 16, 14, 0, 5, 0, time.UTC)
+	table := []struct {
+		params []string
+		ok     bool
+	}{
+		{[]string{"bot", "irc.test", "Friday October 16 2026 -- 14:00:05 +00:00"}, true},
+		{[]string{"bot", "irc.test", "Friday October 16 2026 -- 16:00:05 +0200"}, true},
+		{[]string{"bot", "irc.test", "Fri Oct 16 2026 -- 14:00:05 +00:00"}, true},
+		{[]string{"bot", "irc.test", "Fri Oct 16 14:00:05 2026"}, true},
+		{[]string{"bot", "irc.test", "2026-10-16T14:00:05Z"}, true},
+		// InspIRCd includes a UNIX timestamp.
+		{[]string{"bot", "irc.test", "1792159205", "0", "Fri Oct 16 2026 -- 16:00:05 +02:00"}, true},
+		{[]string{"bot", "irc.test", "tea time"}, false},
+		{[]string{"bot", "irc.test"}, false},
+	}
+	for _, test := range table {
+		got, ok := parseServerTime(test.params)
+		if ok != test.ok || (ok && !got.Equal(want)) {
+			t.Errorf("%q: expected %s, %t, got %s, %t", test.params, want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestServerClock(t *testing.T) {
+	clock := irctest.NewClock(time.Time{})
+	format := func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) }
+	newClient := func() (*ServerClock, *testServer) {
+		sc := NewServerClock()
+		sc.Clock = clock
+		mux := irc.NewOrderedMux()
+		mux.Handle("", sc)
+		s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+		s.welcome()
+		return sc, s
+	}
+
+	// TIME is answered after a round trip of two seconds, during
+	// which the server's clock read an hour ahead of ours.
+	sc, s := newClient()
+	if _, ok := sc.Offset(); ok {
+		t.Error("offset is known without measurements")
+	}
+	if err := sc.Measure(s.c); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("TIME")
+	clock.Advance(time.Second)
+	server := clock.Now().Add(time.Hour)
+	clock.Advance(time.Second)
+	s.send(":irc.test 391 bot irc.test :" + server.UTC().Format(time.RFC3339))
+	s.sync()
+	if offset, ok := sc.Offset(); !ok || offset != time.Hour {
+		t.Errorf("expected an offset of an hour, got %s, %t", offset, ok)
+	}
+	if now, want := sc.Now(), clock.Now().Add(time.Hour); !now.Equal(want) {
+		t.Errorf("expected server time %s, got %s", want, now)
+	}
+
+	// Messages with server-time tags are measurements as well, unless
+	// they're in a batch.
+	sc, s = newClient()
+	s.send("@time=" + format(clock.Now().Add(10*time.Minute)) + " :alice!a@host PRIVMSG #chan :hi")
+	s.sync()
+	if offset, ok := sc.Offset(); !ok || offset != 10*time.Minute {
+		t.Errorf("expected an offset of 10 minutes, got %s, %t", offset, ok)
+	}
+	s.send(
+		":irc.test BATCH +1 chathistory #chan",
+		"@batch=1;time="+format(clock.Now().Add(-24*time.Hour))+" :alice!a@host PRIVMSG #chan :old",
+		":irc.test BATCH -1",
+	)
+	s.sync()
+	if offset, _ := sc.Offset(); offset != 10*time.Minute {
+		t.Errorf("replayed message changed the offset to %s", offset)
+	}
+}
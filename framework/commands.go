@@ -0,0 +1,243 @@
+package framework
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"honnef.co/go/irc"
+)
+
+// ErrUsage can be returned by commands to indicate that they were
+// invoked with the wrong arguments. The command's help text will be
+// sent as a reply.
+var ErrUsage = errors.New("wrong usage")
+
+// ErrDenied can be returned by commands and middleware to deny the
+// user permission to run a command, as if Permission had.
+var ErrDenied = errors.New("permission denied")
+
+// ErrIgnored can be returned by commands and middleware to ignore an
+// invocation without replying. It is audited as denied.
+var ErrIgnored = errors.New("command ignored")
+
+// CommandFunc implements a bot command. args contains the
+// whitespace-separated arguments that followed the command name.
+type CommandFunc func(c *irc.Client, m *irc.Message, args []string) error
+
+// CommandMiddleware wraps the functions of commands, for checks and
+// policies that apply to all commands.
+type CommandMiddleware func(next CommandFunc) CommandFunc
+
+// Permission decides whether the sender of a message may run a
+// command.
+type Permission func(c *irc.Client, m *irc.Message) bool
+
+// Owners returns a Permission that allows users whose hostmask
+// matches any of the given patterns, which may contain the wildcards
+// * and ?. See irc.Mask.Match.
+func Owners(patterns ...string) Permission {
+	return func(c *irc.Client, m *irc.Message) bool {
+		is := c.Support()
+		for _, pattern := range patterns {
+			if is.Match(m.Prefix, pattern) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type Command struct {
+	Name string
+	// A short description of the command, including its arguments
+	Help string
+	// Permission decides who may run the command. If nil, everyone
+	// may run it.
+	Permission Permission
+	Func       CommandFunc
+}
+
+// Commands dispatches bot commands of the form "!name args..." sent
+// via PRIVMSG. It provides a built-in help command that lists all
+// commands available to the user.
+//
+// Commands needs to be registered as a handler for PRIVMSG.
+type Commands struct {
+	// The prefix that starts a command, e.g. "!"
+	Prefix string
+	// Catalog translates replies and help texts. If nil, they are
+	// sent in English.
+	Catalog Catalog
+	// Audit, if set, is informed of every invocation of a command.
+	Audit AuditSink
+
+	mu         sync.RWMutex
+	cmds       map[string]*Command
+	middleware []CommandMiddleware
+}
+
+func NewCommands(prefix string) *Commands {
+	cs := &Commands{Prefix: prefix, cmds: make(map[string]*Command)}
+	cs.Register(&Command{
+		Name: "help",
+		Help: "help [command] - show available commands",
+		Func: cs.help,
+	})
+	return cs
+}
+
+// Register registers a command, replacing any existing command with
+// the same name.
+func (cs *Commands) Register(cmd *Command) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.cmds[cmd.Name] = cmd
+}
+
+// Use adds middleware that wraps every command. Middleware added
+// first is the outermost. Permission is checked before any
+// middleware runs.
+func (cs *Commands) Use(mw CommandMiddleware) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.middleware = append(cs.middleware, mw)
+}
+
+// Lookup returns the command with the given name.
+func (cs *Commands) Lookup(name string) (*Command, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	cmd, ok := cs.cmds[name]
+	return cmd, ok
+}
+
+func (cs *Commands) Process(c *irc.Client, m *irc.Message) {
+	if m.Command != "PRIVMSG" || len(m.Params) < 2 || m.IsCTCP() {
+		return
+	}
+	text := m.Params[len(m.Params)-1]
+	if !strings.HasPrefix(text, cs.Prefix) {
+		return
+	}
+	fields := strings.Fields(text[len(cs.Prefix):])
+	if len(fields) == 0 {
+		return
+	}
+	cmd, ok := cs.Lookup(fields[0])
+	if !ok {
+		return
+	}
+	if cmd.Permission != nil && !cmd.Permission(c, m) {
+		cs.audit(m, fields, Denied, nil)
+		c.Reply(m, cs.Textf(m, "permission denied"))
+		return
+	}
+	fn := cmd.Func
+	cs.mu.RLock()
+	for i := len(cs.middleware) - 1; i >= 0; i-- {
+		fn = cs.middleware[i](fn)
+	}
+	cs.mu.RUnlock()
+	err := fn(c, m, fields[1:])
+	switch {
+	case err == nil:
+		cs.audit(m, fields, Allowed, nil)
+	case errors.Is(err, ErrDenied), errors.Is(err, ErrIgnored):
+		cs.audit(m, fields, Denied, nil)
+	default:
+		cs.audit(m, fields, Failed, err)
+	}
+	switch {
+	case err == nil, errors.Is(err, ErrIgnored):
+	case errors.Is(err, ErrDenied):
+		c.Reply(m, cs.Textf(m, "permission denied"))
+	case errors.Is(err, ErrUsage):
+		c.Reply(m, cs.Textf(m, "usage: %s", cs.Prefix+cs.Textf(m, cmd.Help)))
+	default:
+		c.Reply(m, cs.Textf(m, "error: %s", err))
+	}
+}
+
+// rest returns the text following the command name in m, with its
+// spacing intact.
+func (cs *Commands) rest(m *irc.Message) string {
+	text := strings.TrimPrefix(m.Params[len(m.Params)-1], cs.Prefix)
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	idx := strings.IndexFunc(text, unicode.IsSpace)
+	if idx == -1 {
+		return ""
+	}
+	return strings.TrimLeftFunc(text[idx:], unicode.IsSpace)
+}
+
+func (cs *Commands) audit(m *irc.Message, fields []string, outcome Outcome, err error) {
+	if cs.Audit == nil {
+		return
+	}
+	cs.Audit.Audit(AuditEntry{
+		Time:    m.Time,
+		User:    m.Prefix,
+		Account: m.Tags["account"],
+		Target:  m.Params[0],
+		Command: fields[0],
+		Args:    fields[1:],
+		Outcome: outcome,
+		Err:     err,
+	})
+}
+
+// Textf formats a reply to m, translating format with the Catalog.
+func (cs *Commands) Textf(m *irc.Message, format string, args ...interface{}) string {
+	if cs.Catalog != nil {
+		if tr, ok := cs.Catalog.Translate(m, format); ok {
+			format = tr
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func (cs *Commands) help(c *irc.Client, m *irc.Message, args []string) error {
+	if len(args) > 0 {
+		cmd, ok := cs.Lookup(args[0])
+		if !ok {
+			return errors.New(cs.Textf(m, "no such command: %s", args[0]))
+		}
+		return c.Reply(m, cs.Prefix+cs.Textf(m, cmd.Help))
+	}
+	cs.mu.RLock()
+	var names []string
+	for name, cmd := range cs.cmds {
+		if cmd.Permission == nil || cmd.Permission(c, m) {
+			names = append(names, cs.Prefix+name)
+		}
+	}
+	cs.mu.RUnlock()
+	sort.Strings(names)
+	return c.Reply(m, cs.Textf(m, "available commands: %s", strings.Join(names, " ")))
+}
+
+// Catalog translates the text that Commands generates: help texts,
+// error replies and the replies of the commands registered by
+// Inspection. Texts are identified by their English format strings.
+type Catalog interface {
+	// Translate returns the translation of the format string id,
+	// in the language appropriate for replying to m. ok is false if
+	// there is no translation.
+	Translate(m *irc.Message, id string) (format string, ok bool)
+}
+
+// MapCatalog is a Catalog for a single language, mapping English
+// format strings to their translations.
+type MapCatalog map[string]string
+
+func (mc MapCatalog) Translate(m *irc.Message, id string) (string, bool) {
+	s, ok := mc[id]
+	return s, ok
+}
@@ -0,0 +1,70 @@
+package framework
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+// channelCatalog translates replies to messages sent to #de into
+// German.
+type channelCatalog MapCatalog
+
+func (cc channelCatalog) Translate(m *irc.Message, id string) (string, bool) {
+	if len(m.Params) == 0 || m.Params[0] != "#de" {
+		return "", false
+	}
+	return MapCatalog(cc).Translate(m, id)
+}
+
+func TestCatalog(t *testing.T) {
+	cs := NewCommands("!")
+	cs.Catalog = channelCatalog{
+		"available commands: %s":                   "verfügbare Befehle: %s",
+		"no such command: %s":                      "unbekannter Befehl: %s",
+		"error: %s":                                "Fehler: %s",
+		"permission denied":                        "Zugriff verweigert",
+		"usage: %s":                                "Aufruf: %s",
+		"echo <text> - repeat text":                "echo <Text> - Text wiederholen",
+		"help [command] - show available commands": "help [Befehl] - verfügbare Befehle anzeigen",
+	}
+	cs.Register(&Command{
+		Name: "echo",
+		Help: "echo <text> - repeat text",
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			if len(args) == 0 {
+				return ErrUsage
+			}
+			return c.Reply(m, cs.rest(m))
+		},
+	})
+	cs.Register(&Command{
+		Name:       "secret",
+		Help:       "secret",
+		Permission: func(c *irc.Client, m *irc.Message) bool { return false },
+		Func:       func(c *irc.Client, m *irc.Message, args []string) error { return nil },
+	})
+	mux := irc.NewOrderedMux()
+	mux.Handle("PRIVMSG", cs)
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	for _, test := range []struct {
+		text string
+		de   string
+		en   string
+	}{
+		{"!help", "verfügbare Befehle: !echo !help", "available commands: !echo !help"},
+		{"!help echo", "!echo <Text> - Text wiederholen", "!echo <text> - repeat text"},
+		{"!help nope", "Fehler: unbekannter Befehl: nope", "error: no such command: nope"},
+		{"!echo", "Aufruf: !echo <Text> - Text wiederholen", "usage: !echo <text> - repeat text"},
+		{"!secret", "Zugriff verweigert", "permission denied"},
+		// Text that isn't the framework's is left alone.
+		{"!echo hallo  welt", "hallo  welt", "hallo  welt"},
+	} {
+		s.send(":alice!a@host PRIVMSG #de :" + test.text)
+		s.expectSent("PRIVMSG #de :" + test.de)
+		s.send(":alice!a@host PRIVMSG #en :" + test.text)
+		s.expectSent("PRIVMSG #en :" + test.en)
+	}
+}
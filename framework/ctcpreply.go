@@ -0,0 +1,176 @@
+package framework
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// CTCPResponder answers the common CTCP queries VERSION, CLIENTINFO,
+// PING, TIME, SOURCE and USERINFO. Replies can be overridden or
+// disabled per command, and queries are rate limited, so that a CTCP
+// flood can't make the bot flood itself off the network.
+//
+// CTCPResponder needs to be registered as a catch-all handler.
+type CTCPResponder struct {
+	*irc.Mux
+	// The maximum number of queries answered per sender during
+	// Window. Senders are identified by their host. Defaults to 3.
+	PerSender int
+	// The maximum number of queries answered in total during Window.
+	// Defaults to 10.
+	Total int
+	// Defaults to 10 seconds.
+	Window time.Duration
+	// Clock is used for the rate limits. Defaults to irc.RealClock.
+	Clock irc.Clock
+
+	mu       sync.Mutex
+	disabled bool
+	replies  map[string]irc.Handler
+	windows  map[string]*ctcpWindow
+	total    ctcpWindow
+}
+
+type ctcpWindow struct {
+	start time.Time
+	n     int
+}
+
+// full reports whether the limit has been reached, starting a new
+// window if the current one has expired.
+func (w *ctcpWindow) full(now time.Time, window time.Duration, limit int) bool {
+	if now.Sub(w.start) >= window {
+		w.start = now
+		w.n = 0
+	}
+	return w.n >= limit
+}
+
+// NewCTCPResponder returns a CTCPResponder that replies to VERSION,
+// SOURCE and USERINFO with the given strings. Empty strings disable
+// the respective commands.
+func NewCTCPResponder(version, source, userinfo string) *CTCPResponder {
+	r := &CTCPResponder{
+		Mux: irc.NewOrderedMux(),
+		replies: map[string]irc.Handler{
+			"PING": irc.HandlerFunc(CTCPPing),
+			"TIME": irc.HandlerFunc(CTCPTime),
+		},
+		windows: make(map[string]*ctcpWindow),
+	}
+	for command, reply := range map[string]string{"VERSION": version, "SOURCE": source, "USERINFO": userinfo} {
+		if reply != "" {
+			r.replies[command] = StaticCTCPReply(reply)
+		}
+	}
+	r.replies["CLIENTINFO"] = irc.HandlerFunc(r.clientInfo)
+	r.HandleFunc("ctcp:*", r.query)
+	return r
+}
+
+func (r *CTCPResponder) perSender() int {
+	if r.PerSender == 0 {
+		return 3
+	}
+	return r.PerSender
+}
+
+func (r *CTCPResponder) totalLimit() int {
+	if r.Total == 0 {
+		return 10
+	}
+	return r.Total
+}
+
+func (r *CTCPResponder) window() time.Duration {
+	if r.Window == 0 {
+		return 10 * time.Second
+	}
+	return r.Window
+}
+
+// Set overrides the reply to command. A nil handler disables the
+// command.
+func (r *CTCPResponder) Set(command string, h irc.Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	command = strings.ToUpper(command)
+	if h == nil {
+		delete(r.replies, command)
+		return
+	}
+	r.replies[command] = h
+}
+
+// SetEnabled enables or disables all replies.
+func (r *CTCPResponder) SetEnabled(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = !enabled
+}
+
+// Commands returns the sorted list of commands that are answered.
+func (r *CTCPResponder) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for command := range r.replies {
+		out = append(out, command)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (r *CTCPResponder) clientInfo(c *irc.Client, m *irc.Message) {
+	c.ReplyCTCP(m, strings.Join(r.Commands(), " "))
+}
+
+func (r *CTCPResponder) query(c *irc.Client, m *irc.Message) {
+	if m.Command != "PRIVMSG" {
+		// Don't answer CTCP replies
+		return
+	}
+	ctcp, err := m.CTCP()
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	h, ok := r.replies[strings.ToUpper(ctcp.Command)]
+	if r.disabled || !ok || !r.allow(m.Prefix.Host) {
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+	// Queries are counted in order, but replied to off the read loop,
+	// where a flood would block behind the rate limit.
+	go h.Process(c, m)
+}
+
+// allow applies the rate limits to a query from host. r.mu must be
+// held.
+func (r *CTCPResponder) allow(host string) bool {
+	now := irc.OrRealClock(r.Clock).Now()
+	window := r.window()
+	for key, w := range r.windows {
+		if now.Sub(w.start) >= window {
+			delete(r.windows, key)
+		}
+	}
+	w, ok := r.windows[host]
+	if !ok {
+		w = &ctcpWindow{start: now}
+		r.windows[host] = w
+	}
+	// Check both limits before counting, so that queries dropped by
+	// the total limit don't use up the sender's.
+	if w.full(now, window, r.perSender()) || r.total.full(now, window, r.totalLimit()) {
+		return false
+	}
+	w.n++
+	r.total.n++
+	return true
+}
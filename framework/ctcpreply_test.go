@@ -0,0 +1,89 @@
+package framework
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestCTCPResponder(t *testing.T) {
+	clock := irctest.NewClock(time.Time{})
+	newClient := func() (*CTCPResponder, *testServer) {
+		r := NewCTCPResponder("bot 1.0", "https://example.com/bot", "")
+		r.PerSender = 2
+		r.Total = 3
+		r.Clock = clock
+		s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: r})
+		s.welcome()
+		return r, s
+	}
+	query := func(s *testServer, nick, text string) {
+		s.t.Helper()
+		s.send(fmt.Sprintf(":%s!%s@%s.test PRIVMSG bot :\x01%s\x01", nick, nick, nick, text))
+	}
+	reply := func(s *testServer, nick, text string) {
+		s.t.Helper()
+		s.expectSent(fmt.Sprintf("NOTICE %s :\x01%s\x01", nick, text))
+	}
+
+	// A flood from one host is answered up to PerSender times per
+	// window.
+	r, s := newClient()
+	for i := 0; i < 2; i++ {
+		query(s, "eve", "VERSION")
+		reply(s, "eve", "VERSION bot 1.0")
+	}
+	query(s, "eve", "VERSION")
+	query(s, "eve", "PING 1")
+	s.expectQuiet()
+	clock.Advance(r.window())
+	query(s, "eve", "PING 2")
+	reply(s, "eve", "PING 2")
+
+	// A flood from many hosts is answered up to Total times per
+	// window. Queries dropped by the total limit don't count towards
+	// their sender's.
+	_, s = newClient()
+	clock.Advance(time.Second)
+	for _, nick := range []string{"a", "b", "c"} {
+		query(s, nick, "PING "+nick)
+		reply(s, nick, "PING "+nick)
+	}
+	clock.Advance(5 * time.Second)
+	query(s, "d", "PING d")
+	query(s, "d", "PING d")
+	s.expectQuiet()
+	clock.Advance(5 * time.Second)
+	for i := 0; i < 2; i++ {
+		query(s, "d", "PING d")
+		reply(s, "d", "PING d")
+	}
+
+	// Replies can be overridden and disabled, regardless of case.
+	r, s = newClient()
+	clock.Advance(time.Minute)
+	r.Set("version", StaticCTCPReply("custom"))
+	r.Set("Source", nil)
+	query(s, "alice", "version")
+	reply(s, "alice", "version custom")
+	query(s, "alice", "SOURCE")
+	query(s, "alice", "USERINFO")
+	s.expectQuiet()
+
+	// CLIENTINFO lists the answered commands.
+	query(s, "alice", "CLIENTINFO")
+	reply(s, "alice", "CLIENTINFO CLIENTINFO PING TIME VERSION")
+
+	// Disabling the responder stops all replies.
+	r, s = newClient()
+	clock.Advance(time.Minute)
+	r.SetEnabled(false)
+	query(s, "alice", "VERSION")
+	s.expectQuiet()
+	r.SetEnabled(true)
+	query(s, "alice", "VERSION")
+	reply(s, "alice", "VERSION bot 1.0")
+}
@@ -0,0 +1,191 @@
+package framework
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// A LogLine is a line recorded by LogRing. Kind is one of in, out,
+// info, debug and panic.
+type LogLine struct {
+	Time time.Time
+	Kind string
+	Text string
+}
+
+// LogRing is an irc.Logger that keeps the most recent lines in
+// memory, for showing them on a debug endpoint. Combine it with other
+// loggers using irc.MultiLogger.
+//
+// Credentials are redacted: the parameters of PASS, AUTHENTICATE and
+// OPER, and everything after the command of messages to services,
+// such as IDENTIFY to NickServ.
+type LogRing struct {
+	// Clock timestamps the lines. Defaults to irc.RealClock.
+	Clock irc.Clock
+
+	mu    sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+// NewLogRing returns a LogRing that keeps the last size lines.
+func NewLogRing(size int) *LogRing {
+	if size <= 0 {
+		size = 1
+	}
+	return &LogRing{lines: make([]LogLine, size)}
+}
+
+func (r *LogRing) add(kind, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = LogLine{Time: irc.OrRealClock(r.Clock).Now(), Kind: kind, Text: text}
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Lines returns the recorded lines, oldest first.
+func (r *LogRing) Lines() []LogLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]LogLine(nil), r.lines[:r.next]...)
+	}
+	out := append([]LogLine(nil), r.lines[r.next:]...)
+	return append(out, r.lines[:r.next]...)
+}
+
+func (r *LogRing) Incoming(m *irc.Message) { r.add("in", redact(m)) }
+func (r *LogRing) Outgoing(m *irc.Message) { r.add("out", redact(m)) }
+func (r *LogRing) Info(args ...interface{}) {
+	r.add("info", strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+func (r *LogRing) Debug(args ...interface{}) {
+	r.add("debug", strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+func (r *LogRing) Panic(arg interface{}) { r.add("panic", fmt.Sprint(arg)) }
+
+var _ irc.Logger = (*LogRing)(nil)
+
+// servicesCommands are the commands to services that carry
+// passwords.
+var servicesCommands = map[string]bool{
+	"IDENTIFY":      true,
+	"LOGIN":         true,
+	"AUTH":          true,
+	"CHALLENGEAUTH": true,
+	"REGISTER":      true,
+	"GHOST":         true,
+	"RECOVER":       true,
+	"REGAIN":        true,
+}
+
+// redact returns m's line with credentials replaced.
+func redact(m *irc.Message) string {
+	const redacted = "[redacted]"
+	switch strings.ToUpper(m.Command) {
+	case "PASS", "AUTHENTICATE", "OPER":
+		if len(m.Params) == 0 {
+			return m.Raw
+		}
+		return m.Command + " " + redacted
+	case "NS", "NICKSERV", "CS", "CHANSERV":
+		fields := strings.Fields(strings.Join(m.Params, " "))
+		if len(fields) < 2 {
+			return m.Raw
+		}
+		return m.Command + " " + fields[0] + " " + redacted
+	case "PRIVMSG", "NOTICE":
+		// Services aren't reached through channels.
+		if len(m.Params) < 2 || strings.HasPrefix(m.Params[0], "#") || strings.HasPrefix(m.Params[0], "&") {
+			return m.Raw
+		}
+		fields := strings.Fields(m.Params[1])
+		if len(fields) < 2 || !servicesCommands[strings.ToUpper(fields[0])] {
+			return m.Raw
+		}
+		return m.Command + " " + m.Params[0] + " :" + fields[0] + " " + redacted
+	}
+	return m.Raw
+}
+
+// DebugStatus is the state of a client as reported by Debug.
+type DebugStatus struct {
+	Connected bool
+	TLS       bool
+	Nick      string
+	Network   string
+	Lag       string
+	// QueueLen is the number of messages waiting to be sent.
+	QueueLen int
+	Caps     []string
+	// Channels is only set if Debug.State is set.
+	Channels []string
+}
+
+// Debug exposes a client's state as JSON over HTTP, for adding a
+// debug endpoint to a bot process.
+type Debug struct {
+	Client *irc.Client
+	// State, if set, provides the joined channels.
+	State *State
+	// Log, if set, provides the recent log.
+	Log *LogRing
+}
+
+// Status returns the current state of the client.
+func (d *Debug) Status() DebugStatus {
+	c := d.Client
+	st := DebugStatus{
+		Connected: c.Connected(),
+		Nick:      c.CurrentNick(),
+		Lag:       c.Lag().String(),
+		QueueLen:  c.QueueLen(),
+	}
+	// The connection, ISUPPORT and capabilities are only set up
+	// once the client has connected.
+	if st.Connected {
+		st.TLS = c.TLS()
+		st.Network = c.Support().Network
+		st.Caps = c.Caps.Enabled()
+	}
+	if d.State != nil {
+		st.Channels = d.State.Channels()
+	}
+	return st
+}
+
+// Mount registers handlers on mux: prefix serves the client's status
+// and prefix/log the recent log, if Log is set. prefix must not end
+// in a slash.
+//
+//	d.Mount(http.DefaultServeMux, "/debug/irc")
+func (d *Debug) Mount(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Status())
+	})
+	mux.HandleFunc(prefix+"/log", func(w http.ResponseWriter, r *http.Request) {
+		if d.Log == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, d.Log.Lines())
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,50 @@
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestLogRing(t *testing.T) {
+	table := []struct {
+		line string
+		want string
+	}{
+		{"PASS hunter2", "PASS [redacted]"},
+		{"AUTHENTICATE Ym90AGJvdABodW50ZXIy", "AUTHENTICATE [redacted]"},
+		{"OPER bot hunter2", "OPER [redacted]"},
+		{"PRIVMSG NickServ :IDENTIFY bot hunter2", "PRIVMSG NickServ :IDENTIFY [redacted]"},
+		{"PRIVMSG X@channels.undernet.org :LOGIN bot hunter2", "PRIVMSG X@channels.undernet.org :LOGIN [redacted]"},
+		{"NS IDENTIFY hunter2", "NS IDENTIFY [redacted]"},
+		{"AUTHENTICATE +", "AUTHENTICATE [redacted]"},
+		{"PRIVMSG #chan :identify yourself", "PRIVMSG #chan :identify yourself"},
+		{"PRIVMSG #chan :hello there", "PRIVMSG #chan :hello there"},
+		{":alice!a@host PRIVMSG bot :hi", ":alice!a@host PRIVMSG bot :hi"},
+		{"JOIN #chan", "JOIN #chan"},
+	}
+	clock := irctest.NewClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	r := NewLogRing(len(table))
+	r.Clock = clock
+	for _, test := range table {
+		r.Outgoing(irc.Parse(test.line))
+	}
+	lines := r.Lines()
+	for i, test := range table {
+		if got := lines[i].Text; got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.line, test.want, got)
+		}
+		if !lines[i].Time.Equal(clock.Now()) {
+			t.Errorf("%q: expected time %s, got %s", test.line, clock.Now(), lines[i].Time)
+		}
+	}
+
+	// Only the most recent lines are kept.
+	r.Incoming(irc.Parse("PING :x"))
+	lines = r.Lines()
+	if len(lines) != len(table) || lines[0].Text != table[1].want || lines[len(lines)-1].Text != "PING :x" {
+		t.Errorf("unexpected lines after wrapping around: %v", lines)
+	}
+}
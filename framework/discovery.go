@@ -0,0 +1,222 @@
+package framework
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// A DiscoveryRule selects channels for Discovery to join.
+type DiscoveryRule struct {
+	// Name, if set, has to match the channel name.
+	Name *regexp.Regexp
+	// The minimum number of users the channel has to have.
+	MinUsers int
+}
+
+func (r DiscoveryRule) matches(e irc.ListEntry) bool {
+	if e.Users < r.MinUsers {
+		return false
+	}
+	return r.Name == nil || r.Name.MatchString(e.Channel)
+}
+
+// Discovery periodically lists the channels of the network and joins
+// those matching any of its rules, for bots such as archivers or
+// search indexers that want to be in every channel of interest.
+//
+// If the server supports ELIST with the U filter, only channels with
+// enough users are requested.
+//
+// Channels the bot leaves or gets kicked from aren't rejoined during
+// the same connection.
+//
+// Discovery needs to be registered as a catch-all handler, with
+// HandleSync so that channels left are known before the next scan.
+type Discovery struct {
+	*irc.Mux
+	Rules []DiscoveryRule
+	// How often to list channels. Defaults to one hour.
+	Interval time.Duration
+	// Part causes channels that were joined by Discovery, but no
+	// longer match any rule, to be left.
+	Part bool
+	// How long to wait between JOIN messages. Defaults to one second.
+	JoinInterval time.Duration
+	// OnError, if set, is called with errors encountered while
+	// scanning.
+	OnError func(err error)
+
+	mu sync.Mutex
+	// channels we joined, by casefolded name
+	joined map[string]string
+	// channels we left or were kicked from
+	avoid map[string]bool
+	// channels we're leaving because they no longer match
+	parting map[string]bool
+	// the connection we're scanning for
+	scanningFor <-chan struct{}
+}
+
+func NewDiscovery(rules ...DiscoveryRule) *Discovery {
+	d := &Discovery{
+		Mux:     irc.NewOrderedMux(),
+		Rules:   rules,
+		joined:  make(map[string]string),
+		avoid:   make(map[string]bool),
+		parting: make(map[string]bool),
+	}
+	d.HandleFunc("irc:connected", d.connected)
+	d.HandleFunc(irc.RPL_ENDOFMOTD, d.registered)
+	d.HandleFunc(irc.ERR_NOMOTD, d.registered)
+	d.HandleFunc("self:PART", d.left)
+	d.HandleFunc("irc:kicked", d.left)
+	return d
+}
+
+func (d *Discovery) interval() time.Duration {
+	if d.Interval == 0 {
+		return time.Hour
+	}
+	return d.Interval
+}
+
+func (d *Discovery) joinInterval() time.Duration {
+	if d.JoinInterval == 0 {
+		return time.Second
+	}
+	return d.JoinInterval
+}
+
+// Joined returns the channels joined by Discovery.
+func (d *Discovery) Joined() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []string
+	for _, name := range d.joined {
+		out = append(out, name)
+	}
+	return out
+}
+
+// Scan lists channels once and joins, and if Part is set leaves,
+// channels according to the rules.
+func (d *Discovery) Scan(ctx context.Context, c *irc.Client) error {
+	is := c.Support()
+	var params []string
+	if min := d.minUsers(); min > 0 && strings.ContainsRune(string(is.ELIST), 'U') {
+		params = append(params, ">"+strconv.Itoa(min-1))
+	}
+	entries, err := c.ListChannels(ctx, params...)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]string)
+	for _, e := range entries {
+		for _, r := range d.Rules {
+			if r.matches(e) {
+				wanted[is.Casefold(e.Channel)] = e.Channel
+				break
+			}
+		}
+	}
+
+	join := make(map[string]string)
+	var part []string
+	d.mu.Lock()
+	for key, name := range wanted {
+		if _, ok := d.joined[key]; !ok && !d.avoid[key] {
+			join[name] = ""
+			d.joined[key] = name
+		}
+	}
+	if d.Part {
+		for key, name := range d.joined {
+			if _, ok := wanted[key]; !ok {
+				part = append(part, name)
+				delete(d.joined, key)
+				d.parting[key] = true
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for _, msg := range irc.PackList("PART", part, is.TargMax["PART"], 510) {
+		if err := c.Send(msg); err != nil {
+			return err
+		}
+	}
+	return JoinPaced(c, join, d.joinInterval())
+}
+
+// minUsers returns the smallest MinUsers of all rules, which is the
+// most we can filter by on the server.
+func (d *Discovery) minUsers() int {
+	if len(d.Rules) == 0 {
+		return 0
+	}
+	min := d.Rules[0].MinUsers
+	for _, r := range d.Rules[1:] {
+		if r.MinUsers < min {
+			min = r.MinUsers
+		}
+	}
+	return min
+}
+
+func (d *Discovery) connected(c *irc.Client, m *irc.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.joined = make(map[string]string)
+	d.avoid = make(map[string]bool)
+	d.parting = make(map[string]bool)
+}
+
+func (d *Discovery) registered(c *irc.Client, m *irc.Message) {
+	done := c.Done()
+	d.mu.Lock()
+	if d.scanningFor == done {
+		d.mu.Unlock()
+		return
+	}
+	d.scanningFor = done
+	d.mu.Unlock()
+	go d.loop(c, done)
+}
+
+func (d *Discovery) loop(c *irc.Client, done <-chan struct{}) {
+	ctx := c.Context()
+	t := irc.OrRealClock(c.Clock).NewTicker(d.interval())
+	defer t.Stop()
+	for {
+		if err := d.Scan(ctx, c); err != nil && d.OnError != nil {
+			d.OnError(err)
+		}
+		select {
+		case <-t.C():
+		case <-done:
+			return
+		}
+	}
+}
+
+func (d *Discovery) left(c *irc.Client, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+	key := c.Support().Casefold(m.Params[0])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.parting[key] {
+		delete(d.parting, key)
+		return
+	}
+	delete(d.joined, key)
+	d.avoid[key] = true
+}
@@ -0,0 +1,61 @@
+package framework
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestDiscovery(t *testing.T) {
+	d := NewDiscovery(DiscoveryRule{Name: regexp.MustCompile(`^#go`), MinUsers: 10})
+	d.Part = true
+	mux := irc.NewOrderedMux()
+	mux.HandleSync("", d)
+	clock := irctest.NewClock(time.Time{})
+	s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+
+	// Servers that support filtering by user count only send
+	// channels that are big enough.
+	s.send(welcomeLines[:5]...)
+	s.send(":irc.test 005 bot ELIST=U :are supported by this server")
+	s.send(welcomeLines[5:]...)
+	s.expect("LIST >9")
+	s.send(
+		":irc.test 321 bot Channel :Users  Name",
+		":irc.test 322 bot #go-nuts 50 :Go",
+		":irc.test 322 bot #golang 20 :Go",
+		":irc.test 322 bot #go 5 :Go",
+		":irc.test 322 bot #rust 100 :Rust",
+		":irc.test 323 bot :End of /LIST",
+	)
+	s.expect("JOIN #go-nuts,#golang")
+
+	// Channels the bot gets kicked from aren't rejoined, and channels
+	// that no longer match are left.
+	s.send(
+		":bot!bot@host JOIN #go-nuts",
+		":bot!bot@host JOIN #golang",
+		":op!o@host KICK #go-nuts bot :bye",
+	)
+	s.sync()
+	clock.Advance(time.Hour)
+	s.expect("LIST >9")
+	s.send(
+		":irc.test 321 bot Channel :Users  Name",
+		":irc.test 322 bot #go-nuts 50 :Go",
+		":irc.test 322 bot #gopher 30 :Go",
+		":irc.test 323 bot :End of /LIST",
+	)
+	s.expect("PART #golang")
+	s.expect("JOIN #gopher")
+	s.send(":bot!bot@host PART #golang")
+	s.sync()
+
+	if joined, expected := d.Joined(), []string{"#gopher"}; !reflect.DeepEqual(joined, expected) {
+		t.Errorf("expected joined channels %q, got %q", expected, joined)
+	}
+}
@@ -1,32 +1,55 @@
 package framework // import "honnef.co/go/irc/framework"
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-
+	"syscall"
 	"time"
+
 	"honnef.co/go/irc"
 )
 
+// Membership is a user's membership in a channel.
+type Membership struct {
+	Channel string
+	// The highest ranked prefix mode the user has in the channel,
+	// e.g. 'o' for operators. Zero if the user has none.
+	Mode rune
+}
+
 type User struct {
 	Nick       string
 	Name       string
 	User       string
 	Host       string
-	Channels   []string
+	Channels   []Membership
 	Idle       int
 	Oper       bool
 	SignedOnAt time.Time
 	Account    string
+	Away       bool
+	// The away message, if the user is away
+	AwayMessage string
 }
 
 func Whois(c *irc.Client, co *Coalesce, nick string) User {
+	u, _ := WhoisContext(context.Background(), c, co, nick)
+	return u
+}
+
+// WhoisContext is like Whois, but gives up when ctx is done, in which
+// case it returns the information received so far and ctx's error.
+func WhoisContext(ctx context.Context, c *irc.Client, co *Coalesce, nick string) (User, error) {
 	// TODO handle 263 (rate limit), 401 (NOSUCHNICK), 402 (NOSUCHSERVER)
 	ch := make(chan []*irc.Message, 1)
 	new := co.Subscribe(
@@ -37,6 +60,7 @@ func Whois(c *irc.Client, co *Coalesce, nick string) User {
 			irc.RPL_ENDOFWHOIS,
 			irc.RPL_WHOISCHANNELS,
 			irc.RPL_WHOISACCOUNT,
+			irc.RPL_AWAY,
 			irc.ERR_NOSUCHNICK,
 			irc.ERR_NOSUCHSERVER,
 		},
@@ -49,7 +73,7 @@ func Whois(c *irc.Client, co *Coalesce, nick string) User {
 		c.Send(fmt.Sprintf("WHOIS %s %s", nick, nick))
 	}
 	u := User{}
-	msgs := <-ch
+	msgs, err := co.Wait(ctx, ch)
 	for _, msg := range msgs {
 		switch msg.Command {
 		case irc.RPL_WHOISUSER:
@@ -65,17 +89,24 @@ func Whois(c *irc.Client, co *Coalesce, nick string) User {
 			i, _ = strconv.Atoi(msg.Params[3])
 			u.SignedOnAt = time.Unix(int64(i), 0)
 		case irc.RPL_WHOISCHANNELS:
-			u.Channels = strings.Fields(msg.Params[2])
+			is := c.Support()
+			for _, ch := range strings.Fields(msg.Params[2]) {
+				name, mode := is.SplitPrefix(ch)
+				u.Channels = append(u.Channels, Membership{Channel: name, Mode: mode})
+			}
 		case irc.RPL_WHOISACCOUNT:
 			u.Account = msg.Params[2]
+		case irc.RPL_AWAY:
+			u.Away = true
+			u.AwayMessage = msg.Params[len(msg.Params)-1]
 		}
 	}
-	return u
+	return u, err
 }
 
 type RegexpMuxer struct {
 	mu   sync.RWMutex
-	m    map[string][]pattern
+	m    map[string][]*pattern
 	vars vars
 }
 
@@ -89,15 +120,25 @@ type pattern struct {
 	h  irc.Handler
 }
 
+// Process dispatches m to the matching handlers, each in its own
+// goroutine. Like irc.Mux, it recovers panics in handlers with
+// c.RecoverHandler, unless c is nil.
 func (mux *RegexpMuxer) Process(c *irc.Client, m *irc.Message) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
-	candidates := mux.m[m.Signal]
+	var candidates []*pattern
+	candidates = append(candidates, mux.m[m.Signal]...)
 	candidates = append(candidates, mux.m[""]...)
 	for _, p := range candidates {
 		p := p
 		if p.rx == nil {
-			go p.h.Process(c, m.Copy())
+			m := m.Copy()
+			go func() {
+				if c != nil {
+					defer c.RecoverHandler(m)
+				}
+				p.h.Process(c, m)
+			}()
 			continue
 		}
 		if len(m.Params) == 0 {
@@ -112,15 +153,20 @@ func (mux *RegexpMuxer) Process(c *irc.Client, m *irc.Message) {
 		mux.vars.m[m] = match
 		mux.vars.Unlock()
 		go func() {
+			if c != nil {
+				defer c.RecoverHandler(m)
+			}
+			defer func() {
+				mux.vars.Lock()
+				delete(mux.vars.m, m)
+				mux.vars.Unlock()
+			}()
 			p.h.Process(c, m)
-			mux.vars.Lock()
-			delete(mux.vars.m, m)
-			mux.vars.Unlock()
 		}()
 	}
 }
 
-func (mux *RegexpMuxer) Handle(pat string, handler irc.Handler) {
+func (mux *RegexpMuxer) Handle(pat string, handler irc.Handler) *irc.Registration {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 	parts := strings.SplitN(pat, "/", 2)
@@ -129,20 +175,40 @@ func (mux *RegexpMuxer) Handle(pat string, handler irc.Handler) {
 	if len(parts) == 2 {
 		rx = regexp.MustCompile(parts[1])
 	}
-	mux.m[signal] = append(mux.m[signal], pattern{rx, handler})
+	p := &pattern{rx, handler}
+	mux.m[signal] = append(mux.m[signal], p)
+	return irc.NewRegistration(func() { mux.remove(signal, p) })
+}
+
+func (mux *RegexpMuxer) HandleFunc(pattern string, handler func(*irc.Client, *irc.Message)) *irc.Registration {
+	return mux.Handle(pattern, irc.HandlerFunc(handler))
 }
 
-func (mux *RegexpMuxer) HandleFunc(pattern string, handler func(*irc.Client, *irc.Message)) {
-	mux.Handle(pattern, irc.HandlerFunc(handler))
+func (mux *RegexpMuxer) remove(signal string, p *pattern) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	var ps []*pattern
+	for _, other := range mux.m[signal] {
+		if other != p {
+			ps = append(ps, other)
+		}
+	}
+	if len(ps) == 0 {
+		delete(mux.m, signal)
+		return
+	}
+	mux.m[signal] = ps
 }
 
 func (mux *RegexpMuxer) Handlers(m *irc.Message) []irc.Handler {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
 	var hs []irc.Handler
-	candidates := mux.m[m.Signal]
+	var candidates []*pattern
+	candidates = append(candidates, mux.m[m.Signal]...)
 	candidates = append(candidates, mux.m[""]...)
 	for _, p := range candidates {
+		p := p
 		if p.rx == nil {
 			hs = append(hs, p.h)
 			continue
@@ -158,6 +224,42 @@ func (mux *RegexpMuxer) Handlers(m *irc.Message) []irc.Handler {
 	return hs
 }
 
+// Signals returns the registered patterns mapped to the number of
+// handlers.
+func (mux *RegexpMuxer) Signals() map[string]int {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	out := make(map[string]int)
+	for signal, ps := range mux.m {
+		for _, p := range ps {
+			out[p.describe(signal)]++
+		}
+	}
+	return out
+}
+
+// Describe returns the names of the handlers registered for each
+// pattern. See irc.HandlerName for how handlers are named.
+func (mux *RegexpMuxer) Describe() map[string][]string {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	out := make(map[string][]string)
+	for signal, ps := range mux.m {
+		for _, p := range ps {
+			pat := p.describe(signal)
+			out[pat] = append(out[pat], irc.HandlerName(p.h))
+		}
+	}
+	return out
+}
+
+func (p *pattern) describe(signal string) string {
+	if p.rx == nil {
+		return signal
+	}
+	return signal + "/" + p.rx.String()
+}
+
 func (mux *RegexpMuxer) Vars(m *irc.Message) []string {
 	mux.vars.RLock()
 	defer mux.vars.RUnlock()
@@ -166,7 +268,7 @@ func (mux *RegexpMuxer) Vars(m *irc.Message) []string {
 
 func NewRegexpMuxer() *RegexpMuxer {
 	return &RegexpMuxer{
-		m:    make(map[string][]pattern),
+		m:    make(map[string][]*pattern),
 		vars: vars{m: make(map[*irc.Message][]string)},
 	}
 }
@@ -186,6 +288,26 @@ func SimpleNickChanger(suffix string) func(oldNick string) (newNick string) {
 	}
 }
 
+// JoinPaced joins channels, a map of channel names to keys, by
+// batching them into as few JOIN messages as possible and sending one
+// message every interval. This avoids getting disconnected for
+// flooding when joining a large number of channels at once.
+func JoinPaced(c *irc.Client, channels map[string]string, interval time.Duration) error {
+	for i, msg := range irc.JoinMessages(channels, 510) {
+		if i > 0 {
+			select {
+			case <-irc.OrRealClock(c.Clock).After(interval):
+			case <-c.Done():
+				return irc.ErrDeadClient
+			}
+		}
+		if err := c.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type NickRegainer struct {
 	*irc.Mux
 	mu       sync.Mutex
@@ -213,6 +335,10 @@ func NewNickRegainer(client *irc.Client, wanted string, interval time.Duration)
 func (nr *NickRegainer) Start() {
 	nr.mu.Lock()
 	defer nr.mu.Unlock()
+	nr.start()
+}
+
+func (nr *NickRegainer) start() {
 	if nr.on {
 		return
 	}
@@ -225,6 +351,10 @@ func (nr *NickRegainer) Start() {
 func (nr *NickRegainer) Stop() {
 	nr.mu.Lock()
 	defer nr.mu.Unlock()
+	nr.stop()
+}
+
+func (nr *NickRegainer) stop() {
 	if !nr.on {
 		return
 	}
@@ -241,21 +371,22 @@ func (nr *NickRegainer) SetWanted(wanted string) {
 
 func (nr *NickRegainer) SetInterval(d time.Duration) {
 	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	// Restart with the lock held, so that concurrent calls to Start,
+	// Stop or SetInterval can't interleave with the restart.
 	wasOn := nr.on
-	if nr.on {
-		nr.Stop()
-	}
+	nr.stop()
 	nr.interval = d
 	if wasOn {
-		nr.Start()
+		nr.start()
 	}
 }
 
 func (nr *NickRegainer) monitor() {
-	ticker := time.NewTicker(nr.interval)
+	ticker := irc.OrRealClock(nr.client.Clock).NewTicker(nr.interval)
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			if !nr.client.Connected() {
 				continue
 			}
@@ -306,10 +437,14 @@ func NewCoalesce() *Coalesce {
 	return &Coalesce{m: make(map[Input]*Interested)}
 }
 
+// Subscribe subscribes ch to the replies with the given commands and
+// parameter, until one of ends is received. If new is true, there was
+// no identical subscription yet and the caller has to send the
+// request. ch should be buffered; use Wait to wait on it with a
+// timeout.
 func (co *Coalesce) Subscribe(commands []string, ends []string,
 	param string, ch chan []*irc.Message) (new bool) {
 
-	// FIXME handle timeouts of sent requests
 	co.mu.Lock()
 	defer co.mu.Unlock()
 	var interested *Interested
@@ -340,6 +475,44 @@ func (co *Coalesce) Subscribe(commands []string, ends []string,
 	return new
 }
 
+// Wait waits for the replies of a subscription made with Subscribe.
+// If ctx is done first, ch is unsubscribed and the replies received
+// so far are returned, together with ctx's error. Once no subscribers
+// remain, the subscription is removed, so that a later Subscribe will
+// report it as new.
+func (co *Coalesce) Wait(ctx context.Context, ch chan []*irc.Message) ([]*irc.Message, error) {
+	select {
+	case msgs := <-ch:
+		return msgs, nil
+	case <-ctx.Done():
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	select {
+	case msgs := <-ch:
+		// The replies arrived while we were acquiring the lock.
+		return msgs, nil
+	default:
+	}
+	var partial []*irc.Message
+	for key, interested := range co.m {
+		for i, other := range interested.Inform {
+			if other != ch {
+				continue
+			}
+			interested.Inform = append(interested.Inform[:i:i], interested.Inform[i+1:]...)
+			partial = make([]*irc.Message, len(interested.Messages))
+			copy(partial, interested.Messages)
+			break
+		}
+		if len(interested.Inform) == 0 {
+			delete(co.m, key)
+		}
+	}
+	return partial, ctx.Err()
+}
+
 func (co *Coalesce) Process(c *irc.Client, m *irc.Message) {
 	co.mu.Lock()
 	defer co.mu.Unlock()
@@ -377,32 +550,154 @@ func (co *Coalesce) Process(c *irc.Client, m *irc.Message) {
 }
 
 // Retry executes a function in a loop that continues as long as the
-// function's error return is a temporary network error, a timeout or
-// an EOF. On all other errors, or no error at all, it will terminate.
+// function's error return is a temporary network error, a timeout, an
+// EOF, a recovered panic (see irc.Client.RecoverPanics) or a server
+// that didn't complete registration or capability negotiation in
+// time. On all other errors, or no error at all, it will terminate.
 //
 // This function can be used for a simple reconnect loop that only
 // reconnects on network failure and doesn't reconnect in the case of
 // a programming error or an intended termination of the connection.
+// It waits one second between attempts; use Backoff.Retry for
+// exponential backoff.
 func Retry(fn func() error) error {
+	return Backoff{Min: time.Second, Max: time.Second}.Retry(fn)
+}
+
+// Backoff computes exponentially growing delays between attempts.
+type Backoff struct {
+	// The delay after the first failure. Defaults to one second.
+	Min time.Duration
+	// The maximum delay. Defaults to five minutes.
+	Max time.Duration
+	// Jitter randomly changes delays by up to this fraction of
+	// themselves, so that many clients don't reconnect at once
+	// after a netsplit.
+	Jitter float64
+	// Random is the source of the jitter. Defaults to
+	// irc.DefaultRandom.
+	Random irc.Random
+	// Clock is used for waiting. Defaults to irc.RealClock.
+	Clock irc.Clock
+}
+
+func (b Backoff) min() time.Duration {
+	if b.Min == 0 {
+		return time.Second
+	}
+	return b.Min
+}
+
+func (b Backoff) max() time.Duration {
+	if b.Max == 0 {
+		return 5 * time.Minute
+	}
+	return b.Max
+}
+
+// Delay returns the delay after the given number of consecutive
+// failures, starting at 1.
+func (b Backoff) Delay(failures int) time.Duration {
+	d := b.min()
+	for i := 1; i < failures && d < b.max(); i++ {
+		d *= 2
+	}
+	if d > b.max() {
+		d = b.max()
+	}
+	return irc.Jitter(b.Random, d, b.Jitter)
+}
+
+// Retry is like the package-level Retry, but waits according to b.
+// Once fn ran for longer than Max, the next failure is counted as
+// the first again.
+func (b Backoff) Retry(fn func() error) error {
 	var err error
+	failures := 0
 	for {
 		if err != nil {
 			log.Printf("Reconnecting due to error: %s", err)
 		}
+		start := irc.OrRealClock(b.Clock).Now()
 		err = fn()
 		if err == nil {
 			return nil
 		}
-
-		if err, ok := err.(*net.OpError); ok && (err.Temporary() || err.Timeout()) {
-			// TODO exponential backoff
-			time.Sleep(1 * time.Second)
-			continue
+		if irc.OrRealClock(b.Clock).Now().Sub(start) > b.max() {
+			failures = 0
 		}
-		if err == io.EOF {
-			time.Sleep(1 * time.Second)
-			continue
+
+		if !retryable(err) {
+			return err
 		}
-		return err
+		failures++
+		<-irc.OrRealClock(b.Clock).After(b.Delay(failures))
+	}
+}
+
+// retryable reports whether Retry should try again after err.
+func retryable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Temporary() || opErr.Timeout()) {
+		return true
+	}
+	var panicErr *irc.PanicError
+	return errors.As(err, &panicErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, irc.ErrRegistrationTimeout) ||
+		errors.Is(err, irc.ErrCapTimeout)
+}
+
+// QuitOnSignal installs a handler for the given OS signals, or
+// SIGINT and SIGTERM if none are specified. When a signal arrives,
+// the client sends a QUIT message with the provided reason and waits
+// up to timeout for the server to close the connection before
+// closing it forcefully. The handler is uninstalled as soon as the
+// first signal arrives, so that a second one terminates the process
+// as usual. Signals that arrive while the client isn't connected are
+// ignored.
+//
+// The returned function uninstalls the signal handler.
+func QuitOnSignal(c *irc.Client, reason string, timeout time.Duration, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go quitOnSignal(c, reason, timeout, ch, done)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// quitOnSignal waits for a signal on ch and quits c, unless done is
+// closed first.
+func quitOnSignal(c *irc.Client, reason string, timeout time.Duration, ch chan os.Signal, done <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-done:
+		return
+	}
+	signal.Stop(ch)
+	conn := c.Done()
+	if conn == nil {
+		// Not connected yet
+		return
+	}
+	select {
+	case <-conn:
+		return
+	default:
+	}
+	c.Quit(reason)
+	select {
+	case <-conn:
+	case <-irc.OrRealClock(c.Clock).After(timeout):
+		c.Close()
 	}
 }
@@ -0,0 +1,420 @@
+package framework
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// testServer is the server end of a client that is connected over an
+// in-memory pipe. Lines are written to the client by hand, which
+// gives tests full control over what the client sees.
+type testServer struct {
+	t     *testing.T
+	c     *irc.Client
+	conn  net.Conn
+	lines chan string
+	syncs int
+}
+
+// newTestServer connects a client named bot that dispatches to mux
+// and starts processing.
+func newTestServer(t *testing.T, mux irc.Muxer) *testServer {
+	return newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux})
+}
+
+func newTestServerWith(t *testing.T, c *irc.Client) *testServer {
+	conn, server := net.Pipe()
+	if err := c.Connect(conn); err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, c: c, conn: server, lines: make(chan string, 1000)}
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+		close(s.lines)
+	}()
+	go c.Process()
+	t.Cleanup(func() { c.Close() })
+	return s
+}
+
+// send writes lines to the client.
+func (s *testServer) send(lines ...string) {
+	s.t.Helper()
+	for _, line := range lines {
+		if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+			s.t.Fatalf("couldn't send %q: %s", line, err)
+		}
+	}
+}
+
+// welcomeLines register the client, announcing the # and & channel
+// types, the o and v prefix modes and the rfc1459 casemapping.
+var welcomeLines = []string{
+	":irc.test 001 bot :Welcome",
+	":irc.test 002 bot :Your host is irc.test",
+	":irc.test 003 bot :This server was created today",
+	":irc.test 004 bot irc.test test-1.0 iow biklmnopstv",
+	":irc.test 005 bot CHANTYPES=#& PREFIX=(ov)@+ CHANMODES=beI,k,l,imnpst CASEMAPPING=rfc1459 NETWORK=Test MONITOR=100 :are supported by this server",
+	":irc.test 376 bot :End of MOTD",
+}
+
+// welcome sends welcomeLines and waits for the client to process
+// them.
+func (s *testServer) welcome() {
+	s.t.Helper()
+	s.send(welcomeLines...)
+	s.sync()
+}
+
+// sync waits until the client has processed all lines sent so far.
+// Handlers that run asynchronously may still be running.
+func (s *testServer) sync() {
+	s.t.Helper()
+	s.syncs++
+	token := fmt.Sprintf("sync-%d", s.syncs)
+	s.send("PING " + token)
+	s.expect("PONG " + token)
+}
+
+// expect waits for the client to send want, skipping other lines.
+func (s *testServer) expect(want string) {
+	s.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("connection closed while waiting for %q", want)
+			}
+			if line == want {
+				return
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+// expectSent waits for the client to send the lines in want, in
+// order, excluding registration and PONGs. It is for lines sent
+// asynchronously, which sent might not wait for.
+func (s *testServer) expectSent(want ...string) {
+	s.t.Helper()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatal("connection closed")
+			}
+			if !ignored(line) {
+				got = append(got, line)
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q, got %q", want, got)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		s.t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// expectQuiet waits until the client has processed all lines sent so
+// far and fails if it sent anything other than registration and PONGs
+// in the meantime.
+func (s *testServer) expectQuiet() {
+	s.t.Helper()
+	s.syncs++
+	token := fmt.Sprintf("sync-%d", s.syncs)
+	s.send("PING " + token)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatal("connection closed")
+			}
+			if line == "PONG "+token {
+				return
+			}
+			if !ignored(line) {
+				s.t.Errorf("unexpected %q", line)
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q", "PONG "+token)
+		}
+	}
+}
+
+// ignored reports whether line is part of registration or a PONG.
+func ignored(line string) bool {
+	switch strings.SplitN(line, " ", 2)[0] {
+	case "CAP", "NICK", "USER", "PONG", "USERHOST":
+		return true
+	}
+	return false
+}
+
+// sent returns the lines the client sent until the next sync,
+// excluding registration and PONGs.
+func (s *testServer) sent() []string {
+	s.t.Helper()
+	s.syncs++
+	token := fmt.Sprintf("sync-%d", s.syncs)
+	s.send("PING " + token)
+	var out []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatal("connection closed")
+			}
+			if line == "PONG "+token {
+				return out
+			}
+			if ignored(line) {
+				continue
+			}
+			out = append(out, line)
+		case <-timeout:
+			s.t.Fatal("timed out waiting for sync")
+		}
+	}
+}
+
+func TestRetryRegistrationTimeout(t *testing.T) {
+	var attempts int
+	err := Backoff{Min: time.Millisecond, Max: time.Millisecond}.Retry(func() error {
+		attempts++
+		if attempts == 3 {
+			return nil
+		}
+		// The server never welcomes the client.
+		c := &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: irc.NewMux(), RegistrationTimeout: 10 * time.Millisecond}
+		s := newTestServerWith(t, c)
+		s.expect("NICK bot")
+		select {
+		case <-c.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("registration didn't time out")
+		}
+		return c.Error()
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	quit := errors.New("quit")
+	err = Backoff{Min: time.Millisecond, Max: time.Millisecond}.Retry(func() error {
+		attempts++
+		return quit
+	})
+	if err != quit || attempts != 1 {
+		t.Errorf("expected Retry to give up on %v, got %v after %d attempts", quit, err, attempts)
+	}
+}
+
+func TestQuitOnSignal(t *testing.T) {
+	run := func(c *irc.Client) <-chan struct{} {
+		ch := make(chan os.Signal, 1)
+		ch <- os.Interrupt
+		finished := make(chan struct{})
+		go func() {
+			quitOnSignal(c, "bye", 10*time.Millisecond, ch, nil)
+			close(finished)
+		}()
+		return finished
+	}
+
+	// Signals that arrive before connecting don't block.
+	select {
+	case <-run(&irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: irc.NewMux()}):
+	case <-time.After(5 * time.Second):
+		t.Fatal("quitting an unconnected client blocked")
+	}
+
+	// The connection is closed if the server doesn't close it after
+	// QUIT.
+	s := newTestServer(t, irc.NewMux())
+	s.welcome()
+	finished := run(s.c)
+	s.expect("QUIT :bye")
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+	select {
+	case <-s.c.Done():
+	default:
+		t.Error("client is still connected")
+	}
+}
+
+func TestWhoisContextCancel(t *testing.T) {
+	co := NewCoalesce()
+	mux := irc.NewOrderedMux()
+	mux.Handle("", co)
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	type result struct {
+		u   User
+		err error
+	}
+	whois := func(ctx context.Context) <-chan result {
+		out := make(chan result, 1)
+		go func() {
+			u, err := WhoisContext(ctx, s.c, co, "alice")
+			out <- result{u, err}
+		}()
+		return out
+	}
+	subscriptions := func() int {
+		co.mu.Lock()
+		defer co.mu.Unlock()
+		return len(co.m)
+	}
+	waitCallers := func(n int) {
+		for {
+			co.mu.Lock()
+			i, ok := co.m[Input{irc.RPL_WHOISUSER, "alice"}]
+			done := ok && len(i.Inform) == n
+			co.mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Two callers share one WHOIS. Cancelling one leaves the other
+	// subscribed.
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	first := whois(ctx1)
+	s.expect("WHOIS alice alice")
+	second := whois(ctx2)
+	waitCallers(2)
+	s.send(":irc.test 311 bot alice a host.test * :Alice")
+	s.sync()
+	cancel1()
+	r := <-first
+	if r.err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, r.err)
+	}
+	if r.u.Nick != "alice" || r.u.Host != "host.test" || r.u.Name != "Alice" {
+		t.Errorf("expected the partial WHOIS reply, got %+v", r.u)
+	}
+	if subscriptions() == 0 {
+		t.Error("cancelling one caller removed the subscription of the other")
+	}
+
+	// Once the last caller gives up, the subscription is gone and the
+	// end numeric is ignored.
+	s.send(":irc.test 319 bot alice :@#chan")
+	s.sync()
+	cancel2()
+	r = <-second
+	if r.err != context.Canceled || r.u.Nick != "alice" || len(r.u.Channels) != 1 {
+		t.Errorf("expected the partial WHOIS reply and %v, got %+v, %v", context.Canceled, r.u, r.err)
+	}
+	if n := subscriptions(); n != 0 {
+		t.Errorf("expected no subscriptions, got %d", n)
+	}
+	s.send(":irc.test 318 bot alice :End of WHOIS")
+	s.sync()
+
+	// A later WHOIS is sent anew.
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel3()
+	third := whois(ctx3)
+	s.expect("WHOIS alice alice")
+	s.send(
+		":irc.test 311 bot alice a other.test * :Alice",
+		":irc.test 318 bot alice :End of WHOIS",
+	)
+	r = <-third
+	if r.err != nil || r.u.Host != "other.test" {
+		t.Errorf("expected a fresh WHOIS reply, got %+v, %v", r.u, r.err)
+	}
+}
+
+func TestRegexpMuxerPanic(t *testing.T) {
+	mux := NewRegexpMuxer()
+	mux.HandleFunc("PRIVMSG/^!crash (.+)", func(c *irc.Client, m *irc.Message) {
+		panic("crashed by " + mux.Vars(m)[1])
+	})
+	vars := make(chan []string, 1)
+	mux.HandleFunc("PRIVMSG/^!echo (.+)", func(c *irc.Client, m *irc.Message) {
+		vars <- mux.Vars(m)
+	})
+
+	// Without a client, handlers still run.
+	mux.Process(nil, irc.Parse(":alice!a@host PRIVMSG #chan :!echo hi"))
+	select {
+	case got := <-vars:
+		if !reflect.DeepEqual(got, []string{"!echo hi", "hi"}) {
+			t.Errorf("unexpected submatches %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't run")
+	}
+
+	logs := NewLogRing(10)
+	panics := make(chan *irc.PanicError, 1)
+	c := &irc.Client{
+		Nick:         "bot",
+		User:         "bot",
+		Name:         "bot",
+		Mux:          mux,
+		Logger:       logs,
+		PanicHandler: func(m *irc.Message, err *irc.PanicError) { panics <- err },
+	}
+	s := newTestServerWith(t, c)
+	s.welcome()
+	s.send(":alice!a@host PRIVMSG #chan :!crash alice")
+	select {
+	case err := <-panics:
+		if err.Value != "crashed by alice" || len(err.Stack) == 0 {
+			t.Errorf("unexpected panic error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic wasn't recovered")
+	}
+	var logged bool
+	for _, l := range logs.Lines() {
+		if l.Kind == "panic" && strings.Contains(l.Text, "crashed by alice") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("panic wasn't logged: %v", logs.Lines())
+	}
+
+	// The connection survives.
+	s.send(":alice!a@host PRIVMSG #chan :!echo still here")
+	select {
+	case <-vars:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't run after the panic")
+	}
+}
@@ -0,0 +1,275 @@
+package framework
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// IgnoredTag is the tag set on messages flagged by IgnoreList.
+const IgnoredTag = "framework/ignored"
+
+// Ignored reports whether m was flagged by IgnoreList.
+func Ignored(m *irc.Message) bool {
+	_, ok := m.Tags[IgnoredTag]
+	return ok
+}
+
+// An IgnoreEntry ignores users matching a hostmask pattern, users
+// logged in to a services account, or messages whose text matches a
+// regular expression. Exactly one of Mask, Account and Text is set.
+type IgnoreEntry struct {
+	Mask    string
+	Account string
+	Text    string
+	// Flag causes matching messages to be tagged with IgnoredTag
+	// instead of being dropped, for handlers that want to see them
+	// anyway, such as loggers.
+	Flag bool
+}
+
+const ignoreTextPrefix = "ignore:text:"
+
+// The levels of IgnoreList's mask and account entries. Dropping
+// ranks below flagging, so that it takes precedence.
+const (
+	ignoreDrop = iota
+	ignoreFlag
+)
+
+// IgnoreList drops or flags PRIVMSG, NOTICE, TAGMSG and INVITE
+// messages from ignored users before they reach handlers. Other
+// messages, such as JOIN and QUIT, pass through, so that state
+// tracking isn't affected. The client's own messages are never
+// ignored.
+//
+// Mask and account entries are kept like those of AccessList: when a
+// user matching a complete hostmask entry is seen logged in to an
+// account, the entry is migrated to the account and the
+// ignore:migrated signal is emitted, with the mask, the account and
+// the level as parameters.
+//
+// The entries are stored in Brain, under keys starting with ignore:,
+// so that they persist if Brain does. Temporary ignores use Brain's
+// expiry.
+//
+// Middleware has to be installed with Mux.Use on the client's Mux,
+// and IgnoreList needs to be registered as a catch-all handler, using
+// Handle, for migrations.
+type IgnoreList struct {
+	*irc.Mux
+	// State, if set, provides the accounts of users whose messages
+	// don't carry an account tag.
+	State *State
+
+	acl *AccessList
+
+	mu    sync.Mutex
+	cache *ignoreCache
+}
+
+// ignoreCache holds the entries of an IgnoreList, with their regular
+// expressions compiled, so that matching doesn't have to consult the
+// Brain for every message.
+type ignoreCache struct {
+	// the Brain's changes when the cache was filled
+	changes uint64
+	// when the first temporary entry expires, if any
+	expires  time.Time
+	masks    []IgnoreEntry
+	accounts []IgnoreEntry
+	texts    []ignoreText
+}
+
+type ignoreText struct {
+	IgnoreEntry
+	re *regexp.Regexp
+}
+
+func NewIgnoreList(brain *Brain) *IgnoreList {
+	acl := newAccessList(brain, "ignore:")
+	return &IgnoreList{Mux: acl.Mux, acl: acl}
+}
+
+// Add adds e to the list. If ttl is positive, the entry is removed
+// after ttl. Adding an entry that exists replaces it.
+func (l *IgnoreList) Add(e IgnoreEntry, ttl time.Duration) error {
+	level := ignoreDrop
+	if e.Flag {
+		level = ignoreFlag
+	}
+	switch {
+	case e.Mask != "" && e.Account == "" && e.Text == "":
+		return l.acl.Brain.Set(l.acl.maskPrefix()+e.Mask, strconv.Itoa(level), ttl)
+	case e.Account != "" && e.Mask == "" && e.Text == "":
+		l.acl.mu.Lock()
+		defer l.acl.mu.Unlock()
+		return l.acl.setAccount(e.Account, level, ttl)
+	case e.Text != "" && e.Mask == "" && e.Account == "":
+		if _, err := regexp.Compile(e.Text); err != nil {
+			return err
+		}
+		return l.acl.Brain.Set(ignoreTextPrefix+e.Text, strconv.Itoa(level), ttl)
+	default:
+		return errInvalidIgnoreEntry
+	}
+}
+
+var errInvalidIgnoreEntry = errors.New("exactly one of Mask, Account and Text must be set")
+
+// Remove removes the entry with e's Mask, Account or Text.
+func (l *IgnoreList) Remove(e IgnoreEntry) error {
+	switch {
+	case e.Mask != "" && e.Account == "" && e.Text == "":
+		return l.acl.RemoveMask(e.Mask)
+	case e.Account != "" && e.Mask == "" && e.Text == "":
+		return l.acl.RemoveAccount(e.Account)
+	case e.Text != "" && e.Mask == "" && e.Account == "":
+		return l.acl.Brain.Delete(ignoreTextPrefix + e.Text)
+	default:
+		return errInvalidIgnoreEntry
+	}
+}
+
+// Entries returns all entries, ordered by kind: masks, accounts and
+// texts.
+func (l *IgnoreList) Entries() []IgnoreEntry {
+	c := l.entries()
+	var out []IgnoreEntry
+	out = append(out, c.masks...)
+	out = append(out, c.accounts...)
+	for _, t := range c.texts {
+		out = append(out, t.IgnoreEntry)
+	}
+	return out
+}
+
+// entries returns the cached entries, reloading them from the Brain
+// if they changed or one of them expired.
+func (l *IgnoreList) entries() *ignoreCache {
+	brain := l.acl.Brain
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changes := brain.changes()
+	if c := l.cache; c != nil && c.changes == changes &&
+		(c.expires.IsZero() || irc.OrRealClock(brain.Clock).Now().Before(c.expires)) {
+		return c
+	}
+
+	c := &ignoreCache{changes: changes}
+	load := func(prefix string, add func(IgnoreEntry, string)) {
+		for _, key := range brain.Keys(prefix) {
+			value, ok := brain.Get(key)
+			if !ok {
+				continue
+			}
+			if ttl, ok := brain.TTL(key); ok && ttl > 0 {
+				if expires := irc.OrRealClock(brain.Clock).Now().Add(ttl); c.expires.IsZero() || expires.Before(c.expires) {
+					c.expires = expires
+				}
+			}
+			level, _ := strconv.Atoi(value)
+			add(IgnoreEntry{Flag: level == ignoreFlag}, key[len(prefix):])
+		}
+	}
+	load(l.acl.maskPrefix(), func(e IgnoreEntry, s string) {
+		e.Mask = s
+		c.masks = append(c.masks, e)
+	})
+	load(l.acl.accountPrefix(), func(e IgnoreEntry, s string) {
+		e.Account = s
+		c.accounts = append(c.accounts, e)
+	})
+	load(ignoreTextPrefix, func(e IgnoreEntry, s string) {
+		e.Text = s
+		if re, err := regexp.Compile(s); err == nil {
+			c.texts = append(c.texts, ignoreText{e, re})
+		}
+	})
+	l.cache = c
+	return c
+}
+
+// Match returns the entry that m matches. Dropping entries take
+// precedence over flagging ones.
+func (l *IgnoreList) Match(c *irc.Client, m *irc.Message) (IgnoreEntry, bool) {
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG", "INVITE":
+	default:
+		return IgnoreEntry{}, false
+	}
+	if m.Prefix.Nick == "" || c.IsMe(m.Prefix.Nick) {
+		return IgnoreEntry{}, false
+	}
+	var (
+		match IgnoreEntry
+		found bool
+	)
+	consider := func(e IgnoreEntry) {
+		if !found || match.Flag && !e.Flag {
+			match, found = e, true
+		}
+	}
+	is := c.Support()
+	entries := l.entries()
+	for _, e := range entries.masks {
+		if is.Match(m.Prefix, e.Mask) {
+			consider(e)
+		}
+	}
+	if account := accountOf(l.State, m); account != "" {
+		folded := is.Casefold(account)
+		for _, e := range entries.accounts {
+			if is.Casefold(e.Account) == folded {
+				consider(e)
+			}
+		}
+	}
+	if m.Command != "TAGMSG" && m.Command != "INVITE" && len(m.Params) > 0 {
+		text := m.Params[len(m.Params)-1]
+		for _, e := range entries.texts {
+			if e.re.MatchString(text) {
+				consider(e.IgnoreEntry)
+			}
+		}
+	}
+	return match, found
+}
+
+// Middleware drops and flags messages according to the list. The
+// IgnoreList itself sees all messages, so that it can migrate entries
+// of ignored users.
+func (l *IgnoreList) Middleware(next irc.Handler) irc.Handler {
+	if next == irc.Handler(l) {
+		return next
+	}
+	return irc.HandlerFunc(func(c *irc.Client, m *irc.Message) {
+		e, ok := l.Match(c, m)
+		if ok {
+			if !e.Flag {
+				return
+			}
+			if m.Tags == nil {
+				m.Tags = make(map[string]string)
+			}
+			m.Tags[IgnoredTag] = ""
+		}
+		next.Process(c, m)
+	})
+}
+
+// accountOf returns the account of the sender of m, from the account
+// tag or, if state isn't nil, from state.
+func accountOf(state *State, m *irc.Message) string {
+	if account, ok := m.Tags["account"]; ok {
+		return account
+	}
+	if state != nil && m.Prefix.Nick != "" {
+		return state.User(m.Prefix.Nick).Account
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+func TestIgnoreList(t *testing.T) {
+	brain, _ := NewBrain(nil)
+	l := NewIgnoreList(brain)
+	for _, e := range []IgnoreEntry{
+		{Mask: "*!*@spam.example"},
+		{Account: "Troll", Flag: true},
+		{Text: "buy now"},
+	} {
+		if err := l.Add(e, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Add(IgnoreEntry{Mask: "eve!e@home.example"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(IgnoreEntry{Mask: "a", Text: "b"}, 0); err == nil {
+		t.Error("expected error for entry with both Mask and Text")
+	}
+
+	mux := irc.NewOrderedMux()
+	mux.Use(l.Middleware)
+	mux.Handle("", l)
+	delivered := make(chan *irc.Message, 10)
+	record := func(c *irc.Client, m *irc.Message) { delivered <- m }
+	mux.HandleFunc("PRIVMSG", record)
+	mux.HandleFunc("JOIN", record)
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	check := func(line string, want bool, flagged bool) {
+		t.Helper()
+		s.send(line)
+		s.sync()
+		select {
+		case m := <-delivered:
+			if !want {
+				t.Errorf("%q: expected message to be dropped", line)
+			} else if Ignored(m) != flagged {
+				t.Errorf("%q: expected flagged to be %t", line, flagged)
+			}
+		default:
+			if want {
+				t.Errorf("%q: expected message to be delivered", line)
+			}
+		}
+	}
+	check(":a!a@spam.example PRIVMSG #chan :hi", false, false)
+	check(":a!a@spam.example JOIN #chan", true, false)
+	check("@account=TROLL :t!t@x.example PRIVMSG #chan :hi", true, true)
+	check("@account=TROLL :t!t@x.example PRIVMSG #chan :buy now", false, false)
+	check(":b!b@x.example PRIVMSG #chan :hello", true, false)
+	check(":bot!b@x.example PRIVMSG #chan :buy now", true, false)
+
+	// The ignore of eve's hostmask moves to her account and remains
+	// temporary.
+	check("@account=Eve :eve!e@home.example PRIVMSG #chan :hi", false, false)
+	check("@account=Eve :eve!e@elsewhere.example PRIVMSG #chan :hi", false, false)
+	if ttl, ok := brain.TTL("ignore:account:Eve"); !ok || ttl <= 0 {
+		t.Errorf("expected temporary account entry for Eve, got %s, %t", ttl, ok)
+	}
+	if _, ok := brain.Get("ignore:mask:eve!e@home.example"); ok {
+		t.Error("expected mask entry to be migrated")
+	}
+
+	if err := l.Remove(IgnoreEntry{Text: "buy now"}); err != nil {
+		t.Fatal(err)
+	}
+	check(":b!b@x.example PRIVMSG #chan :buy now", true, false)
+	if n := len(l.Entries()); n != 3 {
+		t.Errorf("expected 3 entries, got %d: %v", n, l.Entries())
+	}
+}
@@ -0,0 +1,121 @@
+package framework
+
+import (
+	"strings"
+
+	"honnef.co/go/irc"
+)
+
+// Inspection is a bundle of owner-only commands for operating a bot
+// from IRC:
+//
+//	raw <line>           send a raw line to the server
+//	join <channel> [key] join a channel
+//	part <channel>       leave a channel
+//	nick <nick>          change the bot's nick
+//	caps                 list enabled capabilities
+//	stats                show statistics, if Stats is set
+//	reload-plugins       reload plugins, if ReloadPlugins is set
+type Inspection struct {
+	// Owner decides who may use the commands. If nil, nobody may.
+	Owner Permission
+	// Stats returns a one-line summary of the bot's statistics.
+	Stats func() string
+	// ReloadPlugins reloads the bot's plugins.
+	ReloadPlugins func() error
+}
+
+// Register registers the inspection commands with cs. Replies are
+// translated with cs.Catalog.
+func (in *Inspection) Register(cs *Commands) {
+	owner := in.Owner
+	if owner == nil {
+		// A nil Permission allows everyone, which would let anyone
+		// send raw lines through the bot.
+		owner = func(*irc.Client, *irc.Message) bool { return false }
+	}
+	cs.Register(&Command{
+		Name:       "raw",
+		Help:       "raw <line> - send a raw line to the server",
+		Permission: owner,
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			if len(args) == 0 {
+				return ErrUsage
+			}
+			// Send the line as written, not as split into args.
+			return c.Send(cs.rest(m))
+		},
+	})
+	cs.Register(&Command{
+		Name:       "join",
+		Help:       "join <channel> [key] - join a channel",
+		Permission: owner,
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			switch len(args) {
+			case 1:
+				return c.Join(args[0], "")
+			case 2:
+				return c.Join(args[0], args[1])
+			default:
+				return ErrUsage
+			}
+		},
+	})
+	cs.Register(&Command{
+		Name:       "part",
+		Help:       "part <channel> - leave a channel",
+		Permission: owner,
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			if len(args) != 1 {
+				return ErrUsage
+			}
+			return c.Sendf("PART %s", args[0])
+		},
+	})
+	cs.Register(&Command{
+		Name:       "nick",
+		Help:       "nick <nick> - change the bot's nick",
+		Permission: owner,
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			if len(args) != 1 {
+				return ErrUsage
+			}
+			return c.SetNick(args[0])
+		},
+	})
+	cs.Register(&Command{
+		Name:       "caps",
+		Help:       "caps - list enabled capabilities",
+		Permission: owner,
+		Func: func(c *irc.Client, m *irc.Message, args []string) error {
+			caps := c.Caps.Enabled()
+			if len(caps) == 0 {
+				return c.Reply(m, cs.Textf(m, "no capabilities enabled"))
+			}
+			return c.Reply(m, strings.Join(caps, " "))
+		},
+	})
+	if in.Stats != nil {
+		cs.Register(&Command{
+			Name:       "stats",
+			Help:       "stats - show statistics",
+			Permission: owner,
+			Func: func(c *irc.Client, m *irc.Message, args []string) error {
+				return c.Reply(m, in.Stats())
+			},
+		})
+	}
+	if in.ReloadPlugins != nil {
+		cs.Register(&Command{
+			Name:       "reload-plugins",
+			Help:       "reload-plugins - reload all plugins",
+			Permission: owner,
+			Func: func(c *irc.Client, m *irc.Message, args []string) error {
+				if err := in.ReloadPlugins(); err != nil {
+					return err
+				}
+				return c.Reply(m, cs.Textf(m, "plugins reloaded"))
+			},
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package framework
+
+import (
+	"reflect"
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestInspection(t *testing.T) {
+	table := []struct {
+		owner Permission
+		line  string
+		sent  []string
+	}{
+		{
+			nil,
+			":eve!e@evil.example PRIVMSG #chan :!raw QUIT :bye",
+			[]string{"PRIVMSG #chan :permission denied"},
+		},
+		{
+			Owners("*!*@owner.example"),
+			":eve!e@evil.example PRIVMSG #chan :!raw QUIT :bye",
+			[]string{"PRIVMSG #chan :permission denied"},
+		},
+		{
+			Owners("*!*@owner.example"),
+			":alice!a@owner.example PRIVMSG #chan :!raw  PRIVMSG #chan :two  spaces",
+			[]string{"PRIVMSG #chan :two  spaces"},
+		},
+		{
+			Owners("*!*@owner.example"),
+			":alice!a@owner.example PRIVMSG #chan :!raw",
+			[]string{"PRIVMSG #chan :usage: !raw <line> - send a raw line to the server"},
+		},
+		{
+			Owners("*!*@owner.example"),
+			":alice!a@owner.example PRIVMSG #chan :!join #other key",
+			[]string{"JOIN #other key"},
+		},
+	}
+	for _, test := range table {
+		cs := NewCommands("!")
+		in := &Inspection{Owner: test.owner}
+		in.Register(cs)
+		mux := irc.NewOrderedMux()
+		mux.Handle("PRIVMSG", cs)
+		s := newTestServer(t, mux)
+		s.welcome()
+		s.send(test.line)
+		if sent := s.sent(); !reflect.DeepEqual(sent, test.sent) {
+			t.Errorf("%q: expected %q, got %q", test.line, test.sent, sent)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package framework
+
+import (
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// KeyStore remembers the keys of channels, as configured by the user
+// or learned from MODE changes and RPL_CHANNELMODEIS replies, and
+// uses them when (re)joining channels. Channel names are compared
+// using the network's casemapping.
+//
+// KeyStore needs to be registered as a catch-all handler, with
+// HandleSync so that consecutive key changes are applied in order.
+type KeyStore struct {
+	*irc.Mux
+	// Rejoin causes the client to rejoin channels it got kicked or
+	// removed from, using the stored key.
+	Rejoin bool
+
+	mu sync.RWMutex
+	// keys maps channel names, as they were given, to keys
+	keys map[string]string
+	is   *irc.ISupport
+}
+
+func NewKeyStore() *KeyStore {
+	ks := &KeyStore{
+		Mux:  irc.NewOrderedMux(),
+		keys: make(map[string]string),
+	}
+	ks.HandleFunc("MODE", ks.mode)
+	ks.HandleFunc(irc.RPL_CHANNELMODEIS, ks.mode)
+	ks.HandleFunc("irc:kicked", ks.kick)
+	ks.HandleFunc("", ks.observe)
+	return ks
+}
+
+// lookup returns the name channel is stored under. The names aren't
+// folded when storing them, as the casemapping isn't known until
+// after connecting. ks.mu must be held.
+func (ks *KeyStore) lookup(channel string) (name string, ok bool) {
+	if _, ok := ks.keys[channel]; ok {
+		return channel, true
+	}
+	is := ks.is
+	if is == nil {
+		is = irc.NewISupport()
+	}
+	folded := is.Casefold(channel)
+	for name := range ks.keys {
+		if is.Casefold(name) == folded {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Set stores the key of a channel. An empty key removes the channel
+// from the store.
+func (ks *KeyStore) Set(channel, key string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if name, ok := ks.lookup(channel); ok {
+		delete(ks.keys, name)
+	}
+	if key != "" {
+		ks.keys[channel] = key
+	}
+}
+
+// Key returns the stored key of a channel.
+func (ks *KeyStore) Key(channel string) (key string, ok bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	name, ok := ks.lookup(channel)
+	return ks.keys[name], ok
+}
+
+func (ks *KeyStore) observe(c *irc.Client, m *irc.Message) {
+	ks.mu.Lock()
+	ks.is = c.Support()
+	ks.mu.Unlock()
+}
+
+// Join joins a channel using its stored key, if any.
+func (ks *KeyStore) Join(c *irc.Client, channel string) error {
+	key, _ := ks.Key(channel)
+	return c.Join(channel, key)
+}
+
+// JoinAll joins several channels using their stored keys. See
+// JoinPaced for details on batching and pacing.
+func (ks *KeyStore) JoinAll(c *irc.Client, channels []string, interval time.Duration) error {
+	m := make(map[string]string, len(channels))
+	for _, channel := range channels {
+		m[channel], _ = ks.Key(channel)
+	}
+	return JoinPaced(c, m, interval)
+}
+
+func (ks *KeyStore) mode(c *irc.Client, m *irc.Message) {
+	channel, changes, _ := irc.ModeParser{ISupport: c.Support()}.Parse(m)
+	if !c.Support().IsChannel(channel) {
+		return
+	}
+	for _, ch := range changes {
+		if ch.Mode != 'k' {
+			continue
+		}
+		if !ch.Add {
+			ks.Set(channel, "")
+		} else if ch.Arg != "*" {
+			ks.Set(channel, ch.Arg)
+		}
+	}
+}
+
+func (ks *KeyStore) kick(c *irc.Client, m *irc.Message) {
+	if !ks.Rejoin {
+		return
+	}
+	// KeyStore is dispatched to synchronously, and sending from the
+	// read loop could block it behind the rate limit.
+	go ks.Join(c, m.Params[0])
+}
@@ -0,0 +1,46 @@
+package framework
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestKeyStore(t *testing.T) {
+	ks := NewKeyStore()
+	ks.Rejoin = true
+	ks.Set("#Stored[", "configured")
+	mux := irc.NewOrderedMux()
+	mux.Handle("", ks)
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	// The network uses the rfc1459 casemapping.
+	if key, ok := ks.Key("#stored{"); !ok || key != "configured" {
+		t.Errorf("expected key configured for #stored{, got %q, %t", key, ok)
+	}
+
+	s.send(
+		":alice!a@host MODE #chan +k secret",
+		":irc.test 324 bot #other +kl other 10",
+		":alice!a@host MODE #stored{ -k configured",
+	)
+	s.sync()
+	table := []struct {
+		channel string
+		key     string
+		ok      bool
+	}{
+		{"#CHAN", "secret", true},
+		{"#other", "other", true},
+		{"#Stored[", "", false},
+	}
+	for _, test := range table {
+		if key, ok := ks.Key(test.channel); key != test.key || ok != test.ok {
+			t.Errorf("%s: expected %q, %t, got %q, %t", test.channel, test.key, test.ok, key, ok)
+		}
+	}
+
+	s.send(":alice!a@host KICK #Chan bot :bye")
+	s.expectSent("JOIN #Chan secret")
+}
@@ -0,0 +1,149 @@
+package framework
+
+import (
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// ModeDebouncer aggregates bursts of channel mode changes, such as
+// services syncing hundreds of bans, into single events. Changes to
+// a channel are collected until no further changes arrive for Delay,
+// or until MaxDelay has passed since the first change.
+//
+// Each burst is reported to OnBurst, if set, and as the signal
+// mode:burst, whose parameters are those of a MODE message covering
+// all changes: the channel, the mode string and the arguments. The
+// signal is dispatched to the client's Mux and can be parsed with
+// irc.ModeParser.
+//
+// ModeDebouncer needs to be registered as a catch-all handler, using
+// Handle. To keep other handlers from seeing the individual MODE
+// messages, Middleware has to be installed with Mux.Use on the same
+// Mux; handlers then only see the bursts.
+type ModeDebouncer struct {
+	*irc.Mux
+	// Defaults to 500 milliseconds.
+	Delay time.Duration
+	// Defaults to 5 seconds.
+	MaxDelay time.Duration
+	// OnBurst, if set, is called with the changes of each burst.
+	OnBurst func(c *irc.Client, channel string, changes []irc.ModeChange)
+
+	mu     sync.Mutex
+	bursts map[string]*modeBurst
+}
+
+type modeBurst struct {
+	channel string
+	changes []irc.ModeChange
+	first   time.Time
+	timer   irc.Timer
+	// incremented whenever the timer is rearmed, so that timers
+	// that fired before being stopped can tell they are stale
+	armed int
+}
+
+func NewModeDebouncer() *ModeDebouncer {
+	d := &ModeDebouncer{
+		Mux:    irc.NewOrderedMux(),
+		bursts: make(map[string]*modeBurst),
+	}
+	d.HandleFunc("MODE", d.mode)
+	d.HandleFunc("irc:connected", d.connected)
+	return d
+}
+
+func (d *ModeDebouncer) delay() time.Duration {
+	if d.Delay == 0 {
+		return 500 * time.Millisecond
+	}
+	return d.Delay
+}
+
+func (d *ModeDebouncer) maxDelay() time.Duration {
+	if d.MaxDelay == 0 {
+		return 5 * time.Second
+	}
+	return d.MaxDelay
+}
+
+// Middleware withholds the channel MODE messages that are coalesced
+// into bursts from every handler but the debouncer itself.
+func (d *ModeDebouncer) Middleware(next irc.Handler) irc.Handler {
+	if next == irc.Handler(d) {
+		return next
+	}
+	return irc.HandlerFunc(func(c *irc.Client, m *irc.Message) {
+		if m.Signal == "MODE" {
+			if _, _, ok := coalesce(c.Support(), m); ok {
+				return
+			}
+		}
+		next.Process(c, m)
+	})
+}
+
+// coalesce returns the channel and the changes of a MODE message, and
+// whether the message is part of a burst.
+func coalesce(is *irc.ISupport, m *irc.Message) (string, []irc.ModeChange, bool) {
+	channel, changes, _ := irc.ModeParser{ISupport: is}.Parse(m)
+	return channel, changes, is.IsChannel(channel) && len(changes) > 0
+}
+
+func (d *ModeDebouncer) mode(c *irc.Client, m *irc.Message) {
+	is := c.Support()
+	channel, changes, ok := coalesce(is, m)
+	if !ok {
+		return
+	}
+	key := is.Casefold(channel)
+	clock := irc.OrRealClock(c.Clock)
+	now := clock.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.bursts[key]
+	if !ok {
+		b = &modeBurst{channel: channel, first: now}
+		d.bursts[key] = b
+	}
+	b.changes = append(b.changes, changes...)
+	wait := d.delay()
+	if left := d.maxDelay() - now.Sub(b.first); left < wait {
+		wait = left
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.armed++
+	armed := b.armed
+	b.timer = clock.AfterFunc(wait, func() { d.flush(c, key, b, armed) })
+}
+
+func (d *ModeDebouncer) flush(c *irc.Client, key string, b *modeBurst, armed int) {
+	d.mu.Lock()
+	if d.bursts[key] != b || b.armed != armed {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.bursts, key)
+	d.mu.Unlock()
+
+	if d.OnBurst != nil {
+		d.OnBurst(c, b.channel, b.changes)
+	}
+	modes, args := irc.FormatModes(b.changes)
+	params := append([]string{b.channel, modes}, args...)
+	c.Mux.Process(c, &irc.Message{Signal: "mode:burst", Params: params})
+}
+
+func (d *ModeDebouncer) connected(c *irc.Client, m *irc.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, b := range d.bursts {
+		b.timer.Stop()
+		delete(d.bursts, key)
+	}
+}
@@ -0,0 +1,100 @@
+package framework
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestModeDebouncer(t *testing.T) {
+	type step struct {
+		lines   []string
+		advance time.Duration
+		// The burst expected after advancing, if any
+		burst string
+	}
+	table := []struct {
+		delay    time.Duration
+		maxDelay time.Duration
+		steps    []step
+	}{
+		// Flushed once no further changes arrive for Delay.
+		{
+			100 * time.Millisecond, time.Minute,
+			[]step{
+				{[]string{":ChanServ!s@services MODE #chan +b a!*@*"}, 60 * time.Millisecond, ""},
+				{[]string{
+					":ChanServ!s@services MODE #CHAN +bo b!*@* alice",
+					":ChanServ!s@services MODE #chan -v bob",
+				}, 99 * time.Millisecond, ""},
+				{nil, time.Millisecond, "#chan +bbo-v a!*@* b!*@* alice bob"},
+			},
+		},
+		// Flushed after MaxDelay, even though changes keep arriving.
+		{
+			time.Minute, 100 * time.Millisecond,
+			[]step{
+				{[]string{":ChanServ!s@services MODE #chan +i"}, 60 * time.Millisecond, ""},
+				{[]string{":ChanServ!s@services MODE #chan +m"}, 39 * time.Millisecond, ""},
+				{nil, time.Millisecond, "#chan +im"},
+			},
+		},
+	}
+	for _, test := range table {
+		d := NewModeDebouncer()
+		d.Delay = test.delay
+		d.MaxDelay = test.maxDelay
+		mux := irc.NewOrderedMux()
+		mux.Use(d.Middleware)
+		mux.Handle("", d)
+		modes := make(chan *irc.Message, 10)
+		mux.HandleFunc("MODE", func(c *irc.Client, m *irc.Message) { modes <- m })
+		bursts := make(chan *irc.Message, 10)
+		mux.HandleFunc("mode:burst", func(c *irc.Client, m *irc.Message) { bursts <- m })
+
+		clock := irctest.NewClock(time.Time{})
+		s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+		s.welcome()
+		for _, step := range test.steps {
+			s.send(step.lines...)
+			s.sync()
+			clock.Advance(step.advance)
+			if step.burst == "" {
+				select {
+				case m := <-bursts:
+					t.Errorf("unexpected burst %q", m.Params)
+				case <-time.After(50 * time.Millisecond):
+				}
+				continue
+			}
+			select {
+			case m := <-bursts:
+				if got := strings.Join(m.Params, " "); got != step.burst {
+					t.Errorf("expected burst %q, got %q", step.burst, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("burst %q wasn't flushed", step.burst)
+			}
+		}
+
+		// User modes aren't coalesced.
+		s.send(":bot MODE bot +i")
+		s.sync()
+		select {
+		case m := <-modes:
+			if m.Params[0] != "bot" {
+				t.Errorf("channel mode %q wasn't withheld", m.Raw)
+			}
+		default:
+			t.Error("user mode was withheld")
+		}
+		select {
+		case m := <-modes:
+			t.Errorf("unexpected MODE %q", m.Raw)
+		default:
+		}
+	}
+}
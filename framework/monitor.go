@@ -0,0 +1,225 @@
+package framework
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"honnef.co/go/irc"
+)
+
+// ErrMonitorListFull is returned by Monitor.Add when adding the nicks
+// would exceed the MONITOR limit advertised by the server.
+var ErrMonitorListFull = errors.New("monitor list is full")
+
+// Monitor maintains the server-side MONITOR list. It remembers the
+// desired set of nicks across reconnects and, after connecting,
+// reconciles it with the output of MONITOR L. Additions and removals
+// are packed into as few MONITOR commands as possible. Nothing is
+// sent to servers that don't advertise MONITOR, but the desired set is
+// kept for servers that do.
+//
+// Notifications are dispatched to the client's Mux as the signals
+// monitor:online and monitor:offline, whose only parameter is the
+// nick.
+//
+// Monitor needs to be registered as a catch-all handler, with
+// HandleSync so that the replies to MONITOR L are reconciled in order.
+type Monitor struct {
+	*irc.Mux
+
+	mu sync.Mutex
+	// the desired set, as the nicks were given
+	wanted map[string]bool
+	// the server's list, by casefolded nick
+	listed map[string]string
+}
+
+func NewMonitor() *Monitor {
+	mo := &Monitor{
+		Mux:    irc.NewOrderedMux(),
+		wanted: make(map[string]bool),
+	}
+	mo.HandleFunc("irc:connected", mo.connected)
+	mo.HandleFunc(irc.RPL_MONLIST, mo.monlist)
+	mo.HandleFunc(irc.RPL_ENDOFMONLIST, mo.endOfMonlist)
+	mo.HandleFunc(irc.RPL_MONONLINE, mo.notify)
+	mo.HandleFunc(irc.RPL_MONOFFLINE, mo.notify)
+	return mo
+}
+
+// support returns the client's ISupport, or the defaults if the
+// client hasn't connected yet.
+func support(c *irc.Client) *irc.ISupport {
+	if is := c.Support(); is != nil {
+		return is
+	}
+	return irc.NewISupport()
+}
+
+// monitorSupported reports whether the server supports MONITOR.
+// ISupport.Monitor can't tell, as it is zero if there is no limit.
+func monitorSupported(c *irc.Client) bool {
+	_, ok := support(c).Raw("MONITOR")
+	return ok
+}
+
+// Nicks returns the desired set of monitored nicks.
+func (mo *Monitor) Nicks() []string {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	var nicks []string
+	for nick := range mo.wanted {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// find returns the name nick is stored under in the desired set. The
+// names aren't folded when storing them, as the casemapping isn't
+// known until after connecting. mo.mu must be held.
+func (mo *Monitor) find(is *irc.ISupport, nick string) (string, bool) {
+	if mo.wanted[nick] {
+		return nick, true
+	}
+	folded := is.Casefold(nick)
+	for name := range mo.wanted {
+		if is.Casefold(name) == folded {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Add adds nicks to the monitor list. If the client is connected,
+// the server's list will be updated immediately.
+func (mo *Monitor) Add(c *irc.Client, nicks ...string) error {
+	is := support(c)
+	mo.mu.Lock()
+	var added []string
+	for _, nick := range nicks {
+		if _, ok := mo.find(is, nick); ok {
+			continue
+		}
+		added = append(added, nick)
+	}
+	if max := is.Monitor; max > 0 && len(mo.wanted)+len(added) > max {
+		mo.mu.Unlock()
+		return ErrMonitorListFull
+	}
+	for _, nick := range added {
+		mo.wanted[nick] = true
+	}
+	mo.mu.Unlock()
+	if !c.Connected() {
+		return nil
+	}
+	return mo.send(c, "+", added)
+}
+
+// Remove removes nicks from the monitor list. If the client is
+// connected, the server's list will be updated immediately.
+func (mo *Monitor) Remove(c *irc.Client, nicks ...string) error {
+	is := support(c)
+	mo.mu.Lock()
+	var removed []string
+	for _, nick := range nicks {
+		name, ok := mo.find(is, nick)
+		if !ok {
+			continue
+		}
+		delete(mo.wanted, name)
+		removed = append(removed, nick)
+	}
+	mo.mu.Unlock()
+	if !c.Connected() {
+		return nil
+	}
+	return mo.send(c, "-", removed)
+}
+
+func (mo *Monitor) send(c *irc.Client, op string, nicks []string) error {
+	if !monitorSupported(c) {
+		return nil
+	}
+	max := support(c).TargMax["MONITOR"]
+	for _, msg := range irc.PackList("MONITOR "+op, nicks, max, 510) {
+		if err := c.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mo *Monitor) connected(c *irc.Client, m *irc.Message) {
+	mo.mu.Lock()
+	mo.listed = make(map[string]string)
+	mo.mu.Unlock()
+	// Monitor is dispatched to synchronously, and sending from the
+	// read loop could block it behind the rate limit.
+	go c.Send("MONITOR L")
+}
+
+func (mo *Monitor) monlist(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+	is := c.Support()
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	if mo.listed == nil {
+		return
+	}
+	for _, nick := range strings.Split(m.Params[len(m.Params)-1], ",") {
+		mo.listed[is.Casefold(nick)] = nick
+	}
+}
+
+func (mo *Monitor) endOfMonlist(c *irc.Client, m *irc.Message) {
+	is := c.Support()
+	mo.mu.Lock()
+	if mo.listed == nil {
+		mo.mu.Unlock()
+		return
+	}
+	var add, remove []string
+	wanted := make(map[string]bool, len(mo.wanted))
+	for nick := range mo.wanted {
+		key := is.Casefold(nick)
+		wanted[key] = true
+		if _, ok := mo.listed[key]; !ok {
+			add = append(add, nick)
+		}
+	}
+	for key, nick := range mo.listed {
+		if !wanted[key] {
+			remove = append(remove, nick)
+		}
+	}
+	mo.listed = nil
+	mo.mu.Unlock()
+
+	sort.Strings(add)
+	sort.Strings(remove)
+	go func() {
+		mo.send(c, "-", remove)
+		mo.send(c, "+", add)
+	}()
+}
+
+func (mo *Monitor) notify(c *irc.Client, m *irc.Message) {
+	// :server 730 me :nick!user@host[,nick!user@host]*
+	// :server 731 me :nick[,nick]*
+	if len(m.Params) < 2 {
+		return
+	}
+	signal := "monitor:online"
+	if m.Command == irc.RPL_MONOFFLINE {
+		signal = "monitor:offline"
+	}
+	for _, target := range strings.Split(m.Params[len(m.Params)-1], ",") {
+		c.Mux.Process(c, &irc.Message{Signal: signal, Params: []string{irc.ParseMask(target).Nick}})
+	}
+}
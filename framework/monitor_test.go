@@ -0,0 +1,55 @@
+package framework
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestMonitor(t *testing.T) {
+	mo := NewMonitor()
+	// Adding nicks before connecting only records them.
+	if err := mo.Add(&irc.Client{}, "alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	mux := irc.NewMux()
+	mux.HandleSync("", mo)
+	s := newTestServer(t, mux)
+	s.send(welcomeLines...)
+	s.expect("MONITOR L")
+
+	// The server's list is reconciled with the desired set, using
+	// the network's casemapping.
+	s.send(
+		":irc.test 732 bot :BOB,carol",
+		":irc.test 733 bot :End of MONITOR list",
+	)
+	s.expectSent("MONITOR - carol", "MONITOR + alice")
+
+	if err := mo.Add(s.c, "Alice", "dave"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Remove(s.c, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if sent, want := s.sent(), []string{"MONITOR + dave", "MONITOR - Bob"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("expected %q, got %q", want, sent)
+	}
+	if nicks, want := mo.Nicks(), []string{"alice", "dave"}; !reflect.DeepEqual(nicks, want) {
+		t.Errorf("expected nicks %q, got %q", want, nicks)
+	}
+
+	// The server allows 100 entries.
+	var many []string
+	for i := 0; i < 99; i++ {
+		many = append(many, fmt.Sprintf("user%d", i))
+	}
+	if err := mo.Add(s.c, many...); err != ErrMonitorListFull {
+		t.Errorf("expected ErrMonitorListFull, got %v", err)
+	}
+	if len(mo.Nicks()) != 2 {
+		t.Errorf("nicks were added despite the full list: %q", mo.Nicks())
+	}
+}
@@ -0,0 +1,79 @@
+package framework
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"honnef.co/go/irc"
+)
+
+// zeroWidthSpace breaks up nicks so that clients don't highlight the
+// users they belong to.
+const zeroWidthSpace = "\u200b"
+
+// NickRenderer renders the nicks of users whose messages are relayed
+// to another network or channel, such that the users don't get
+// pinged by their own relayed messages.
+type NickRenderer struct {
+	// Format is the format of a rendered nick, containing a single
+	// %s, e.g. "<%s>" or "[%s]". Defaults to "<%s>".
+	Format string
+	// ZeroWidth causes a zero-width space to be inserted after the
+	// first character of nicks.
+	ZeroWidth bool
+	// MaxLen is the maximum length of nicks in bytes, not counting
+	// Format and the zero-width space. Longer nicks are truncated. If
+	// zero, nicks aren't truncated, unless rendered with RenderFor.
+	MaxLen int
+}
+
+// Render renders nick.
+func (r NickRenderer) Render(nick string) string {
+	return r.render(nick, r.MaxLen)
+}
+
+// RenderFor renders nick for the network described by is, truncating
+// it to the network's NICKLEN if that's shorter than MaxLen.
+func (r NickRenderer) RenderFor(is *irc.ISupport, nick string) string {
+	max := r.MaxLen
+	if is.NickLen > 0 && (max == 0 || is.NickLen < max) {
+		max = is.NickLen
+	}
+	return r.render(nick, max)
+}
+
+func (r NickRenderer) render(nick string, max int) string {
+	if max > 0 {
+		nick = irc.Truncate(nick, max)
+	}
+	if r.ZeroWidth && nick != "" {
+		_, size := utf8.DecodeRuneInString(nick)
+		nick = nick[:size] + zeroWidthSpace + nick[size:]
+	}
+	format := r.Format
+	if format == "" {
+		format = "<%s>"
+	}
+	return fmt.Sprintf(format, nick)
+}
+
+// RandomNick returns base followed by digits random digits, for use
+// when base is taken. base is shortened as needed to fit the
+// network's NICKLEN. If r is nil, irc.DefaultRandom is used.
+func RandomNick(is *irc.ISupport, r irc.Random, base string, digits int) string {
+	if r == nil {
+		r = irc.DefaultRandom
+	}
+	suffix := ""
+	for i := 0; i < digits; i++ {
+		suffix += strconv.FormatInt(r.Int63n(10), 10)
+	}
+	if max := is.NickLen - len(suffix); is.NickLen > 0 && len(base) > max {
+		if max < 1 {
+			max = 1
+		}
+		base = irc.Truncate(base, max)
+	}
+	return base + suffix
+}
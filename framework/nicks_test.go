@@ -0,0 +1,63 @@
+package framework
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestNickRenderer(t *testing.T) {
+	is := irc.NewISupport()
+	is.NickLen = 5
+	table := []struct {
+		r      NickRenderer
+		nick   string
+		render string
+		// The result of RenderFor with a NICKLEN of 5
+		renderFor string
+	}{
+		{NickRenderer{}, "alice", "<alice>", "<alice>"},
+		{NickRenderer{Format: "[%s]", ZeroWidth: true}, "bob", "[b\u200bob]", "[b\u200bob]"},
+		{NickRenderer{ZeroWidth: true}, "ünï", "<ü\u200bnï>", "<ü\u200bnï>"},
+		{NickRenderer{MaxLen: 3}, "mallory", "<mal>", "<mal>"},
+		{NickRenderer{}, "mallory", "<mallory>", "<mallo>"},
+		// Runes aren't split when truncating.
+		{NickRenderer{MaxLen: 4}, "ünïcode", "<ün>", "<ün>"},
+		{NickRenderer{}, "ünïcode", "<ünïcode>", "<ünï>"},
+	}
+	for _, test := range table {
+		if got := test.r.Render(test.nick); got != test.render {
+			t.Errorf("%+v: Render(%q) = %q, expected %q", test.r, test.nick, got, test.render)
+		}
+		if got := test.r.RenderFor(is, test.nick); got != test.renderFor {
+			t.Errorf("%+v: RenderFor(%q) = %q, expected %q", test.r, test.nick, got, test.renderFor)
+		}
+	}
+}
+
+// constRandom always returns the same number.
+type constRandom int64
+
+func (r constRandom) Int63n(n int64) int64 { return int64(r) % n }
+
+func TestRandomNick(t *testing.T) {
+	table := []struct {
+		nickLen int
+		base    string
+		digits  int
+		want    string
+	}{
+		{0, "bot", 3, "bot777"},
+		{9, "bot", 3, "bot777"},
+		{6, "robot", 3, "rob777"},
+		{3, "robot", 3, "r777"},
+		{6, "ünïbot", 2, "ün77"},
+	}
+	for _, test := range table {
+		is := irc.NewISupport()
+		is.NickLen = test.nickLen
+		if got := RandomNick(is, constRandom(7), test.base, test.digits); got != test.want {
+			t.Errorf("RandomNick(%d, %q, %d) = %q, expected %q", test.nickLen, test.base, test.digits, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package framework
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// ErrOpTimeout is passed to OpQueue.OnError for actions that were
+// dropped because op couldn't be acquired in time.
+var ErrOpTimeout = errors.New("timed out waiting for op")
+
+// OpAction is a moderation action that requires channel operator
+// status.
+type OpAction func(c *irc.Client, channel string) error
+
+// OpQueue queues moderation actions until the bot is a channel
+// operator. If it isn't, op is requested from ChanServ, the queued
+// actions are performed once it is granted and, if Deop is set, op
+// is given up again afterwards.
+//
+// OpQueue tracks the bot's op status from NAMES replies and mode
+// changes and needs to be registered as a catch-all handler, with
+// HandleSync so that op and deop are seen in order.
+type OpQueue struct {
+	*irc.Mux
+	// The nick of the channel services bot. Defaults to ChanServ.
+	ChanServ string
+	// Deop causes the bot to remove its own op after performing the
+	// queued actions, if it had to request op for them.
+	Deop bool
+	// How long to wait for op before dropping the queued actions.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+	// OnError, if set, is called with errors returned by actions and
+	// with ErrOpTimeout for dropped actions.
+	OnError func(channel string, err error)
+
+	mu      sync.Mutex
+	opped   map[string]bool
+	pending map[string]*opRequest
+}
+
+type opRequest struct {
+	actions []OpAction
+	timer   irc.Timer
+}
+
+func NewOpQueue() *OpQueue {
+	q := &OpQueue{
+		Mux:     irc.NewOrderedMux(),
+		opped:   make(map[string]bool),
+		pending: make(map[string]*opRequest),
+	}
+	q.HandleFunc(irc.RPL_NAMREPLY, q.names)
+	q.HandleFunc("MODE", q.mode)
+	q.HandleFunc("self:PART", q.left)
+	q.HandleFunc("irc:kicked", q.left)
+	q.HandleFunc("irc:connected", q.connected)
+	return q
+}
+
+func (q *OpQueue) chanServ() string {
+	if q.ChanServ == "" {
+		return "ChanServ"
+	}
+	return q.ChanServ
+}
+
+func (q *OpQueue) timeout() time.Duration {
+	if q.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return q.Timeout
+}
+
+// Opped reports whether the bot is an operator in channel.
+func (q *OpQueue) Opped(channel string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.opped[strings.ToLower(channel)]
+}
+
+// Do performs action in channel, immediately if the bot is an
+// operator, and otherwise once op has been acquired.
+func (q *OpQueue) Do(c *irc.Client, channel string, action OpAction) error {
+	key := strings.ToLower(channel)
+	q.mu.Lock()
+	if q.opped[key] {
+		q.mu.Unlock()
+		q.report(channel, action(c, channel))
+		return nil
+	}
+	req, ok := q.pending[key]
+	if ok {
+		req.actions = append(req.actions, action)
+		q.mu.Unlock()
+		return nil
+	}
+	req = &opRequest{actions: []OpAction{action}}
+	req.timer = irc.OrRealClock(c.Clock).AfterFunc(q.timeout(), func() { q.expire(key, channel, req) })
+	q.pending[key] = req
+	q.mu.Unlock()
+	return c.Privmsg(q.chanServ(), "OP "+channel+" "+c.CurrentNick())
+}
+
+func (q *OpQueue) report(channel string, err error) {
+	if err != nil && q.OnError != nil {
+		q.OnError(channel, err)
+	}
+}
+
+func (q *OpQueue) expire(key, channel string, req *opRequest) {
+	q.mu.Lock()
+	if q.pending[key] != req {
+		q.mu.Unlock()
+		return
+	}
+	delete(q.pending, key)
+	q.mu.Unlock()
+	for range req.actions {
+		q.report(channel, ErrOpTimeout)
+	}
+}
+
+func (q *OpQueue) setOpped(c *irc.Client, channel string, opped bool) {
+	key := strings.ToLower(channel)
+	q.mu.Lock()
+	q.opped[key] = opped
+	req := q.pending[key]
+	if !opped || req == nil {
+		q.mu.Unlock()
+		return
+	}
+	delete(q.pending, key)
+	req.timer.Stop()
+	q.mu.Unlock()
+
+	// OpQueue is dispatched to synchronously, and sending from the
+	// read loop could block it behind the rate limit.
+	go func() {
+		for _, action := range req.actions {
+			q.report(channel, action(c, channel))
+		}
+		if q.Deop {
+			c.Sendf("MODE %s -o %s", channel, c.CurrentNick())
+		}
+	}()
+}
+
+func (q *OpQueue) names(c *irc.Client, m *irc.Message) {
+	// :server 353 me = #channel :@nick +other
+	if len(m.Params) < 4 {
+		return
+	}
+	is := c.Support()
+	me := c.CurrentNick()
+	for _, name := range strings.Fields(m.Params[3]) {
+		nick := strings.TrimLeft(name, string(prefixSigils(is)))
+		if strings.EqualFold(nick, me) {
+			opped := strings.ContainsRune(name[:len(name)-len(nick)], is.Prefix['o'])
+			q.setOpped(c, m.Params[2], opped)
+			return
+		}
+	}
+}
+
+func prefixSigils(is *irc.ISupport) []rune {
+	var sigils []rune
+	for _, r := range is.Prefix {
+		sigils = append(sigils, r)
+	}
+	return sigils
+}
+
+func (q *OpQueue) mode(c *irc.Client, m *irc.Message) {
+	channel, changes, _ := irc.ModeParser{ISupport: c.Support()}.Parse(m)
+	if !c.Support().IsChannel(channel) {
+		return
+	}
+	me := c.CurrentNick()
+	for _, ch := range changes {
+		if ch.Mode == 'o' && strings.EqualFold(ch.Arg, me) {
+			q.setOpped(c, channel, ch.Add)
+		}
+	}
+}
+
+func (q *OpQueue) left(c *irc.Client, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+	q.mu.Lock()
+	delete(q.opped, strings.ToLower(m.Params[0]))
+	q.mu.Unlock()
+}
+
+func (q *OpQueue) connected(c *irc.Client, m *irc.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.opped = make(map[string]bool)
+}
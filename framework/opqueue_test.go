@@ -0,0 +1,88 @@
+package framework
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestOpQueue(t *testing.T) {
+	q := NewOpQueue()
+	q.Deop = true
+	q.Timeout = time.Minute
+	errs := make(chan error, 10)
+	q.OnError = func(channel string, err error) { errs <- err }
+	mux := irc.NewOrderedMux()
+	mux.HandleSync("", q)
+	clock := irctest.NewClock(time.Time{})
+	s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+	s.welcome()
+
+	kick := func(nick string) OpAction {
+		return func(c *irc.Client, channel string) error {
+			return c.Sendf("KICK %s %s", channel, nick)
+		}
+	}
+
+	s.send(
+		":bot!bot@host JOIN #chan",
+		":irc.test 353 bot = #chan :+bot @alice",
+	)
+	s.sync()
+	if q.Opped("#chan") {
+		t.Error("bot isn't opped in #chan")
+	}
+
+	// Actions are queued until op has been granted, and op is given
+	// up again afterwards.
+	if err := q.Do(s.c, "#chan", kick("eve")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Do(s.c, "#CHAN", kick("mallory")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"PRIVMSG ChanServ :OP #chan bot"}
+	if sent := s.sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("expected %q, got %q", expected, sent)
+	}
+	s.send(":ChanServ!s@services MODE #chan +o bot")
+	s.expectSent("KICK #chan eve", "KICK #chan mallory", "MODE #chan -o bot")
+
+	// Actions run immediately while opped.
+	s.send(":ChanServ!s@services MODE #chan +o bot")
+	s.sync()
+	if !q.Opped("#chan") {
+		t.Fatal("bot is opped in #chan")
+	}
+	if err := q.Do(s.c, "#chan", kick("trudy")); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"KICK #chan trudy"}
+	if sent := s.sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("expected %q, got %q", expected, sent)
+	}
+
+	// Queued actions are dropped if op isn't granted in time.
+	s.send(":alice!a@host MODE #chan -o bot")
+	s.sync()
+	if err := q.Do(s.c, "#chan", kick("eve")); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("PRIVMSG ChanServ :OP #chan bot")
+	clock.Advance(time.Minute)
+	select {
+	case err := <-errs:
+		if err != ErrOpTimeout {
+			t.Errorf("expected ErrOpTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued action wasn't dropped")
+	}
+	s.send(":ChanServ!s@services MODE #chan +o bot")
+	if sent := s.sent(); len(sent) != 0 {
+		t.Errorf("dropped action was performed: %q", sent)
+	}
+}
@@ -0,0 +1,232 @@
+package framework
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Presence tracks whether nicks of interest are online. It uses
+// MONITOR when the server supports it and falls back to polling with
+// ISON otherwise.
+//
+// Changes are reported to OnChange, if set, and as the signals
+// presence:online and presence:offline, whose first parameter is the
+// nick. The signals are dispatched to the client's Mux.
+//
+// The tracked nicks are Monitor's desired set, so Monitor restores
+// them after reconnecting. Presence needs to be registered as a
+// catch-all handler, with HandleSync so that ISON replies are matched
+// with the queries they answer. It registers its Monitor itself.
+type Presence struct {
+	*irc.Mux
+	Monitor *Monitor
+	// How often to poll with ISON if the server doesn't support
+	// MONITOR. Defaults to one minute.
+	PollInterval time.Duration
+	// OnChange, if set, is called whenever a tracked nick comes
+	// online or goes offline.
+	OnChange func(c *irc.Client, nick string, online bool)
+
+	mu     sync.Mutex
+	online map[string]bool
+	// the connection we're polling with ISON for
+	pollingFor <-chan struct{}
+	// nicks of the ISON queries that haven't been answered yet
+	pending [][]string
+}
+
+func NewPresence() *Presence {
+	p := &Presence{
+		Mux:     irc.NewOrderedMux(),
+		Monitor: NewMonitor(),
+		online:  make(map[string]bool),
+	}
+	p.Handle("", p.Monitor)
+	p.HandleFunc("irc:connected", p.connected)
+	p.HandleFunc(irc.RPL_ENDOFMOTD, p.registered)
+	p.HandleFunc(irc.ERR_NOMOTD, p.registered)
+	p.HandleFunc("monitor:online", p.monitored)
+	p.HandleFunc("monitor:offline", p.monitored)
+	p.HandleFunc(irc.RPL_ISON, p.ison)
+	return p
+}
+
+func (p *Presence) pollInterval() time.Duration {
+	if p.PollInterval == 0 {
+		return time.Minute
+	}
+	return p.PollInterval
+}
+
+// Online reports whether nick is known to be online.
+func (p *Presence) Online(c *irc.Client, nick string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.online[support(c).Casefold(nick)]
+}
+
+// Nicks returns the tracked nicks.
+func (p *Presence) Nicks() []string {
+	return p.Monitor.Nicks()
+}
+
+// tracked reports whether nick is tracked.
+func (p *Presence) tracked(is *irc.ISupport, nick string) bool {
+	key := is.Casefold(nick)
+	for _, tracked := range p.Monitor.Nicks() {
+		if is.Casefold(tracked) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Track starts tracking nicks. If the client is connected, their
+// current state is queried immediately.
+func (p *Presence) Track(c *irc.Client, nicks ...string) error {
+	if err := p.Monitor.Add(c, nicks...); err != nil {
+		return err
+	}
+	if !c.Connected() || monitorSupported(c) {
+		return nil
+	}
+	return p.sendISON(c, nicks)
+}
+
+// Untrack stops tracking nicks.
+func (p *Presence) Untrack(c *irc.Client, nicks ...string) error {
+	is := support(c)
+	p.mu.Lock()
+	for _, nick := range nicks {
+		delete(p.online, is.Casefold(nick))
+	}
+	p.mu.Unlock()
+	return p.Monitor.Remove(c, nicks...)
+}
+
+func (p *Presence) set(c *irc.Client, nick string, online bool) {
+	is := c.Support()
+	if !p.tracked(is, nick) {
+		return
+	}
+	key := is.Casefold(nick)
+	p.mu.Lock()
+	if p.online[key] == online {
+		p.mu.Unlock()
+		return
+	}
+	if online {
+		p.online[key] = true
+	} else {
+		delete(p.online, key)
+	}
+	p.mu.Unlock()
+
+	if p.OnChange != nil {
+		p.OnChange(c, nick, online)
+	}
+	signal := "presence:offline"
+	if online {
+		signal = "presence:online"
+	}
+	c.Mux.Process(c, &irc.Message{Signal: signal, Params: []string{nick}})
+}
+
+func (p *Presence) connected(c *irc.Client, m *irc.Message) {
+	// Whoever was online during the previous connection will be
+	// reported again.
+	p.mu.Lock()
+	p.online = make(map[string]bool)
+	p.pending = nil
+	p.mu.Unlock()
+}
+
+// registered is called at the end of the MOTD, at which point we know
+// whether the server supports MONITOR. If it does, Monitor takes care
+// of restoring the list.
+func (p *Presence) registered(c *irc.Client, m *irc.Message) {
+	if monitorSupported(c) {
+		return
+	}
+
+	done := c.Done()
+	p.mu.Lock()
+	if p.pollingFor == done {
+		p.mu.Unlock()
+		return
+	}
+	p.pollingFor = done
+	p.mu.Unlock()
+	go p.poll(c, done)
+}
+
+func (p *Presence) poll(c *irc.Client, done <-chan struct{}) {
+	t := irc.OrRealClock(c.Clock).NewTicker(p.pollInterval())
+	defer t.Stop()
+	for {
+		if err := p.sendISON(c, p.Nicks()); err != nil {
+			return
+		}
+		select {
+		case <-t.C():
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *Presence) sendISON(c *irc.Client, nicks []string) error {
+	// ISON doesn't have a TARGMAX, but its reply has to fit in a
+	// single line as well.
+	for _, msg := range irc.PackList("ISON", nicks, 0, 400) {
+		query := strings.Split(strings.TrimPrefix(msg, "ISON "), ",")
+		p.mu.Lock()
+		p.pending = append(p.pending, query)
+		p.mu.Unlock()
+		if err := c.Send("ISON " + strings.Join(query, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Presence) monitored(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+	p.set(c, m.Params[0], m.Signal == "monitor:online")
+}
+
+func (p *Presence) ison(c *irc.Client, m *irc.Message) {
+	// :server 303 me :nick nick
+	//
+	// The reply only lists the nicks that are online, so we match it
+	// up with the oldest query we sent to learn which ones aren't.
+	if len(m.Params) < 2 {
+		return
+	}
+	p.mu.Lock()
+	if len(p.pending) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	query := p.pending[0]
+	p.pending = p.pending[1:]
+	p.mu.Unlock()
+
+	is := c.Support()
+	online := make(map[string]string)
+	for _, nick := range strings.Fields(m.Params[len(m.Params)-1]) {
+		online[is.Casefold(nick)] = nick
+	}
+	for _, nick := range query {
+		if actual, ok := online[is.Casefold(nick)]; ok {
+			p.set(c, actual, true)
+		} else {
+			p.set(c, nick, false)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package framework
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+type presenceChange struct {
+	nick   string
+	online bool
+}
+
+func newTestPresence(t *testing.T) (*testServer, *Presence, chan presenceChange) {
+	p := NewPresence()
+	changes := make(chan presenceChange, 10)
+	p.OnChange = func(c *irc.Client, nick string, online bool) {
+		changes <- presenceChange{nick, online}
+	}
+	// Presence can be used before connecting.
+	disconnected := &irc.Client{}
+	p.Track(disconnected, "carol")
+	p.Untrack(disconnected, "carol")
+	if p.Online(disconnected, "carol") {
+		t.Error("carol is online before connecting")
+	}
+	mux := irc.NewMux()
+	mux.HandleSync("", p)
+	s := newTestServer(t, mux)
+	if err := p.Track(s.c, "alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	return s, p, changes
+}
+
+func expectChange(t *testing.T, changes chan presenceChange, want presenceChange) {
+	t.Helper()
+	select {
+	case got := <-changes:
+		if got != want {
+			t.Errorf("expected change %v, got %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for change %v", want)
+	}
+}
+
+func TestPresenceMonitor(t *testing.T) {
+	s, p, changes := newTestPresence(t)
+	s.send(welcomeLines...)
+	// Monitor restores the list after connecting; the end of the
+	// MOTD doesn't add the nicks again.
+	s.expect("MONITOR L")
+	s.send(":irc.test 732 bot :bob", ":irc.test 733 bot :End of MONITOR list")
+	s.expect("MONITOR + alice")
+
+	s.send(":irc.test 730 bot :Alice!a@host,bob!b@host", ":irc.test 731 bot :carol")
+	// Signals are dispatched concurrently.
+	got := map[presenceChange]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case change := <-changes:
+			got[change] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for changes")
+		}
+	}
+	if want := map[presenceChange]bool{{"Alice", true}: true, {"bob", true}: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected changes %v, got %v", want, got)
+	}
+	if !p.Online(s.c, "ALICE") {
+		t.Error("alice isn't online")
+	}
+	s.send(":irc.test 731 bot :alice")
+	expectChange(t, changes, presenceChange{"alice", false})
+
+	p.Untrack(s.c, "bob")
+	for _, line := range s.sent() {
+		if strings.HasPrefix(line, "MONITOR") && line != "MONITOR - bob" {
+			t.Errorf("unexpected %q", line)
+		}
+	}
+	if nicks := p.Nicks(); !reflect.DeepEqual(nicks, []string{"alice"}) {
+		t.Errorf("expected to track alice, got %q", nicks)
+	}
+}
+
+func TestPresenceISON(t *testing.T) {
+	s, p, changes := newTestPresence(t)
+	s.send(
+		":irc.test 001 bot :Welcome",
+		":irc.test 002 bot :Your host is irc.test",
+		":irc.test 003 bot :This server was created today",
+		":irc.test 004 bot irc.test test-1.0 iow biklmnopstv",
+		":irc.test 005 bot CHANTYPES=# PREFIX=(ov)@+ CASEMAPPING=rfc1459 :are supported by this server",
+		":irc.test 376 bot :End of MOTD",
+	)
+	s.expect("ISON alice bob")
+	s.send(":irc.test 303 bot :Alice")
+	expectChange(t, changes, presenceChange{"Alice", true})
+
+	p.Track(s.c, "carol")
+	s.expect("ISON carol")
+	s.send(":irc.test 303 bot :carol")
+	expectChange(t, changes, presenceChange{"carol", true})
+	for _, line := range s.sent() {
+		if strings.HasPrefix(line, "MONITOR +") {
+			t.Errorf("sent %q to a server without MONITOR", line)
+		}
+	}
+}
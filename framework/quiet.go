@@ -0,0 +1,49 @@
+package framework
+
+import (
+	"errors"
+	"strings"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/extban"
+)
+
+// ErrQuietUnsupported is returned when the server offers no way of
+// quieting users.
+var ErrQuietUnsupported = errors.New("server doesn't support quieting users")
+
+// QuietMode returns the mode change that quiets users matching mask
+// on the server described by is. Servers of the charybdis family
+// have a +q list mode, while on UnrealIRCd +q is the channel owner
+// prefix and quieting is done with an extended ban, as it is on
+// InspIRCd. Blindly sending +q would make the user an owner on the
+// latter.
+func QuietMode(is *irc.ISupport, mask string) (mode rune, arg string, err error) {
+	_, isPrefix := is.Prefix['q']
+	if !isPrefix && strings.ContainsRune(string(is.ChanModes.A), 'q') {
+		return 'q', mask, nil
+	}
+	ban, err := extban.Quiet(mask).Format(is)
+	if err != nil {
+		return 0, "", ErrQuietUnsupported
+	}
+	return 'b', ban, nil
+}
+
+// Quiet quiets users matching mask in channel.
+func Quiet(c *irc.Client, channel, mask string) error {
+	mode, arg, err := QuietMode(c.Support(), mask)
+	if err != nil {
+		return err
+	}
+	return c.Sendf("MODE %s +%c %s", channel, mode, arg)
+}
+
+// Unquiet removes a quiet set by Quiet.
+func Unquiet(c *irc.Client, channel, mask string) error {
+	mode, arg, err := QuietMode(c.Support(), mask)
+	if err != nil {
+		return err
+	}
+	return c.Sendf("MODE %s -%c %s", channel, mode, arg)
+}
@@ -0,0 +1,31 @@
+package framework
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestQuietMode(t *testing.T) {
+	table := []struct {
+		server string
+		tokens string
+		mode   rune
+		arg    string
+		err    error
+	}{
+		{"charybdis", "PREFIX=(ov)@+ CHANMODES=eIbq,k,flj,CFLMPQScgimnprstuz", 'q', "*!*@host", nil},
+		{"UnrealIRCd", "PREFIX=(qaohv)~&@%+ CHANMODES=beI,kLf,l,psmntirzMQNRTOVKDdGPZSCc EXTBAN=~,acqrS", 'b', "~q:*!*@host", nil},
+		{"InspIRCd", "PREFIX=(ov)@+ CHANMODES=IXbeg,k,Ffjl,ACKMNOPQRSTcimnprstz EXTBAN=,ORmrjz", 'b', "m:*!*@host", nil},
+		{"owner prefix without extbans", "PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnpst", 0, "", ErrQuietUnsupported},
+	}
+	for _, test := range table {
+		is := irc.NewISupport()
+		is.Parse(irc.Parse(":irc.test 005 bot " + test.tokens + " :are supported by this server"))
+		mode, arg, err := QuietMode(is, "*!*@host")
+		if mode != test.mode || arg != test.arg || err != test.err {
+			t.Errorf("%s: got %q, %q, %v, expected %q, %q, %v",
+				test.server, mode, arg, err, test.mode, test.arg, test.err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package framework
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"honnef.co/go/irc"
+)
+
+var (
+	handlerType = reflect.TypeOf(func(*irc.Client, *irc.Message) {})
+	commandType = reflect.TypeOf(CommandFunc(nil))
+)
+
+// Route registers the methods and fields of v, which must be a
+// pointer to a struct, as handlers:
+//
+//   - Methods named OnX, where X starts with an upper-case letter or
+//     a digit, that have the signature of a handler function are
+//     registered on mux for the signal X, converted to upper case.
+//     For example, OnPrivmsg handles PRIVMSG and On001 handles 001,
+//     while Online isn't a handler.
+//   - Methods named Cmd_X that have the signature of a CommandFunc
+//     are registered on cs as the command x, converted to lower case.
+//   - Fields of handler function type that have an irc struct tag
+//     are registered on mux for the pattern in the tag, e.g.
+//     `irc:"PRIVMSG"`. Patterns with a regular expression, such as
+//     `irc:"PRIVMSG/^hello"`, require mux to be a RegexpMuxer.
+//
+// Route returns an error if a method or field looks like a handler
+// but has the wrong signature, in which case nothing is registered.
+// cs may be nil if v has no commands.
+func Route(mux irc.Muxer, cs *Commands, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected pointer to struct, got %T", v)
+	}
+	type route struct {
+		pattern string
+		h       irc.Handler
+	}
+	var routes []route
+	var cmds []*Command
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumMethod(); i++ {
+		meth := rt.Method(i)
+		fn := rv.Method(i)
+		switch {
+		case isHandlerName(meth.Name):
+			if fn.Type() != handlerType {
+				return fmt.Errorf("method %s has the wrong signature for a handler", meth.Name)
+			}
+			h := fn.Interface().(func(*irc.Client, *irc.Message))
+			routes = append(routes, route{strings.ToUpper(meth.Name[2:]), irc.Named(meth.Name, irc.HandlerFunc(h))})
+		case strings.HasPrefix(meth.Name, "Cmd_") && len(meth.Name) > 4:
+			if !fn.Type().ConvertibleTo(commandType) {
+				return fmt.Errorf("method %s has the wrong signature for a command", meth.Name)
+			}
+			if cs == nil {
+				return fmt.Errorf("method %s is a command but no Commands were provided", meth.Name)
+			}
+			cmds = append(cmds, &Command{
+				Name: strings.ToLower(meth.Name[4:]),
+				Help: strings.ToLower(meth.Name[4:]),
+				Func: fn.Convert(commandType).Interface().(CommandFunc),
+			})
+		}
+	}
+
+	st := rt.Elem()
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		pattern, ok := field.Tag.Lookup("irc")
+		if !ok {
+			continue
+		}
+		if field.Type != handlerType {
+			return fmt.Errorf("field %s has the wrong type for a handler", field.Name)
+		}
+		if field.PkgPath != "" {
+			return fmt.Errorf("field %s is unexported", field.Name)
+		}
+		if i := strings.Index(pattern, "/"); i >= 0 {
+			if _, ok := mux.(*RegexpMuxer); !ok {
+				return fmt.Errorf("field %s has a regular expression, which requires a RegexpMuxer", field.Name)
+			}
+			if _, err := regexp.Compile(pattern[i+1:]); err != nil {
+				return fmt.Errorf("field %s: %s", field.Name, err)
+			}
+		}
+		fv := rv.Elem().Field(i)
+		if fv.IsNil() {
+			continue
+		}
+		h := fv.Interface().(func(*irc.Client, *irc.Message))
+		routes = append(routes, route{pattern, irc.Named(field.Name, irc.HandlerFunc(h))})
+	}
+
+	for _, r := range routes {
+		mux.Handle(r.pattern, r.h)
+	}
+	for _, cmd := range cmds {
+		cs.Register(cmd)
+	}
+	return nil
+}
+
+// isHandlerName reports whether name is that of a handler method,
+// On followed by an upper-case letter or a digit.
+func isHandlerName(name string) bool {
+	if !strings.HasPrefix(name, "On") {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(name[2:])
+	return unicode.IsUpper(r) || unicode.IsDigit(r)
+}
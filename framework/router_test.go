@@ -0,0 +1,72 @@
+package framework
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+type routed struct {
+	Hello func(*irc.Client, *irc.Message) `irc:"PRIVMSG"`
+	Unset func(*irc.Client, *irc.Message) `irc:"NOTICE"`
+}
+
+func (*routed) OnPrivmsg(c *irc.Client, m *irc.Message)                     {}
+func (*routed) On001(c *irc.Client, m *irc.Message)                         {}
+func (*routed) Online() bool                                                { return true }
+func (*routed) Once(fn func())                                              {}
+func (*routed) Cmd_Ping(c *irc.Client, m *irc.Message, args []string) error { return nil }
+
+type badRouted struct{}
+
+func (*badRouted) Cmd_Ping(c *irc.Client, m *irc.Message, args []string) error { return nil }
+func (*badRouted) OnJoin(c *irc.Client, m *irc.Message)                        {}
+func (*badRouted) OnPart(c *irc.Client)                                        {}
+
+type regexpRouted struct {
+	Hello func(*irc.Client, *irc.Message) `irc:"PRIVMSG/^hello"`
+}
+
+func TestRoute(t *testing.T) {
+	mux := irc.NewMux()
+	cs := NewCommands("!")
+	if err := Route(mux, cs, &routed{Hello: func(*irc.Client, *irc.Message) {}}); err != nil {
+		t.Fatal(err)
+	}
+	got := mux.Describe()
+	for _, names := range got {
+		sort.Strings(names)
+	}
+	want := map[string][]string{
+		"PRIVMSG": {"Hello", "OnPrivmsg"},
+		"001":     {"On001"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected handlers %v, got %v", want, got)
+	}
+	if _, ok := cs.Lookup("ping"); !ok {
+		t.Error("expected command ping to be registered")
+	}
+
+	mux = irc.NewMux()
+	cs = NewCommands("!")
+	if err := Route(mux, cs, &badRouted{}); err == nil {
+		t.Error("expected error for handler with wrong signature")
+	}
+	if got := mux.Describe(); len(got) != 0 {
+		t.Errorf("expected no handlers after failure, got %v", got)
+	}
+	if _, ok := cs.Lookup("ping"); ok {
+		t.Error("expected no commands after failure")
+	}
+
+	v := &regexpRouted{Hello: func(*irc.Client, *irc.Message) {}}
+	if err := Route(irc.NewMux(), nil, v); err == nil {
+		t.Error("expected error for regular expression on a plain Mux")
+	}
+	if err := Route(NewRegexpMuxer(), nil, v); err != nil {
+		t.Errorf("unexpected error for regular expression on a RegexpMuxer: %s", err)
+	}
+}
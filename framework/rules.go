@@ -0,0 +1,298 @@
+package framework
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"honnef.co/go/irc"
+)
+
+// RuleAction is what a Rule does with the messages it matches.
+type RuleAction int
+
+const (
+	// ActionDrop keeps messages from reaching any handler.
+	ActionDrop RuleAction = iota
+	// ActionTag sets a tag on messages.
+	ActionTag
+	// ActionSignal additionally dispatches messages as a signal.
+	ActionSignal
+)
+
+// A Rule matches messages and applies an action to them. Empty
+// matchers match everything.
+//
+// Rules can be written in a small language, one rule per line:
+//
+//	command=PRIVMSG channel=#chan* mask=*!*@*.example text=/buy(ing)? now/ drop
+//	command=NOTICE mask=NickServ tag log=services
+//	text=/\bbot\b/ signal rules:mention
+//
+// Matchers are command, channel and mask, which take wildcard
+// patterns, and text, which takes a regular expression between
+// slashes. The matchers are followed by the action: drop, tag
+// key[=value] or signal name.
+type Rule struct {
+	Command string
+	// A wildcard pattern for the channel the message refers to.
+	Channel string
+	// A wildcard pattern for the sender's hostmask.
+	Mask string
+	// Matched against the last parameter.
+	Text   *regexp.Regexp
+	Action RuleAction
+	// The tag set by ActionTag.
+	Tag   string
+	Value string
+	// The signal dispatched by ActionSignal.
+	Signal string
+}
+
+// Matches reports whether m matches the rule.
+func (r Rule) Matches(is *irc.ISupport, m *irc.Message) bool {
+	if r.Command != "" && !strings.EqualFold(r.Command, m.Command) {
+		return false
+	}
+	if r.Channel != "" {
+		channel, ok := is.ChannelForMsg(m)
+		if !ok || !irc.WildcardMatch(is.Casefold(r.Channel), is.Casefold(channel)) {
+			return false
+		}
+	}
+	if r.Mask != "" && !is.Match(m.Prefix, r.Mask) {
+		return false
+	}
+	if r.Text != nil && (len(m.Params) == 0 || !r.Text.MatchString(m.Params[len(m.Params)-1])) {
+		return false
+	}
+	return true
+}
+
+func (r Rule) String() string {
+	var fields []string
+	if r.Command != "" {
+		fields = append(fields, "command="+r.Command)
+	}
+	if r.Channel != "" {
+		fields = append(fields, "channel="+r.Channel)
+	}
+	if r.Mask != "" {
+		fields = append(fields, "mask="+r.Mask)
+	}
+	if r.Text != nil {
+		fields = append(fields, "text=/"+strings.Replace(r.Text.String(), "/", `\/`, -1)+"/")
+	}
+	switch r.Action {
+	case ActionDrop:
+		fields = append(fields, "drop")
+	case ActionTag:
+		tag := r.Tag
+		if r.Value != "" {
+			tag += "=" + r.Value
+		}
+		fields = append(fields, "tag", tag)
+	case ActionSignal:
+		fields = append(fields, "signal", r.Signal)
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseRule parses a rule in the language described by Rule.
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	s = strings.TrimSpace(s)
+	for s != "" {
+		if strings.HasPrefix(s, "text=/") {
+			// The expression may contain spaces, so it extends to
+			// the next unescaped slash.
+			expr, rest, ok := cutRegexp(s[len("text=/"):])
+			if !ok {
+				return r, fmt.Errorf("unterminated regular expression in %q", s)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return r, err
+			}
+			r.Text = re
+			s = strings.TrimSpace(rest)
+			continue
+		}
+		var word string
+		word, s = nextRuleWord(s)
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) < 2 {
+			return r, parseAction(&r, word, s)
+		}
+		switch kv[0] {
+		case "command":
+			r.Command = kv[1]
+		case "channel":
+			r.Channel = kv[1]
+		case "mask":
+			r.Mask = kv[1]
+		case "text":
+			return r, fmt.Errorf("text needs a regular expression between slashes, got %q", kv[1])
+		default:
+			return r, fmt.Errorf("unknown matcher %q", kv[0])
+		}
+	}
+	return r, fmt.Errorf("missing action")
+}
+
+func nextRuleWord(s string) (word, rest string) {
+	if idx := strings.IndexByte(s, ' '); idx != -1 {
+		return s[:idx], strings.TrimSpace(s[idx+1:])
+	}
+	return s, ""
+}
+
+// cutRegexp splits s at the first slash not escaped with a backslash.
+// Escaped slashes are unescaped.
+func cutRegexp(s string) (expr, rest string, ok bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '/':
+			b.WriteByte('/')
+			i++
+		case s[i] == '/':
+			return b.String(), s[i+1:], true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+func parseAction(r *Rule, action, args string) error {
+	arg, rest := nextRuleWord(args)
+	switch action {
+	case "drop":
+		r.Action = ActionDrop
+		rest = args
+	case "tag":
+		if arg == "" {
+			return fmt.Errorf("tag needs a key")
+		}
+		r.Action = ActionTag
+		kv := strings.SplitN(arg, "=", 2)
+		r.Tag = kv[0]
+		if len(kv) == 2 {
+			r.Value = kv[1]
+		}
+	case "signal":
+		if arg == "" {
+			return fmt.Errorf("signal needs a name")
+		}
+		r.Action = ActionSignal
+		r.Signal = arg
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if rest != "" {
+		return fmt.Errorf("unexpected %q after action", rest)
+	}
+	return nil
+}
+
+// ParseRules parses one rule per line. Empty lines and lines starting
+// with # are ignored.
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Filter applies rules to incoming messages. The rules can be
+// replaced at runtime, for example from an admin command, letting
+// operators tweak the bot's behavior without recompiling.
+//
+// Drop and tag rules are applied by Middleware, which has to be
+// installed with Mux.Use on the client's Mux. Signal rules are
+// applied by Filter itself, which needs to be registered as a
+// catch-all handler. Match can be used on its own, for example to
+// decide which messages to log where.
+type Filter struct {
+	*irc.Mux
+
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+func NewFilter(rules ...Rule) *Filter {
+	f := &Filter{Mux: irc.NewMux(), rules: rules}
+	f.HandleFunc("", f.route)
+	return f
+}
+
+// SetRules replaces the rules.
+func (f *Filter) SetRules(rules []Rule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+}
+
+// Rules returns the current rules.
+func (f *Filter) Rules() []Rule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]Rule(nil), f.rules...)
+}
+
+// Match returns the rules that match m. Synthetic signals, such as
+// irc:connected or those dispatched by signal rules, never match.
+func (f *Filter) Match(is *irc.ISupport, m *irc.Message) []Rule {
+	if m.Signal != m.Command {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var out []Rule
+	for _, r := range f.rules {
+		if r.Matches(is, m) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Middleware drops and tags messages according to the rules.
+func (f *Filter) Middleware(next irc.Handler) irc.Handler {
+	return irc.HandlerFunc(func(c *irc.Client, m *irc.Message) {
+		for _, r := range f.Match(c.Support(), m) {
+			switch r.Action {
+			case ActionDrop:
+				return
+			case ActionTag:
+				if m.Tags == nil {
+					m.Tags = make(map[string]string)
+				}
+				m.Tags[r.Tag] = r.Value
+			}
+		}
+		next.Process(c, m)
+	})
+}
+
+func (f *Filter) route(c *irc.Client, m *irc.Message) {
+	for _, r := range f.Match(c.Support(), m) {
+		if r.Action != ActionSignal {
+			continue
+		}
+		routed := m.Copy()
+		routed.Signal = r.Signal
+		c.Mux.Process(c, routed)
+	}
+}
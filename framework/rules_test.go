@@ -0,0 +1,106 @@
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+func TestFilterMatch(t *testing.T) {
+	rules, err := ParseRules("command=PRIVMSG drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter(rules...)
+	is := irc.NewISupport()
+	is.ChanTypes = []rune("#")
+
+	m := irc.Parse(":a!b@c PRIVMSG #chan :hi")
+	if got := f.Match(is, m); len(got) != 1 {
+		t.Errorf("expected parsed message to match 1 rule, got %d", len(got))
+	}
+	routed := m.Copy()
+	routed.Signal = "rules:privmsg"
+	if got := f.Match(is, routed); len(got) != 0 {
+		t.Errorf("expected routed signal not to match, got %d rules", len(got))
+	}
+	if got := f.Match(is, &irc.Message{Signal: "irc:connected"}); len(got) != 0 {
+		t.Errorf("expected synthetic signal not to match, got %d rules", len(got))
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rules, err := ParseRules(`
+command=PRIVMSG text=/spam/ drop
+mask=*!*@vip.example tag vip=yes
+channel=#ops* signal rules:ops
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter(rules...)
+	mux := irc.NewOrderedMux()
+	mux.Use(f.Middleware)
+	mux.Handle("", f)
+	delivered := make(chan *irc.Message, 10)
+	record := func(c *irc.Client, m *irc.Message) { delivered <- m }
+	mux.HandleFunc("PRIVMSG", record)
+	mux.HandleFunc("NOTICE", record)
+	routed := make(chan *irc.Message, 10)
+	mux.HandleFunc("rules:ops", func(c *irc.Client, m *irc.Message) { routed <- m })
+
+	s := newTestServer(t, mux)
+	s.welcome()
+
+	table := []struct {
+		line    string
+		dropped bool
+		vip     bool
+		routed  bool
+	}{
+		{":a!b@c PRIVMSG #chan :buy spam", true, false, false},
+		{":a!b@c NOTICE #chan :buy spam", false, false, false},
+		{":a!b@vip.example PRIVMSG #chan :hi", false, true, false},
+		{":a!b@vip.example PRIVMSG #chan :spam", true, false, false},
+		{":a!b@c PRIVMSG #OPS-team :hi", false, false, true},
+		{":a!b@c PRIVMSG #chan :hi", false, false, false},
+	}
+	for _, test := range table {
+		s.send(test.line)
+		s.sync()
+		var m *irc.Message
+		select {
+		case m = <-delivered:
+		default:
+		}
+		if test.dropped {
+			if m != nil {
+				t.Errorf("%q: expected message to be dropped", test.line)
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%q: expected message to be delivered", test.line)
+			continue
+		}
+		if _, ok := m.Tags["vip"]; ok != test.vip {
+			t.Errorf("%q: expected vip tag to be %t, got tags %v", test.line, test.vip, m.Tags)
+		}
+		if test.routed {
+			select {
+			case r := <-routed:
+				if r.Command != "PRIVMSG" || r.Params[1] != "hi" {
+					t.Errorf("%q: routed unexpected message %q", test.line, r.Raw)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("%q: expected message to be routed", test.line)
+			}
+		}
+	}
+	select {
+	case r := <-routed:
+		t.Errorf("unexpectedly routed %q", r.Raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
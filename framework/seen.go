@@ -0,0 +1,121 @@
+package framework
+
+import (
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Seen is what a SeenCache remembers about a nick.
+type Seen struct {
+	Mask irc.Mask
+	// The account the user was logged in to, if known from the
+	// account-tag or extended-join capabilities
+	Account string
+	At      time.Time
+}
+
+// SeenCache remembers the full hostmask and account behind recently
+// seen nicks, so that moderation actions taken a few seconds after a
+// message still target the right user, even after they left or
+// changed their nick.
+//
+// SeenCache needs to be registered as a catch-all handler, with
+// HandleSync so that a nick's most recent sighting always wins.
+type SeenCache struct {
+	*irc.Mux
+	// How long entries are kept. Defaults to 5 minutes.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]Seen
+	added int
+}
+
+func NewSeenCache() *SeenCache {
+	sc := &SeenCache{
+		Mux:  irc.NewOrderedMux(),
+		seen: make(map[string]Seen),
+	}
+	sc.HandleFunc("", sc.observe)
+	return sc
+}
+
+func (sc *SeenCache) ttl() time.Duration {
+	if sc.TTL == 0 {
+		return 5 * time.Minute
+	}
+	return sc.TTL
+}
+
+// Lookup returns what was last seen of nick, if it was seen within
+// the TTL.
+func (sc *SeenCache) Lookup(c *irc.Client, nick string) (Seen, bool) {
+	key := c.Support().Casefold(nick)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s, ok := sc.seen[key]
+	if !ok || irc.OrRealClock(c.Clock).Now().Sub(s.At) > sc.ttl() {
+		return Seen{}, false
+	}
+	return s, true
+}
+
+// BanMask returns a ban mask of the form *!*@host for nick, based on
+// what was last seen of it.
+func (sc *SeenCache) BanMask(c *irc.Client, nick string) (string, bool) {
+	s, ok := sc.Lookup(c, nick)
+	if !ok || s.Mask.Host == "" {
+		return "", false
+	}
+	return "*!*@" + s.Mask.Host, true
+}
+
+func (sc *SeenCache) observe(c *irc.Client, m *irc.Message) {
+	if m.Prefix.Nick == "" || m.Prefix.User == "" {
+		return
+	}
+	// Prefer the server's timestamp, so that messages replayed from
+	// history don't appear fresh.
+	at := m.Time
+	if at.IsZero() {
+		at = irc.OrRealClock(c.Clock).Now()
+	}
+	s := Seen{Mask: m.Prefix, Account: m.Tags["account"], At: at}
+	if m.Command == "JOIN" && len(m.Params) >= 3 && m.Params[1] != "*" {
+		// extended-join
+		s.Account = m.Params[1]
+	}
+	is := c.Support()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key := is.Casefold(m.Prefix.Nick)
+	if s.Account == "" {
+		// Don't forget the account just because a message didn't
+		// carry the tag.
+		if old, ok := sc.seen[key]; ok && old.Mask == s.Mask {
+			s.Account = old.Account
+		}
+	}
+	sc.seen[key] = s
+	if m.Command == "NICK" && len(m.Params) > 0 {
+		s.Mask.Nick = m.Params[0]
+		sc.seen[is.Casefold(m.Params[0])] = s
+	}
+
+	sc.added++
+	if sc.added%1000 == 0 {
+		sc.expire(irc.OrRealClock(c.Clock).Now())
+	}
+}
+
+func (sc *SeenCache) expire(now time.Time) {
+	ttl := sc.ttl()
+	for key, s := range sc.seen {
+		if now.Sub(s.At) > ttl {
+			delete(sc.seen, key)
+		}
+	}
+}
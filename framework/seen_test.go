@@ -0,0 +1,67 @@
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestSeenCache(t *testing.T) {
+	clock := irctest.NewClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	sc := NewSeenCache()
+	mux := irc.NewMux()
+	mux.HandleSync("", sc)
+	s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+	s.welcome()
+
+	expect := func(nick string, want Seen, ok bool) {
+		t.Helper()
+		got, found := sc.Lookup(s.c, nick)
+		if found != ok || (ok && (got.Mask != want.Mask || got.Account != want.Account || !got.At.Equal(want.At))) {
+			t.Errorf("Lookup(%q) = %+v, %t, expected %+v, %t", nick, got, found, want, ok)
+		}
+	}
+	alice := irc.Mask{Nick: "alice", User: "a", Host: "alice.test"}
+
+	// The account from extended-join is kept across messages that
+	// don't carry it.
+	s.send(":alice!a@alice.test JOIN #chan alice :Alice")
+	s.sync()
+	clock.Advance(time.Minute)
+	s.send(":alice!a@alice.test PRIVMSG #chan :hi")
+	s.sync()
+	expect("ALICE", Seen{Mask: alice, Account: "alice", At: clock.Now()}, true)
+	if mask, ok := sc.BanMask(s.c, "alice"); !ok || mask != "*!*@alice.test" {
+		t.Errorf("expected ban mask *!*@alice.test, got %q, %t", mask, ok)
+	}
+
+	// A different host is a different user.
+	s.send(":alice!a@elsewhere.test PRIVMSG #chan :hi")
+	s.sync()
+	expect("alice", Seen{Mask: irc.Mask{Nick: "alice", User: "a", Host: "elsewhere.test"}, At: clock.Now()}, true)
+
+	// Nick changes are remembered under both nicks.
+	s.send(
+		":bob!b@bob.test PRIVMSG #chan :hi",
+		":bob!b@bob.test NICK robert",
+	)
+	s.sync()
+	expect("bob", Seen{Mask: irc.Mask{Nick: "bob", User: "b", Host: "bob.test"}, At: clock.Now()}, true)
+	expect("robert", Seen{Mask: irc.Mask{Nick: "robert", User: "b", Host: "bob.test"}, At: clock.Now()}, true)
+
+	// Entries expire after the TTL.
+	clock.Advance(sc.ttl() + time.Second)
+	expect("robert", Seen{}, false)
+
+	// Server-time is preferred over the local clock, so that old
+	// messages replayed from history are expired already.
+	old := clock.Now().Add(-time.Hour)
+	s.send("@time=" + old.Format(time.RFC3339) + " :carol!c@carol.test PRIVMSG #chan :hi")
+	recent := clock.Now().Add(-time.Minute)
+	s.send("@time=" + recent.Format(time.RFC3339) + " :dave!d@dave.test PRIVMSG #chan :hi")
+	s.sync()
+	expect("carol", Seen{}, false)
+	expect("dave", Seen{Mask: irc.Mask{Nick: "dave", User: "d", Host: "dave.test"}, At: recent}, true)
+}
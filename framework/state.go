@@ -0,0 +1,619 @@
+package framework
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// StateCaps are the capabilities that State uses to keep users'
+// accounts and away status current without polling.
+var StateCaps = []string{"away-notify", "account-notify", "extended-join", "account-tag"}
+
+// State tracks the channels the bot is in and the users it shares
+// them with. With the capabilities in StateCaps enabled, the account
+// and away status of users are kept current, too.
+//
+// On networks without extended-join, or for users listed by NAMES,
+// accounts and hosts aren't known. If Enrich is set, State looks
+// them up lazily with WHOIS, one user at a time, so as not to flood
+// the server.
+//
+// When a user the bot shares a channel with changes their nick, State
+// emits the state:nick signal, with the old and the new nick as
+// parameters, after updating its own records. Identity provides keys
+// for per-user data that survive nick changes.
+//
+// The prefix modes of members, such as operator status, are kept
+// current from MODE messages, including the bursts reported by
+// ModeDebouncer.
+//
+// State needs to be registered as a catch-all handler. Register it
+// with HandleSync, so that JOINs, PARTs and NICKs are applied in the
+// order the server sent them.
+type State struct {
+	*irc.Mux
+	// Enrich causes State to look up users whose account isn't known
+	// with paced WHOIS queries.
+	Enrich bool
+	// How long to wait between WHOIS queries. Defaults to 2 seconds.
+	EnrichInterval time.Duration
+
+	mu       sync.Mutex
+	is       *irc.ISupport
+	users    map[string]*User
+	channels map[string]*channelState
+	// users whose account is known, by casefolded nick
+	known map[string]bool
+	// session identities, assigned by Identity
+	ids    map[*User]uint64
+	nextID uint64
+	// the connection we're enriching users for
+	enrichingFor <-chan struct{}
+}
+
+type channelState struct {
+	name string
+	// members maps casefolded nicks to their prefix modes, highest
+	// ranked first
+	members map[string][]rune
+}
+
+func NewState() *State {
+	s := &State{Mux: irc.NewOrderedMux()}
+	s.reset()
+	s.HandleFunc("", s.observe)
+	s.HandleFunc("irc:connected", s.connected)
+	s.HandleFunc("JOIN", s.join)
+	s.HandleFunc("PART", s.part)
+	s.HandleFunc("KICK", s.kick)
+	s.HandleFunc("QUIT", s.quit)
+	s.HandleFunc("NICK", s.nick)
+	s.HandleFunc("MODE", s.mode)
+	s.HandleFunc("mode:burst", s.mode)
+	s.HandleFunc("AWAY", s.away)
+	s.HandleFunc("ACCOUNT", s.account)
+	s.HandleFunc(irc.RPL_NAMREPLY, s.names)
+	s.HandleFunc(irc.RPL_ENDOFMOTD, s.registered)
+	s.HandleFunc(irc.ERR_NOMOTD, s.registered)
+	return s
+}
+
+func (s *State) enrichInterval() time.Duration {
+	if s.EnrichInterval == 0 {
+		return 2 * time.Second
+	}
+	return s.EnrichInterval
+}
+
+// RequestCaps requests the capabilities in StateCaps. It has to be
+// called before connecting.
+func (s *State) RequestCaps(c *irc.Client) {
+	if c.Caps == nil {
+		c.Caps = irc.NewCapabilityManager()
+	}
+	c.Caps.Request(StateCaps...)
+}
+
+func (s *State) reset() {
+	s.users = make(map[string]*User)
+	s.channels = make(map[string]*channelState)
+	s.known = make(map[string]bool)
+	s.ids = make(map[*User]uint64)
+}
+
+func (s *State) fold(name string) string {
+	if s.is == nil {
+		return irc.Casefold("rfc1459", name)
+	}
+	return s.is.Casefold(name)
+}
+
+// User returns what is known about the user with the given nick. If
+// the bot doesn't share a channel with the user, the returned User's
+// Nick is empty. Idle, Oper and SignedOnAt are never set.
+func (s *State) User(nick string) User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.fold(nick)
+	u, ok := s.users[key]
+	if !ok {
+		return User{}
+	}
+	out := *u
+	out.Channels = nil
+	for _, ch := range s.channels {
+		if modes, ok := ch.members[key]; ok {
+			out.Channels = append(out.Channels, Membership{Channel: ch.name, Mode: highest(modes)})
+		}
+	}
+	return out
+}
+
+// Channels returns the channels the bot is in.
+func (s *State) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for _, ch := range s.channels {
+		out = append(out, ch.name)
+	}
+	return out
+}
+
+// Identity returns a stable key for the user with the given nick, for
+// storing per-user data such as karma or notes. If the user's account
+// is known, the key is "account:" followed by the casefolded account,
+// which survives nick changes and reconnects. Otherwise, it is
+// "session:" followed by a number that follows the user across nick
+// changes for as long as they share a channel with the bot; it
+// changes to the account key once the account becomes known.
+//
+// Identity returns the empty string for users that don't share a
+// channel with the bot.
+func (s *State) Identity(nick string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[s.fold(nick)]
+	if !ok {
+		return ""
+	}
+	if u.Account != "" {
+		return "account:" + irc.Casefold("rfc1459", u.Account)
+	}
+	id, ok := s.ids[u]
+	if !ok {
+		s.nextID++
+		id = s.nextID
+		s.ids[u] = id
+	}
+	return "session:" + strconv.FormatUint(id, 10)
+}
+
+// SharesChannel reports whether the user with the given nick is in
+// any of the bot's channels.
+func (s *State) SharesChannel(nick string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[s.fold(nick)]
+	return ok
+}
+
+// Members returns the nicks of the users in channel. Safe channels
+// may be referred to by their short names.
+func (s *State) Members(channel string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.channel(channel)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for key := range ch.members {
+		out = append(out, s.users[key].Nick)
+	}
+	return out
+}
+
+// channel looks up a channel by its name or, for safe channels, its
+// short name. s.mu must be held.
+func (s *State) channel(name string) (*channelState, bool) {
+	if ch, ok := s.channels[s.fold(name)]; ok {
+		return ch, true
+	}
+	if s.is == nil {
+		return nil, false
+	}
+	for _, ch := range s.channels {
+		if s.is.SameChannel(ch.name, name) {
+			return ch, true
+		}
+	}
+	return nil, false
+}
+
+// addUser adds a user to a channel, creating the user if necessary.
+// s.mu must be held.
+func (s *State) addUser(channel string, mask irc.Mask, modes []rune) *User {
+	key := s.fold(mask.Nick)
+	u, ok := s.users[key]
+	if !ok {
+		u = &User{Nick: mask.Nick}
+		s.users[key] = u
+	}
+	if mask.User != "" {
+		u.User = mask.User
+		u.Host = mask.Host
+	}
+	ch, ok := s.channels[s.fold(channel)]
+	if !ok {
+		ch = &channelState{name: channel, members: make(map[string][]rune)}
+		s.channels[s.fold(channel)] = ch
+	}
+	ch.members[key] = modes
+	return u
+}
+
+// removeUser removes a user from a channel and forgets it if it's no
+// longer in any channel. s.mu must be held.
+func (s *State) removeUser(channel, nick string) {
+	key := s.fold(nick)
+	if ch, ok := s.channels[s.fold(channel)]; ok {
+		delete(ch.members, key)
+	}
+	for _, ch := range s.channels {
+		if _, ok := ch.members[key]; ok {
+			return
+		}
+	}
+	delete(s.ids, s.users[key])
+	delete(s.users, key)
+	delete(s.known, key)
+}
+
+// leave forgets a channel the bot is no longer in. s.mu must be
+// held.
+func (s *State) leave(channel string) {
+	ch, ok := s.channels[s.fold(channel)]
+	if !ok {
+		return
+	}
+	delete(s.channels, s.fold(channel))
+	for key := range ch.members {
+		s.removeUser("", s.users[key].Nick)
+	}
+}
+
+func (s *State) observe(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.is = c.Support()
+	if m.Prefix.Nick == "" {
+		return
+	}
+	u, ok := s.users[s.fold(m.Prefix.Nick)]
+	if !ok {
+		return
+	}
+	if account, ok := m.Tags["account"]; ok {
+		u.Account = account
+		s.known[s.fold(m.Prefix.Nick)] = true
+	}
+}
+
+func (s *State) connected(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+}
+
+func (s *State) join(c *irc.Client, m *irc.Message) {
+	ev, err := irc.DecodeJoin(m)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.addUser(ev.Channel, ev.User, nil)
+	if ev.Account != "" {
+		// extended-join
+		u.Account = ev.Account
+		if u.Account == "*" {
+			u.Account = ""
+		}
+		u.Name = ev.RealName
+		s.known[s.fold(ev.User.Nick)] = true
+	}
+}
+
+func (s *State) part(c *irc.Client, m *irc.Message) {
+	ev, err := irc.DecodePart(m)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.IsMe(ev.User.Nick) {
+		s.leave(ev.Channel)
+		return
+	}
+	s.removeUser(ev.Channel, ev.User.Nick)
+}
+
+func (s *State) kick(c *irc.Client, m *irc.Message) {
+	ev, err := irc.DecodeKick(m)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.IsMe(ev.Target) {
+		s.leave(ev.Channel)
+		return
+	}
+	s.removeUser(ev.Channel, ev.Target)
+}
+
+func (s *State) quit(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.fold(m.Prefix.Nick)
+	for _, ch := range s.channels {
+		delete(ch.members, key)
+	}
+	delete(s.ids, s.users[key])
+	delete(s.users, key)
+	delete(s.known, key)
+}
+
+func (s *State) nick(c *irc.Client, m *irc.Message) {
+	ev, err := irc.DecodeNick(m)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	oldKey, newKey := s.fold(ev.User.Nick), s.fold(ev.New)
+	u, ok := s.users[oldKey]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.users, oldKey)
+	u.Nick = ev.New
+	s.users[newKey] = u
+	if s.known[oldKey] {
+		delete(s.known, oldKey)
+		s.known[newKey] = true
+	}
+	for _, ch := range s.channels {
+		if modes, ok := ch.members[oldKey]; ok {
+			delete(ch.members, oldKey)
+			ch.members[newKey] = modes
+		}
+	}
+	s.mu.Unlock()
+
+	if c.IsMe(ev.New) {
+		return
+	}
+	c.Mux.Process(c, &irc.Message{
+		Signal: "state:nick",
+		Params: []string{ev.User.Nick, ev.New},
+	})
+}
+
+// mode keeps the prefix modes of members current. It also handles
+// the bursts of ModeDebouncer, which withholds the individual MODE
+// messages.
+func (s *State) mode(c *irc.Client, m *irc.Message) {
+	is := c.Support()
+	p := irc.ModeParser{ISupport: is}
+	var channel string
+	var changes []irc.ModeChange
+	var err error
+	if m.Signal == "mode:burst" {
+		if len(m.Params) < 2 {
+			return
+		}
+		channel = m.Params[0]
+		changes, err = p.ParseModes(m.Params[1], m.Params[2:])
+	} else {
+		channel, changes, err = p.Parse(m)
+	}
+	if err != nil || !is.IsChannel(channel) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.channel(channel)
+	if !ok {
+		return
+	}
+	for _, change := range changes {
+		if _, ok := is.Prefix[change.Mode]; !ok {
+			continue
+		}
+		key := s.fold(change.Arg)
+		modes, ok := ch.members[key]
+		if !ok {
+			continue
+		}
+		if change.Add {
+			ch.members[key] = addPrefixMode(is, modes, change.Mode)
+		} else {
+			ch.members[key] = removePrefixMode(modes, change.Mode)
+		}
+	}
+}
+
+func (s *State) away(c *irc.Client, m *irc.Message) {
+	// away-notify:
+	// :nick!user@host AWAY :message
+	// :nick!user@host AWAY
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[s.fold(m.Prefix.Nick)]
+	if !ok {
+		return
+	}
+	u.Away = len(m.Params) > 0
+	u.AwayMessage = ""
+	if u.Away {
+		u.AwayMessage = m.Params[0]
+	}
+}
+
+func (s *State) account(c *irc.Client, m *irc.Message) {
+	// account-notify:
+	// :nick!user@host ACCOUNT accountname
+	// :nick!user@host ACCOUNT *
+	if len(m.Params) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[s.fold(m.Prefix.Nick)]
+	if !ok {
+		return
+	}
+	u.Account = m.Params[0]
+	if u.Account == "*" {
+		u.Account = ""
+	}
+	s.known[s.fold(m.Prefix.Nick)] = true
+}
+
+func (s *State) registered(c *irc.Client, m *irc.Message) {
+	if !s.Enrich {
+		return
+	}
+	done := c.Done()
+	s.mu.Lock()
+	if s.enrichingFor == done {
+		s.mu.Unlock()
+		return
+	}
+	s.enrichingFor = done
+	s.mu.Unlock()
+	go s.enrich(c, done)
+}
+
+// unknown returns the nick of a user whose account isn't known.
+func (s *State) unknown() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, u := range s.users {
+		if !s.known[key] {
+			return u.Nick, true
+		}
+	}
+	return "", false
+}
+
+func (s *State) enrich(c *irc.Client, done <-chan struct{}) {
+	t := irc.OrRealClock(c.Clock).NewTicker(s.enrichInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+		case <-done:
+			return
+		}
+		nick, ok := s.unknown()
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(c.Context(), time.Minute)
+		res, err := c.Whois(ctx, nick)
+		cancel()
+		s.mu.Lock()
+		key := s.fold(nick)
+		if err == nil {
+			if u, ok := s.users[key]; ok {
+				u.Account = res.Account
+				u.User = res.User.User
+				u.Host = res.User.Host
+				u.Name = res.RealName
+				u.Away = res.Away != ""
+				u.AwayMessage = res.Away
+			}
+		}
+		// Even if the query failed, don't keep asking about the
+		// same user.
+		if _, ok := s.users[key]; ok {
+			s.known[key] = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *State) names(c *irc.Client, m *irc.Message) {
+	// :server 353 me = #channel :@nick +other
+	// With userhost-in-names, the names are full hostmasks.
+	if len(m.Params) < 4 {
+		return
+	}
+	is := c.Support()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range strings.Fields(m.Params[3]) {
+		nick, modes := splitNickPrefix(is, name)
+		s.addUser(m.Params[2], irc.ParseMask(nick), modes)
+	}
+}
+
+// splitNickPrefix splits a name from RPL_NAMREPLY into the nick and
+// the modes indicated by its prefix sigils. Without multi-prefix,
+// servers only send the sigil of the highest ranked mode.
+func splitNickPrefix(is *irc.ISupport, name string) (nick string, modes []rune) {
+	for i, r := range name {
+		m, ok := prefixModeOf(is, r)
+		if !ok {
+			return name[i:], modes
+		}
+		modes = addPrefixMode(is, modes, m)
+	}
+	return "", modes
+}
+
+// highest returns the highest ranked of modes, which are ordered by
+// addPrefixMode, or zero if there are none.
+func highest(modes []rune) rune {
+	if len(modes) == 0 {
+		return 0
+	}
+	return modes[0]
+}
+
+// addPrefixMode adds mode to modes, keeping them ordered from highest
+// to lowest rank.
+func addPrefixMode(is *irc.ISupport, modes []rune, mode rune) []rune {
+	rank := func(mode rune) int {
+		for i, r := range is.PrefixOrder {
+			if r == mode {
+				return i
+			}
+		}
+		return len(is.PrefixOrder)
+	}
+	out := make([]rune, 0, len(modes)+1)
+	added := false
+	for _, r := range modes {
+		if r == mode {
+			return modes
+		}
+		if !added && rank(mode) < rank(r) {
+			out = append(out, mode)
+			added = true
+		}
+		out = append(out, r)
+	}
+	if !added {
+		out = append(out, mode)
+	}
+	return out
+}
+
+// removePrefixMode removes mode from modes.
+func removePrefixMode(modes []rune, mode rune) []rune {
+	out := make([]rune, 0, len(modes))
+	for _, r := range modes {
+		if r != mode {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func prefixModeOf(is *irc.ISupport, sigil rune) (rune, bool) {
+	for mode, r := range is.Prefix {
+		if r == sigil {
+			return mode, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,173 @@
+package framework
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestStateOrdering(t *testing.T) {
+	mux := irc.NewMux()
+	st := NewState()
+	mux.HandleSync("", st)
+	s := newTestServer(t, mux)
+	s.welcome()
+	s.send(":bot!b@host JOIN #chan")
+	for i := 0; i < 50; i++ {
+		nick := fmt.Sprintf("user%d", i)
+		s.send(
+			":"+nick+"!u@host JOIN #chan",
+			":"+nick+"!u@host NICK "+nick+"_",
+			":"+nick+"_!u@host PART #chan",
+		)
+	}
+	s.sync()
+	if members := st.Members("#chan"); !reflect.DeepEqual(members, []string{"bot"}) {
+		t.Errorf("expected only bot to be left in #chan, got %q", members)
+	}
+}
+
+func TestState(t *testing.T) {
+	table := []struct {
+		lines []string
+		want  map[string]rune
+	}{
+		{nil, map[string]rune{"bot": 'o', "alice": 'v', "bob": 0, "carol": 'o'}},
+		{
+			[]string{":dave!d@host JOIN #chan"},
+			map[string]rune{"bot": 'o', "alice": 'v', "bob": 0, "carol": 'o', "dave": 0},
+		},
+		{
+			[]string{":alice!a@host PART #chan :bye"},
+			map[string]rune{"bot": 'o', "bob": 0, "carol": 'o'},
+		},
+		{
+			[]string{":bot!b@host KICK #chan bob :out"},
+			map[string]rune{"bot": 'o', "alice": 'v', "carol": 'o'},
+		},
+		{
+			[]string{":bob!b@host QUIT :gone"},
+			map[string]rune{"bot": 'o', "alice": 'v', "carol": 'o'},
+		},
+		{
+			[]string{":alice!a@host NICK alicia"},
+			map[string]rune{"bot": 'o', "alicia": 'v', "bob": 0, "carol": 'o'},
+		},
+		{
+			[]string{":bot!b@host MODE #chan +o bob"},
+			map[string]rune{"bot": 'o', "alice": 'v', "bob": 'o', "carol": 'o'},
+		},
+		{
+			// carol keeps the voice listed by multi-prefix.
+			[]string{":bot!b@host MODE #chan -o carol"},
+			map[string]rune{"bot": 'o', "alice": 'v', "bob": 0, "carol": 'v'},
+		},
+		{
+			[]string{":bot!b@host MODE #CHAN +o-v ALICE alice"},
+			map[string]rune{"bot": 'o', "alice": 'o', "bob": 0, "carol": 'o'},
+		},
+		{
+			[]string{":bot!b@host MODE #chan +b-v alice!*@* alice"},
+			map[string]rune{"bot": 'o', "alice": 0, "bob": 0, "carol": 'o'},
+		},
+		{
+			[]string{":bot!b@host PART #chan"},
+			map[string]rune{},
+		},
+		{
+			[]string{":alice!a@host KICK #chan bot :out"},
+			map[string]rune{},
+		},
+	}
+	for _, test := range table {
+		mux := irc.NewMux()
+		st := NewState()
+		mux.HandleSync("", st)
+		s := newTestServer(t, mux)
+		s.welcome()
+		s.send(
+			":bot!b@host JOIN #chan",
+			":irc.test 353 bot = #chan :@bot +alice bob @+carol",
+			":irc.test 366 bot #chan :End of /NAMES list.",
+		)
+		s.send(test.lines...)
+		s.sync()
+
+		got := make(map[string]rune)
+		for _, nick := range st.Members("#chan") {
+			for _, ms := range st.User(nick).Channels {
+				got[nick] = ms.Mode
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected members %q, got %q", test.lines, test.want, got)
+		}
+	}
+}
+
+func TestStateEnrich(t *testing.T) {
+	mux := irc.NewMux()
+	st := NewState()
+	st.Enrich = true
+	st.EnrichInterval = time.Second
+	mux.HandleSync("", st)
+	clock := irctest.NewClock(time.Time{})
+	s := newTestServerWith(t, &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Clock: clock})
+	s.welcome()
+	s.send(
+		":bot!b@host JOIN #chan",
+		":irc.test 353 bot = #chan :@bot alice bob",
+		":irc.test 366 bot #chan :End of /NAMES list.",
+		// bob's account is known from account-notify and doesn't
+		// have to be looked up.
+		":bob!b@host ACCOUNT bob",
+	)
+	s.sync()
+
+	// Users are looked up one at a time, in no particular order.
+	queried := make(map[string]bool)
+	for len(queried) < 2 {
+		clock.Advance(time.Second)
+		select {
+		case line := <-s.lines:
+			var nick string
+			if _, err := fmt.Sscanf(line, "WHOIS %s", &nick); err != nil {
+				continue
+			}
+			queried[nick] = true
+			s.send(
+				":irc.test 311 bot "+nick+" "+nick+" "+nick+".example * :"+nick,
+				":irc.test 330 bot "+nick+" "+nick+"-account :is logged in as",
+				":irc.test 318 bot "+nick+" :End of /WHOIS list.",
+			)
+			s.sync()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if expected := map[string]bool{"bot": true, "alice": true}; !reflect.DeepEqual(queried, expected) {
+		t.Errorf("expected WHOIS for %v, got %v", expected, queried)
+	}
+	// The last reply is applied once the query returns.
+	for deadline := time.Now().Add(5 * time.Second); st.User("alice").Account == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("alice wasn't enriched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if u := st.User("alice"); u.Account != "alice-account" || u.Host != "alice.example" {
+		t.Errorf("alice wasn't enriched correctly: %+v", u)
+	}
+	if u := st.User("bob"); u.Account != "bob" {
+		t.Errorf("expected bob's account to be bob, got %q", u.Account)
+	}
+
+	// Once everyone is known, no more queries are sent.
+	clock.Advance(time.Second)
+	if sent := s.sent(); len(sent) != 0 {
+		t.Errorf("unexpected lines %q", sent)
+	}
+}
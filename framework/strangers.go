@@ -0,0 +1,48 @@
+package framework
+
+import (
+	"honnef.co/go/irc"
+)
+
+// StrangerPolicy decides what happens to commands sent in private
+// messages by users who don't share a channel with the bot.
+type StrangerPolicy int
+
+const (
+	// AllowStrangers runs their commands like everybody else's.
+	AllowStrangers StrangerPolicy = iota
+	// IgnoreStrangers ignores their commands without replying.
+	IgnoreStrangers
+	// RefuseStrangers replies that they aren't allowed to run
+	// commands.
+	RefuseStrangers
+)
+
+// Strangers returns command middleware that applies policy to
+// commands sent in private messages by users who, according to
+// state, don't share a channel with the bot. Anyone on the network
+// can send private messages, so bots often want to restrict them to
+// users they know from their channels. Commands sent in channels are
+// unaffected.
+func Strangers(state *State, policy StrangerPolicy) CommandMiddleware {
+	return func(next CommandFunc) CommandFunc {
+		return func(c *irc.Client, m *irc.Message, args []string) error {
+			if policy == AllowStrangers || !IsStranger(c, state, m) {
+				return next(c, m, args)
+			}
+			if policy == RefuseStrangers {
+				return ErrDenied
+			}
+			return ErrIgnored
+		}
+	}
+}
+
+// IsStranger reports whether m is a private message from a user who
+// doesn't share a channel with the bot.
+func IsStranger(c *irc.Client, state *State, m *irc.Message) bool {
+	if len(m.Params) == 0 || !c.IsMe(m.Params[0]) {
+		return false
+	}
+	return !state.SharesChannel(m.Prefix.Nick)
+}
@@ -0,0 +1,85 @@
+package framework
+
+import (
+	"testing"
+
+	"honnef.co/go/irc"
+)
+
+func TestStrangers(t *testing.T) {
+	newClient := func(policy StrangerPolicy) (*State, *testServer) {
+		st := NewState()
+		cs := NewCommands("!")
+		cs.Use(Strangers(st, policy))
+		cs.Register(&Command{
+			Name: "hi",
+			Func: func(c *irc.Client, m *irc.Message, args []string) error {
+				return c.Reply(m, "hi "+m.Prefix.Nick)
+			},
+		})
+		mux := irc.NewMux()
+		mux.HandleSync("", st)
+		mux.HandleSync("PRIVMSG", cs)
+		s := newTestServer(t, mux)
+		s.welcome()
+		s.send(
+			":bot!b@host JOIN #chan",
+			":irc.test 353 bot = #chan :@bot alice",
+			":irc.test 366 bot #chan :End of /NAMES list.",
+		)
+		s.sync()
+		return st, s
+	}
+
+	st, s := newClient(RefuseStrangers)
+	for _, test := range []struct {
+		line     string
+		stranger bool
+	}{
+		{":alice!a@host PRIVMSG bot :hi", false},
+		{":alice!a@host PRIVMSG BOT :hi", false},
+		{":eve!e@host PRIVMSG bot :hi", true},
+		// Messages in channels are never from strangers.
+		{":eve!e@host PRIVMSG #chan :hi", false},
+	} {
+		if got := IsStranger(s.c, st, irc.Parse(test.line)); got != test.stranger {
+			t.Errorf("IsStranger(%q) = %t, expected %t", test.line, got, test.stranger)
+		}
+	}
+
+	// Strangers are refused, known users and channels are served.
+	s.send(":eve!e@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG eve :permission denied")
+	s.send(":alice!a@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG alice :hi alice")
+	s.send(":eve!e@host PRIVMSG #chan :!hi")
+	s.expectSent("PRIVMSG #chan :hi eve")
+
+	// Users become known by joining a shared channel, including with
+	// their account from extended-join, and stay known across nick
+	// changes.
+	s.send(":eve!e@host JOIN #chan eve :Eve")
+	s.send(":eve!e@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG eve :hi eve")
+	s.send(":eve!e@host NICK mallory")
+	s.send(":mallory!e@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG mallory :hi mallory")
+	if u := st.User("mallory"); u.Account != "eve" {
+		t.Errorf("expected mallory to be logged in as eve, got %+v", u)
+	}
+	s.send(":mallory!e@host PART #chan")
+	s.send(":mallory!e@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG mallory :permission denied")
+
+	// Ignored strangers get no reply.
+	_, s = newClient(IgnoreStrangers)
+	s.send(":eve!e@host PRIVMSG bot :!hi")
+	s.expectQuiet()
+	s.send(":alice!a@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG alice :hi alice")
+
+	// AllowStrangers doesn't restrict anyone.
+	_, s = newClient(AllowStrangers)
+	s.send(":eve!e@host PRIVMSG bot :!hi")
+	s.expectSent("PRIVMSG eve :hi eve")
+}
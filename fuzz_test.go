@@ -0,0 +1,159 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+// weirdLines are real-world lines that have tripped up IRC parsers,
+// used as the seed corpus for the fuzz targets and as benchmark
+// input.
+var weirdLines = []string{
+	"",
+	" ",
+	":",
+	"@",
+	"@a",
+	"@ ",
+	":prefix",
+	":prefix ",
+	"PING",
+	"PING :",
+	"PING :irc.example.net",
+	"PRIVMSG #chan :hello  world  ",
+	":nick!user@host PRIVMSG #chan :\x01ACTION waves\x01",
+	":nick!user@host PRIVMSG #chan :\x01VERSION\x01",
+	":nick!~user@2001:db8::1 JOIN #chan account :Real Name",
+	":nick!user@host JOIN :#chan",
+	"@time=2011-10-19T16:40:51.620Z :nick!user@host PRIVMSG #chan :hi",
+	"@label=abc;draft/msgid=123 :irc.example.net 001 nick :Welcome",
+	"@a=\\:\\s\\\\\\r\\n;b;c= :nick PRIVMSG #chan :escaped tags",
+	"@a=trailing\\ :nick PRIVMSG #chan :bad escape",
+	// Twitch
+	"@badge-info=subscriber/8;badges=subscriber/6,premium/1;color=#1E90FF;display-name=Some_User;emotes=25:0-4,12-16/1902:6-10;flags=;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=0;room-id=1337;subscriber=1;tmi-sent-ts=1507246572675;turbo=0;user-id=1337;user-type= :some_user!some_user@some_user.tmi.twitch.tv PRIVMSG #channel :Kappa Keepo Kappa",
+	"@emote-only=0;followers-only=-1;r9k=0;rituals=0;room-id=1337;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #channel",
+	":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands",
+	// solanum
+	":irc.libera.chat 005 nick CALLERID=g WHOX ETRACE FNC SAFELIST ELIST=CMNTU KNOCK MONITOR=100 CHANTYPES=# EXCEPTS INVEX CHANMODES=eIbq,k,flj,CFLMPQRSTcgimnprstuz :are supported by this server",
+	":irc.libera.chat 005 nick CHANLIMIT=#:250 PREFIX=(ov)@+ MAXLIST=bqeI:100 MODES=4 NETWORK=Libera.Chat STATUSMSG=@+ CASEMAPPING=rfc1459 NICKLEN=16 MAXNICKLEN=16 CHANNELLEN=50 TOPICLEN=390 DEAF=D :are supported by this server",
+	":irc.libera.chat 005 nick TARGMAX=NAMES:1,LIST:1,KICK:1,WHOIS:1,PRIVMSG:4,NOTICE:4,ACCEPT:,MONITOR: EXTBAN=$,agjrxz :are supported by this server",
+	":irc.example.net 005 nick TARGMAX=PRIVMSG PREFIX=(ov)@ MAXLIST=b CHANMODES= :are supported by this server",
+	":irc.libera.chat 353 nick = #chan :@op +voice plain",
+	":irc.libera.chat 900 nick nick!user@host account :You are now logged in as account",
+	":irc.libera.chat 710 #chan #chan nick!user@host :has asked for an invite.",
+	":irc.libera.chat NOTICE * :*** Checking Ident",
+	":nick!user@host QUIT :Quit: ",
+	":nick!user@host QUIT",
+	"ERROR :Closing Link: 127.0.0.1 (Excess Flood)",
+	"PRIVMSG    #chan    :many   spaces",
+	":nick!user@host PRIVMSG #chan :\xff\xfe invalid utf-8",
+}
+
+func FuzzParse(f *testing.F) {
+	for _, line := range weirdLines {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		m := Parse(line)
+		if m.Raw != line {
+			t.Errorf("Raw is %q, expected %q", m.Raw, line)
+		}
+		m.CTCPs()
+		m.Copy()
+	})
+}
+
+func FuzzParseCTCP(f *testing.F) {
+	for _, s := range []string{"", "\x01", "\x01\x01", "\x01VERSION\x01", "\x01ACTION waves\x01", "\x01PING 123 \x01"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		ParseCTCP(s)
+		ParseCTCPs(s)
+	})
+}
+
+func FuzzISupportParse(f *testing.F) {
+	for _, line := range weirdLines {
+		if strings.Contains(line, " 005 ") {
+			f.Add(line)
+		}
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		m := Parse(line)
+		if m.Command != RPL_ISUPPORT {
+			return
+		}
+		NewISupport().Parse(m)
+	})
+}
+
+func FuzzSplitMessage(f *testing.F) {
+	f.Add("PRIVMSG #chan :hello world", 10)
+	f.Add("PRIVMSG #chan :\xe2\x82\xac\xe2\x82\xac\xe2\x82\xac", 17)
+	f.Add("PRIVMSG #chan :"+strings.Repeat("a ", 300), 350)
+	f.Fuzz(func(t *testing.T, s string, n int) {
+		if n <= 0 || n > 1024 {
+			return
+		}
+		parts := SplitMessage(s, n)
+		// Without a trailing parameter, the result is undefined.
+		idx := strings.Index(s, " :")
+		if idx == -1 || len(s) == idx+2 {
+			return
+		}
+		if len(parts) == 0 {
+			t.Errorf("no parts for %q", s)
+		}
+	})
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		line string
+	}{
+		{"Simple", ":nick!user@host PRIVMSG #chan :hello world"},
+		{"Tags", weirdLines[20]},
+		{"ISupport", weirdLines[23]},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Parse(bench.line)
+			}
+		})
+	}
+}
+
+func BenchmarkParseCTCP(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseCTCP("\x01ACTION waves at everyone\x01")
+	}
+}
+
+func BenchmarkISupportParse(b *testing.B) {
+	var msgs []*Message
+	for _, line := range weirdLines {
+		if strings.Contains(line, " 005 ") {
+			msgs = append(msgs, Parse(line))
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		is := NewISupport()
+		for _, m := range msgs {
+			is.Parse(m)
+		}
+	}
+}
+
+func BenchmarkSplitMessage(b *testing.B) {
+	s := "PRIVMSG #chan :" + strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		SplitMessage(s, 350)
+	}
+}
@@ -0,0 +1,224 @@
+package irc
+
+import (
+	"errors"
+	"os"
+	"sort"
+)
+
+// ErrHandedOver is returned by Process after the connection has been
+// handed over to another process with Handover.
+var ErrHandedOver = errors.New("connection handed over")
+
+// ErrHandoverUnsupported is returned by Handover for connections
+// that can't be handed over, such as TLS connections, whose session
+// state can't be exported.
+var ErrHandoverUnsupported = errors.New("connection can't be handed over")
+
+// handoverState is the state of a session that is handed over along
+// with the connection.
+type handoverState struct {
+	Nick      string
+	User      string
+	Name      string
+	Self      Mask
+	Connected []string
+	ISupport  map[string]string
+	Available map[string]string
+	Enabled   []string
+	// Bytes that were read from the connection but not yet
+	// processed.
+	Pending []byte
+	// The batches that were open, outermost first
+	Batches []handoverBatch
+}
+
+// handoverBatch is an open batch and the messages it has received so
+// far.
+type handoverBatch struct {
+	Ref      string
+	Type     string
+	Params   []string
+	Parent   string
+	Messages []string
+}
+
+// file returns a duplicate of the connection's file descriptor.
+func (c *Conn) file() (*os.File, error) {
+	fc, ok := c.NetConn().(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, ErrHandoverUnsupported
+	}
+	return fc.File()
+}
+
+// export stops reading from the connection and returns a duplicate of
+// its file descriptor and the state of the session. Reading stays
+// suspended until done is called with the outcome of the transfer. If
+// it is nil, the client dies and Process returns ErrHandedOver;
+// otherwise, reading resumes and the client carries on.
+func (c *Client) export() (f *os.File, st *handoverState, done func(error), err error) {
+	c.mu.Lock()
+	conn, dead := c.conn, c.dead
+	if conn == nil || dead {
+		c.mu.Unlock()
+		return nil, nil, nil, ErrDeadClient
+	}
+	if c.handover != nil {
+		c.mu.Unlock()
+		return nil, nil, nil, errHandoverInProgress
+	}
+	resume := make(chan struct{})
+	c.handover = resume
+	c.mu.Unlock()
+
+	f, err = conn.file()
+	if err != nil {
+		c.mu.Lock()
+		c.handover = nil
+		c.mu.Unlock()
+		return nil, nil, nil, err
+	}
+	pending := conn.pause()
+	// Wait for Read to finish processing the last message it read.
+	c.rmu.Lock()
+
+	c.mu.RLock()
+	st = &handoverState{
+		Nick:      c.Nick,
+		User:      c.User,
+		Name:      c.Name,
+		Self:      c.self,
+		Connected: c.connected,
+		ISupport:  c.ISupport.raw,
+		Available: c.Caps.Available(),
+		Enabled:   c.Caps.Enabled(),
+		Pending:   pending,
+		Batches:   c.exportBatches(),
+	}
+	c.mu.RUnlock()
+
+	done = func(err error) {
+		defer c.rmu.Unlock()
+		if err == nil {
+			c.error(ErrHandedOver)
+			return
+		}
+		conn.resume()
+		c.mu.Lock()
+		c.handover = nil
+		c.mu.Unlock()
+		close(resume)
+	}
+	return f, st, done, nil
+}
+
+var errHandoverInProgress = errors.New("handover already in progress")
+
+// awaitHandover waits for a handover in progress to finish and
+// reports whether it failed, in which case reading resumes.
+func (c *Client) awaitHandover() bool {
+	c.mu.RLock()
+	resume, quit := c.handover, c.chQuit
+	c.mu.RUnlock()
+	if resume == nil {
+		return true
+	}
+	select {
+	case <-resume:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// exportBatches returns the open batches, outermost first. It must
+// only be called while Read is suspended.
+func (c *Client) exportBatches() []handoverBatch {
+	depth := func(b *Batch) int {
+		n := 0
+		for ; b.Parent != nil; b = b.Parent {
+			n++
+		}
+		return n
+	}
+	var open []*openBatch
+	for _, b := range c.batches {
+		open = append(open, b)
+	}
+	sort.Slice(open, func(i, j int) bool {
+		di, dj := depth(open[i].meta), depth(open[j].meta)
+		if di != dj {
+			return di < dj
+		}
+		return open[i].meta.Ref < open[j].meta.Ref
+	})
+	var out []handoverBatch
+	for _, b := range open {
+		hb := handoverBatch{Ref: b.meta.Ref, Type: b.meta.Type, Params: b.meta.Params}
+		if b.meta.Parent != nil {
+			hb.Parent = b.meta.Parent.Ref
+		}
+		for _, m := range b.msgs {
+			hb.Messages = append(hb.Messages, m.Raw)
+		}
+		out = append(out, hb)
+	}
+	return out
+}
+
+// restore restores the state of a session handed over by another
+// process. It must be called after Connect and before Process.
+func (c *Client) restore(st *handoverState) {
+	c.conn.unread(st.Pending)
+
+	c.mu.Lock()
+	c.Nick, c.User, c.Name = st.Nick, st.User, st.Name
+	c.self = st.Self
+	c.connected = st.Connected
+	c.resumed = true
+	close(c.chWelcome)
+	c.mu.Unlock()
+
+	tokens := make([]string, 0, len(st.ISupport))
+	for token, value := range st.ISupport {
+		if value != "" {
+			token += "=" + value
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	params := append([]string{st.Self.Nick}, tokens...)
+	c.parseISupport(&Message{Command: RPL_ISUPPORT, Params: append(params, "are supported by this server")})
+
+	for _, hb := range st.Batches {
+		meta := &Batch{Ref: hb.Ref, Type: hb.Type, Params: hb.Params}
+		if parent, ok := c.batches[hb.Parent]; ok {
+			meta.Parent = parent.meta
+		}
+		b := &openBatch{meta: meta}
+		for _, raw := range hb.Messages {
+			m := Parse(raw)
+			m.Batch = meta
+			b.msgs = append(b.msgs, m)
+		}
+		if c.batches == nil {
+			c.batches = make(map[string]*openBatch)
+		}
+		c.batches[hb.Ref] = b
+	}
+
+	c.Caps.restore(st.Available, st.Enabled)
+}
+
+func (cm *CapabilityManager) restore(available map[string]string, enabled []string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for name, value := range available {
+		cm.available[name] = value
+	}
+	for _, name := range enabled {
+		cm.enabled[name] = true
+	}
+	cm.completed = true
+}
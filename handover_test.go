@@ -0,0 +1,176 @@
+//go:build unix
+
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// registeredClient connects a client with the given mux to a TCP
+// server and registers it. The server has sent the beginning of a
+// line the client hasn't seen the end of yet, and a batch is open.
+func registeredClient(t *testing.T, mux Muxer) (c *Client, srv net.Conn, lines chan string, processed chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	lines = make(chan string, 100)
+	server := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server <- conn
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	c = &Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux}
+	if err := c.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	processed = make(chan error, 1)
+	go func() { processed <- c.Process() }()
+	srv = <-server
+	t.Cleanup(func() { srv.Close() })
+	fmt.Fprintf(srv, ":irc.test 001 bot :Welcome\r\n:irc.test 002 bot :Host\r\n:irc.test 003 bot :Created\r\n"+
+		":irc.test 004 bot irc.test v1 i o\r\n:irc.test 005 bot NETWORK=Test :are supported\r\n:irc.test 422 bot :No MOTD\r\n"+
+		":irc.test BATCH +split netsplit a.test b.test\r\n@batch=split :x!y@z QUIT :a.test b.test\r\n"+
+		":a!b@c PRIVMSG bot :par")
+	for deadline := time.Now().Add(5 * time.Second); !c.Connected(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client didn't register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give the client a chance to buffer the partial line.
+	time.Sleep(50 * time.Millisecond)
+	return c, srv, lines, processed
+}
+
+// receiver returns a mux that reports the text of private messages
+// and the number of messages in completed batches.
+func receiver() (mux *Mux, received chan string, batches chan int) {
+	mux = NewMux()
+	received = make(chan string, 1)
+	batches = make(chan int, 1)
+	mux.HandleFunc("PRIVMSG", func(c *Client, m *Message) { received <- m.Params[1] })
+	mux.HandleFunc("BATCH", func(c *Client, m *Message) {
+		if m.Batch != nil && strings.HasPrefix(m.Params[0], "-") {
+			batches <- len(m.Batch.Messages)
+		}
+	})
+	return mux, received, batches
+}
+
+// finish completes the partial line and the open batch and checks
+// that they arrive.
+func finish(t *testing.T, srv net.Conn, received chan string, batches chan int) {
+	t.Helper()
+	fmt.Fprintf(srv, "tial\r\n:irc.test BATCH -split\r\n")
+	select {
+	case text := <-received:
+		if text != "partial" {
+			t.Errorf("got %q, expected %q", text, "partial")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	select {
+	case n := <-batches:
+		if n != 1 {
+			t.Errorf("batch had %d messages, expected 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the batch to end")
+	}
+}
+
+func TestHandover(t *testing.T) {
+	old, srv, lines, processed := registeredClient(t, NewMux())
+
+	a, b := unixPair(t)
+	defer a.Close()
+	defer b.Close()
+	handedOver := make(chan error, 1)
+	go func() { handedOver <- old.Handover(a) }()
+
+	mux, received, batches := receiver()
+	c, err := Resume(b, WithMux(mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := <-handedOver; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-processed; err != ErrHandedOver {
+		t.Errorf("old client's Process returned %v, expected ErrHandedOver", err)
+	}
+	go c.Process()
+
+	if !c.Connected() || c.CurrentNick() != "bot" || c.Support().Network != "Test" {
+		t.Errorf("state wasn't restored: connected=%t nick=%q network=%q",
+			c.Connected(), c.CurrentNick(), c.Support().Network)
+	}
+	finish(t, srv, received, batches)
+	c.Send("PRIVMSG #chan :still here")
+	for {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, "PRIVMSG #chan") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the resumed client's message")
+		}
+	}
+}
+
+func TestHandoverFailed(t *testing.T) {
+	mux, received, batches := receiver()
+	old, srv, _, processed := registeredClient(t, mux)
+
+	// Nobody is listening on the other end.
+	a, b := unixPair(t)
+	b.Close()
+	defer a.Close()
+	if err := old.Handover(a); err == nil {
+		t.Fatal("expected handover to fail")
+	}
+	select {
+	case err := <-processed:
+		t.Fatalf("Process returned %v after failed handover", err)
+	default:
+	}
+	finish(t, srv, received, batches)
+}
@@ -0,0 +1,89 @@
+//go:build unix
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Handover passes the client's connection and session state over uc,
+// a Unix socket, to another process, which resumes the session with
+// Resume. This allows replacing a bot's binary without reconnecting.
+//
+// The client stops reading immediately; messages the server sends
+// from then on are processed by the receiving process, as are the
+// rest of open batches. Afterwards, the client is dead and Process
+// returns ErrHandedOver. Messages that were queued but not yet sent
+// fail with ErrDeadClient, pending queries fail, and the channels of
+// SendLabeled are closed; the responses are dispatched to the
+// receiving process's handlers as ordinary messages.
+//
+// If the transfer fails, Handover returns the error and the client
+// resumes reading as if nothing happened. The receiving process
+// might have received the connection nonetheless and must not use it
+// unless Resume succeeded.
+//
+// Only plaintext connections can be handed over.
+func (c *Client) Handover(uc *net.UnixConn) (err error) {
+	f, st, done, err := c.export()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func() { done(err) }()
+	// The descriptor travels with a single byte of data; the state
+	// follows as JSON.
+	if _, _, err := uc.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+	return json.NewEncoder(uc).Encode(st)
+}
+
+// Resume receives a connection and session state sent by Handover
+// over uc and returns a client for it. The options are applied as by
+// NewClient. The client is registered already; Process doesn't
+// register again, but emits the irc:resumed signal.
+func Resume(uc *net.UnixConn, opts ...ClientOption) (*Client, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("handover didn't include a connection")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, errors.New("handover didn't include a connection")
+	}
+	f := os.NewFile(uintptr(fds[0]), "irc")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var st handoverState
+	if err := json.NewDecoder(uc).Decode(&st); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := NewClient(conn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.restore(&st)
+	return c, nil
+}
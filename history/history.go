@@ -0,0 +1,280 @@
+// Package history retrieves scrollback from servers and bouncers,
+// such as soju and Ergo, that implement the IRCv3 CHATHISTORY
+// extension. Servers that instead advertise the simpler HISTORY
+// command, such as UnrealIRCd, are supported for requests of the
+// latest messages.
+//
+// The client needs to have the draft/chathistory, batch,
+// labeled-response and server-time capabilities enabled; message-tags
+// is recommended so that messages carry their IDs. For HISTORY,
+// draft/chathistory isn't needed.
+//
+// For servers without any history support, Recorder keeps a log of
+// incoming messages in a Store, which can be queried later.
+package history // import "honnef.co/go/irc/history"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Ref identifies a point in a conversation's history, by timestamp
+// or message ID.
+type Ref string
+
+// None is the Ref used by Latest to request the latest messages,
+// without a lower bound.
+const None Ref = "*"
+
+// Timestamp refers to the given point in time.
+func Timestamp(t time.Time) Ref {
+	return Ref("timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z"))
+}
+
+// MsgID refers to the message with the given ID.
+func MsgID(id string) Ref {
+	return Ref("msgid=" + id)
+}
+
+// Entry is a message from history.
+type Entry struct {
+	// The message's ID, if the server provides one
+	ID   string
+	Time time.Time
+	// The decoded message, as returned by irc.Decode, or nil if it
+	// has no event type
+	Event   interface{}
+	Message *irc.Message
+}
+
+// Target is a conversation with recent activity, as returned by
+// Targets.
+type Target struct {
+	Name   string
+	Latest time.Time
+}
+
+// A FailError is returned when the server rejects a request.
+type FailError struct {
+	// The command that failed. Empty means CHATHISTORY.
+	Command     string
+	Code        string
+	Description string
+}
+
+func (err *FailError) Error() string {
+	command := err.Command
+	if command == "" {
+		command = "CHATHISTORY"
+	}
+	return fmt.Sprintf("%s failed: %s (%s)", command, err.Description, err.Code)
+}
+
+// ErrUnsupported is returned for requests that the server's method of
+// providing history can't express.
+var ErrUnsupported = errors.New("request not supported by the server's history method")
+
+// Method is a way of requesting history.
+type Method int
+
+const (
+	// ChatHistory is the IRCv3 CHATHISTORY command.
+	ChatHistory Method = iota
+	// HistoryCommand is the HISTORY command, which only returns the
+	// latest messages in a channel.
+	HistoryCommand
+)
+
+// Detect returns the method to use with the client's server. Servers
+// that advertise HISTORY in RPL_ISUPPORT but don't offer
+// draft/chathistory use HistoryCommand, all others ChatHistory.
+func Detect(c *irc.Client) Method {
+	if c.HasCap("draft/chathistory") {
+		return ChatHistory
+	}
+	if _, ok := c.Support().Raw("HISTORY"); ok {
+		return HistoryCommand
+	}
+	return ChatHistory
+}
+
+// Latest returns up to limit of the most recent messages in target,
+// newer than since, which may be None.
+//
+// With HistoryCommand, the latest limit messages are requested and
+// those not newer than since are discarded.
+func Latest(ctx context.Context, c *irc.Client, target string, since Ref, limit int) ([]Entry, error) {
+	if Detect(c) == HistoryCommand {
+		out, err := LatestHistory(ctx, c, target, limit)
+		if err != nil || since == None {
+			return out, err
+		}
+		return newerThan(out, since), nil
+	}
+	return entries(ctx, c, "LATEST", target, string(since), strconv.Itoa(limit))
+}
+
+// LatestHistory returns up to limit of the most recent messages in
+// target, using the HISTORY command regardless of what Detect
+// returns. This is useful for servers that support HISTORY without
+// advertising it.
+func LatestHistory(ctx context.Context, c *irc.Client, target string, limit int) ([]Entry, error) {
+	msgs, err := send(ctx, c, &irc.Message{Command: "HISTORY", Params: []string{target, strconv.Itoa(limit)}})
+	if err != nil {
+		return nil, err
+	}
+	return toEntries(msgs), nil
+}
+
+// newerThan returns the entries after ref. If ref is a message ID
+// that isn't among the entries, all entries are returned.
+func newerThan(entries []Entry, ref Ref) []Entry {
+	s := string(ref)
+	switch {
+	case strings.HasPrefix(s, "msgid="):
+		id := s[len("msgid="):]
+		for i, e := range entries {
+			if e.ID == id {
+				return entries[i+1:]
+			}
+		}
+		return entries
+	case strings.HasPrefix(s, "timestamp="):
+		t, err := time.Parse(time.RFC3339Nano, s[len("timestamp="):])
+		if err != nil {
+			return entries
+		}
+		var out []Entry
+		for _, e := range entries {
+			if e.Time.After(t) {
+				out = append(out, e)
+			}
+		}
+		return out
+	default:
+		return entries
+	}
+}
+
+// Before returns up to limit messages in target before ref.
+func Before(ctx context.Context, c *irc.Client, target string, ref Ref, limit int) ([]Entry, error) {
+	if Detect(c) == HistoryCommand {
+		return nil, ErrUnsupported
+	}
+	return entries(ctx, c, "BEFORE", target, string(ref), strconv.Itoa(limit))
+}
+
+// After returns up to limit messages in target after ref.
+func After(ctx context.Context, c *irc.Client, target string, ref Ref, limit int) ([]Entry, error) {
+	if Detect(c) == HistoryCommand {
+		return nil, ErrUnsupported
+	}
+	return entries(ctx, c, "AFTER", target, string(ref), strconv.Itoa(limit))
+}
+
+// Between returns up to limit messages in target between start and
+// end. If start is later than end, the latest messages before start
+// are returned.
+func Between(ctx context.Context, c *irc.Client, target string, start, end Ref, limit int) ([]Entry, error) {
+	if Detect(c) == HistoryCommand {
+		return nil, ErrUnsupported
+	}
+	return entries(ctx, c, "BETWEEN", target, string(start), string(end), strconv.Itoa(limit))
+}
+
+// Targets returns up to limit conversations with activity between
+// start and end, which must be timestamps.
+func Targets(ctx context.Context, c *irc.Client, start, end time.Time, limit int) ([]Target, error) {
+	if Detect(c) == HistoryCommand {
+		return nil, ErrUnsupported
+	}
+	msgs, err := request(ctx, c, "TARGETS", string(Timestamp(start)), string(Timestamp(end)), strconv.Itoa(limit))
+	if err != nil {
+		return nil, err
+	}
+	var out []Target
+	for _, m := range msgs {
+		// CHATHISTORY TARGETS <target> <timestamp>
+		if m.Command != "CHATHISTORY" || len(m.Params) < 3 || m.Params[0] != "TARGETS" {
+			continue
+		}
+		t := Target{Name: m.Params[1]}
+		t.Latest, _ = time.Parse(time.RFC3339Nano, strings.TrimPrefix(m.Params[2], "timestamp="))
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func entries(ctx context.Context, c *irc.Client, params ...string) ([]Entry, error) {
+	msgs, err := request(ctx, c, params...)
+	if err != nil {
+		return nil, err
+	}
+	return toEntries(msgs), nil
+}
+
+func toEntries(msgs []*irc.Message) []Entry {
+	out := make([]Entry, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, newEntry(m))
+	}
+	return out
+}
+
+// request sends a CHATHISTORY command and returns the messages in
+// the response, without BATCH markers.
+func request(ctx context.Context, c *irc.Client, params ...string) ([]*irc.Message, error) {
+	return send(ctx, c, &irc.Message{Command: "CHATHISTORY", Params: params})
+}
+
+// send sends a history request and returns the messages in the
+// response, without BATCH markers.
+func send(ctx context.Context, c *irc.Client, req *irc.Message) ([]*irc.Message, error) {
+	ch, err := c.SendLabeled(req)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*irc.Message
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return msgs, nil
+			}
+			switch m.Command {
+			case "BATCH":
+			case "FAIL":
+				err := &FailError{}
+				if len(m.Params) > 0 && m.Params[0] != "CHATHISTORY" {
+					err.Command = m.Params[0]
+				}
+				if len(m.Params) > 1 {
+					err.Code = m.Params[1]
+				}
+				if len(m.Params) > 2 {
+					err.Description = m.Params[len(m.Params)-1]
+				}
+				go drain(ch)
+				return nil, err
+			default:
+				msgs = append(msgs, m)
+			}
+		case <-ctx.Done():
+			go drain(ch)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// drain discards the rest of a response we're no longer interested
+// in, so that it doesn't block the client.
+func drain(ch <-chan *irc.Message) {
+	for range ch {
+	}
+}
@@ -0,0 +1,208 @@
+package history
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+// historyServer returns a server that answers command with lines,
+// in which $label is replaced by the request's label, and that sends
+// the parameters of requests to params.
+func historyServer(command string, lines []string, params chan<- []string) *irctest.Server {
+	srv := irctest.NewServer()
+	srv.Caps = map[string]string{
+		"batch":             "",
+		"labeled-response":  "",
+		"message-tags":      "",
+		"server-time":       "",
+		"draft/chathistory": "",
+	}
+	srv.Handle(command, func(sess *irctest.Session, m *irc.Message) {
+		params <- m.Params
+		for _, line := range lines {
+			sess.Send(strings.Replace(line, "$label", m.Tags["label"], -1))
+		}
+	})
+	return srv
+}
+
+func connect(t *testing.T, srv *irctest.Server) *irc.Client {
+	t.Helper()
+	c := &irc.Client{
+		Nick:   "bot",
+		User:   "bot",
+		Mux:    irc.NewMux(),
+		Caps:   irc.NewCapabilityManager("batch", "labeled-response", "message-tags", "server-time", "draft/chathistory"),
+		Dialer: srv,
+	}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go c.Process()
+	t.Cleanup(func() { c.Close() })
+	// Wait for RPL_ISUPPORT, which arrives after the client is
+	// connected.
+	for deadline := time.Now().Add(5 * time.Second); c.Support().Network == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("client didn't register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return c
+}
+
+func ids(entries []Entry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.ID)
+	}
+	return out
+}
+
+var chathistoryBatch = []string{
+	"@label=$label :irc.test BATCH +r labeled-response",
+	"@batch=r :irc.test BATCH +h chathistory #chan",
+	"@batch=h;msgid=1;time=2020-01-01T12:00:00.000Z :alice!a@host PRIVMSG #chan :one",
+	"@batch=h;msgid=2;time=2020-01-01T12:01:00.000Z :bob!b@host NOTICE #chan :two",
+	":irc.test BATCH -h",
+	":irc.test BATCH -r",
+}
+
+func TestChatHistory(t *testing.T) {
+	params := make(chan []string, 1)
+	c := connect(t, historyServer("CHATHISTORY", chathistoryBatch, params))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entries, err := Latest(ctx, c, "#chan", None, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := <-params; !reflect.DeepEqual(p, []string{"LATEST", "#chan", "*", "10"}) {
+		t.Errorf("unexpected request %q", p)
+	}
+	if got := ids(entries); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("expected messages 1 and 2, got %q", got)
+	}
+	if want := time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC); !entries[1].Time.Equal(want) {
+		t.Errorf("expected time %v, got %v", want, entries[1].Time)
+	}
+	if ev, ok := entries[1].Event.(*irc.MessageEvent); !ok || !ev.Notice || ev.Text != "two" {
+		t.Errorf("unexpected event %#v", entries[1].Event)
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := Between(ctx, c, "#chan", Timestamp(start), MsgID("2"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-params; !reflect.DeepEqual(p, []string{"BETWEEN", "#chan", "timestamp=2020-01-01T00:00:00.000Z", "msgid=2", "5"}) {
+		t.Errorf("unexpected request %q", p)
+	}
+}
+
+func TestChatHistoryTargets(t *testing.T) {
+	params := make(chan []string, 1)
+	c := connect(t, historyServer("CHATHISTORY", []string{
+		"@label=$label :irc.test BATCH +r labeled-response",
+		"@batch=r :irc.test BATCH +t draft/chathistory-targets",
+		"@batch=t :irc.test CHATHISTORY TARGETS #chan timestamp=2020-01-01T12:00:00.000Z",
+		"@batch=t :irc.test CHATHISTORY TARGETS alice timestamp=2020-01-01T13:00:00.000Z",
+		":irc.test BATCH -t",
+		":irc.test BATCH -r",
+	}, params))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	targets, err := Targets(ctx, c, start, start.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-params
+	expected := []Target{
+		{"#chan", time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"alice", time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+}
+
+func TestChatHistoryFail(t *testing.T) {
+	params := make(chan []string, 1)
+	c := connect(t, historyServer("CHATHISTORY", []string{
+		"@label=$label :irc.test FAIL CHATHISTORY INVALID_TARGET LATEST #secret :Messages could not be retrieved",
+	}, params))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Latest(ctx, c, "#secret", None, 10)
+	<-params
+	expected := &FailError{Code: "INVALID_TARGET", Description: "Messages could not be retrieved"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected %v, got %v", expected, err)
+	}
+	if err != nil && !strings.HasPrefix(err.Error(), "CHATHISTORY failed") {
+		t.Errorf("unexpected error message %q", err)
+	}
+}
+
+func TestHistoryFallback(t *testing.T) {
+	params := make(chan []string, 1)
+	srv := historyServer("HISTORY", chathistoryBatch, params)
+	delete(srv.Caps, "draft/chathistory")
+	srv.ISupport = append(srv.ISupport, "HISTORY=50")
+	c := connect(t, srv)
+	if m := Detect(c); m != HistoryCommand {
+		t.Fatalf("expected HistoryCommand, got %v", m)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entries, err := Latest(ctx, c, "#chan", MsgID("1"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := <-params; !reflect.DeepEqual(p, []string{"#chan", "10"}) {
+		t.Errorf("unexpected request %q", p)
+	}
+	if got := ids(entries); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("expected only message 2, got %q", got)
+	}
+
+	if _, err := Before(ctx, c, "#chan", MsgID("1"), 10); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestNewerThan(t *testing.T) {
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{ID: "a", Time: base},
+		{ID: "b", Time: base.Add(time.Minute)},
+		{ID: "c", Time: base.Add(2 * time.Minute)},
+	}
+	table := []struct {
+		ref Ref
+		ids []string
+	}{
+		{MsgID("a"), []string{"b", "c"}},
+		{MsgID("c"), nil},
+		{MsgID("unknown"), []string{"a", "b", "c"}},
+		{Timestamp(base.Add(time.Minute)), []string{"c"}},
+		{Timestamp(base.Add(-time.Minute)), []string{"a", "b", "c"}},
+		{"timestamp=garbage", []string{"a", "b", "c"}},
+		{None, []string{"a", "b", "c"}},
+	}
+	for _, test := range table {
+		if got := ids(newerThan(entries, test.ref)); !reflect.DeepEqual(got, test.ids) {
+			t.Errorf("%s: expected %q, got %q", test.ref, test.ids, got)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package history
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// A Store keeps messages per conversation, so that what happened
+// while a bot or bouncer was offline can be looked up later.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Append adds m, which has its Time set, to the history of
+	// target. Targets are casefolded by the caller.
+	Append(target string, m *irc.Message) error
+	// Query returns up to limit messages in target sent at or after
+	// start and before end, in chronological order. If there are
+	// more, the latest are returned. Zero times don't limit the
+	// range, and a limit of zero means no limit.
+	Query(target string, start, end time.Time, limit int) ([]Entry, error)
+}
+
+// inRange reports whether t lies in [start, end), with zero times
+// meaning no bound.
+func inRange(t, start, end time.Time) bool {
+	return (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end))
+}
+
+func latest(entries []Entry, limit int) []Entry {
+	if limit > 0 && len(entries) > limit {
+		return entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+func newEntry(m *irc.Message) Entry {
+	e := Entry{ID: m.Tags["msgid"], Time: m.Time, Message: m}
+	e.Event, _ = irc.Decode(m)
+	return e
+}
+
+// MemoryStore is a Store that keeps the most recent messages of each
+// target in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string][]Entry
+}
+
+// NewMemoryStore returns a MemoryStore that keeps the last size
+// messages per target.
+func NewMemoryStore(size int) *MemoryStore {
+	if size <= 0 {
+		size = 1
+	}
+	return &MemoryStore{size: size, entries: make(map[string][]Entry)}
+}
+
+func (s *MemoryStore) Append(target string, m *irc.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := append(s.entries[target], newEntry(m))
+	// Drop old entries in bulk, so that appending stays cheap.
+	if len(entries) >= 2*s.size {
+		entries = append([]Entry(nil), latest(entries, s.size)...)
+	}
+	s.entries[target] = entries
+	return nil
+}
+
+func (s *MemoryStore) Query(target string, start, end time.Time, limit int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Entry
+	for _, e := range latest(s.entries[target], s.size) {
+		if inRange(e.Time, start, end) {
+			out = append(out, e)
+		}
+	}
+	// Server-time may disagree with the order in which messages
+	// arrived.
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return latest(out, limit), nil
+}
+
+// FileStore is a Store that appends messages to one file per target
+// in a directory, one line per message. Lines carry the time of the
+// message in a server-time tag, so the files are valid IRC and can
+// be read by other tools.
+type FileStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (s *FileStore) path(target string) string {
+	return filepath.Join(s.Dir, url.PathEscape(target)+".log")
+}
+
+func (s *FileStore) Append(target string, m *irc.Message) error {
+	m = m.Copy()
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags["time"] = m.Time.UTC().Format("2006-01-02T15:04:05.000Z")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path(target), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(m.WireString() + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *FileStore) Query(target string, start, end time.Time, limit int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path(target))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := irc.Parse(scanner.Text())
+		if m.Command == "" {
+			continue
+		}
+		m.Time, _ = time.Parse(time.RFC3339Nano, m.Tags["time"])
+		if inRange(m.Time, start, end) {
+			out = append(out, newEntry(m))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Messages are appended as they arrive, but server-time may
+	// disagree about their order.
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return latest(out, limit), nil
+}
+
+// Recorder writes incoming messages to a Store. Messages are recorded
+// under the channel they belong to or, for private messages, under
+// the nick of the other party. Messages without such a target, like
+// QUIT, NICK and numerics, aren't recorded. The client's own messages
+// are recorded if the echo-message capability is enabled.
+//
+// Recorder needs to be registered as a catch-all handler. Register it
+// with HandleSync, or messages may be stored out of order.
+type Recorder struct {
+	*irc.Mux
+	Store Store
+	// Errors, if set, is called with errors from the store.
+	Errors func(err error)
+}
+
+func NewRecorder(store Store) *Recorder {
+	r := &Recorder{Mux: irc.NewOrderedMux(), Store: store}
+	r.HandleFunc("", r.record)
+	return r
+}
+
+// RecordTarget returns the target m is recorded under by Recorder.
+func RecordTarget(c *irc.Client, m *irc.Message) (string, bool) {
+	if m.Command == "" || m.IsNumeric() || m.Prefix.Nick == "" {
+		return "", false
+	}
+	if channel, ok := c.ChannelForMsg(m); ok {
+		return channel, true
+	}
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		if len(m.Params) == 0 {
+			return "", false
+		}
+		if c.IsMe(m.Prefix.Nick) {
+			return m.Params[0], true
+		}
+		return m.Prefix.Nick, true
+	}
+	return "", false
+}
+
+func (r *Recorder) record(c *irc.Client, m *irc.Message) {
+	target, ok := RecordTarget(c, m)
+	if !ok {
+		return
+	}
+	if err := r.Store.Append(c.Support().Casefold(target), m); err != nil && r.Errors != nil {
+		r.Errors(err)
+	}
+}
+
+// Replay returns up to limit messages in target from store, sent
+// at or after since, for catching up on what happened while offline.
+func Replay(c *irc.Client, store Store, target string, since time.Time, limit int) ([]Entry, error) {
+	return store.Query(c.Support().Casefold(target), since, time.Time{}, limit)
+}
@@ -0,0 +1,121 @@
+package history
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, line := range []string{
+		"@msgid=1 :alice!a@host PRIVMSG #chan :one",
+		"@msgid=2 :bob!b@host PRIVMSG #chan :two",
+		"@msgid=4 :alice!a@host PRIVMSG #chan :four",
+		"@msgid=3 :bob!b@host PRIVMSG #chan :three",
+		"@msgid=x :alice!a@host PRIVMSG bob :elsewhere",
+	} {
+		m := irc.Parse(line)
+		m.Time = base.Add(time.Duration(i) * time.Minute)
+		// The third and fourth message disagree about their order.
+		switch m.Tags["msgid"] {
+		case "4":
+			m.Time = base.Add(3 * time.Minute)
+		case "3":
+			m.Time = base.Add(2 * time.Minute)
+		}
+		target := "#chan"
+		if m.Params[0] == "bob" {
+			target = "alice"
+		}
+		if err := store.Append(target, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		start, end time.Time
+		limit      int
+		ids        []string
+	}{
+		{time.Time{}, time.Time{}, 0, []string{"1", "2", "3", "4"}},
+		{time.Time{}, time.Time{}, 2, []string{"3", "4"}},
+		{base.Add(time.Minute), base.Add(3 * time.Minute), 0, []string{"2", "3"}},
+		{base.Add(time.Hour), time.Time{}, 0, nil},
+	}
+	for _, test := range table {
+		entries, err := store.Query("#chan", test.start, test.end, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%v-%v limit %d: expected %q, got %q", test.start, test.end, test.limit, test.ids, ids)
+		}
+	}
+
+	entries, err := store.Query("alice", time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry for alice, got %d", len(entries))
+	}
+	e := entries[0]
+	if !e.Time.Equal(base.Add(4*time.Minute)) || e.Message.Params[1] != "elsewhere" {
+		t.Errorf("unexpected entry %v", e)
+	}
+	if ev, ok := e.Event.(*irc.MessageEvent); !ok || ev.Text != "elsewhere" {
+		t.Errorf("expected decoded PRIVMSG, got %#v", e.Event)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(100))
+
+	// Only the last size messages are kept.
+	store := NewMemoryStore(3)
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		m := irc.Parse(fmt.Sprintf("@msgid=%d :alice!a@host PRIVMSG #chan :hi", i))
+		m.Time = base.Add(time.Duration(i) * time.Second)
+		store.Append("#chan", m)
+	}
+	entries, _ := store.Query("#chan", time.Time{}, time.Time{}, 0)
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	if expected := []string{"7", "8", "9"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %q, got %q", expected, ids)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	// The files outlive the store.
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := store.Query("#chan", time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].Message.Prefix.Nick != "alice" || entries[0].Message.Params[1] != "one" {
+		t.Errorf("unexpected entries after reopening: %v", entries)
+	}
+}
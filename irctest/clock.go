@@ -0,0 +1,170 @@
+package irctest
+
+import (
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Clock is an irc.Clock whose time only moves when Advance is
+// called, for testing pings, timeouts and other time-based behavior
+// without waiting.
+//
+//	clock := irctest.NewClock(time.Time{})
+//	c := &irc.Client{Nick: "bot", User: "bot", Dialer: srv, Clock: clock}
+//	srv.Clock = clock
+//	...
+//	clock.Advance(2 * time.Minute) // the client sends a PING
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ irc.Clock = (*Clock)(nil)
+
+// NewClock returns a Clock set to start, or to the start of 2000 if
+// start is zero.
+func NewClock(start time.Time) *Clock {
+	if start.IsZero() {
+		start = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *Clock) NewTimer(d time.Duration) irc.Timer {
+	return c.add(d, 0)
+}
+
+func (c *Clock) NewTicker(d time.Duration) irc.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) irc.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), fn: f}
+	c.timers = append(c.timers, t)
+	if d <= 0 {
+		c.fire()
+	}
+	return t
+}
+
+func (c *Clock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), when: c.now.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	if d <= 0 {
+		c.fire()
+	}
+	return t
+}
+
+// Timers returns the number of active timers and tickers. Tests can
+// poll it to wait for a goroutine to start waiting before calling
+// Advance.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by d, firing timers and tickers
+// that become due, in order. Like their counterparts in the time
+// package, tickers drop ticks that their receivers aren't ready
+// for.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		next := c.next()
+		if next == nil || next.when.After(end) {
+			break
+		}
+		c.now = next.when
+		c.fire()
+	}
+	c.now = end
+}
+
+// next returns the timer that is due first. c.mu must be held.
+func (c *Clock) next() *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if next == nil || t.when.Before(next.when) {
+			next = t
+		}
+	}
+	return next
+}
+
+// fire fires the timers that are due. c.mu must be held.
+func (c *Clock) fire() {
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			active = append(active, t)
+			continue
+		}
+		if t.fn != nil {
+			go t.fn()
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			active = append(active, t)
+		}
+	}
+	c.timers = active
+}
+
+// remove removes t and reports whether it was active.
+func (c *Clock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock  *Clock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+	// called instead of sending on ch, for AfterFunc
+	fn func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+func (t *fakeTimer) Stop() bool          { return t.clock.remove(t) }
+
+type fakeTicker struct{ t *fakeTimer }
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.ch }
+func (t fakeTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,125 @@
+package irctest
+
+import (
+	"fmt"
+	"sync"
+
+	"honnef.co/go/irc"
+)
+
+// Fake is an irc.ClientAPI that records the lines sent through it
+// instead of sending them to a server.
+type Fake struct {
+	Self     irc.Mask
+	ISupport *irc.ISupport
+	Caps     []string
+	// ReplyToNotices allows Reply to answer NOTICE messages, like
+	// Client.ReplyToNotices.
+	ReplyToNotices bool
+
+	mu   sync.Mutex
+	sent []string
+}
+
+var _ irc.ClientAPI = (*Fake)(nil)
+
+// NewFake returns a Fake using the nick nick, that believes the
+// channel types # and & to be supported.
+func NewFake(nick string) *Fake {
+	is := irc.NewISupport()
+	is.ChanTypes = []rune("#&")
+	return &Fake{
+		Self:     irc.Mask{Nick: nick, User: nick, Host: "irctest"},
+		ISupport: is,
+	}
+}
+
+// Sent returns the lines that have been sent so far.
+func (f *Fake) Sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]string, len(f.sent))
+	copy(out, f.sent)
+	return out
+}
+
+// Reset forgets all lines that have been sent so far.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = nil
+}
+
+func (f *Fake) Send(s string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, s)
+	return nil
+}
+
+func (f *Fake) SendMessage(m *irc.Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	return f.Send(m.WireString())
+}
+
+func (f *Fake) Sendf(format string, args ...interface{}) error {
+	return f.Send(fmt.Sprintf(format, args...))
+}
+
+func (f *Fake) Privmsg(target, message string) error {
+	return f.Sendf("PRIVMSG %s :%s", target, message)
+}
+
+func (f *Fake) Notice(target, message string) error {
+	return f.Sendf("NOTICE %s :%s", target, message)
+}
+
+func (f *Fake) Reply(m *irc.Message, response string) error {
+	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
+		panic("cannot reply to " + m.Command)
+	}
+	if m.Command == "NOTICE" && !f.ReplyToNotices {
+		return nil
+	}
+	return f.Privmsg(f.ISupport.ReplyTarget(m), response)
+}
+
+func (f *Fake) ReplyCTCP(m *irc.Message, response string) error {
+	ctcp, err := m.CTCP()
+	if err != nil {
+		panic("message is not a CTCP")
+	}
+	if m.Command == "NOTICE" {
+		return nil
+	}
+	return f.Notice(m.Prefix.Nick, irc.FormatCTCP(ctcp.Command, response))
+}
+
+func (f *Fake) Join(channel, password string) error {
+	if password == "" {
+		return f.Sendf("JOIN %s", channel)
+	}
+	return f.Sendf("JOIN %s %s", channel, password)
+}
+
+func (f *Fake) SetNick(nick string) error {
+	return f.Sendf("NICK %s", nick)
+}
+
+func (f *Fake) CurrentNick() string    { return f.Self.Nick }
+func (f *Fake) Identity() irc.Mask     { return f.Self }
+func (f *Fake) Support() *irc.ISupport { return f.ISupport }
+func (f *Fake) HasCap(name string) bool {
+	for _, c := range f.Caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fake) ChannelForMsg(m *irc.Message) (string, bool) {
+	return f.ISupport.ChannelForMsg(m)
+}
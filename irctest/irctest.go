@@ -0,0 +1,50 @@
+// Package irctest provides helpers for testing IRC handlers without
+// connecting to a real network.
+package irctest // import "honnef.co/go/irc/irctest"
+
+import (
+	"bufio"
+	"net"
+
+	"honnef.co/go/irc"
+)
+
+// Dispatch parses line, dispatches it synchronously to the handlers
+// that mux has registered for it and returns the lines the handlers
+// sent in response. Handlers that are muxers themselves are descended
+// into, so that their handlers run synchronously as well.
+//
+// The client passed to handlers is connected to an in-memory pipe and
+// believes the channel types # and & to be supported.
+func Dispatch(mux irc.Muxer, line string) []string {
+	conn, server := net.Pipe()
+	c := &irc.Client{Mux: mux}
+	c.Connect(conn)
+	c.ISupport.ChanTypes = []rune("#&")
+
+	var lines []string
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		close(done)
+	}()
+
+	m := irc.Parse(line)
+	dispatch(c, mux, m)
+	c.Close()
+	<-done
+	return lines
+}
+
+func dispatch(c *irc.Client, h irc.Handler, m *irc.Message) {
+	if mux, ok := h.(irc.Muxer); ok {
+		for _, h := range mux.Handlers(m) {
+			dispatch(c, h, m)
+		}
+		return
+	}
+	h.Process(c, m.Copy())
+}
@@ -0,0 +1,168 @@
+package irctest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/sasl"
+)
+
+func TestDispatch(t *testing.T) {
+	mux := irc.NewMux()
+	mux.HandleFunc("PRIVMSG", func(c *irc.Client, m *irc.Message) {
+		c.Reply(m, "pong")
+	})
+	lines := Dispatch(mux, ":nick!user@host PRIVMSG #channel :ping")
+	expected := []string{"PRIVMSG #channel :pong"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestFake(t *testing.T) {
+	h := func(c irc.ClientAPI, m *irc.Message) {
+		c.Reply(m, "hello "+m.Prefix.Nick)
+	}
+	f := NewFake("bot")
+	h(f, irc.Parse(":nick!user@host PRIVMSG bot :hi"))
+	h(f, irc.Parse(":nick!user@host PRIVMSG #channel :hi"))
+	expected := []string{"PRIVMSG nick :hello nick", "PRIVMSG #channel :hello nick"}
+	if !reflect.DeepEqual(f.Sent(), expected) {
+		t.Errorf("expected %q, got %q", expected, f.Sent())
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	srv.Accounts = map[string]string{"alice": "secret"}
+	srv.Whois["bob"] = &irc.WhoisResult{
+		User:     irc.Mask{Nick: "bob", User: "b", Host: "example.com"},
+		RealName: "Bob",
+		Account:  "bob",
+	}
+	srv.Handle("VERSION", func(sess *Session, m *irc.Message) {
+		sess.Reply(irc.RPL_VERSION, "irctest-1.0", "irc.test", "scripted")
+	})
+
+	mux := irc.NewMux()
+	connected := make(chan struct{}, 1)
+	mux.HandleFunc("irc:connected", func(c *irc.Client, m *irc.Message) {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	echoes := make(chan *irc.Message, 1)
+	mux.HandleFunc("PRIVMSG", func(c *irc.Client, m *irc.Message) { echoes <- m })
+	auth := sasl.New(&sasl.Plain{User: "alice", Password: "secret"})
+	mux.Handle("", auth)
+	c := &irc.Client{
+		Nick:          "alice",
+		User:          "alice",
+		Name:          "Alice",
+		Mux:           mux,
+		Authenticator: auth,
+		Dialer:        srv,
+	}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go c.Process()
+	defer c.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+	if !c.HasCap("sasl") {
+		t.Error("sasl wasn't enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.Whois(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RealName != "Alice" || res.Account != "alice" {
+		t.Errorf("got WHOIS %+v for alice", res)
+	}
+	res, err = c.Whois(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User.Host != "example.com" || res.Account != "bob" {
+		t.Errorf("got WHOIS %+v for bob fixture", res)
+	}
+	if _, err := c.Whois(ctx, "carol"); err == nil {
+		t.Error("expected error for WHOIS of unknown nick")
+	}
+
+	c.Privmsg("#test", "hello")
+	select {
+	case m := <-echoes:
+		if m.Prefix.Nick != "alice" || m.Params[1] != "hello" {
+			t.Errorf("unexpected echo %q", m.Raw)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for echo")
+	}
+
+	c.Send("VERSION")
+	if _, err := srv.WaitFor(ctx, "VERSION"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Time{})
+	srv := NewServer()
+	srv.Clock = clock
+	srv.Handle("VERSION", func(sess *Session, m *irc.Message) {
+		sess.Reply(irc.RPL_VERSION, "v1", "irc.test", "test")
+	})
+	mux := irc.NewMux()
+	versions := make(chan *irc.Message, 1)
+	mux.HandleFunc(irc.RPL_VERSION, func(c *irc.Client, m *irc.Message) { versions <- m })
+	c := &irc.Client{
+		Nick:         "bot",
+		User:         "bot",
+		Dialer:       srv,
+		Mux:          mux,
+		Clock:        clock,
+		Caps:         irc.NewCapabilityManager("server-time"),
+		PingInterval: time.Minute,
+	}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Process()
+	for deadline := time.Now().Add(5 * time.Second); !c.Connected(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client didn't register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := srv.WaitFor(ctx, "PING"); err != nil {
+		t.Fatal("client didn't ping after advancing the clock:", err)
+	}
+
+	c.Send("VERSION")
+	select {
+	case m := <-versions:
+		if !m.Time.Equal(clock.Now()) {
+			t.Errorf("message time %v doesn't match the clock's %v", m.Time, clock.Now())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for RPL_VERSION")
+	}
+}
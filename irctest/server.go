@@ -0,0 +1,772 @@
+package irctest
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"honnef.co/go/irc"
+)
+
+// A HandlerFunc scripts the server's response to a command.
+type HandlerFunc func(sess *Session, m *irc.Message)
+
+// Server is a minimal in-process IRC server for integration tests. It
+// accepts registrations, negotiates capabilities, authenticates with
+// SASL PLAIN, relays PRIVMSG and NOTICE to channels and other
+// sessions and answers WHOIS, either for connected sessions or from
+// fixtures. Handle overrides the response to any command.
+//
+// Server implements irc.Dialer, so that a client can be connected to
+// it without a network:
+//
+//	srv := irctest.NewServer()
+//	c := &irc.Client{Nick: "bot", User: "bot", Dialer: srv}
+//	c.Dial("tcp", "irc.test:6667")
+//
+// Server doesn't enforce any limits, permissions or channel modes.
+type Server struct {
+	// The server's name. Defaults to irc.test.
+	Name string
+	// The tokens sent in RPL_ISUPPORT.
+	ISupport []string
+	// The capabilities offered in CAP LS, mapped to their values.
+	Caps map[string]string
+	// Accounts and their passwords. If not empty, the sasl
+	// capability is offered with the PLAIN mechanism.
+	Accounts map[string]string
+	// WHOIS replies for users that aren't connected, by nick.
+	Whois map[string]*irc.WhoisResult
+	// Echo causes PRIVMSG and NOTICE to be sent back to their
+	// senders, regardless of the echo-message capability.
+	Echo bool
+	// Clock provides the time for server-time tags. Defaults to
+	// irc.RealClock; a Clock from this package lets tests control
+	// it.
+	Clock irc.Clock
+
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+	sessions map[*Session]struct{}
+	channels map[string]map[*Session]struct{}
+	received []*irc.Message
+	// closed and replaced whenever a message is received
+	changed chan struct{}
+}
+
+// NewServer returns a Server that supports the rfc1459 casemapping,
+// the # channel type and the op and voice prefixes, and that echoes
+// messages.
+func NewServer() *Server {
+	return &Server{
+		ISupport: []string{"CASEMAPPING=rfc1459", "CHANTYPES=#", "PREFIX=(ov)@+", "NETWORK=IRCTest"},
+		Caps:     map[string]string{"echo-message": "", "server-time": ""},
+		Whois:    make(map[string]*irc.WhoisResult),
+		Echo:     true,
+		handlers: make(map[string]HandlerFunc),
+		sessions: make(map[*Session]struct{}),
+		channels: make(map[string]map[*Session]struct{}),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (s *Server) name() string {
+	if s.Name == "" {
+		return "irc.test"
+	}
+	return s.Name
+}
+
+func fold(s string) string {
+	return irc.Casefold("rfc1459", s)
+}
+
+// Handle makes fn respond to command instead of the built-in
+// behavior. A nil fn restores the built-in behavior.
+func (s *Server) Handle(command string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command = strings.ToUpper(command)
+	if fn == nil {
+		delete(s.handlers, command)
+		return
+	}
+	s.handlers[command] = fn
+}
+
+// Dial connects to the server over an in-memory pipe. The network
+// and address are ignored.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client, nil
+}
+
+// Serve accepts connections on l and serves them until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection. It returns once the
+// connection has been closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	sess := &Session{
+		Server: s,
+		conn:   irc.NewConn(conn),
+		wake:   make(chan struct{}, 1),
+		caps:   make(map[string]bool),
+	}
+	go sess.writeLoop()
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer s.remove(sess, "Connection closed")
+
+	for {
+		m, err := sess.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if m.Command == "" {
+			continue
+		}
+		s.process(sess, m)
+	}
+}
+
+// Received returns all messages received from clients so far.
+func (s *Server) Received() []*irc.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*irc.Message(nil), s.received...)
+}
+
+// WaitFor returns the first message with the given command that was
+// received from any client, waiting for one to arrive if necessary.
+func (s *Server) WaitFor(ctx context.Context, command string) (*irc.Message, error) {
+	for {
+		s.mu.Lock()
+		for _, m := range s.received {
+			if m.Command == command {
+				s.mu.Unlock()
+				return m, nil
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Broadcast sends a raw line to all registered sessions.
+func (s *Server) Broadcast(line string) {
+	s.mu.Lock()
+	var sessions []*Session
+	for sess := range s.sessions {
+		if sess.registered {
+			sessions = append(sessions, sess)
+		}
+	}
+	s.mu.Unlock()
+	for _, sess := range sessions {
+		sess.Send(line)
+	}
+}
+
+func (s *Server) process(sess *Session, m *irc.Message) {
+	s.mu.Lock()
+	s.received = append(s.received, m)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	h, ok := s.handlers[strings.ToUpper(m.Command)]
+	s.mu.Unlock()
+	if ok {
+		h(sess, m)
+		return
+	}
+
+	switch strings.ToUpper(m.Command) {
+	case "PASS":
+		// Accepted and ignored
+	case "CAP":
+		s.cap(sess, m)
+	case "AUTHENTICATE":
+		s.authenticate(sess, m)
+	case "NICK":
+		s.nick(sess, m)
+	case "USER":
+		if len(m.Params) < 4 {
+			sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+			return
+		}
+		s.mu.Lock()
+		sess.user, sess.realname = m.Params[0], m.Params[3]
+		s.mu.Unlock()
+		s.register(sess)
+	case "PING":
+		token := ""
+		if len(m.Params) > 0 {
+			token = m.Params[0]
+		}
+		sess.SendMessage(&irc.Message{Command: "PONG", Params: []string{s.name(), token}})
+	case "JOIN":
+		s.join(sess, m)
+	case "PART":
+		s.part(sess, m)
+	case "PRIVMSG", "NOTICE":
+		s.privmsg(sess, m)
+	case "WHOIS":
+		s.whois(sess, m)
+	case "QUIT":
+		reason := "Client quit"
+		if len(m.Params) > 0 {
+			reason = "Quit: " + m.Params[0]
+		}
+		sess.Send("ERROR :Closing link")
+		s.remove(sess, reason)
+	default:
+		sess.Reply(irc.ERR_UNKNOWNCOMMAND, m.Command, "Unknown command")
+	}
+}
+
+// caps returns the capabilities on offer.
+func (s *Server) caps() map[string]string {
+	caps := make(map[string]string, len(s.Caps)+1)
+	for k, v := range s.Caps {
+		caps[k] = v
+	}
+	if len(s.Accounts) > 0 {
+		caps["sasl"] = "PLAIN"
+	}
+	return caps
+}
+
+func (s *Server) cap(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 {
+		sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+		return
+	}
+	caps := s.caps()
+	switch strings.ToUpper(m.Params[0]) {
+	case "LS":
+		s.mu.Lock()
+		sess.negotiating = !sess.registered
+		s.mu.Unlock()
+		var list []string
+		for k, v := range caps {
+			if v != "" {
+				k += "=" + v
+			}
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		sess.Reply("CAP", "LS", strings.Join(list, " "))
+	case "LIST":
+		s.mu.Lock()
+		var list []string
+		for k := range sess.caps {
+			list = append(list, k)
+		}
+		s.mu.Unlock()
+		sort.Strings(list)
+		sess.Reply("CAP", "LIST", strings.Join(list, " "))
+	case "REQ":
+		if len(m.Params) < 2 {
+			return
+		}
+		s.mu.Lock()
+		sess.negotiating = !sess.registered
+		s.mu.Unlock()
+		req := strings.Fields(m.Params[1])
+		for _, name := range req {
+			if _, ok := caps[strings.TrimPrefix(name, "-")]; !ok {
+				sess.Reply("CAP", "NAK", m.Params[1])
+				return
+			}
+		}
+		s.mu.Lock()
+		for _, name := range req {
+			if strings.HasPrefix(name, "-") {
+				delete(sess.caps, name[1:])
+			} else {
+				sess.caps[name] = true
+			}
+		}
+		s.mu.Unlock()
+		sess.Reply("CAP", "ACK", m.Params[1])
+	case "END":
+		s.mu.Lock()
+		sess.negotiating = false
+		s.mu.Unlock()
+		s.register(sess)
+	default:
+		sess.Reply("410", m.Params[0], "Invalid CAP command")
+	}
+}
+
+func (s *Server) authenticate(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 {
+		sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+		return
+	}
+	arg := m.Params[0]
+	s.mu.Lock()
+	authenticating := sess.authenticating
+	sess.authenticating = false
+	s.mu.Unlock()
+
+	switch {
+	case arg == "*":
+		sess.Reply(irc.RPL_SASLABORT, "SASL authentication aborted")
+	case !authenticating && arg == "PLAIN" && len(s.Accounts) > 0:
+		s.mu.Lock()
+		sess.authenticating = true
+		s.mu.Unlock()
+		sess.Send("AUTHENTICATE +")
+	case !authenticating:
+		sess.Reply(irc.RPL_SASLFAILED, "SASL authentication failed")
+	default:
+		// authzid NUL authcid NUL password
+		b, err := base64.StdEncoding.DecodeString(arg)
+		fields := strings.Split(string(b), "\x00")
+		if err != nil || len(fields) != 3 {
+			sess.Reply(irc.RPL_SASLFAILED, "SASL authentication failed")
+			return
+		}
+		account, password := fields[1], fields[2]
+		if pw, ok := s.Accounts[account]; !ok || pw != password {
+			sess.Reply(irc.RPL_SASLFAILED, "SASL authentication failed")
+			return
+		}
+		s.mu.Lock()
+		sess.account = account
+		mask := sess.mask()
+		s.mu.Unlock()
+		sess.Reply(irc.RPL_SASLLOGIN, mask.String(), account, "You are now logged in as "+account)
+		sess.Reply(irc.RPL_SASLSUCCESS, "SASL authentication successful")
+	}
+}
+
+func (s *Server) nick(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 || m.Params[0] == "" {
+		sess.Reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return
+	}
+	nick := m.Params[0]
+	s.mu.Lock()
+	if other := s.session(nick); other != nil && other != sess {
+		s.mu.Unlock()
+		sess.Reply(irc.ERR_NICKNAMEINUSE, nick, "Nickname is already in use")
+		return
+	}
+	registered := sess.registered
+	msg := &irc.Message{Prefix: sess.mask(), Command: "NICK", Params: []string{nick}}
+	sess.nick = nick
+	var recipients []*Session
+	if registered {
+		recipients = s.neighbors(sess)
+	}
+	s.mu.Unlock()
+
+	if !registered {
+		s.register(sess)
+		return
+	}
+	sess.SendMessage(msg)
+	for _, other := range recipients {
+		other.SendMessage(msg)
+	}
+}
+
+// register completes the registration of sess once it has sent NICK
+// and USER and finished capability negotiation.
+func (s *Server) register(sess *Session) {
+	s.mu.Lock()
+	if sess.registered || sess.negotiating || sess.nick == "" || sess.user == "" {
+		s.mu.Unlock()
+		return
+	}
+	sess.registered = true
+	nick := sess.nick
+	s.mu.Unlock()
+
+	name := s.name()
+	sess.Reply(irc.RPL_WELCOME, "Welcome to the test network, "+nick)
+	sess.Reply(irc.RPL_YOURHOST, "Your host is "+name)
+	sess.Reply(irc.RPL_CREATED, "This server was created for testing")
+	sess.Reply(irc.RPL_MYINFO, name, "irctest", "i", "ov")
+	tokens := s.ISupport
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > 13 {
+			n = 13
+		}
+		params := append(append([]string(nil), tokens[:n]...), "are supported by this server")
+		sess.Reply(irc.RPL_ISUPPORT, params...)
+		tokens = tokens[n:]
+	}
+	sess.Reply(irc.ERR_NOMOTD, "MOTD File is missing")
+}
+
+func (s *Server) join(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 {
+		sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(m.Params[0], ",") {
+		s.mu.Lock()
+		key := fold(channel)
+		members, ok := s.channels[key]
+		if !ok {
+			members = make(map[*Session]struct{})
+			s.channels[key] = members
+		}
+		if _, ok := members[sess]; ok {
+			s.mu.Unlock()
+			continue
+		}
+		members[sess] = struct{}{}
+		msg := &irc.Message{Prefix: sess.mask(), Command: "JOIN", Params: []string{channel}}
+		var recipients []*Session
+		var names []string
+		for member := range members {
+			recipients = append(recipients, member)
+			names = append(names, member.nick)
+		}
+		s.mu.Unlock()
+
+		for _, member := range recipients {
+			member.SendMessage(msg)
+		}
+		sort.Strings(names)
+		sess.Reply(irc.RPL_NAMREPLY, "=", channel, strings.Join(names, " "))
+		sess.Reply(irc.RPL_ENDOFNAMES, channel, "End of /NAMES list")
+	}
+}
+
+func (s *Server) part(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 {
+		sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(m.Params[0], ",") {
+		s.mu.Lock()
+		members := s.channels[fold(channel)]
+		if _, ok := members[sess]; !ok {
+			s.mu.Unlock()
+			sess.Reply(irc.ERR_NOTONCHANNEL, channel, "You're not on that channel")
+			continue
+		}
+		params := []string{channel}
+		if len(m.Params) > 1 {
+			params = append(params, m.Params[1])
+		}
+		msg := &irc.Message{Prefix: sess.mask(), Command: "PART", Params: params}
+		var recipients []*Session
+		for member := range members {
+			recipients = append(recipients, member)
+		}
+		delete(members, sess)
+		if len(members) == 0 {
+			delete(s.channels, fold(channel))
+		}
+		s.mu.Unlock()
+
+		for _, member := range recipients {
+			member.SendMessage(msg)
+		}
+	}
+}
+
+func (s *Server) privmsg(sess *Session, m *irc.Message) {
+	if len(m.Params) < 2 {
+		sess.Reply(irc.ERR_NEEDMOREPARAMS, m.Command, "Not enough parameters")
+		return
+	}
+	s.mu.Lock()
+	msg := &irc.Message{Tags: m.Tags, Prefix: sess.mask(), Command: m.Command, Params: m.Params}
+	echo := s.Echo || sess.caps["echo-message"]
+	var recipients []*Session
+	var missing []string
+	for _, target := range strings.Split(m.Params[0], ",") {
+		if strings.HasPrefix(target, "#") {
+			for member := range s.channels[fold(target)] {
+				if member != sess {
+					recipients = append(recipients, member)
+				}
+			}
+		} else if other := s.session(target); other != nil {
+			recipients = append(recipients, other)
+		} else {
+			missing = append(missing, target)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, other := range recipients {
+		other.SendMessage(msg)
+	}
+	if echo {
+		sess.SendMessage(msg)
+	}
+	if m.Command == "PRIVMSG" {
+		for _, target := range missing {
+			sess.Reply(irc.ERR_NOSUCHNICK, target, "No such nick/channel")
+		}
+	}
+}
+
+func (s *Server) whois(sess *Session, m *irc.Message) {
+	if len(m.Params) < 1 {
+		sess.Reply(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return
+	}
+	nick := m.Params[len(m.Params)-1]
+	s.mu.Lock()
+	var res *irc.WhoisResult
+	if other := s.session(nick); other != nil {
+		res = &irc.WhoisResult{
+			User:     other.mask(),
+			RealName: other.realname,
+			Server:   s.name(),
+			Account:  other.account,
+		}
+		for channel, members := range s.channels {
+			if _, ok := members[other]; ok {
+				res.Channels = append(res.Channels, channel)
+			}
+		}
+		sort.Strings(res.Channels)
+	} else {
+		for k, v := range s.Whois {
+			if fold(k) == fold(nick) {
+				res = v
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if res == nil {
+		sess.Reply(irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+		sess.Reply(irc.RPL_ENDOFWHOIS, nick, "End of /WHOIS list")
+		return
+	}
+	if res.User.Nick != "" {
+		nick = res.User.Nick
+	}
+	sess.Reply(irc.RPL_WHOISUSER, nick, res.User.User, res.User.Host, "*", res.RealName)
+	if len(res.Channels) > 0 {
+		sess.Reply(irc.RPL_WHOISCHANNELS, nick, strings.Join(res.Channels, " "))
+	}
+	if res.Server != "" {
+		sess.Reply(irc.RPL_WHOISSERVER, nick, res.Server, "IRC test server")
+	}
+	if res.Account != "" {
+		sess.Reply(irc.RPL_WHOISACCOUNT, nick, res.Account, "is logged in as")
+	}
+	sess.Reply(irc.RPL_ENDOFWHOIS, nick, "End of /WHOIS list")
+}
+
+// remove disconnects sess and tells the users sharing a channel with
+// it.
+func (s *Server) remove(sess *Session, reason string) {
+	s.mu.Lock()
+	if _, ok := s.sessions[sess]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, sess)
+	var recipients []*Session
+	if sess.registered {
+		recipients = s.neighbors(sess)
+	}
+	for key, members := range s.channels {
+		delete(members, sess)
+		if len(members) == 0 {
+			delete(s.channels, key)
+		}
+	}
+	msg := &irc.Message{Prefix: sess.mask(), Command: "QUIT", Params: []string{reason}}
+	s.mu.Unlock()
+
+	sess.Close()
+	for _, other := range recipients {
+		other.SendMessage(msg)
+	}
+}
+
+// session returns the registered session using nick. s.mu must be
+// held.
+func (s *Server) session(nick string) *Session {
+	for sess := range s.sessions {
+		if sess.nick != "" && fold(sess.nick) == fold(nick) {
+			return sess
+		}
+	}
+	return nil
+}
+
+// neighbors returns the other sessions that share a channel with
+// sess. s.mu must be held.
+func (s *Server) neighbors(sess *Session) []*Session {
+	seen := make(map[*Session]bool)
+	var out []*Session
+	for _, members := range s.channels {
+		if _, ok := members[sess]; !ok {
+			continue
+		}
+		for member := range members {
+			if member != sess && !seen[member] {
+				seen[member] = true
+				out = append(out, member)
+			}
+		}
+	}
+	return out
+}
+
+// A Session is a client's connection to a Server.
+type Session struct {
+	Server *Server
+
+	conn *irc.Conn
+	// Lines are queued and written by writeLoop, so that the server
+	// never blocks on a client that is busy writing itself.
+	qmu    sync.Mutex
+	queue  []string
+	wake   chan struct{}
+	closed bool
+
+	// The following fields are guarded by Server.mu.
+	nick, user, realname string
+	account              string
+	registered           bool
+	negotiating          bool
+	authenticating       bool
+	caps                 map[string]bool
+}
+
+// mask returns the session's hostmask. Server.mu must be held.
+func (sess *Session) mask() irc.Mask {
+	return irc.Mask{Nick: sess.nick, User: sess.user, Host: "localhost"}
+}
+
+// Nick returns the session's current nick.
+func (sess *Session) Nick() string {
+	sess.Server.mu.Lock()
+	defer sess.Server.mu.Unlock()
+	return sess.nick
+}
+
+// Account returns the account the session authenticated as.
+func (sess *Session) Account() string {
+	sess.Server.mu.Lock()
+	defer sess.Server.mu.Unlock()
+	return sess.account
+}
+
+// HasCap reports whether the session enabled the capability.
+func (sess *Session) HasCap(name string) bool {
+	sess.Server.mu.Lock()
+	defer sess.Server.mu.Unlock()
+	return sess.caps[name]
+}
+
+// Send sends a raw line to the client.
+func (sess *Session) Send(line string) error {
+	sess.qmu.Lock()
+	defer sess.qmu.Unlock()
+	if sess.closed {
+		return io.ErrClosedPipe
+	}
+	sess.queue = append(sess.queue, line)
+	sess.signal()
+	return nil
+}
+
+// signal wakes up writeLoop. sess.qmu must be held.
+func (sess *Session) signal() {
+	select {
+	case sess.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sess *Session) writeLoop() {
+	for range sess.wake {
+		sess.qmu.Lock()
+		lines, closed := sess.queue, sess.closed
+		sess.queue = nil
+		sess.qmu.Unlock()
+		for _, line := range lines {
+			if err := sess.conn.WriteLine(line); err != nil {
+				sess.conn.Close()
+				return
+			}
+		}
+		if closed {
+			sess.conn.Close()
+			return
+		}
+	}
+}
+
+// SendMessage sends m to the client. Sessions that enabled the
+// server-time capability receive a time tag, unless m has one
+// already.
+func (sess *Session) SendMessage(m *irc.Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if _, ok := m.Tags["time"]; !ok && sess.HasCap("server-time") {
+		m = m.Copy()
+		if m.Tags == nil {
+			m.Tags = make(map[string]string)
+		}
+		m.Tags["time"] = irc.OrRealClock(sess.Server.Clock).Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	return sess.Send(m.WireString())
+}
+
+// Reply sends a message from the server, such as a numeric reply,
+// with the client's nick, or * if it hasn't chosen one yet, as the
+// first parameter.
+func (sess *Session) Reply(command string, params ...string) error {
+	target := sess.Nick()
+	if target == "" {
+		target = "*"
+	}
+	return sess.SendMessage(&irc.Message{
+		Prefix:  irc.Mask{Host: sess.Server.name()},
+		Command: command,
+		Params:  append([]string{target}, params...),
+	})
+}
+
+// Close disconnects the client once everything sent so far has been
+// written.
+func (sess *Session) Close() error {
+	sess.qmu.Lock()
+	defer sess.qmu.Unlock()
+	if !sess.closed {
+		sess.closed = true
+		sess.signal()
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package irc
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 type ChanModes struct {
@@ -13,7 +16,9 @@ type ChanModes struct {
 }
 
 type ISupport struct {
-	AwayLen     int
+	AwayLen int
+	// The user mode for server-side ignore, or 0 if unsupported.
+	CallerID    rune
 	CNOTICE     bool
 	CPRIVMSG    bool
 	CaseMapping string
@@ -22,10 +27,17 @@ type ISupport struct {
 	ChanTypes   []rune
 	ChannelLen  int
 	ChidLen     int
-	ETRACE      bool
-	ELIST       []rune
-	Excepts     bool
-	FNC         bool
+	ClientVer   string
+	// The user mode for not receiving channel messages, or 0 if
+	// unsupported.
+	Deaf    rune
+	ETRACE  bool
+	ELIST   []rune
+	Excepts bool
+	ExtBan  ExtBan
+	FNC     bool
+	// IDChan maps safe channel prefixes to the length of their IDs.
+	IDChan      map[rune]int
 	Invex       bool
 	KickLen     int
 	Knock       bool
@@ -38,18 +50,100 @@ type ISupport struct {
 	Network     string
 	NickLen     int
 	Prefix      map[rune]rune
+	// PrefixOrder lists the modes of Prefix from highest to lowest
+	// rank.
+	PrefixOrder []rune
+	SafeList    bool
 	Silence     int
 	StatusMsg   []rune
 	TargMax     map[string]int
 	TopicLen    int
 	Watch       int
-	// TODO IDCHAN pfx:num[,pfx:num,...]
-	// TODO CALLERID (with and without argument)
-	// TODO DEAF
-	// TODO EXTBAN=$,arxz
-	// TODO WHOX
-	// TODO CLIENTVER=3.0
-	// TODO SAFELIST
+	WHOX        bool
+	// Unknown maps tokens that aren't otherwise supported to their
+	// raw values.
+	Unknown map[string]string
+
+	// the raw values of all tokens
+	raw      map[string]string
+	onChange *changeHooks
+}
+
+// changeHooks are the functions registered with OnChange. They are
+// shared by all copies of an ISupport.
+type changeHooks struct {
+	mu  sync.Mutex
+	fns []func(token, old, new string)
+}
+
+func (h *changeHooks) call(token, old, new string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	fns := h.fns
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(token, old, new)
+	}
+}
+
+// clone returns a copy of is that can be modified without affecting
+// is.
+func (is *ISupport) clone() *ISupport {
+	out := *is
+	out.ChanLimit = copyRuneInts(is.ChanLimit)
+	out.IDChan = copyRuneInts(is.IDChan)
+	out.MaxList = copyRuneInts(is.MaxList)
+	if is.Prefix != nil {
+		out.Prefix = make(map[rune]rune, len(is.Prefix))
+		for k, v := range is.Prefix {
+			out.Prefix[k] = v
+		}
+	}
+	if is.TargMax != nil {
+		out.TargMax = make(map[string]int, len(is.TargMax))
+		for k, v := range is.TargMax {
+			out.TargMax[k] = v
+		}
+	}
+	out.Unknown = copyStrings(is.Unknown)
+	out.raw = copyStrings(is.raw)
+	return &out
+}
+
+func copyRuneInts(m map[rune]int) map[rune]int {
+	if m == nil {
+		return nil
+	}
+	out := make(map[rune]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func copyStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// ExtBan describes the extended ban types supported by the server.
+// Prefix is empty on servers that don't use one, such as InspIRCd.
+type ExtBan struct {
+	Prefix string
+	Types  []rune
+}
+
+// Supports reports whether the extended ban type t is supported.
+func (eb ExtBan) Supports(t rune) bool {
+	return inRunes(eb.Types, t)
 }
 
 func NewISupport() *ISupport {
@@ -58,9 +152,11 @@ func NewISupport() *ISupport {
 		NickLen:     9,
 		ChanLimit:   map[rune]int{},
 		Prefix:      map[rune]rune{'o': '@', 'v': '+'},
+		PrefixOrder: []rune{'o', 'v'},
 		MaxList:     map[rune]int{},
 		TargMax:     map[string]int{},
 		CaseMapping: "rfc1459",
+		onChange:    &changeHooks{},
 	}
 }
 
@@ -80,6 +176,10 @@ func (is *ISupport) setBool(name string, value bool) {
 		is.CNOTICE = value
 	case "FNC":
 		is.FNC = value
+	case "WHOX":
+		is.WHOX = value
+	case "SAFELIST":
+		is.SafeList = value
 	}
 }
 
@@ -114,34 +214,104 @@ func (is *ISupport) setInt(name string, value int) {
 	}
 }
 
+// An ISupportError describes a malformed ISUPPORT token that was
+// skipped.
+type ISupportError struct {
+	Token  string
+	Reason string
+}
+
+func (err *ISupportError) Error() string {
+	return fmt.Sprintf("skipping ISUPPORT token %q: %s", err.Token, err.Reason)
+}
+
 // Parse parses a RPL_ISUPPORT message and sets the contained options.
 // Parse can be called multiple times to build a full ISUPPORT
-// representation from multiple messages.
+// representation from multiple messages. Malformed tokens are
+// skipped.
 func (is *ISupport) Parse(m *Message) {
-	if m.Command != RPL_ISUPPORT {
+	is.ParseReport(m, nil)
+}
+
+// ParseReport is like Parse, but calls report, if not nil, for each
+// malformed token that was skipped.
+func (is *ISupport) ParseReport(m *Message, report func(err *ISupportError)) {
+	if m.Command != RPL_ISUPPORT || len(m.Params) < 2 {
 		return
 	}
+	skip := func(token, reason string) {
+		if report != nil {
+			report(&ISupportError{Token: token, Reason: reason})
+		}
+	}
 
 	for _, option := range m.Params[1:] {
-		parts := strings.Split(option, "=")
-		parts = pad(parts, 2)
+		if strings.Contains(option, " ") {
+			// the human-readable "are supported by this server"
+			continue
+		}
+		if strings.HasPrefix(option, "-") {
+			is.negate(option[1:])
+			continue
+		}
+		parts := pad(strings.SplitN(option, "=", 2), 2)
 		switch parts[0] {
-		case "EXCEPTS", "INVEX", "KNOCK", "ETRACE", "CPRIVMSG", "CNOTICE", "FNC":
+		case "EXCEPTS", "INVEX", "KNOCK", "ETRACE", "CPRIVMSG", "CNOTICE", "FNC", "WHOX", "SAFELIST":
 			is.setBool(parts[0], true)
 		case "MODES", "NICKLEN", "CHANNELLEN", "TOPICLEN", "MONITOR", "MAXCHANNELS",
 			"MAXBANS", "KICKLEN", "CHIDLEN", "SILENCE", "AWAYLEN", "WATCH", "MAXTARGETS":
+			if parts[1] == "" && (parts[0] == "MONITOR" || parts[0] == "WATCH") {
+				// Supported without a limit, which Raw reports.
+				break
+			}
 			i, err := strconv.Atoi(parts[1])
 			if err != nil {
+				skip(option, "value is not a number")
 				continue
 			}
 			is.setInt(parts[0], i)
 		case "NETWORK":
 			is.Network = parts[1]
+		case "CLIENTVER":
+			is.ClientVer = parts[1]
+		case "CALLERID":
+			mode, ok := modeOrDefault(parts[1], 'g')
+			if !ok {
+				skip(option, "expected a single mode")
+				continue
+			}
+			is.CallerID = mode
+		case "DEAF":
+			mode, ok := modeOrDefault(parts[1], 'D')
+			if !ok {
+				skip(option, "expected a single mode")
+				continue
+			}
+			is.Deaf = mode
+		case "IDCHAN":
+			m, ok := splitPrefixNum(parts[1])
+			if !ok {
+				skip(option, "malformed prefix:number list")
+				continue
+			}
+			if is.IDChan == nil {
+				is.IDChan = make(map[rune]int)
+			}
+			for key, value := range m {
+				for _, r := range key {
+					is.IDChan[r] = value
+				}
+			}
 		case "CASEMAPPING":
 			is.CaseMapping = parts[1]
 		case "CHANMODES":
 			modes := strings.Split(parts[1], ",")
-			modes = pad(modes, 4)
+			if len(modes) < 4 {
+				// Servers may add more types in the future, but
+				// fewer than four means the token is broken.
+				skip(option, "need at least 4 types of modes")
+				continue
+			}
 			is.ChanModes.A = []rune(modes[0])
 			is.ChanModes.B = []rune(modes[1])
 			is.ChanModes.C = []rune(modes[2])
@@ -149,10 +319,14 @@ func (is *ISupport) Parse(m *Message) {
 		case "CHANTYPES":
 			is.ChanTypes = []rune(parts[1])
 		case "CHANLIMIT":
+			m, ok := splitPrefixNum(parts[1])
+			if !ok {
+				skip(option, "malformed prefix:number list")
+				continue
+			}
 			if is.ChanLimit == nil {
 				is.ChanLimit = make(map[rune]int)
 			}
-			m := splitPrefixNum(parts[1])
 			for key, value := range m {
 				for _, r := range key {
 					is.ChanLimit[r] = value
@@ -161,30 +335,29 @@ func (is *ISupport) Parse(m *Message) {
 		case "ELIST":
 			is.ELIST = []rune(parts[1])
 		case "PREFIX":
-			if is.Prefix == nil {
-				is.Prefix = make(map[rune]rune)
-			}
-			if len(parts[1]) < 4 {
+			prefix, order, ok := parsePrefix(parts[1])
+			if !ok {
+				skip(option, "expected (modes)sigils with as many sigils as modes")
 				continue
 			}
-			idx := strings.Index(parts[1], ")")
-			if idx == -1 || idx == len(parts[1])-1 {
+			is.Prefix = prefix
+			is.PrefixOrder = order
+		case "TARGMAX":
+			m, ok := splitPrefixNum(parts[1])
+			if !ok {
+				skip(option, "malformed command:number list")
 				continue
 			}
-			letters, sigils := []rune(parts[1][1:idx]), []rune(parts[1][idx+1:])
-			if len(letters) != len(sigils) {
+			is.TargMax = m
+		case "MAXLIST":
+			m, ok := splitPrefixNum(parts[1])
+			if !ok {
+				skip(option, "malformed modes:number list")
 				continue
 			}
-			for i, l := range letters {
-				is.Prefix[l] = sigils[i]
-			}
-		case "TARGMAX":
-			is.TargMax = splitPrefixNum(parts[1])
-		case "MAXLIST":
 			if is.MaxList == nil {
 				is.MaxList = make(map[rune]int)
 			}
-			m := splitPrefixNum(parts[1])
 			for modes, n := range m {
 				for _, mode := range modes {
 					is.MaxList[mode] = n
@@ -192,20 +365,302 @@ func (is *ISupport) Parse(m *Message) {
 			}
 		case "STATUSMSG":
 			is.StatusMsg = []rune(parts[1])
+		case "EXTBAN":
+			idx := strings.Index(parts[1], ",")
+			if idx == -1 {
+				skip(option, "expected prefix,types")
+				continue
+			}
+			is.ExtBan = ExtBan{Prefix: parts[1][:idx], Types: []rune(parts[1][idx+1:])}
+		default:
+			if is.Unknown == nil {
+				is.Unknown = make(map[string]string)
+			}
+			is.Unknown[parts[0]] = parts[1]
 		}
+		is.set(parts[0], parts[1])
+	}
+}
+
+// OnChange registers fn to be called whenever a token is added or
+// its value changes, such as when a server sends RPL_ISUPPORT again
+// after a rehash. Removed tokens are reported with an empty new
+// value. fn is called from the client's read loop and must not
+// block.
+//
+// Clients create a new ISupport for every connection, carrying over
+// the registered functions, so tokens are reported anew after
+// reconnecting.
+func (is *ISupport) OnChange(fn func(token, old, new string)) {
+	if is.onChange == nil {
+		is.onChange = &changeHooks{}
+	}
+	is.onChange.mu.Lock()
+	defer is.onChange.mu.Unlock()
+	is.onChange.fns = append(is.onChange.fns, fn)
+}
+
+// Raw returns the raw value of a token, and whether the server
+// advertised it.
+func (is *ISupport) Raw(token string) (value string, ok bool) {
+	value, ok = is.raw[token]
+	return value, ok
+}
+
+func (is *ISupport) set(token, value string) {
+	old, ok := is.raw[token]
+	if ok && old == value {
+		return
+	}
+	if is.raw == nil {
+		is.raw = make(map[string]string)
 	}
+	is.raw[token] = value
+	is.onChange.call(token, old, value)
 }
 
-func splitPrefixNum(pairs string) map[string]int {
+// negate handles tokens of the form -TOKEN, which remove a
+// previously advertised token. Typed fields keep their values; only
+// Unknown and Raw reflect the removal.
+func (is *ISupport) negate(token string) {
+	delete(is.Unknown, token)
+	old, ok := is.raw[token]
+	if !ok {
+		return
+	}
+	delete(is.raw, token)
+	is.onChange.call(token, old, "")
+}
+
+// modeOrDefault parses the value of tokens such as CALLERID, which
+// optionally specify the mode that implements them.
+func modeOrDefault(s string, def rune) (rune, bool) {
+	if s == "" {
+		return def, true
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, false
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return r, true
+}
+
+// MaxTargetsFor returns the maximum number of targets that command
+// accepts, according to TARGMAX or MAXTARGETS, or 0 if there is no
+// limit. If the server advertises neither, 1 is returned.
+func (is *ISupport) MaxTargetsFor(command string) int {
+	if n, ok := is.TargMax[command]; ok {
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+	if is.MaxTargets > 0 {
+		return is.MaxTargets
+	}
+	return 1
+}
+
+// parsePrefix parses the value of the PREFIX token, e.g. (ov)@+. An
+// empty value means that the server has no prefix modes.
+func parsePrefix(s string) (prefix map[rune]rune, order []rune, ok bool) {
+	prefix = make(map[rune]rune)
+	if s == "" {
+		return prefix, nil, true
+	}
+	idx := strings.Index(s, ")")
+	if !strings.HasPrefix(s, "(") || idx == -1 {
+		return nil, nil, false
+	}
+	letters, sigils := []rune(s[1:idx]), []rune(s[idx+1:])
+	if len(letters) != len(sigils) {
+		return nil, nil, false
+	}
+	for i, l := range letters {
+		prefix[l] = sigils[i]
+	}
+	return prefix, letters, true
+}
+
+// splitPrefixNum parses lists of the form name:num,name:num. A missing
+// number means that there is no limit and is reported as -1.
+func splitPrefixNum(pairs string) (map[string]int, bool) {
 	m := make(map[string]int)
+	if pairs == "" {
+		return m, true
+	}
 	for _, pair := range strings.Split(pairs, ",") {
-		parts := strings.Split(pair, ":")
-		name := parts[0]
+		idx := strings.Index(pair, ":")
+		if idx == -1 {
+			return nil, false
+		}
+		name := pair[:idx]
 		num := -1
-		if len(parts[1]) > 0 {
-			num, _ = strconv.Atoi(parts[1])
+		if idx < len(pair)-1 {
+			var err error
+			num, err = strconv.Atoi(pair[idx+1:])
+			if err != nil {
+				return nil, false
+			}
 		}
 		m[name] = num
 	}
-	return m
+	return m, true
+}
+
+// IsChannel reports whether name is a channel name, according to the
+// supported channel types.
+func (is *ISupport) IsChannel(name string) bool {
+	r, size := utf8.DecodeRuneInString(name)
+	return size > 0 && inRunes(is.ChanTypes, r)
+}
+
+// ChannelIDLen returns the length of the IDs of channels with the
+// given type, such as ! for IRCnet's safe channels, or 0 if they
+// don't have IDs. It uses IDCHAN, falling back to CHIDLEN and the
+// RFC 2811 default of 5 for ! channels.
+func (is *ISupport) ChannelIDLen(chantype rune) int {
+	if n, ok := is.IDChan[chantype]; ok {
+		return n
+	}
+	if chantype != '!' || !inRunes(is.ChanTypes, '!') {
+		return 0
+	}
+	if is.ChidLen > 0 {
+		return is.ChidLen
+	}
+	return 5
+}
+
+// SplitChannelID splits the full name of a safe channel, such as
+// !ABCDEfoo, into its ID, ABCDE, and its short name, !foo. For other
+// channels and for short names, id is empty and name is channel.
+func (is *ISupport) SplitChannelID(channel string) (id, name string) {
+	chantype, size := utf8.DecodeRuneInString(channel)
+	n := is.ChannelIDLen(chantype)
+	if n == 0 || len(channel) <= size+n {
+		return "", channel
+	}
+	id = channel[size : size+n]
+	for _, r := range id {
+		// IDs consist of uppercase letters and digits.
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			return "", channel
+		}
+	}
+	return id, channel[:size] + channel[size+n:]
+}
+
+// SameChannel reports whether a and b refer to the same channel,
+// using the server's casemapping. The short name of a safe channel
+// refers to the same channel as its full name.
+func (is *ISupport) SameChannel(a, b string) bool {
+	if is.Casefold(a) == is.Casefold(b) {
+		return true
+	}
+	if id, short := is.SplitChannelID(a); id != "" && is.Casefold(short) == is.Casefold(b) {
+		return true
+	}
+	if id, short := is.SplitChannelID(b); id != "" && is.Casefold(short) == is.Casefold(a) {
+		return true
+	}
+	return false
+}
+
+// SplitPrefix splits a channel name as returned by RPL_WHOISCHANNELS
+// or RPL_NAMREPLY into the channel and the highest ranked mode
+// indicated by its prefix sigils. mode is zero if there are no
+// sigils.
+func (is *ISupport) SplitPrefix(s string) (channel string, mode rune) {
+	sigils := 0
+	for _, r := range s {
+		if is.prefixMode(r) == 0 {
+			break
+		}
+		sigils++
+	}
+	// Sigils may clash with channel types, e.g. & for both admins
+	// and local channels, so strip as many sigils as possible while
+	// still leaving a valid channel name.
+	n := sigils
+	if len(is.ChanTypes) > 0 {
+		for n > 0 && !is.IsChannel(string([]rune(s)[n:])) {
+			n--
+		}
+	}
+	rs := []rune(s)
+	for _, r := range rs[:n] {
+		m := is.prefixMode(r)
+		if mode == 0 || is.prefixRank(m) < is.prefixRank(mode) {
+			mode = m
+		}
+	}
+	return string(rs[n:]), mode
+}
+
+func (is *ISupport) prefixMode(sigil rune) rune {
+	for mode, r := range is.Prefix {
+		if r == sigil {
+			return mode
+		}
+	}
+	return 0
+}
+
+func (is *ISupport) prefixRank(mode rune) int {
+	for i, r := range is.PrefixOrder {
+		if r == mode {
+			return i
+		}
+	}
+	return len(is.PrefixOrder)
+}
+
+// ChannelForMsg returns the channel a message refers to, if any.
+// Safe channels are returned as named by the server, which is usually
+// their full name, including the ID. Replies to attempts at creating
+// a safe channel, such as !!foo, return its short name, !foo. Use
+// SameChannel to compare the names of safe channels.
+func (is *ISupport) ChannelForMsg(m *Message) (string, bool) {
+	if len(m.Params) == 0 {
+		return "", false
+	}
+	switch m.Command {
+	case "INVITE", RPL_CHANNELMODEIS, RPL_BANLIST:
+		if len(m.Params) > 1 {
+			return is.shortCreateName(m.Params[1]), true
+		}
+	case RPL_NAMEREPLY:
+		if len(m.Params) > 2 {
+			return is.shortCreateName(m.Params[2]), true
+		}
+	default:
+		if is.IsChannel(m.Params[0]) {
+			return is.shortCreateName(m.Params[0]), true
+		}
+		if m.IsNumeric() && len(m.Params) > 1 && is.IsChannel(m.Params[1]) {
+			return is.shortCreateName(m.Params[1]), true
+		}
+	}
+	return "", false
+}
+
+// shortCreateName turns the name used for creating a safe channel,
+// such as !!foo, into its short name, !foo. Other names are returned
+// unchanged.
+func (is *ISupport) shortCreateName(channel string) string {
+	if strings.HasPrefix(channel, "!!") && is.ChannelIDLen('!') > 0 {
+		return channel[1:]
+	}
+	return channel
+}
+
+// ReplyTarget returns the target that a reply to m should be sent to:
+// the channel it was sent to, or the sender if it was sent to us
+// directly.
+func (is *ISupport) ReplyTarget(m *Message) string {
+	if target, ok := is.ChannelForMsg(m); ok {
+		return target
+	}
+	return m.Prefix.Nick
 }
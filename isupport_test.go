@@ -2,17 +2,25 @@ package irc
 
 import (
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 func TestISupport(t *testing.T) {
-	const completeAndUnknown = ":prefix 005 recipient AWAYLEN=1 CNOTICE CPRIVMSG CASEMAPPING=ascii CHANLIMIT=#&:2,!:3 CHANMODES=beI,k,l,imnpstaqr CHANTYPES=#& CHANNELLEN=4 CHIDLEN=5 ETRACE ELIST=MNUCT EXCEPTS FNC INVEX KICKLEN=6 KNOCK MAXBANS=7 MAXCHANNELS=8 MAXLIST=be:9,I:8 MAXTARGETS=7 MODES=6 MONITOR=7 NETWORK=some_network NICKLEN=13 PREFIX=(ohv)@%+ SILENCE=42 STATUSMSG=+@ TARGMAX=PRIVMSG:55,NOTICE: TOPICLEN=66 WATCH=32 UNKNOWN=foobar"
+	const completeAndUnknown = ":prefix 005 recipient AWAYLEN=1 CALLERID CLIENTVER=3.0 CNOTICE CPRIVMSG CASEMAPPING=ascii CHANLIMIT=#&:2,!:3 CHANMODES=beI,k,l,imnpstaqr CHANTYPES=#& CHANNELLEN=4 CHIDLEN=5 DEAF=d ETRACE ELIST=MNUCT EXCEPTS EXTBAN=$,arxz FNC IDCHAN=!:5 INVEX KICKLEN=6 KNOCK MAXBANS=7 MAXCHANNELS=8 MAXLIST=be:9,I:8 MAXTARGETS=7 MODES=6 MONITOR=7 NETWORK=some_network NICKLEN=13 PREFIX=(ohv)@%+ SAFELIST SILENCE=42 STATUSMSG=+@ TARGMAX=PRIVMSG:55,NOTICE: TOPICLEN=66 WATCH=32 WHOX UNKNOWN=foobar"
 
 	is := NewISupport()
 	is.Parse(Parse(completeAndUnknown))
 
 	expected := &ISupport{
 		AwayLen:     1,
+		CallerID:    'g',
+		ClientVer:   "3.0",
+		Deaf:        'd',
+		IDChan:      map[rune]int{'!': 5},
+		SafeList:    true,
+		WHOX:        true,
 		CNOTICE:     true,
 		CPRIVMSG:    true,
 		CaseMapping: "ascii",
@@ -29,6 +37,7 @@ func TestISupport(t *testing.T) {
 		ETRACE:      true,
 		ELIST:       []rune("MNUCT"),
 		Excepts:     true,
+		ExtBan:      ExtBan{Prefix: "$", Types: []rune("arxz")},
 		FNC:         true,
 		Invex:       true,
 		KickLen:     6,
@@ -42,14 +51,205 @@ func TestISupport(t *testing.T) {
 		Network:     "some_network",
 		NickLen:     13,
 		Prefix:      map[rune]rune{'o': '@', 'h': '%', 'v': '+'},
+		PrefixOrder: []rune("ohv"),
 		Silence:     42,
 		StatusMsg:   []rune("+@"),
 		TargMax:     map[string]int{"PRIVMSG": 55, "NOTICE": -1},
 		TopicLen:    66,
 		Watch:       32,
+		Unknown:     map[string]string{"UNKNOWN": "foobar"},
 	}
+	ev, gv := reflect.ValueOf(expected).Elem(), reflect.ValueOf(is).Elem()
+	for i := 0; i < ev.NumField(); i++ {
+		field := ev.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if !reflect.DeepEqual(ev.Field(i).Interface(), gv.Field(i).Interface()) {
+			t.Errorf("parsing isupport: expected %s to be %#v, got %#v",
+				field.Name, ev.Field(i).Interface(), gv.Field(i).Interface())
+		}
+	}
+
+	raw := make(map[string]string)
+	for _, token := range strings.Fields(completeAndUnknown)[3:] {
+		kv := pad(strings.SplitN(token, "=", 2), 2)
+		raw[kv[0]] = kv[1]
+	}
+	if !reflect.DeepEqual(raw, is.raw) {
+		t.Errorf("parsing isupport: expected raw values %v, got %v", raw, is.raw)
+	}
+}
+
+func TestSplitPrefix(t *testing.T) {
+	is := NewISupport()
+	is.Parse(Parse(":prefix 005 recipient CHANTYPES=#& PREFIX=(qaohv)~&@%+"))
+
+	table := []struct {
+		in      string
+		channel string
+		mode    rune
+	}{
+		{"#chan", "#chan", 0},
+		{"@#chan", "#chan", 'o'},
+		{"+#chan", "#chan", 'v'},
+		{"+@#chan", "#chan", 'o'},
+		{"&local", "&local", 0},
+		{"&&local", "&local", 'a'},
+		{"~#chan", "#chan", 'q'},
+	}
+	for _, test := range table {
+		channel, mode := is.SplitPrefix(test.in)
+		if channel != test.channel || mode != test.mode {
+			t.Errorf("splitting %q: expected (%q, %q), got (%q, %q)", test.in, test.channel, test.mode, channel, mode)
+		}
+	}
+}
+
+func TestISupportUnlimited(t *testing.T) {
+	is := NewISupport()
+	is.Parse(Parse(":prefix 005 recipient MONITOR WATCH :are supported"))
+	if is.Monitor != 0 || is.Watch != 0 {
+		t.Errorf("got MONITOR=%d WATCH=%d, want 0 for both", is.Monitor, is.Watch)
+	}
+	for _, token := range []string{"MONITOR", "WATCH"} {
+		if _, ok := is.Raw(token); !ok {
+			t.Errorf("%s isn't reported as supported", token)
+		}
+	}
+}
 
-	if !reflect.DeepEqual(expected, is) {
-		t.Errorf("parsing isupport: expected %#v, got %#v", expected, is)
+func TestISupportMalformed(t *testing.T) {
+	tokens := []string{
+		"TARGMAX=PRIVMSG",
+		"MAXLIST=b",
+		"CHANLIMIT=#:x",
+		"PREFIX=ov@+",
+		"PREFIX=(ov)@",
+		"CHANMODES=b,k",
+		"NICKLEN=long",
+		"EXTBAN=$",
+	}
+	is := NewISupport()
+	var skipped []string
+	for _, token := range tokens {
+		is.ParseReport(Parse(":prefix 005 recipient "+token+" :are supported"), func(err *ISupportError) {
+			skipped = append(skipped, err.Token)
+		})
+	}
+	if !reflect.DeepEqual(skipped, tokens) {
+		t.Errorf("got skipped tokens %q, expected %q", skipped, tokens)
+	}
+	if !reflect.DeepEqual(is, NewISupport()) {
+		t.Errorf("malformed tokens modified ISupport: %#v", is)
+	}
+
+	// Messages without parameters must not panic
+	is.Parse(&Message{Command: RPL_ISUPPORT})
+}
+
+func TestISupportOnChange(t *testing.T) {
+	is := NewISupport()
+	var changes []string
+	is.OnChange(func(token, old, new string) {
+		changes = append(changes, token+":"+old+"->"+new)
+	})
+	is.Parse(Parse(":prefix 005 recipient NETWORK=foo EXCEPTS X=1 :are supported"))
+	is.Parse(Parse(":prefix 005 recipient NETWORK=bar EXCEPTS -X :are supported"))
+	expected := []string{
+		"NETWORK:->foo",
+		"EXCEPTS:->",
+		"X:->1",
+		"NETWORK:foo->bar",
+		"X:1->",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("got changes %q, expected %q", changes, expected)
+	}
+	if _, ok := is.Unknown["X"]; ok {
+		t.Error("negated token is still listed as unknown")
+	}
+	if v, ok := is.Raw("NETWORK"); !ok || v != "bar" {
+		t.Errorf("got raw NETWORK %q, expected bar", v)
+	}
+}
+
+func TestSafeChannels(t *testing.T) {
+	is := NewISupport()
+	is.Parse(Parse(":prefix 005 recipient CHANTYPES=#&! CHIDLEN=5"))
+
+	table := []struct {
+		in   string
+		id   string
+		name string
+	}{
+		{"!ABCDEfoo", "ABCDE", "!foo"},
+		{"!foo", "", "!foo"},
+		{"!abcdefoo", "", "!abcdefoo"},
+		{"!ABCDE", "", "!ABCDE"},
+		{"#ABCDEfoo", "", "#ABCDEfoo"},
+	}
+	for _, e := range table {
+		id, name := is.SplitChannelID(e.in)
+		if id != e.id || name != e.name {
+			t.Errorf("SplitChannelID(%q) = %q, %q, expected %q, %q", e.in, id, name, e.id, e.name)
+		}
+	}
+
+	if !is.SameChannel("!ABCDEfoo", "!FOO") || !is.SameChannel("!foo", "!ABCDEfoo") {
+		t.Error("short name doesn't refer to safe channel")
+	}
+	if is.SameChannel("!ABCDEfoo", "!ABCDEbar") || is.SameChannel("#ABCDEfoo", "#foo") {
+		t.Error("different channels are the same")
+	}
+
+	for _, e := range []struct {
+		line    string
+		channel string
+	}{
+		{":a!b@c JOIN !ABCDEfoo", "!ABCDEfoo"},
+		{":a!b@c PRIVMSG !ABCDEfoo :hi", "!ABCDEfoo"},
+		{":irc.test 403 bot !!foo :No such channel", "!foo"},
+		{":irc.test 437 bot !foo :Channel is temporarily unavailable", "!foo"},
+		{":irc.test 353 bot = !ABCDEfoo :@bot", "!ABCDEfoo"},
+	} {
+		if channel, ok := is.ChannelForMsg(Parse(e.line)); !ok || channel != e.channel {
+			t.Errorf("ChannelForMsg(%q) = %q, %t, expected %q", e.line, channel, ok, e.channel)
+		}
+	}
+
+	is.Parse(Parse(":prefix 005 recipient IDCHAN=!:3"))
+	if id, name := is.SplitChannelID("!ABCfoo"); id != "ABC" || name != "!foo" {
+		t.Errorf("IDCHAN wasn't respected, got %q, %q", id, name)
+	}
+}
+
+func TestISupportTruncate(t *testing.T) {
+	is := NewISupport()
+	if got := is.TruncateTopic("héllo"); got != "héllo" {
+		t.Errorf("TruncateTopic without TOPICLEN = %q, want it unchanged", got)
+	}
+	is.Parse(Parse(":prefix 005 recipient TOPICLEN=2 KICKLEN=3 :are supported"))
+	if got := is.TruncateTopic("héllo"); got != "h" {
+		t.Errorf("TruncateTopic(%q) = %q, want %q", "héllo", got, "h")
+	}
+	if got := is.TruncateKickReason("héllo"); got != "hé" {
+		t.Errorf("TruncateKickReason(%q) = %q, want %q", "héllo", got, "hé")
+	}
+}
+
+func TestISupportOnChangeConcurrent(t *testing.T) {
+	is := NewISupport()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			is.OnChange(func(token, old, new string) {})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		is.Parse(Parse(":prefix 005 recipient NICKLEN=" + strconv.Itoa(i)))
 	}
+	<-done
 }
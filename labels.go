@@ -0,0 +1,185 @@
+package irc
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoLabeledResponse is returned by SendLabeled if the
+// labeled-response capability isn't enabled.
+var ErrNoLabeledResponse = errors.New("labeled-response capability not enabled")
+
+// labeled tracks the response to a labeled message.
+type labeled struct {
+	ch chan *Message
+	// The reference of the labeled-response batch, once it started
+	batch string
+	// The references of batches nested in the labeled-response batch
+	nested map[string]bool
+
+	// Messages are queued by the read loop and delivered to ch by
+	// a goroutine of their own, so that a slow receiver doesn't
+	// stall reading from the server.
+	mu    sync.Mutex
+	queue []*Message
+	done  bool
+	wake  chan struct{}
+}
+
+// push queues m for delivery. If final is set, the channel is closed
+// after m has been delivered.
+func (l *labeled) push(m *Message, final bool) {
+	l.mu.Lock()
+	if m != nil {
+		l.queue = append(l.queue, m)
+	}
+	if final {
+		l.done = true
+	}
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver delivers queued messages to l.ch until the response is
+// complete or the connection failed.
+func (c *Client) deliver(l *labeled, quit chan struct{}) {
+	defer close(l.ch)
+	for {
+		l.mu.Lock()
+		queue, done := l.queue, l.done
+		l.queue = nil
+		l.mu.Unlock()
+		for _, m := range queue {
+			select {
+			case l.ch <- m:
+			case <-quit:
+				return
+			}
+		}
+		if done {
+			return
+		}
+		select {
+		case <-l.wake:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// SendLabeled sends m with a unique label tag and returns a channel
+// on which the server's response will be delivered. The response is
+// either a single message, such as an ACK, a FAIL or, with the
+// echo-message capability, the echo of a PRIVMSG, or a
+// labeled-response batch, in which case the BATCH markers and all
+// messages in the batch, including those of nested batches, are
+// delivered. The channel is closed once the response is complete, or
+// when the connection fails, in which case the rest of the response
+// is discarded. Responses are buffered, so receiving slowly doesn't
+// block reading from the server.
+//
+// SendLabeled requires the labeled-response capability.
+func (c *Client) SendLabeled(m *Message) (<-chan *Message, error) {
+	if !c.HasCap("labeled-response") {
+		return nil, ErrNoLabeledResponse
+	}
+	label := "L" + strconv.FormatUint(atomic.AddUint64(&c.lastLabel, 1), 10)
+	m = m.Copy()
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags["label"] = label
+
+	l := &labeled{
+		ch:     make(chan *Message),
+		nested: make(map[string]bool),
+		wake:   make(chan struct{}, 1),
+	}
+	c.lmu.Lock()
+	if c.labeled == nil {
+		c.labeled = make(map[string]*labeled)
+	}
+	c.labeled[label] = l
+	c.lmu.Unlock()
+
+	if err := c.SendMessage(m); err != nil {
+		c.lmu.Lock()
+		delete(c.labeled, label)
+		c.lmu.Unlock()
+		return nil, err
+	}
+	c.mu.RLock()
+	quit := c.chQuit
+	c.mu.RUnlock()
+	c.spawn("labeled", func() {
+		defer c.recoverPanic()
+		c.deliver(l, quit)
+	})
+	return l.ch, nil
+}
+
+// routeLabeled queues m for the SendLabeled call it responds to, if
+// any. It must only be called from Read.
+func (c *Client) routeLabeled(m *Message) {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	if len(c.labeled) == 0 {
+		return
+	}
+	if label, ok := m.Tags["label"]; ok {
+		l, ok := c.labeled[label]
+		if !ok {
+			return
+		}
+		if m.Command == "BATCH" && len(m.Params) >= 2 &&
+			len(m.Params[0]) > 1 && m.Params[0][0] == '+' && m.Params[1] == "labeled-response" {
+			l.batch = m.Params[0][1:]
+			l.push(m, false)
+			return
+		}
+		l.push(m, true)
+		delete(c.labeled, label)
+		return
+	}
+
+	ref, ok := m.Tags["batch"]
+	end := m.Command == "BATCH" && len(m.Params) >= 1 && len(m.Params[0]) > 1 && m.Params[0][0] == '-'
+	if end {
+		ref, ok = m.Params[0][1:], true
+	}
+	if !ok {
+		return
+	}
+	for label, l := range c.labeled {
+		if l.batch == "" || (l.batch != ref && !l.nested[ref]) {
+			continue
+		}
+		switch {
+		case end && ref == l.batch:
+			l.push(m, true)
+			delete(c.labeled, label)
+			return
+		case end:
+			delete(l.nested, ref)
+		case m.Command == "BATCH" && len(m.Params) >= 1 && len(m.Params[0]) > 1 && m.Params[0][0] == '+':
+			l.nested[m.Params[0][1:]] = true
+		}
+		l.push(m, false)
+		return
+	}
+}
+
+// closeLabeled closes the channels of all pending labeled messages.
+func (c *Client) closeLabeled() {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	for label, l := range c.labeled {
+		l.push(nil, true)
+		delete(c.labeled, label)
+	}
+}
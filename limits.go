@@ -0,0 +1,95 @@
+package irc
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// LengthPolicy determines how helper methods such as SetNick, Join,
+// SetTopic, Kick and Away deal with arguments that exceed the limits
+// advertised by the server in RPL_ISUPPORT.
+type LengthPolicy int
+
+const (
+	// LengthIgnore sends arguments as they are and leaves it to the
+	// server to truncate them. Topics, kick reasons and away
+	// messages, which servers cut at a byte offset, are still
+	// shortened at a rune boundary so that the server doesn't split
+	// a character.
+	LengthIgnore LengthPolicy = iota
+	// LengthReject refuses to send arguments that are too long and
+	// returns a *LengthError instead.
+	LengthReject
+	// LengthTruncate truncates arguments to the advertised limit.
+	// Channel names are never truncated, as that would refer to a
+	// different channel; they are rejected instead.
+	LengthTruncate
+)
+
+// LengthError is returned when an argument exceeds the limit
+// advertised by the server.
+type LengthError struct {
+	// The ISUPPORT token that describes the limit, e.g. NICKLEN
+	Token string
+	Value string
+	Max   int
+}
+
+func (err *LengthError) Error() string {
+	return fmt.Sprintf("%q is %d bytes long, exceeding %s of %d", err.Value, len(err.Value), err.Token, err.Max)
+}
+
+// Truncate shortens s to at most n bytes without splitting a UTF-8
+// encoded rune.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// truncateTo is like Truncate, but treats a limit of zero or less as
+// no limit.
+func truncateTo(s string, max int) string {
+	if max <= 0 {
+		return s
+	}
+	return Truncate(s, max)
+}
+
+// TruncateTopic shortens topic to the server's TOPICLEN without
+// splitting a rune.
+func (is *ISupport) TruncateTopic(topic string) string {
+	return truncateTo(topic, is.TopicLen)
+}
+
+// TruncateKickReason shortens reason to the server's KICKLEN without
+// splitting a rune.
+func (is *ISupport) TruncateKickReason(reason string) string {
+	return truncateTo(reason, is.KickLen)
+}
+
+// TruncateAwayMessage shortens message to the server's AWAYLEN
+// without splitting a rune.
+func (is *ISupport) TruncateAwayMessage(message string) string {
+	return truncateTo(message, is.AwayLen)
+}
+
+func (c *Client) checkLen(token, s string, max int, truncatable bool) (string, error) {
+	if max <= 0 || len(s) <= max {
+		return s, nil
+	}
+	switch c.Lengths {
+	case LengthTruncate:
+		if truncatable {
+			return Truncate(s, max), nil
+		}
+		fallthrough
+	case LengthReject:
+		return "", &LengthError{Token: token, Value: s, Max: max}
+	}
+	return s, nil
+}
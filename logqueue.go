@@ -0,0 +1,84 @@
+package irc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxLogQueue is the number of entries a logQueue holds before it
+// starts dropping them.
+const maxLogQueue = 4096
+
+// logQueue decouples logging from reading and writing, so that
+// loggers may call Send without deadlocking the write loop. It never
+// blocks; entries are delivered to the Logger in order by a goroutine
+// of their own. If the Logger falls too far behind, new entries are
+// dropped and counted instead.
+type logQueue struct {
+	mu      sync.Mutex
+	entries []logEntry
+	dropped int
+	notify  chan struct{}
+}
+
+type logEntry struct {
+	m        *Message
+	outgoing bool
+}
+
+func newLogQueue() *logQueue {
+	return &logQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *logQueue) push(m *Message, outgoing bool) {
+	q.mu.Lock()
+	if len(q.entries) >= maxLogQueue {
+		q.dropped++
+	} else {
+		q.entries = append(q.entries, logEntry{m, outgoing})
+	}
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued entries and the number of entries dropped
+// since the last call.
+func (q *logQueue) take() ([]logEntry, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries, dropped := q.entries, q.dropped
+	q.entries, q.dropped = nil, 0
+	return entries, dropped
+}
+
+// logLoop delivers queued entries to the logger until quit is closed,
+// after which it flushes the remaining entries.
+func (c *Client) logLoop(q *logQueue, quit chan struct{}) {
+	defer c.recoverPanic()
+	for {
+		select {
+		case <-q.notify:
+			c.flushLog(q)
+		case <-quit:
+			c.flushLog(q)
+			return
+		}
+	}
+}
+
+func (c *Client) flushLog(q *logQueue) {
+	entries, dropped := q.take()
+	for _, e := range entries {
+		if e.outgoing {
+			c.Logger.Outgoing(e.m)
+		} else {
+			c.Logger.Incoming(e.m)
+		}
+	}
+	if dropped > 0 {
+		c.Logger.Info(fmt.Sprintf("logger is falling behind, dropped %d messages", dropped))
+	}
+}
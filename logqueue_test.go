@@ -0,0 +1,80 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+type echoLogger struct {
+	nullLogger
+	c    *Client
+	done chan struct{}
+}
+
+func (l *echoLogger) Outgoing(m *Message) {
+	if m.Command == "PRIVMSG" && m.Params[0] == "#chan" {
+		l.c.Privmsg("#debug", m.Params[1])
+	}
+	if m.Command == "PRIVMSG" && m.Params[0] == "#debug" {
+		close(l.done)
+	}
+}
+
+func TestLoggerSend(t *testing.T) {
+	c := fakeServer(t, func(string) []string { return nil })
+	defer c.Close()
+	l := &echoLogger{c: c, done: make(chan struct{})}
+	c.Logger = l
+	c.Privmsg("#chan", "hi")
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending from within the logger deadlocked")
+	}
+}
+
+func TestLogQueueBound(t *testing.T) {
+	q := newLogQueue()
+	for i := 0; i < maxLogQueue+10; i++ {
+		q.push(&Message{Command: "PING"}, false)
+	}
+	entries, dropped := q.take()
+	if len(entries) != maxLogQueue || dropped != 10 {
+		t.Errorf("got %d entries and %d dropped, expected %d and 10", len(entries), dropped, maxLogQueue)
+	}
+	if entries, dropped := q.take(); len(entries) != 0 || dropped != 0 {
+		t.Errorf("queue wasn't emptied: %d entries, %d dropped", len(entries), dropped)
+	}
+}
+
+type readingLogger struct {
+	nullLogger
+	seen chan string
+}
+
+func (l *readingLogger) Incoming(m *Message) {
+	// Read everything Read may still be touching.
+	_ = m.Batch
+	l.seen <- m.Command
+}
+
+func TestLoggerGetsCopy(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		return []string{
+			":server BATCH +ref netsplit a.example b.example",
+			"@batch=ref :nick!user@host QUIT :a.example b.example",
+			":server BATCH -ref",
+		}
+	})
+	defer c.Close()
+	l := &readingLogger{seen: make(chan string, 10)}
+	c.Logger = l
+	c.Send("VERSION")
+	for i := 0; i < 3; i++ {
+		select {
+		case <-l.seen:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for logger")
+		}
+	}
+}
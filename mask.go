@@ -0,0 +1,112 @@
+package irc
+
+import (
+	"strings"
+)
+
+// ParseMask parses a hostmask of the form nick!user@host. Missing
+// parts are left empty; a mask without ! or @ is taken to be a nick.
+func ParseMask(s string) Mask {
+	var m Mask
+	if idx := strings.LastIndex(s, "@"); idx != -1 {
+		m.Host = s[idx+1:]
+		s = s[:idx]
+	}
+	if idx := strings.Index(s, "!"); idx != -1 {
+		m.User = s[idx+1:]
+		s = s[:idx]
+	}
+	m.Nick = s
+	return m
+}
+
+// Match reports whether the mask matches pattern, which may contain
+// the wildcards * (any number of characters) and ? (exactly one
+// character). Missing parts of the pattern match anything, so that
+// "nick" is equivalent to "nick!*@*". Comparison uses the rfc1459
+// casemapping; use ISupport.Match to honour the server's casemapping.
+func (m Mask) Match(pattern string) bool {
+	return m.match(pattern, "rfc1459")
+}
+
+func (m Mask) match(pattern, casemapping string) bool {
+	p := ParseMask(pattern)
+	if p.Nick == "" {
+		p.Nick = "*"
+	}
+	if p.User == "" {
+		p.User = "*"
+	}
+	if p.Host == "" {
+		p.Host = "*"
+	}
+	full := m.Nick + "!" + m.User + "@" + m.Host
+	pat := p.Nick + "!" + p.User + "@" + p.Host
+	return WildcardMatch(Casefold(casemapping, pat), Casefold(casemapping, full))
+}
+
+// Match reports whether m matches pattern, using the server's
+// casemapping. See Mask.Match.
+func (is *ISupport) Match(m Mask, pattern string) bool {
+	return m.match(pattern, is.CaseMapping)
+}
+
+// Casefold folds the case of s according to an IRC casemapping, as
+// advertised by CASEMAPPING. In rfc1459, the characters {}|~ are the
+// lowercase versions of []\^, in strict-rfc1459 ~ and ^ aren't
+// considered. ascii only folds A-Z. Unknown casemappings fold like
+// rfc1459.
+func Casefold(casemapping, s string) string {
+	var upper string
+	switch casemapping {
+	case "ascii":
+		upper = ""
+	case "strict-rfc1459":
+		upper = "[]\\"
+	default:
+		upper = "[]\\^"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		case r < 128 && strings.IndexRune(upper, r) != -1:
+			return r + ('{' - '[')
+		}
+		return r
+	}, s)
+}
+
+// Casefold folds the case of s according to the server's
+// casemapping.
+func (is *ISupport) Casefold(s string) string {
+	return Casefold(is.CaseMapping, s)
+}
+
+// WildcardMatch reports whether s matches pattern, which may contain
+// the wildcards * (any number of characters) and ? (exactly one
+// character). Matching is case-sensitive.
+func WildcardMatch(pattern, s string) bool {
+	var star, mark = -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star != -1:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,79 @@
+package irc
+
+import "testing"
+
+func TestParseMask(t *testing.T) {
+	table := []struct {
+		in  string
+		out Mask
+	}{
+		{"nick!user@host", Mask{"nick", "user", "host"}},
+		{"nick", Mask{Nick: "nick"}},
+		{"*!*@host", Mask{"*", "*", "host"}},
+		{"nick@host", Mask{Nick: "nick", Host: "host"}},
+		{"nick!user", Mask{Nick: "nick", User: "user"}},
+	}
+	for _, test := range table {
+		if out := ParseMask(test.in); out != test.out {
+			t.Errorf("parsing %q: expected %#v, got %#v", test.in, test.out, out)
+		}
+	}
+}
+
+func TestMaskMatch(t *testing.T) {
+	m := Mask{"Nick[away]", "user", "host.example.com"}
+	table := []struct {
+		pattern string
+		match   bool
+	}{
+		{"*!*@*", true},
+		{"nick{away}", true},
+		{"NICK[AWAY]!*@*", true},
+		{"*!*@*.example.com", true},
+		{"*!us?r@*", true},
+		{"*!*@*.example.org", false},
+		{"other", false},
+	}
+	for _, test := range table {
+		if match := m.Match(test.pattern); match != test.match {
+			t.Errorf("matching %q against %q: expected %t, got %t", m, test.pattern, test.match, match)
+		}
+	}
+
+	is := NewISupport()
+	is.CaseMapping = "ascii"
+	if is.Match(m, "nick{away}") {
+		t.Errorf("ascii casemapping shouldn't fold [] to {}")
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	table := []struct {
+		casemapping string
+		in          string
+		out         string
+	}{
+		{"rfc1459", "Nick[]\\^", "nick{}|~"},
+		{"rfc1459", "a~", "a~"},
+		{"rfc1459", "a^", "a~"},
+		{"rfc1459", "{}|", "{}|"},
+		{"", "FOO^", "foo~"},
+		{"strict-rfc1459", "Nick[]\\^", "nick{}|^"},
+		{"ascii", "Nick[]\\^", "nick[]\\^"},
+	}
+	for _, test := range table {
+		if out := Casefold(test.casemapping, test.in); out != test.out {
+			t.Errorf("folding %q with %q: expected %q, got %q", test.in, test.casemapping, test.out, out)
+		}
+	}
+
+	pairs := [][2]string{{"foo^", "FOO~"}, {"a[b]", "A{B}"}, {"x\\y", "X|Y"}}
+	for _, pair := range pairs {
+		if !(Mask{Nick: pair[0]}).Match(pair[1]) {
+			t.Errorf("expected %q to match %q", pair[0], pair[1])
+		}
+		if !(Mask{Nick: pair[1]}).Match(pair[0]) {
+			t.Errorf("expected %q to match %q", pair[1], pair[0])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package irc
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics receives measurements of a client's activity, for exporting
+// them to systems such as Prometheus or expvar. Methods are called
+// synchronously from the client's goroutines, so they must be fast
+// and safe for concurrent use.
+//
+// Clients can't be reused, so reconnecting means creating a new
+// client; share one Metrics between them to count reconnects.
+type Metrics interface {
+	// Connected is called when the client gets a connection.
+	Connected()
+	// MessageReceived is called for every message read, with the
+	// size of its line, including the line terminator.
+	MessageReceived(command string, bytes int)
+	// MessageSent is called for every message written.
+	MessageSent(command string, bytes int)
+	// HandlerDone is called after a handler registered with the
+	// client's Mux processed a message or signal, with the time it
+	// took. Handlers of muxes nested in components aren't measured
+	// separately; their time counts towards the component.
+	HandlerDone(signal string, d time.Duration)
+	// HandlerPanicked is called for every panic recovered by
+	// Client.RecoverHandler.
+	HandlerPanicked(signal string)
+}
+
+// MetricsSnapshot is the state of a Counters at one point in time.
+type MetricsSnapshot struct {
+	// Connects is the number of connections made. All but the first
+	// are reconnects.
+	Connects int64
+	// Received and Sent count messages per command.
+	Received map[string]int64
+	Sent     map[string]int64
+	BytesIn  int64
+	BytesOut int64
+	// Handled counts runs of the handlers registered with the
+	// client's Mux per signal, and HandlerTime sums up how long they
+	// took.
+	Handled     map[string]int64
+	HandlerTime map[string]time.Duration
+	Panics      int64
+}
+
+// Counters is a Metrics that keeps simple counters in memory. Its
+// snapshots can be published with expvar:
+//
+//	expvar.Publish("irc", expvar.Func(func() interface{} { return counters.Snapshot() }))
+type Counters struct {
+	mu sync.Mutex
+	s  MetricsSnapshot
+}
+
+func NewCounters() *Counters {
+	return &Counters{s: MetricsSnapshot{
+		Received:    make(map[string]int64),
+		Sent:        make(map[string]int64),
+		Handled:     make(map[string]int64),
+		HandlerTime: make(map[string]time.Duration),
+	}}
+}
+
+func (c *Counters) Connected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.Connects++
+}
+
+func (c *Counters) MessageReceived(command string, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.Received[command]++
+	c.s.BytesIn += int64(bytes)
+}
+
+func (c *Counters) MessageSent(command string, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.Sent[command]++
+	c.s.BytesOut += int64(bytes)
+}
+
+func (c *Counters) HandlerDone(signal string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.Handled[signal]++
+	c.s.HandlerTime[signal] += d
+}
+
+func (c *Counters) HandlerPanicked(signal string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.Panics++
+}
+
+// Snapshot returns a copy of the current counters.
+func (c *Counters) Snapshot() MetricsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.s
+	s.Received = copyCounts(c.s.Received)
+	s.Sent = copyCounts(c.s.Sent)
+	s.Handled = copyCounts(c.s.Handled)
+	s.HandlerTime = make(map[string]time.Duration, len(c.s.HandlerTime))
+	for k, v := range c.s.HandlerTime {
+		s.HandlerTime[k] = v
+	}
+	return s
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+var _ Metrics = (*Counters)(nil)
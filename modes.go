@@ -0,0 +1,116 @@
+package irc
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrMissingModeArg is returned by ModeParser when a mode that takes
+// an argument has none.
+var ErrMissingModeArg = errors.New("mode is missing its argument")
+
+// ModeChange is a single mode being set or unset, together with its
+// argument, if any.
+type ModeChange struct {
+	Add  bool
+	Mode rune
+	Arg  string
+}
+
+// ModeParser parses mode strings, using the CHANMODES and PREFIX
+// advertised by the server to determine which modes take arguments:
+// type A and B modes and prefix modes always do, type C modes only
+// when being set, and type D modes never do.
+type ModeParser struct {
+	ISupport *ISupport
+}
+
+// Parse parses a MODE message or an RPL_CHANNELMODEIS reply. User
+// modes are assumed to never take arguments.
+func (p ModeParser) Parse(m *Message) (target string, changes []ModeChange, err error) {
+	params := m.Params
+	switch m.Command {
+	case "MODE":
+	case RPL_CHANNELMODEIS:
+		if len(params) > 0 {
+			params = params[1:]
+		}
+	default:
+		return "", nil, &DecodeError{m.Command, "not a mode message"}
+	}
+	if len(params) < 2 {
+		return "", nil, &DecodeError{m.Command, "too few parameters"}
+	}
+	target = params[0]
+	if !p.ISupport.IsChannel(target) {
+		changes, err = parseModes(params[1], nil, func(bool, rune) bool { return false })
+		return target, changes, err
+	}
+	changes, err = p.ParseModes(params[1], params[2:])
+	return target, changes, err
+}
+
+// ParseModes parses channel modes such as "+ov-k" with their
+// arguments. If arguments are missing, the changes parsed up to that
+// point are returned together with ErrMissingModeArg.
+func (p ModeParser) ParseModes(modes string, args []string) ([]ModeChange, error) {
+	is := p.ISupport
+	return parseModes(modes, args, func(add bool, r rune) bool {
+		if _, ok := is.Prefix[r]; ok {
+			return true
+		}
+		return inRunes(is.ChanModes.A, r) ||
+			inRunes(is.ChanModes.B, r) ||
+			(add && inRunes(is.ChanModes.C, r))
+	})
+}
+
+func parseModes(modes string, args []string, takesArg func(add bool, r rune) bool) ([]ModeChange, error) {
+	var changes []ModeChange
+	add := true
+	for len(modes) > 0 {
+		r, size := utf8.DecodeRuneInString(modes)
+		modes = modes[size:]
+		switch r {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			ch := ModeChange{Add: add, Mode: r}
+			if takesArg(add, r) {
+				if len(args) == 0 {
+					return changes, ErrMissingModeArg
+				}
+				ch.Arg = args[0]
+				args = args[1:]
+			}
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// FormatModes is the inverse of ModeParser.ParseModes, turning changes
+// into a mode string such as "+ov-k" and its arguments.
+func FormatModes(changes []ModeChange) (modes string, args []string) {
+	var b []byte
+	first := true
+	add := false
+	for _, ch := range changes {
+		if first || ch.Add != add {
+			if ch.Add {
+				b = append(b, '+')
+			} else {
+				b = append(b, '-')
+			}
+			add = ch.Add
+			first = false
+		}
+		b = append(b, string(ch.Mode)...)
+		if ch.Arg != "" {
+			args = append(args, ch.Arg)
+		}
+	}
+	return string(b), args
+}
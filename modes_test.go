@@ -0,0 +1,79 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModeParser(t *testing.T) {
+	is := NewISupport()
+	is.Parse(Parse(":prefix 005 recipient CHANTYPES=# CHANMODES=beI,k,l,imnpst PREFIX=(ov)@+"))
+	p := ModeParser{is}
+
+	table := []struct {
+		in      string
+		target  string
+		changes []ModeChange
+		err     error
+	}{
+		{
+			":op!u@h MODE #chan +ov-b+lk a b c!*@* 10 key",
+			"#chan",
+			[]ModeChange{{true, 'o', "a"}, {true, 'v', "b"}, {false, 'b', "c!*@*"}, {true, 'l', "10"}, {true, 'k', "key"}},
+			nil,
+		},
+		{
+			":op!u@h MODE #chan -lk+m key",
+			"#chan",
+			[]ModeChange{{false, 'l', ""}, {false, 'k', "key"}, {true, 'm', ""}},
+			nil,
+		},
+		{
+			":server 324 me #chan +ntl 5",
+			"#chan",
+			[]ModeChange{{true, 'n', ""}, {true, 't', ""}, {true, 'l', "5"}},
+			nil,
+		},
+		{
+			":me MODE me +iw",
+			"me",
+			[]ModeChange{{true, 'i', ""}, {true, 'w', ""}},
+			nil,
+		},
+		{
+			":op!u@h MODE #chan +mb",
+			"#chan",
+			[]ModeChange{{true, 'm', ""}},
+			ErrMissingModeArg,
+		},
+	}
+
+	for _, test := range table {
+		target, changes, err := p.Parse(Parse(test.in))
+		if target != test.target || !reflect.DeepEqual(changes, test.changes) || err != test.err {
+			t.Errorf("parsing %q: expected %q, %v, %v, got %q, %v, %v",
+				test.in, test.target, test.changes, test.err, target, changes, err)
+		}
+	}
+}
+
+func TestFormatModes(t *testing.T) {
+	is := NewISupport()
+	is.Parse(Parse(":prefix 005 recipient CHANTYPES=# CHANMODES=beI,k,l,imnpst PREFIX=(ov)@+"))
+	p := ModeParser{is}
+
+	for _, in := range []string{"+ov-k+b", "-bbb", "+nt-l"} {
+		changes, err := p.ParseModes(in, []string{"a", "b", "c", "d"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes, args := FormatModes(changes)
+		again, err := p.ParseModes(modes, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modes != in || !reflect.DeepEqual(changes, again) {
+			t.Errorf("%q: got %q %q, which parses as %v, expected %v", in, modes, args, again, changes)
+		}
+	}
+}
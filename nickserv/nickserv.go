@@ -0,0 +1,246 @@
+// Package nickserv identifies to services on networks without SASL.
+package nickserv // import "honnef.co/go/irc/nickserv"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"honnef.co/go/irc"
+)
+
+// Variant selects the kind of services to identify to.
+type Variant int
+
+const (
+	// NickServ identifies with IDENTIFY, as supported by Atheme and
+	// Anope.
+	NickServ Variant = iota
+	// QuakeNet identifies to Q with CHALLENGEAUTH, so that the
+	// password is never sent in the clear.
+	QuakeNet
+	// Undernet identifies to X with LOGIN.
+	Undernet
+)
+
+// Services is an irc.Authenticator that registers normally and
+// identifies to services once the MOTD has been received.
+//
+// After identifying, it emits the irc:identified signal. If Confirm
+// is set, it waits for services to confirm, and emits
+// irc:identify-failed, whose only parameter is the reason, if they
+// reject the password or don't answer in time. The QuakeNet variant
+// always waits for confirmation, as it needs to answer a challenge
+// first.
+//
+// Services needs to be registered as a catch-all handler.
+type Services struct {
+	*irc.Mux
+	Variant Variant
+	// The account to identify to. For NickServ, it defaults to the
+	// client's nick.
+	Account  string
+	Password string
+	// The nick of the services bot. Defaults to NickServ,
+	// Q@CServe.quakenet.org or X@channels.undernet.org, depending on
+	// Variant.
+	Service string
+	// Confirm causes irc:identified to be emitted only once services
+	// confirmed the login, by notice, RPL_SASLLOGIN or user mode +r.
+	Confirm bool
+	// How long to wait for confirmation. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// the connection we're identifying for
+	identifyingFor <-chan struct{}
+	// closed once the current attempt is confirmed or rejected
+	pending chan struct{}
+}
+
+func New(variant Variant, account, password string) *Services {
+	s := &Services{
+		Mux:      irc.NewMux(),
+		Variant:  variant,
+		Account:  account,
+		Password: password,
+	}
+	s.HandleFunc(irc.RPL_ENDOFMOTD, s.identify)
+	s.HandleFunc(irc.ERR_NOMOTD, s.identify)
+	s.HandleFunc("NOTICE", s.notice)
+	s.HandleFunc(irc.RPL_SASLLOGIN, s.loggedIn)
+	s.HandleFunc("MODE", s.mode)
+	return s
+}
+
+func (s *Services) service() string {
+	if s.Service != "" {
+		return s.Service
+	}
+	switch s.Variant {
+	case QuakeNet:
+		return "Q@CServe.quakenet.org"
+	case Undernet:
+		return "X@channels.undernet.org"
+	default:
+		return "NickServ"
+	}
+}
+
+func (s *Services) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return s.Timeout
+}
+
+// serviceNick returns the nick part of the service, which is what
+// notices come from.
+func (s *Services) serviceNick() string {
+	service := s.service()
+	if idx := strings.IndexByte(service, '@'); idx != -1 {
+		return service[:idx]
+	}
+	return service
+}
+
+func (s *Services) Authenticate(c *irc.Client) {
+	c.NegotiateCaps()
+	c.Login()
+}
+
+func (s *Services) identify(c *irc.Client, m *irc.Message) {
+	done := c.Done()
+	pending := make(chan struct{})
+	s.mu.Lock()
+	if s.identifyingFor == done {
+		// RPL_ENDOFMOTD is repeated by MOTD commands.
+		s.mu.Unlock()
+		return
+	}
+	s.identifyingFor = done
+	s.pending = pending
+	s.mu.Unlock()
+
+	var err error
+	switch s.Variant {
+	case QuakeNet:
+		// The challenge arrives as a notice.
+		err = c.Privmsg(s.service(), "CHALLENGE")
+	case Undernet:
+		err = c.Privmsg(s.service(), "LOGIN "+s.Account+" "+s.Password)
+	default:
+		account := s.Account
+		if account == "" {
+			account = c.CurrentNick()
+		}
+		err = c.Privmsg(s.service(), "IDENTIFY "+account+" "+s.Password)
+	}
+	if err != nil {
+		return
+	}
+	if !s.Confirm && s.Variant != QuakeNet {
+		s.finish(c, true, "")
+		return
+	}
+	go func() {
+		t := irc.OrRealClock(c.Clock).NewTimer(s.timeout())
+		defer t.Stop()
+		select {
+		case <-t.C():
+			s.finish(c, false, "timed out waiting for services")
+		case <-pending:
+		case <-done:
+		}
+	}()
+}
+
+// finish ends the current attempt and emits the appropriate signal.
+func (s *Services) finish(c *irc.Client, ok bool, reason string) {
+	s.mu.Lock()
+	pending := s.pending
+	if pending == nil {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case <-pending:
+		// Already finished
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(pending)
+	s.mu.Unlock()
+
+	if ok {
+		c.Mux.Process(c, &irc.Message{Signal: "irc:identified"})
+	} else {
+		c.Mux.Process(c, &irc.Message{Signal: "irc:identify-failed", Params: []string{reason}})
+	}
+}
+
+func (s *Services) notice(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 2 || !strings.EqualFold(m.Prefix.Nick, s.serviceNick()) {
+		return
+	}
+	text := m.Params[len(m.Params)-1]
+	if s.Variant == QuakeNet && strings.HasPrefix(text, "CHALLENGE ") {
+		// CHALLENGE <challenge> <algorithms...>
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return
+		}
+		response := ChallengeResponse(s.Account, s.Password, fields[1])
+		c.Privmsg(s.service(), "CHALLENGEAUTH "+s.Account+" "+response+" HMAC-SHA-256")
+		return
+	}
+
+	lower := strings.ToLower(text)
+	switch {
+	case strings.Contains(lower, "you are now identified"),
+		strings.Contains(lower, "password accepted"),
+		strings.Contains(lower, "you are now logged in"),
+		strings.Contains(lower, "authentication successful"):
+		s.finish(c, true, "")
+	case strings.Contains(lower, "invalid password"),
+		strings.Contains(lower, "password incorrect"),
+		strings.Contains(lower, "username or password incorrect"),
+		strings.Contains(lower, "authentication failed"):
+		s.finish(c, false, text)
+	}
+}
+
+func (s *Services) loggedIn(c *irc.Client, m *irc.Message) {
+	s.finish(c, true, "")
+}
+
+func (s *Services) mode(c *irc.Client, m *irc.Message) {
+	// :me MODE me :+r
+	if len(m.Params) < 2 || !c.IsMe(m.Params[0]) {
+		return
+	}
+	_, changes, _ := irc.ModeParser{ISupport: c.Support()}.Parse(m)
+	for _, ch := range changes {
+		if ch.Add && ch.Mode == 'r' {
+			s.finish(c, true, "")
+		}
+	}
+}
+
+// ChallengeResponse computes the response to a QuakeNet
+// CHALLENGEAUTH challenge, using HMAC-SHA-256.
+func ChallengeResponse(account, password, challenge string) string {
+	// Q only considers the first 10 characters of passwords.
+	if len(password) > 10 {
+		password = password[:10]
+	}
+	pass := sha256.Sum256([]byte(password))
+	key := sha256.Sum256([]byte(irc.Casefold("rfc1459", account) + ":" + hex.EncodeToString(pass[:])))
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(key[:])))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
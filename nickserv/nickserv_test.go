@@ -0,0 +1,105 @@
+package nickserv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestChallengeResponse(t *testing.T) {
+	table := []struct {
+		account, password, challenge string
+		want                         string
+	}{
+		{"fishking", "iLOVEfish1", "3afabede5c2859fd821e315f889d9a6c", "110222fa88a6dba3ae0e6c68352f2109ac0f265e72044b2b0fc05a9b770f4343"},
+		// Accounts are casefolded and passwords are cut off after 10
+		// characters.
+		{"FishKing[]", "iLOVEfish1234", "3afabede5c2859fd821e315f889d9a6c", "46f20299ae9fc2f57ac6cf9efaabf7f1e26a4b4120605b07d2c854ca010d46e1"},
+		{"fishking{}", "iLOVEfish1", "3afabede5c2859fd821e315f889d9a6c", "46f20299ae9fc2f57ac6cf9efaabf7f1e26a4b4120605b07d2c854ca010d46e1"},
+	}
+	for _, test := range table {
+		if got := ChallengeResponse(test.account, test.password, test.challenge); got != test.want {
+			t.Errorf("ChallengeResponse(%q, %q, %q) = %s, expected %s", test.account, test.password, test.challenge, got, test.want)
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	const challenge = "3afabede5c2859fd821e315f889d9a6c"
+	table := []struct {
+		variant  Variant
+		account  string
+		password string
+		// The service's reply to each PRIVMSG
+		replies map[string]string
+		// The reason of irc:identify-failed, or empty if identifying
+		// should succeed
+		failure string
+	}{
+		{
+			NickServ, "", "secret",
+			map[string]string{"NickServ IDENTIFY bot secret": ":NickServ!s@services NOTICE bot :You are now identified for bot."},
+			"",
+		},
+		{
+			NickServ, "account", "wrong",
+			map[string]string{"NickServ IDENTIFY account wrong": ":NickServ!s@services NOTICE bot :Invalid password for account."},
+			"Invalid password for account.",
+		},
+		{
+			Undernet, "account", "secret",
+			map[string]string{"X@channels.undernet.org LOGIN account secret": ":X!cservice@undernet.org NOTICE bot :AUTHENTICATION SUCCESSFUL as account!"},
+			"",
+		},
+		{
+			QuakeNet, "fishking", "iLOVEfish1",
+			map[string]string{
+				"Q@CServe.quakenet.org CHALLENGE": ":Q!TheQBot@CServe.quakenet.org NOTICE bot :CHALLENGE " + challenge + " HMAC-MD5 HMAC-SHA-1 HMAC-SHA-256",
+				"Q@CServe.quakenet.org CHALLENGEAUTH fishking 110222fa88a6dba3ae0e6c68352f2109ac0f265e72044b2b0fc05a9b770f4343 HMAC-SHA-256": ":Q!TheQBot@CServe.quakenet.org NOTICE bot :You are now logged in as fishking.",
+			},
+			"",
+		},
+		{
+			// Services never answer.
+			QuakeNet, "fishking", "iLOVEfish1",
+			nil,
+			"timed out waiting for services",
+		},
+	}
+	for _, test := range table {
+		srv := irctest.NewServer()
+		srv.Handle("PRIVMSG", func(sess *irctest.Session, m *irc.Message) {
+			if reply, ok := test.replies[strings.Join(m.Params, " ")]; ok {
+				sess.Send(reply)
+			}
+		})
+		s := New(test.variant, test.account, test.password)
+		s.Confirm = true
+		if test.replies == nil {
+			s.Timeout = 10 * time.Millisecond
+		}
+		mux := irc.NewMux()
+		mux.Handle("", s)
+		result := make(chan string, 2)
+		mux.HandleFunc("irc:identified", func(c *irc.Client, m *irc.Message) { result <- "" })
+		mux.HandleFunc("irc:identify-failed", func(c *irc.Client, m *irc.Message) { result <- m.Params[0] })
+		c := &irc.Client{Nick: "bot", User: "bot", Mux: mux, Authenticator: s, Dialer: srv}
+		if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+			t.Fatal(err)
+		}
+		go c.Process()
+
+		select {
+		case got := <-result:
+			if got != test.failure {
+				t.Errorf("%v: expected failure %q, got %q", test.replies, test.failure, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v: timed out waiting for the result", test.replies)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,5 @@
+//go:build irc_nodefaultmux
+
+package irc
+
+func defaultMuxer() Muxer { return nil }
@@ -0,0 +1,126 @@
+package irc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader describes a PROXY protocol header, which gateways and
+// bouncers send before anything else to tell the IRCd the address of
+// the user they are connecting on behalf of. The IRCd has to be
+// configured to expect it.
+type ProxyHeader struct {
+	// 1 for the text format, 2 for the binary format.
+	Version int
+	// The user's address. If Source or Destination is nil, the
+	// header says that the address is unknown.
+	Source *net.TCPAddr
+	// The address the user connected to.
+	Destination *net.TCPAddr
+}
+
+// Format returns the encoded header.
+func (h *ProxyHeader) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", h.Version)
+	}
+}
+
+// addrs returns the source and destination IPs in a common length,
+// and whether they are IPv4 addresses. ok is false if the addresses
+// are unknown.
+func (h *ProxyHeader) addrs() (src, dst net.IP, v4, ok bool) {
+	if h.Source == nil || h.Destination == nil {
+		return nil, nil, false, false
+	}
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src4 != nil && dst4 != nil {
+		return src4, dst4, true, true
+	}
+	src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+	if src == nil || dst == nil {
+		return nil, nil, false, false
+	}
+	return src, dst, false, true
+}
+
+func (h *ProxyHeader) formatV1() []byte {
+	src, dst, v4, ok := h.addrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	format := func(ip net.IP) string {
+		if !v4 && ip.To4() != nil {
+			// net.IP would print the IPv4 address, but TCP6
+			// needs IPv6 addresses on both sides.
+			return "::ffff:" + ip.To4().String()
+		}
+		return ip.String()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, format(src), format(dst), h.Source.Port, h.Destination.Port))
+}
+
+func (h *ProxyHeader) formatV2() []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	src, dst, v4, ok := h.addrs()
+	if !ok {
+		// LOCAL command, unspecified family, no addresses
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	}
+	family := byte(0x21) // TCP over IPv6
+	if v4 {
+		family = 0x11 // TCP over IPv4
+	}
+	// PROXY command
+	b = append(b, 0x21, family)
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(2*len(src)+4))
+	b = append(b, length[:]...)
+	b = append(b, src...)
+	b = append(b, dst...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:2], uint16(h.Source.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(h.Destination.Port))
+	return append(b, ports[:]...)
+}
+
+// WebIRC describes a WEBIRC command, which web gateways send before
+// registering to tell the IRCd the real hostname and IP of the user.
+// The IRCd has to be configured to trust the gateway.
+type WebIRC struct {
+	Password string
+	// The name of the gateway
+	Gateway  string
+	Hostname string
+	IP       string
+	// Options, such as "secure", as key or key=value
+	Options []string
+}
+
+func (w *WebIRC) message() *Message {
+	ip := w.IP
+	if strings.HasPrefix(ip, ":") {
+		// IPv6 addresses such as ::1 would be mistaken for the
+		// trailing parameter.
+		ip = "0" + ip
+	}
+	params := []string{w.Password, w.Gateway, w.Hostname, ip}
+	if len(w.Options) > 0 {
+		params = append(params, strings.Join(w.Options, " "))
+	}
+	return &Message{Command: "WEBIRC", Params: params}
+}
@@ -0,0 +1,57 @@
+package irc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4 := &ProxyHeader{
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 6697},
+	}
+	v6 := &ProxyHeader{
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 6697},
+	}
+
+	table := []struct {
+		h        *ProxyHeader
+		version  int
+		expected []byte
+	}{
+		{v4, 1, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6697\r\n")},
+		{v6, 1, []byte("PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 56324 6697\r\n")},
+		{&ProxyHeader{}, 1, []byte("PROXY UNKNOWN\r\n")},
+		{v4, 2, append(append([]byte(nil), proxyV2Signature...),
+			0x21, 0x11, 0x00, 0x0c,
+			192, 0, 2, 1,
+			198, 51, 100, 1,
+			0xdc, 0x04, 0x1a, 0x29)},
+		{&ProxyHeader{}, 2, append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+	}
+	for _, e := range table {
+		e.h.Version = e.version
+		b, err := e.h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, e.expected) {
+			t.Errorf("got %q, expected %q", b, e.expected)
+		}
+	}
+
+	v6.Version = 2
+	b, _ := v6.Format()
+	if len(b) != len(proxyV2Signature)+4+36 || b[13] != 0x21 {
+		t.Errorf("malformed IPv6 header %q", b)
+	}
+}
+
+func TestWebIRC(t *testing.T) {
+	w := &WebIRC{Password: "secret", Gateway: "gateway", Hostname: "localhost", IP: "::1", Options: []string{"secure", "local-port=6697"}}
+	if got, expected := w.message().WireString(), "WEBIRC secret gateway localhost 0::1 :secure local-port=6697"; got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
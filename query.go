@@ -0,0 +1,394 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ReplyError is returned by queries such as Whois when the server
+// replies with an error numeric, such as ERR_NOSUCHNICK.
+type ReplyError struct {
+	Numeric string
+	Target  string
+	Text    string
+}
+
+func (err *ReplyError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", err.Target, err.Text, err.Numeric)
+}
+
+// query collects the replies to a command. Servers answer commands
+// in order, so every reply is handed to the oldest pending query that
+// accepts it.
+type query struct {
+	accept func(m *Message) bool
+	end    func(m *Message) bool
+	msgs   []*Message
+	done   chan struct{}
+}
+
+// feedQueries hands an incoming message to the pending queries.
+func (c *Client) feedQueries(m *Message) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	for i, q := range c.queries {
+		if !q.accept(m) {
+			continue
+		}
+		q.msgs = append(q.msgs, m)
+		if q.end(m) {
+			c.queries = append(c.queries[:i:i], c.queries[i+1:]...)
+			close(q.done)
+		}
+		return
+	}
+}
+
+func (c *Client) removeQuery(q *query) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	for i, other := range c.queries {
+		if other == q {
+			c.queries = append(c.queries[:i:i], c.queries[i+1:]...)
+			return
+		}
+	}
+}
+
+// runQuery sends line and collects replies until end matches one of
+// them. Numerics in errs that accept matched are returned as a
+// *ReplyError.
+func (c *Client) runQuery(ctx context.Context, line string, accept, end func(m *Message) bool, errs ...string) ([]*Message, error) {
+	q := &query{
+		accept: accept,
+		end:    end,
+		done:   make(chan struct{}),
+	}
+	c.mu.RLock()
+	chQuit := c.chQuit
+	c.mu.RUnlock()
+	c.qmu.Lock()
+	c.queries = append(c.queries, q)
+	c.qmu.Unlock()
+
+	if err := c.Send(line); err != nil {
+		c.removeQuery(q)
+		return nil, err
+	}
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		c.removeQuery(q)
+		return nil, ctx.Err()
+	case <-chQuit:
+		c.removeQuery(q)
+		return nil, ErrDeadClient
+	}
+	last := q.msgs[len(q.msgs)-1]
+	if inStrings(errs, last.Command) {
+		err := &ReplyError{Numeric: last.Command}
+		if len(last.Params) > 1 {
+			err.Target = last.Params[1]
+		}
+		if len(last.Params) > 2 {
+			err.Text = last.Params[len(last.Params)-1]
+		}
+		return nil, err
+	}
+	return q.msgs, nil
+}
+
+// matchTarget returns a function that accepts the given numerics if
+// their first parameter after our nick is target.
+func (c *Client) matchTarget(target string, numerics ...string) func(m *Message) bool {
+	return func(m *Message) bool {
+		return inStrings(numerics, m.Command) &&
+			len(m.Params) > 1 &&
+			strings.EqualFold(m.Params[1], target)
+	}
+}
+
+func isCommand(cmds ...string) func(m *Message) bool {
+	return func(m *Message) bool {
+		return inStrings(cmds, m.Command)
+	}
+}
+
+// WhoisResult is the reply to a WHOIS query.
+type WhoisResult struct {
+	User     Mask
+	RealName string
+	Server   string
+	// The channels the user is in, including prefix sigils; use
+	// ISupport.SplitPrefix to decode them.
+	Channels []string
+	// The account the user is logged in to, if any
+	Account  string
+	Away     string
+	Oper     bool
+	Secure   bool
+	Idle     time.Duration
+	SignedOn time.Time
+}
+
+// Whois queries information about nick. It returns a *ReplyError if
+// there is no such nick.
+func (c *Client) Whois(ctx context.Context, nick string) (*WhoisResult, error) {
+	accept := c.matchTarget(nick,
+		RPL_WHOISUSER, RPL_WHOISSERVER, RPL_WHOISOPERATOR, RPL_WHOISIDLE,
+		RPL_WHOISCHANNELS, RPL_WHOISACCOUNT, RPL_WHOISSECURE, RPL_AWAY,
+		RPL_ENDOFWHOIS, ERR_NOSUCHNICK, ERR_NOSUCHSERVER)
+	msgs, err := c.runQuery(ctx, "WHOIS "+nick, accept, isCommand(RPL_ENDOFWHOIS, ERR_NOSUCHNICK, ERR_NOSUCHSERVER),
+		ERR_NOSUCHNICK, ERR_NOSUCHSERVER)
+	if err != nil {
+		return nil, err
+	}
+	res := &WhoisResult{}
+	for _, m := range msgs {
+		p := m.Params
+		switch m.Command {
+		case RPL_WHOISUSER:
+			if len(p) >= 6 {
+				res.User = Mask{Nick: p[1], User: p[2], Host: p[3]}
+				res.RealName = p[5]
+			}
+		case RPL_WHOISSERVER:
+			if len(p) >= 3 {
+				res.Server = p[2]
+			}
+		case RPL_WHOISOPERATOR:
+			res.Oper = true
+		case RPL_WHOISSECURE:
+			res.Secure = true
+		case RPL_WHOISIDLE:
+			if len(p) >= 3 {
+				idle, _ := strconv.Atoi(p[2])
+				res.Idle = time.Duration(idle) * time.Second
+			}
+			if len(p) >= 5 {
+				if signon, err := strconv.ParseInt(p[3], 10, 64); err == nil {
+					res.SignedOn = time.Unix(signon, 0)
+				}
+			}
+		case RPL_WHOISCHANNELS:
+			if len(p) >= 3 {
+				res.Channels = append(res.Channels, strings.Fields(p[2])...)
+			}
+		case RPL_WHOISACCOUNT:
+			if len(p) >= 3 {
+				res.Account = p[2]
+			}
+		case RPL_AWAY:
+			if len(p) >= 3 {
+				res.Away = p[2]
+			}
+		}
+	}
+	return res, nil
+}
+
+// WhoEntry is a single RPL_WHOREPLY.
+type WhoEntry struct {
+	Channel  string
+	User     Mask
+	Server   string
+	Flags    string
+	Hops     int
+	RealName string
+}
+
+// Who lists the users matching mask, which may be a channel.
+func (c *Client) Who(ctx context.Context, mask string) ([]WhoEntry, error) {
+	accept := func(m *Message) bool {
+		return m.Command == RPL_WHOREPLY || c.matchTarget(mask, RPL_ENDOFWHO)(m)
+	}
+	msgs, err := c.runQuery(ctx, "WHO "+mask, accept, isCommand(RPL_ENDOFWHO))
+	if err != nil {
+		return nil, err
+	}
+	var out []WhoEntry
+	for _, m := range msgs {
+		p := m.Params
+		if m.Command != RPL_WHOREPLY || len(p) < 8 {
+			continue
+		}
+		e := WhoEntry{
+			Channel: p[1],
+			User:    Mask{Nick: p[5], User: p[2], Host: p[3]},
+			Server:  p[4],
+			Flags:   p[6],
+		}
+		// The last parameter is "<hops> <realname>"
+		hops := p[7]
+		if idx := strings.IndexByte(hops, ' '); idx != -1 {
+			e.RealName = hops[idx+1:]
+			hops = hops[:idx]
+		}
+		e.Hops, _ = strconv.Atoi(hops)
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// TopicResult is the topic of a channel. SetBy and SetAt are only
+// set if the server provides them.
+type TopicResult struct {
+	Channel string
+	Topic   string
+	SetBy   string
+	SetAt   time.Time
+}
+
+// Topic queries the topic of channel. Topic is empty if no topic is
+// set.
+func (c *Client) Topic(ctx context.Context, channel string) (*TopicResult, error) {
+	accept := c.matchTarget(channel, RPL_TOPIC, RPL_TOPICWHOTIME, RPL_NOTOPIC, ERR_NOSUCHCHANNEL, ERR_NOTONCHANNEL)
+	msgs, err := c.runQuery(ctx, "TOPIC "+channel, accept,
+		isCommand(RPL_TOPICWHOTIME, RPL_NOTOPIC, ERR_NOSUCHCHANNEL, ERR_NOTONCHANNEL),
+		ERR_NOSUCHCHANNEL, ERR_NOTONCHANNEL)
+	if err != nil {
+		return nil, err
+	}
+	res := &TopicResult{Channel: channel}
+	for _, m := range msgs {
+		p := m.Params
+		switch m.Command {
+		case RPL_TOPIC:
+			if len(p) >= 3 {
+				res.Topic = p[2]
+			}
+		case RPL_TOPICWHOTIME:
+			if len(p) >= 4 {
+				res.SetBy = p[2]
+				if at, err := strconv.ParseInt(p[3], 10, 64); err == nil {
+					res.SetAt = time.Unix(at, 0)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// ListEntry is a single channel returned by LIST.
+type ListEntry struct {
+	Channel string
+	Users   int
+	Topic   string
+}
+
+// ListChannels lists channels. params are passed to LIST as is and
+// may be used to filter the list, for example by channel names or,
+// on servers supporting ELIST, by user count.
+func (c *Client) ListChannels(ctx context.Context, params ...string) ([]ListEntry, error) {
+	line := "LIST"
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	msgs, err := c.runQuery(ctx, line, isCommand(RPL_LISTSTART, RPL_LIST, RPL_LISTEND), isCommand(RPL_LISTEND))
+	if err != nil {
+		return nil, err
+	}
+	var out []ListEntry
+	for _, m := range msgs {
+		p := m.Params
+		if m.Command != RPL_LIST || len(p) < 3 {
+			continue
+		}
+		e := ListEntry{Channel: p[1]}
+		e.Users, _ = strconv.Atoi(p[2])
+		if len(p) >= 4 {
+			e.Topic = p[3]
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// NamesEntry is a member of a channel as returned by NAMES. Mode is
+// the highest ranked prefix mode of the member, or zero.
+type NamesEntry struct {
+	Nick string
+	Mode rune
+}
+
+// Names lists the members of channel.
+func (c *Client) Names(ctx context.Context, channel string) ([]NamesEntry, error) {
+	accept := func(m *Message) bool {
+		switch m.Command {
+		case RPL_NAMREPLY:
+			return len(m.Params) > 2 && strings.EqualFold(m.Params[2], channel)
+		case RPL_ENDOFNAMES:
+			return len(m.Params) > 1 && strings.EqualFold(m.Params[1], channel)
+		}
+		return false
+	}
+	msgs, err := c.runQuery(ctx, "NAMES "+channel, accept, isCommand(RPL_ENDOFNAMES))
+	if err != nil {
+		return nil, err
+	}
+	is := c.Support()
+	var out []NamesEntry
+	for _, m := range msgs {
+		if m.Command != RPL_NAMREPLY || len(m.Params) < 4 {
+			continue
+		}
+		for _, name := range strings.Fields(m.Params[3]) {
+			e := NamesEntry{}
+			// With multi-prefix, there may be several sigils.
+			for name != "" {
+				mode := is.prefixMode([]rune(name)[0])
+				if mode == 0 {
+					break
+				}
+				if e.Mode == 0 || is.prefixRank(mode) < is.prefixRank(e.Mode) {
+					e.Mode = mode
+				}
+				name = string([]rune(name)[1:])
+			}
+			e.Nick = name
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// A JoinError describes why the server refused to let us join a
+// channel.
+type JoinError struct {
+	Channel string
+	// The error numeric, such as ERR_BANNEDFROMCHAN
+	Numeric string
+	// The server's explanation
+	Text string
+}
+
+func (err *JoinError) Error() string {
+	return fmt.Sprintf("cannot join %s: %s (%s)", err.Channel, err.Text, err.Numeric)
+}
+
+var joinErrors = []string{
+	ERR_NOSUCHCHANNEL, ERR_TOOMANYCHANNELS, ERR_CHANNELISFULL,
+	ERR_INVITEONLYCHAN, ERR_BANNEDFROMCHAN, ERR_BADCHANNELKEY,
+}
+
+// JoinContext joins a single channel and waits until the server
+// confirms it by sending the channel's member list. If the server
+// refuses the join, a *JoinError is returned.
+func (c *Client) JoinContext(ctx context.Context, channel, key string) error {
+	if _, err := c.checkLen("CHANNELLEN", channel, c.Support().ChannelLen, false); err != nil {
+		return err
+	}
+	line := "JOIN " + channel
+	if key != "" {
+		line += " " + key
+	}
+	ends := append([]string{RPL_ENDOFNAMES}, joinErrors...)
+	_, err := c.runQuery(ctx, line, c.matchTarget(channel, ends...), isCommand(ends...), joinErrors...)
+	if err, ok := err.(*ReplyError); ok {
+		return &JoinError{Channel: channel, Numeric: err.Numeric, Text: err.Text}
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package irc_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+// connect connects a client named bot to srv and waits for it to
+// register.
+func connect(t *testing.T, srv *irctest.Server) *irc.Client {
+	t.Helper()
+	mux := irc.NewMux()
+	connected := make(chan struct{}, 1)
+	mux.HandleFunc("irc:connected", func(c *irc.Client, m *irc.Message) { connected <- struct{}{} })
+	c := &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Dialer: srv}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go c.Process()
+	t.Cleanup(func() { c.Close() })
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't register")
+	}
+	return c
+}
+
+// silent makes srv ignore command, so that queries time out.
+func silent(srv *irctest.Server, command string) {
+	srv.Handle(command, func(sess *irctest.Session, m *irc.Message) {})
+}
+
+func expectReplyError(t *testing.T, err error, numeric string) {
+	t.Helper()
+	if err, ok := err.(*irc.ReplyError); !ok || err.Numeric != numeric {
+		t.Errorf("expected %s, got %v", numeric, err)
+	}
+}
+
+func expectTimeout(t *testing.T, query func(ctx context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := query(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWho(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Handle("WHO", func(sess *irctest.Session, m *irc.Message) {
+		if m.Params[0] == "#chan" {
+			sess.Reply(irc.RPL_WHOREPLY, "#chan", "a", "alice.test", "irc.test", "alice", "H@", "0 Alice Liddell")
+			sess.Reply(irc.RPL_WHOREPLY, "#chan", "b", "bob.test", "leaf.test", "bob", "G", "2 Bob")
+		}
+		sess.Reply(irc.RPL_ENDOFWHO, m.Params[0], "End of WHO list")
+	})
+	c := connect(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	who, err := c.Who(ctx, "#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []irc.WhoEntry{
+		{Channel: "#chan", User: irc.Mask{Nick: "alice", User: "a", Host: "alice.test"}, Server: "irc.test", Flags: "H@", Hops: 0, RealName: "Alice Liddell"},
+		{Channel: "#chan", User: irc.Mask{Nick: "bob", User: "b", Host: "bob.test"}, Server: "leaf.test", Flags: "G", Hops: 2, RealName: "Bob"},
+	}
+	if !reflect.DeepEqual(who, expected) {
+		t.Errorf("expected %+v, got %+v", expected, who)
+	}
+
+	who, err = c.Who(ctx, "#empty")
+	if err != nil || len(who) != 0 {
+		t.Errorf("expected no entries, got %+v, %v", who, err)
+	}
+
+	silent(srv, "WHO")
+	expectTimeout(t, func(ctx context.Context) error {
+		_, err := c.Who(ctx, "#chan")
+		return err
+	})
+}
+
+func TestTopic(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Handle("TOPIC", func(sess *irctest.Session, m *irc.Message) {
+		switch channel := m.Params[0]; channel {
+		case "#chan":
+			sess.Reply(irc.RPL_TOPIC, channel, "Welcome to #chan")
+			sess.Reply(irc.RPL_TOPICWHOTIME, channel, "alice!a@alice.test", "1792159205")
+		case "#quiet":
+			sess.Reply(irc.RPL_NOTOPIC, channel, "No topic is set")
+		case "#secret":
+			sess.Reply(irc.ERR_NOTONCHANNEL, channel, "You're not on that channel")
+		default:
+			sess.Reply(irc.ERR_NOSUCHCHANNEL, channel, "No such channel")
+		}
+	})
+	c := connect(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	topic, err := c.Topic(ctx, "#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &irc.TopicResult{
+		Channel: "#chan",
+		Topic:   "Welcome to #chan",
+		SetBy:   "alice!a@alice.test",
+		SetAt:   time.Unix(1792159205, 0),
+	}
+	if !reflect.DeepEqual(topic, expected) {
+		t.Errorf("expected %+v, got %+v", expected, topic)
+	}
+
+	topic, err = c.Topic(ctx, "#quiet")
+	if err != nil || !reflect.DeepEqual(topic, &irc.TopicResult{Channel: "#quiet"}) {
+		t.Errorf("expected no topic, got %+v, %v", topic, err)
+	}
+
+	_, err = c.Topic(ctx, "#secret")
+	expectReplyError(t, err, irc.ERR_NOTONCHANNEL)
+	_, err = c.Topic(ctx, "#nowhere")
+	expectReplyError(t, err, irc.ERR_NOSUCHCHANNEL)
+
+	silent(srv, "TOPIC")
+	expectTimeout(t, func(ctx context.Context) error {
+		_, err := c.Topic(ctx, "#chan")
+		return err
+	})
+}
+
+func TestListChannels(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Handle("LIST", func(sess *irctest.Session, m *irc.Message) {
+		sess.Reply(irc.RPL_LISTSTART, "Channel", "Users  Name")
+		if len(m.Params) == 0 {
+			sess.Reply(irc.RPL_LIST, "#small", "2", "")
+		}
+		sess.Reply(irc.RPL_LIST, "#big", "120", "[+nt] Big channel")
+		sess.Reply(irc.RPL_LISTEND, "End of /LIST")
+	})
+	c := connect(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	list, err := c.ListChannels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []irc.ListEntry{
+		{Channel: "#small", Users: 2},
+		{Channel: "#big", Users: 120, Topic: "[+nt] Big channel"},
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %+v, got %+v", expected, list)
+	}
+
+	list, err = c.ListChannels(ctx, ">100")
+	if err != nil || !reflect.DeepEqual(list, expected[1:]) {
+		t.Errorf("expected %+v, got %+v, %v", expected[1:], list, err)
+	}
+	var sent [][]string
+	for _, m := range srv.Received() {
+		if m.Command == "LIST" {
+			sent = append(sent, m.Params)
+		}
+	}
+	if !reflect.DeepEqual(sent, [][]string{nil, {">100"}}) {
+		t.Errorf("expected LIST and LIST >100, got %q", sent)
+	}
+
+	silent(srv, "LIST")
+	expectTimeout(t, func(ctx context.Context) error {
+		_, err := c.ListChannels(ctx)
+		return err
+	})
+}
+
+func TestNames(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Handle("NAMES", func(sess *irctest.Session, m *irc.Message) {
+		channel := m.Params[0]
+		if channel == "#chan" {
+			sess.Reply(irc.RPL_NAMREPLY, "=", channel, "@alice +bob")
+			sess.Reply(irc.RPL_NAMREPLY, "=", channel, "@+carol dave")
+		}
+		sess.Reply(irc.RPL_ENDOFNAMES, channel, "End of /NAMES list")
+	})
+	c := connect(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	names, err := c.Names(ctx, "#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []irc.NamesEntry{{"alice", 'o'}, {"bob", 'v'}, {"carol", 'o'}, {"dave", 0}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	// Servers only send the end of the list for channels that don't
+	// exist.
+	names, err = c.Names(ctx, "#nowhere")
+	if err != nil || len(names) != 0 {
+		t.Errorf("expected no names, got %v, %v", names, err)
+	}
+
+	silent(srv, "NAMES")
+	expectTimeout(t, func(ctx context.Context) error {
+		_, err := c.Names(ctx, "#chan")
+		return err
+	})
+}
@@ -0,0 +1,179 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeServer answers each line the client sends with the lines
+// returned by respond.
+func fakeServer(t *testing.T, respond func(line string) []string) *Client {
+	a, b := net.Pipe()
+	go func() {
+		r := bufio.NewReader(b)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			for _, reply := range respond(line[:len(line)-2]) {
+				io.WriteString(b, reply+"\r\n")
+			}
+		}
+	}()
+	c := &Client{Mux: NewMux()}
+	if err := c.Connect(a); err != nil {
+		t.Fatal(err)
+	}
+	go c.readLoop()
+	return c
+}
+
+func TestQueries(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		switch line {
+		case "WHOIS nick":
+			return []string{
+				":server 311 me nick user host * :Real Name",
+				":server 319 me nick :@#foo #bar",
+				":server 330 me nick account :is logged in as",
+				":server 318 me nick :End of /WHOIS list.",
+			}
+		case "WHOIS nobody":
+			return []string{":server 401 me nobody :No such nick/channel"}
+		case "JOIN #banned":
+			return []string{":server 474 me #banned :Cannot join channel (+b)"}
+		case "JOIN #foo":
+			return []string{
+				":me!user@host JOIN #foo",
+				":server 353 me = #foo :@me",
+				":server 366 me #foo :End of /NAMES list.",
+			}
+		case "NAMES #foo":
+			return []string{
+				":server 353 me = #foo :@+op +voice user",
+				":server 366 me #foo :End of /NAMES list.",
+			}
+		}
+		return nil
+	})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	whois, err := c.Whois(ctx, "nick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &WhoisResult{
+		User:     Mask{"nick", "user", "host"},
+		RealName: "Real Name",
+		Channels: []string{"@#foo", "#bar"},
+		Account:  "account",
+	}
+	if !reflect.DeepEqual(whois, expected) {
+		t.Errorf("expected %#v, got %#v", expected, whois)
+	}
+
+	_, err = c.Whois(ctx, "nobody")
+	if err, ok := err.(*ReplyError); !ok || err.Numeric != ERR_NOSUCHNICK {
+		t.Errorf("expected ERR_NOSUCHNICK, got %v", err)
+	}
+
+	names, err := c.Names(ctx, "#foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNames := []NamesEntry{{"op", 'o'}, {"voice", 'v'}, {"user", 0}}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected %v, got %v", expectedNames, names)
+	}
+
+	if err := c.JoinContext(ctx, "#foo", ""); err != nil {
+		t.Errorf("joining #foo: %s", err)
+	}
+	err = c.JoinContext(ctx, "#banned", "")
+	if err, ok := err.(*JoinError); !ok || err.Numeric != ERR_BANNEDFROMCHAN {
+		t.Errorf("expected ERR_BANNEDFROMCHAN, got %v", err)
+	}
+}
+
+func TestSendLabeled(t *testing.T) {
+	c := fakeServer(t, func(line string) []string {
+		switch line {
+		case "@label=L1 PRIVMSG #chan hi":
+			return []string{"@label=L1 :me!user@host PRIVMSG #chan :hi"}
+		case "@label=L2 WHOIS nick":
+			return []string{
+				"@label=L2 :server BATCH +b1 labeled-response",
+				"@batch=b1 :server 311 me nick user host * :Real Name",
+				"@batch=b1 :server 318 me nick :End of /WHOIS list.",
+				":server BATCH -b1",
+			}
+		case "@label=L3 CHATHISTORY LATEST #chan * 2":
+			return []string{
+				"@label=L3 :server BATCH +b2 labeled-response",
+				"@batch=b2 :server BATCH +b3 chathistory #chan",
+				"@batch=b3 :a!b@c PRIVMSG #chan :one",
+				"@batch=b3 :a!b@c PRIVMSG #chan :two",
+				"@batch=b2 :server BATCH -b3",
+				":server BATCH -b2",
+			}
+		case "@label=L4 WHOIS slow":
+			lines := []string{"@label=L4 :server BATCH +b4 labeled-response"}
+			for i := 0; i < 100; i++ {
+				lines = append(lines, "@batch=b4 :server NOTICE me :filler")
+			}
+			return append(lines, ":server BATCH -b4")
+		case "WHOIS nobody":
+			return []string{":server 401 me nobody :No such nick/channel"}
+		}
+		return nil
+	})
+	defer c.Close()
+	c.Caps.enabled["labeled-response"] = true
+
+	collect := func(line string) []string {
+		ch, err := c.SendLabeled(Parse(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return out
+				}
+				out = append(out, m.Command)
+			case <-timeout:
+				t.Fatalf("timed out waiting for response to %q", line)
+			}
+		}
+	}
+	if out := collect("PRIVMSG #chan :hi"); !reflect.DeepEqual(out, []string{"PRIVMSG"}) {
+		t.Errorf("unexpected response to PRIVMSG: %v", out)
+	}
+	if out := collect("WHOIS nick"); !reflect.DeepEqual(out, []string{"BATCH", "311", "318", "BATCH"}) {
+		t.Errorf("unexpected response to WHOIS: %v", out)
+	}
+	if out := collect("CHATHISTORY LATEST #chan * 2"); !reflect.DeepEqual(out, []string{"BATCH", "BATCH", "PRIVMSG", "PRIVMSG", "BATCH", "BATCH"}) {
+		t.Errorf("unexpected response to CHATHISTORY: %v", out)
+	}
+
+	// Not receiving the response mustn't stall the read loop.
+	if _, err := c.SendLabeled(Parse("WHOIS slow")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Whois(ctx, "nobody"); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("expected ERR_NOSUCHNICK, got %v", err)
+	}
+}
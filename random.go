@@ -0,0 +1,91 @@
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Random is a source of random numbers, used for jitter, backoff,
+// nicks and tokens. Implementations must be safe for concurrent use.
+// Tests can use NewRandom with a fixed seed to be deterministic.
+type Random interface {
+	// Int63n returns a number in [0, n). It panics if n <= 0.
+	Int63n(n int64) int64
+}
+
+// DefaultRandom is the Random used when none is configured. It is
+// not suitable for security-sensitive values; use CryptoRandom for
+// those.
+var DefaultRandom Random = NewRandom(time.Now().UnixNano())
+
+// CryptoRandom is a Random backed by crypto/rand.
+var CryptoRandom Random = cryptoRandom{}
+
+type lockedRandom struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+// NewRandom returns a Random backed by math/rand, seeded with seed.
+func NewRandom(seed int64) Random {
+	return &lockedRandom{r: mrand.New(mrand.NewSource(seed))}
+}
+
+func (r *lockedRandom) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Int63n(n)
+}
+
+type cryptoRandom struct{}
+
+func (cryptoRandom) Int63n(n int64) int64 {
+	if n <= 0 {
+		panic("invalid argument to Int63n")
+	}
+	// Reject values from the incomplete last interval to avoid
+	// modulo bias.
+	max := int64((1<<63 - 1) - (1<<63)%uint64(n))
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic("crypto/rand failed: " + err.Error())
+		}
+		v := int64(binary.BigEndian.Uint64(b[:]) &^ (1 << 63))
+		if v < max {
+			return v % n
+		}
+	}
+}
+
+const tokenAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// RandomToken returns a string of n random letters and digits,
+// drawn from r. If r is nil, CryptoRandom is used.
+func RandomToken(r Random, n int) string {
+	if r == nil {
+		r = CryptoRandom
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = tokenAlphabet[r.Int63n(int64(len(tokenAlphabet)))]
+	}
+	return string(b)
+}
+
+// Jitter returns d, randomly changed by up to fraction of itself in
+// either direction, so that many clients don't act in lockstep. If r
+// is nil, DefaultRandom is used.
+func Jitter(r Random, d time.Duration, fraction float64) time.Duration {
+	spread := int64(float64(d) * fraction)
+	if spread <= 0 {
+		return d
+	}
+	if r == nil {
+		r = DefaultRandom
+	}
+	return d - time.Duration(spread) + time.Duration(r.Int63n(2*spread+1))
+}
@@ -0,0 +1,33 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRandom(t *testing.T) {
+	a, b := NewRandom(1), NewRandom(1)
+	for i := 0; i < 10; i++ {
+		if x, y := a.Int63n(1000), b.Int63n(1000); x != y {
+			t.Fatalf("sources with the same seed diverged: %d != %d", x, y)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if n := CryptoRandom.Int63n(7); n < 0 || n >= 7 {
+			t.Fatalf("Int63n(7) returned %d", n)
+		}
+		d := Jitter(a, 10*time.Second, 0.1)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("jittered 10s by more than 10%%: %s", d)
+		}
+	}
+	if d := Jitter(a, time.Second, 0); d != time.Second {
+		t.Errorf("Jitter without fraction returned %s", d)
+	}
+
+	tok := RandomToken(nil, 16)
+	if len(tok) != 16 || tok == RandomToken(nil, 16) {
+		t.Errorf("unexpected token %q", tok)
+	}
+}
@@ -0,0 +1,115 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RateProfile describes how quickly the client may send messages
+// to the server, in the form of a token bucket. The client may send
+// up to Burst messages at once and regains one token every Interval.
+//
+// Profiles can be swapped at runtime with Client.SetRateLimit, for
+// example to relax limits after the client has been opped or
+// identified, as some servers exempt such clients from flood
+// protection.
+type RateProfile struct {
+	Burst    int
+	Interval time.Duration
+	// Costs maps upper-case commands to the number of tokens they
+	// consume. Commands that aren't in the map cost a single token.
+	Costs map[string]int
+	// If BytesPerToken is positive, messages cost an additional
+	// token for every BytesPerToken bytes.
+	BytesPerToken int
+}
+
+var (
+	// ProfileRFC1459 implements the flood control described in
+	// section 8.10 of RFC 1459: every message costs two seconds and
+	// the client may be up to ten seconds ahead.
+	ProfileRFC1459 = &RateProfile{Burst: 5, Interval: 2 * time.Second}
+
+	// ProfilePenalty is like ProfileRFC1459, but also penalizes
+	// long messages.
+	ProfilePenalty = &RateProfile{Burst: 5, Interval: 2 * time.Second, BytesPerToken: 120}
+
+	// ProfileHybrid allows bursts of ten messages and one message
+	// per second, and charges extra for WHO, WHOIS and LIST. Servers
+	// differ in their limits and networks configure their own, so
+	// check them before relying on any profile.
+	ProfileHybrid = &RateProfile{
+		Burst:    10,
+		Interval: time.Second,
+		Costs:    map[string]int{"WHO": 2, "WHOIS": 2, "LIST": 3},
+	}
+
+	// ProfileInspIRCd is like ProfileHybrid, but only charges extra
+	// for LIST.
+	ProfileInspIRCd = &RateProfile{
+		Burst:    10,
+		Interval: time.Second,
+		Costs:    map[string]int{"LIST": 3},
+	}
+
+	// ProfileExempt is suitable for clients that have been exempted
+	// from flood protection, e.g. via an oper block or a trusted
+	// services account. It still guards against runaway loops.
+	ProfileExempt = &RateProfile{Burst: 20, Interval: 250 * time.Millisecond}
+)
+
+func (p *RateProfile) cost(command string, size int) int {
+	n, ok := p.Costs[strings.ToUpper(command)]
+	if !ok {
+		n = 1
+	}
+	if p.BytesPerToken > 0 {
+		n += size / p.BytesPerToken
+	}
+	return n
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	clock   Clock
+	profile *RateProfile
+	tokens  float64
+	last    time.Time
+}
+
+func (l *rateLimiter) setProfile(p *RateProfile) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.profile == nil && p != nil {
+		l.tokens = float64(p.Burst)
+		l.last = OrRealClock(l.clock).Now()
+	}
+	if p != nil && l.tokens > float64(p.Burst) {
+		l.tokens = float64(p.Burst)
+	}
+	l.profile = p
+}
+
+// reserve consumes the tokens needed to send a message with the
+// given command and size and returns how long the caller has to wait
+// before sending it.
+func (l *rateLimiter) reserve(command string, size int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.profile
+	if p == nil || p.Interval <= 0 {
+		return 0
+	}
+	now := OrRealClock(l.clock).Now()
+	l.tokens += float64(now.Sub(l.last)) / float64(p.Interval)
+	if l.tokens > float64(p.Burst) {
+		l.tokens = float64(p.Burst)
+	}
+	l.last = now
+	l.tokens -= float64(p.cost(command, size))
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens * float64(p.Interval))
+}
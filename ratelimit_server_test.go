@@ -0,0 +1,96 @@
+package irc_test
+
+import (
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+func TestSetRateLimit(t *testing.T) {
+	srv := irctest.NewServer()
+	clock := irctest.NewClock(time.Now())
+	mux := irc.NewMux()
+	connected := make(chan struct{}, 1)
+	mux.HandleFunc("irc:connected", func(c *irc.Client, m *irc.Message) { connected <- struct{}{} })
+	// Advancing the clock by hours mustn't time out pings.
+	c := &irc.Client{Nick: "bot", User: "bot", Name: "bot", Mux: mux, Dialer: srv, Clock: clock, PingInterval: 24 * time.Hour}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go c.Process()
+	defer c.Close()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't register")
+	}
+
+	received := func(text string) bool {
+		for _, m := range srv.Received() {
+			if m.Command == "PRIVMSG" && m.Params[len(m.Params)-1] == text {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(text string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !received(text); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q wasn't sent", text)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// delayed sends text and waits for the client to start waiting
+	// for the rate limit.
+	delayed := func(text string) {
+		t.Helper()
+		timers := clock.Timers()
+		go c.Privmsg("#chan", text)
+		for deadline := time.Now().Add(5 * time.Second); clock.Timers() == timers; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q wasn't delayed", text)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if received(text) {
+			t.Errorf("%q was sent despite the rate limit", text)
+		}
+	}
+
+	// Switching profiles takes effect for the next message: after
+	// using up the strict profile's only token, the relaxed profile
+	// regains one within its own interval.
+	strict := &irc.RateProfile{Burst: 1, Interval: time.Hour}
+	c.SetRateLimit(strict)
+	c.Privmsg("#chan", "1")
+	waitFor("1")
+	c.SetRateLimit(irc.ProfileExempt)
+	delayed("2")
+	clock.Advance(irc.ProfileExempt.Interval)
+	waitFor("2")
+
+	// And back.
+	c.SetRateLimit(strict)
+	delayed("3")
+	clock.Advance(irc.ProfileExempt.Interval)
+	time.Sleep(10 * time.Millisecond)
+	if received("3") {
+		t.Error("the relaxed profile still applies")
+	}
+	// 2 left the bucket a token short.
+	clock.Advance(2 * strict.Interval)
+	waitFor("3")
+
+	// Without a profile, nothing waits.
+	c.SetRateLimit(nil)
+	for _, text := range []string{"4", "5", "6"} {
+		if err := c.Privmsg("#chan", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor("6")
+}
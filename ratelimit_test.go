@@ -0,0 +1,47 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	l.setProfile(&RateProfile{
+		Burst:         3,
+		Interval:      time.Hour,
+		Costs:         map[string]int{"LIST": 2},
+		BytesPerToken: 100,
+	})
+	if d := l.reserve("PRIVMSG", 10); d != 0 {
+		t.Errorf("expected first message to be sent immediately, got delay %s", d)
+	}
+	if d := l.reserve("list", 10); d != 0 {
+		t.Errorf("expected burst to allow LIST, got delay %s", d)
+	}
+	if l.tokens >= 1 {
+		t.Errorf("expected LIST to cost two tokens regardless of case, %v tokens are left", l.tokens)
+	}
+	if d := l.reserve("PRIVMSG", 150); d < time.Hour {
+		t.Errorf("expected long message to be delayed by at least an hour, got %s", d)
+	}
+	l.setProfile(nil)
+	if d := l.reserve("PRIVMSG", 10); d != 0 {
+		t.Errorf("expected no delay without a profile, got %s", d)
+	}
+}
+
+func TestCommandOf(t *testing.T) {
+	table := map[string]string{
+		"PONG :123":                    "PONG",
+		"quit":                         "QUIT",
+		":nick!user@host QUIT :bye":    "QUIT",
+		"@label=1 :prefix PRIVMSG x y": "PRIVMSG",
+		"":                             "",
+	}
+	for in, out := range table {
+		if cmd := commandOf(in); cmd != out {
+			t.Errorf("commandOf(%q), expected %q, got %q", in, out, cmd)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package sasl // import "honnef.co/go/irc/sasl"
 import (
 	"encoding/base64"
 	"fmt"
+	"sync"
+	"time"
 
 	"honnef.co/go/irc"
 )
@@ -10,6 +12,14 @@ import (
 type SASL struct {
 	*irc.Mux
 	Mechanism Mechanism
+	// How long to wait for authentication to finish before aborting
+	// it and registering without being logged in. Defaults to 30
+	// seconds. A negative value disables the timeout.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// closed when the current authentication finishes
+	done chan struct{}
 }
 
 type Mechanism interface {
@@ -23,9 +33,9 @@ type Plain struct {
 }
 
 func New(m Mechanism) *SASL {
-	s := &SASL{irc.NewMux(), m}
+	s := &SASL{Mux: irc.NewMux(), Mechanism: m}
 
-	s.HandleFunc("CAP", s.auth1)
+	s.HandleFunc("irc:capabilities", s.auth1)
 	s.HandleFunc("AUTHENTICATE", s.auth2)
 	s.HandleFunc(irc.RPL_SASLSUCCESS, s.auth3)
 	s.HandleFunc(irc.RPL_SASLFAILED, s.auth3)
@@ -44,22 +54,64 @@ func (p *Plain) Generate(_ string) string {
 }
 
 func (s *SASL) Authenticate(c *irc.Client) {
-	c.Send("CAP REQ :sasl")
+	c.Caps.Request("sasl")
+	c.NegotiateCaps()
 	c.Login()
 }
 
+func (s *SASL) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return s.Timeout
+}
+
 func (s *SASL) auth1(c *irc.Client, m *irc.Message) {
-	if m.Params[1] != "ACK" {
-		s.auth3(c, m)
+	if !c.HasCap("sasl") {
+		c.Send("CAP END")
 		return
 	}
-	if m.Params[2] != "sasl" {
-		s.auth3(c, m)
-		return
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.done = done
+	s.mu.Unlock()
+	if timeout := s.timeout(); timeout > 0 {
+		go s.watch(c, timeout, done)
 	}
 	c.Send(fmt.Sprintf("AUTHENTICATE %s", s.Mechanism.Name()))
 }
 
+// watch aborts authentication if it hasn't finished after timeout.
+func (s *SASL) watch(c *irc.Client, timeout time.Duration, done chan struct{}) {
+	t := irc.OrRealClock(c.Clock).NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-t.C():
+	case <-done:
+		return
+	case <-c.Done():
+		return
+	}
+	if !s.finish(done) {
+		return
+	}
+	c.Send("AUTHENTICATE *")
+	c.Send("CAP END")
+}
+
+// finish marks the authentication identified by done as finished and
+// reports whether it was still in progress.
+func (s *SASL) finish(done chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if done == nil || s.done != done {
+		return false
+	}
+	close(done)
+	s.done = nil
+	return true
+}
+
 func (s *SASL) auth2(c *irc.Client, m *irc.Message) {
 	// TODO check Params length
 	payload := m.Params[0]
@@ -67,5 +119,12 @@ func (s *SASL) auth2(c *irc.Client, m *irc.Message) {
 }
 
 func (s *SASL) auth3(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if !s.finish(done) {
+		// We already gave up
+		return
+	}
 	c.Send("CAP END")
 }
@@ -0,0 +1,133 @@
+package sasl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"honnef.co/go/irc"
+	"honnef.co/go/irc/irctest"
+)
+
+// connect connects a client authenticating as alice with password to
+// srv and waits for it to register.
+func connect(t *testing.T, srv *irctest.Server, password string, clock irc.Clock) *irc.Client {
+	t.Helper()
+	auth := New(&Plain{User: "alice", Password: password})
+	auth.Timeout = 10 * time.Second
+	mux := irc.NewMux()
+	mux.Handle("", auth)
+	connected := make(chan struct{}, 1)
+	mux.HandleFunc("irc:connected", func(c *irc.Client, m *irc.Message) { connected <- struct{}{} })
+	c := &irc.Client{
+		Nick:                "alice",
+		User:                "alice",
+		Mux:                 mux,
+		Authenticator:       auth,
+		Dialer:              srv,
+		Clock:               clock,
+		RegistrationTimeout: -1,
+	}
+	if err := c.Dial("tcp", "irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	go c.Process()
+	t.Cleanup(func() { c.Close() })
+	if clock, ok := clock.(*irctest.Clock); ok {
+		// Authentication never finishes, so time has to pass for
+		// the client to give up.
+		if _, err := waitFor(srv, "AUTHENTICATE", 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		for !capEnded(srv) {
+			clock.Advance(auth.Timeout)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't register")
+	}
+	return c
+}
+
+func waitFor(srv *irctest.Server, command string, timeout time.Duration) (*irc.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.WaitFor(ctx, command)
+}
+
+// capEnded reports whether srv has received CAP END.
+func capEnded(srv *irctest.Server) bool {
+	for _, m := range srv.Received() {
+		if m.Command == "CAP" && len(m.Params) > 0 && m.Params[0] == "END" {
+			return true
+		}
+	}
+	return false
+}
+
+func account(t *testing.T, c *irc.Client) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.Whois(ctx, c.CurrentNick())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Account
+}
+
+func TestSASL(t *testing.T) {
+	table := []struct {
+		password string
+		account  string
+	}{
+		{"secret", "alice"},
+		// Failed authentication still registers, just without
+		// logging in.
+		{"wrong", ""},
+	}
+	for _, test := range table {
+		srv := irctest.NewServer()
+		srv.Accounts = map[string]string{"alice": "secret"}
+		c := connect(t, srv, test.password, nil)
+		if got := account(t, c); got != test.account {
+			t.Errorf("password %q: expected account %q, got %q", test.password, test.account, got)
+		}
+	}
+}
+
+func TestSASLUnsupported(t *testing.T) {
+	srv := irctest.NewServer()
+	c := connect(t, srv, "secret", nil)
+	if c.HasCap("sasl") {
+		t.Error("sasl was enabled without being offered")
+	}
+	for _, m := range srv.Received() {
+		if m.Command == "AUTHENTICATE" {
+			t.Errorf("unexpected %q", m.Raw)
+		}
+	}
+}
+
+func TestSASLTimeout(t *testing.T) {
+	srv := irctest.NewServer()
+	srv.Accounts = map[string]string{"alice": "secret"}
+	// Never respond to AUTHENTICATE
+	srv.Handle("AUTHENTICATE", func(sess *irctest.Session, m *irc.Message) {})
+	c := connect(t, srv, "secret", irctest.NewClock(time.Time{}))
+	if got := account(t, c); got != "" {
+		t.Errorf("expected not to be logged in, got %q", got)
+	}
+	var aborted bool
+	for _, m := range srv.Received() {
+		if m.Command == "AUTHENTICATE" && m.Params[0] == "*" {
+			aborted = true
+		}
+	}
+	if !aborted {
+		t.Error("authentication wasn't aborted")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build go1.21
+
+package irc
+
+import "log/slog"
+
+// NewSlogLogger returns a StructuredLogger that logs to l, or to
+// slog.Default() if l is nil.
+func NewSlogLogger(l *slog.Logger) *StructuredLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &StructuredLogger{L: l}
+}
@@ -0,0 +1,69 @@
+package irc
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// KVLogger is a structured logger that takes a message followed by
+// alternating keys and values. *slog.Logger implements it, and
+// adapters for other libraries, such as zap's SugaredLogger, are a
+// few lines each.
+type KVLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// StructuredLogger is a Logger that emits structured records instead
+// of raw lines. Traffic is logged at debug level as "irc message",
+// with the fields direction ("in" or "out"), command, prefix and
+// params, as well as latency for incoming messages that carry a
+// server-time tag. Use RawLogger, possibly in a MultiLogger, when the
+// exact bytes on the wire matter.
+type StructuredLogger struct {
+	L KVLogger
+}
+
+func (l *StructuredLogger) Incoming(m *Message) {
+	kv := messageFields("in", m)
+	if _, ok := m.Tags["time"]; ok && !m.Received.IsZero() {
+		kv = append(kv, "latency", m.Received.Sub(m.Time))
+	}
+	l.L.Debug("irc message", kv...)
+}
+
+func (l *StructuredLogger) Outgoing(m *Message) {
+	l.L.Debug("irc message", messageFields("out", m)...)
+}
+
+func messageFields(direction string, m *Message) []interface{} {
+	kv := []interface{}{"direction", direction, "command", m.Command}
+	if prefix := m.Prefix.String(); prefix != "" {
+		kv = append(kv, "prefix", prefix)
+	}
+	return append(kv, "params", m.Params)
+}
+
+// sprintln formats args like FormattedLogger does, without the
+// trailing newline.
+func sprintln(args []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+func (l *StructuredLogger) Info(args ...interface{}) {
+	l.L.Info(sprintln(args))
+}
+
+func (l *StructuredLogger) Debug(args ...interface{}) {
+	l.L.Debug(sprintln(args))
+}
+
+func (l *StructuredLogger) Panic(arg interface{}) {
+	buf := make([]byte, 64<<10)
+	n := runtime.Stack(buf, false)
+	l.L.Error("panic in handler", "panic", arg, "stack", string(buf[:n]))
+}
+
+var _ Logger = (*StructuredLogger)(nil)
@@ -0,0 +1,40 @@
+package irc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordingKVLogger struct {
+	records []string
+}
+
+func (l *recordingKVLogger) record(level, msg string, kv []interface{}) {
+	l.records = append(l.records, fmt.Sprint(level, " ", msg, " ", kv))
+}
+
+func (l *recordingKVLogger) Debug(msg string, kv ...interface{}) { l.record("DEBUG", msg, kv) }
+func (l *recordingKVLogger) Info(msg string, kv ...interface{})  { l.record("INFO", msg, kv) }
+func (l *recordingKVLogger) Error(msg string, kv ...interface{}) { l.record("ERROR", msg, kv) }
+
+func TestStructuredLogger(t *testing.T) {
+	kv := &recordingKVLogger{}
+	l := &StructuredLogger{L: kv}
+
+	in := Parse("@time=2009-11-10T23:00:00.000Z :nick!user@host PRIVMSG #chan :hello world")
+	in.Received = in.Time.Add(2 * time.Second)
+	l.Incoming(in)
+	l.Outgoing(Parse("JOIN #chan"))
+	l.Info("connected to", "irc.test")
+
+	want := []string{
+		"DEBUG irc message [direction in command PRIVMSG prefix nick!user@host params [#chan hello world] latency 2s]",
+		"DEBUG irc message [direction out command JOIN params [#chan]]",
+		"INFO connected to irc.test []",
+	}
+	if !reflect.DeepEqual(kv.records, want) {
+		t.Errorf("got records\n%q\nwant\n%q", kv.records, want)
+	}
+}